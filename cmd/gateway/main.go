@@ -0,0 +1,77 @@
+// Command gateway serves the Open Points chaincode functions as REST/JSON resources, with their OpenAPI description at
+// /openapi.json. With -embedded it runs the chaincode in memory on a fresh demo ledger for development and tests;
+// without an auth file it then accepts one development token per role, the name of the role.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gscdist/GscLabChaincode/gateway"
+	"github.com/gscdist/GscLabChaincode/openpoints"
+)
+
+func main() {
+
+	listen := flag.String("listen", "127.0.0.1:8080", "address to serve HTTP on")
+	authPath := flag.String("auth", "", "auth file mapping bearer tokens to Fabric identities")
+	embedded := flag.Bool("embedded", false, "run the chaincode in memory instead of calling a peer")
+	flag.Parse()
+
+	if !*embedded {
+		fmt.Println("Error: this build can only run the chaincode embedded, start it with -embedded")
+		os.Exit(2)
+	}
+
+	backend, err := gateway.NewEmbeddedBackend()
+	if err != nil {
+		fmt.Println("Error starting the embedded chaincode: ", err)
+		os.Exit(2)
+	}
+
+	var auth *gateway.Authenticator
+	if *authPath != "" {
+		auth, err = gateway.LoadAuthenticator(*authPath)
+		if err != nil {
+			fmt.Println("Error loading the auth file: ", err)
+			os.Exit(2)
+		}
+	} else {
+		auth = developmentTokens()
+	}
+
+	server, err := gateway.NewServer(backend, auth)
+	if err != nil {
+		fmt.Println("Error starting the gateway: ", err)
+		os.Exit(2)
+	}
+
+	fmt.Printf("gateway serving %d routes on http://%s, OpenAPI at /openapi.json\n", len(server.Routes()), *listen)
+	err = http.ListenAndServe(*listen, server)
+	if err != nil {
+		fmt.Println("Error serving: ", err)
+		os.Exit(1)
+	}
+}
+
+// One token per role for the embedded ledger, the token is the name of the role. Members and businesses act for the
+// demo accounts init creates.
+func developmentTokens() *gateway.Authenticator {
+
+	auth := &gateway.Authenticator{Tokens: make(map[string]gateway.Identity)}
+	roles := []string{openpoints.ROLE_MEMBER, openpoints.ROLE_BUSINESS, openpoints.ROLE_RISK_OFFICER,
+		openpoints.ROLE_COMPLIANCE, openpoints.ROLE_ADMIN}
+	accounts := map[string]string{openpoints.ROLE_MEMBER: "U2974034", openpoints.ROLE_BUSINESS: "T5940872"}
+	for _, role := range roles {
+		attributes := map[string]string{openpoints.ROLE_ATTRIBUTE: role}
+		if accounts[role] != "" {
+			attributes[openpoints.ACCOUNT_ATTRIBUTE] = accounts[role]
+		}
+		auth.Tokens[role] = gateway.Identity{Id: role, Attributes: attributes}
+		fmt.Printf("development token %s acts as %s %s\n", role, role, accounts[role])
+	}
+
+	return auth
+}
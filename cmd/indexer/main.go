@@ -0,0 +1,90 @@
+// Command indexer projects the Open Points chaincode events of a block file into an embedded store, resuming from the
+// checkpoint saved with the store, and optionally reconciles the indexed balances with saved getUserAccount responses.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/gscdist/GscLabChaincode/indexer"
+)
+
+func main() {
+
+	blocks := flag.String("blocks", "", "block file to index, one block or ledger event per line")
+	storePath := flag.String("store", "openpoints-index.json", "file the projection and its checkpoint are saved to")
+	chaincodeId := flag.String("chaincode", "", "index only the events of this chaincode")
+	replay := flag.Bool("replay", false, "discard the projection and replay the block file from genesis")
+	saveEvery := flag.Int("save-every", 1000, "save the store after this many events")
+	accounts := flag.String("reconcile", "", "file of getUserAccount responses keyed by programId/userId to check balances against")
+	flag.Parse()
+
+	if *blocks == "" {
+		fmt.Println("Error: -blocks is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	store, err := indexer.OpenStore(*storePath)
+	if err != nil {
+		fmt.Println("Error opening the store: ", err)
+		os.Exit(2)
+	}
+	if *replay {
+		store.Reset()
+	}
+
+	source, err := indexer.OpenFile(*blocks)
+	if err != nil {
+		fmt.Println("Error opening the block file: ", err)
+		os.Exit(2)
+	}
+	defer source.Close()
+
+	from := store.Checkpoint
+	stats, err := indexer.Index(store, source, indexer.Config{ChaincodeId: *chaincodeId, SaveEvery: *saveEvery})
+	if err != nil {
+		fmt.Println("Error indexing: ", err)
+		os.Exit(2)
+	}
+
+	fmt.Printf("indexed %d events of %d blocks from block %d, skipped %d, checkpoint block %d tx %d\n",
+		stats.Events, stats.Blocks, from.Block, stats.Skipped, store.Checkpoint.Block, store.Checkpoint.Tx)
+	fmt.Printf("%d users, %d transactions, %d contracts, %d settlements\n",
+		len(store.Users), len(store.Transactions), len(store.Contracts), len(store.Settlements))
+
+	if *accounts == "" {
+		return
+	}
+
+	asBytes, err := ioutil.ReadFile(*accounts)
+	if err != nil {
+		fmt.Println("Error reading the accounts: ", err)
+		os.Exit(2)
+	}
+	var saved indexer.Accounts
+	err = json.Unmarshal(asBytes, &saved)
+	if err != nil {
+		fmt.Println("Error decoding the accounts: ", err)
+		os.Exit(2)
+	}
+
+	mismatches, err := indexer.Reconcile(store, saved)
+	if err != nil {
+		fmt.Println("Error reconciling: ", err)
+		os.Exit(2)
+	}
+	if len(mismatches) == 0 {
+		fmt.Println("balances match the ledger")
+		return
+	}
+
+	fmt.Printf("%d balances differ from the ledger:\n", len(mismatches))
+	for _, mismatch := range mismatches {
+		fmt.Println("  ", mismatch)
+	}
+	os.Exit(1)
+}
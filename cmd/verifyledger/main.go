@@ -0,0 +1,39 @@
+// Command verifyledger runs random operation sequences against an in-memory Open Points ledger and prints the
+// smallest sequence it finds that breaks a ledger invariant.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gscdist/GscLabChaincode/verify"
+)
+
+func main() {
+
+	seed := flag.Int64("seed", time.Now().UnixNano(), "seed of the random sequences")
+	sequences := flag.Int("sequences", 200, "number of sequences to run")
+	length := flag.Int("length", 40, "operations per sequence")
+	flag.Parse()
+
+	fmt.Printf("verifyledger seed %d, %d sequences of %d operations\n", *seed, *sequences, *length)
+
+	failure, err := verify.Fuzz(verify.Config{Seed: *seed, Sequences: *sequences, Length: *length})
+	if err != nil {
+		fmt.Println("Error running sequences: ", err)
+		os.Exit(2)
+	}
+
+	if failure == nil {
+		fmt.Println("no invariant violations found")
+		return
+	}
+
+	fmt.Println("invariant violated, minimal sequence:")
+	out, _ := json.MarshalIndent(failure, "", "  ")
+	fmt.Println(string(out))
+	os.Exit(1)
+}
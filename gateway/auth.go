@@ -0,0 +1,90 @@
+package gateway
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// ============================================================================================================================
+// Authentication
+//
+// Clients authenticate with a bearer token. The auth file maps every token to the Fabric identity the gateway
+// submits as, a common name and the Fabric CA attributes the chaincode reads its role and account from:
+//
+//	{
+//	  "tokens": {
+//	    "3f9a...": {"id": "cashier1", "attributes": {"role": "business", "userId": "T5940872"}},
+//	    "c71e...": {"id": "ops", "attributes": {"role": "admin", "role.travel": "member"}}
+//	  },
+//	  "anonymous": {"id": "guest", "attributes": {}}
+//	}
+//
+// Requests without a token act as the anonymous identity, and are rejected when the file declares none. The
+// gateway never decides what an identity may call: the chaincode checks the role of every call against its registry.
+// ============================================================================================================================
+
+// Fabric identity a request is submitted as
+type Identity struct {
+	Id         string            `json:"id"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+// Maps bearer tokens to identities
+type Authenticator struct {
+	Tokens    map[string]Identity `json:"tokens"`
+	Anonymous *Identity           `json:"anonymous,omitempty"`
+}
+
+// LoadAuthenticator reads an auth file
+func LoadAuthenticator(path string) (*Authenticator, error) {
+
+	asBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var auth Authenticator
+	err = json.Unmarshal(asBytes, &auth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode auth file %s: %s", path, err)
+	}
+	for token, identity := range auth.Tokens {
+		if token == "" || identity.Id == "" {
+			return nil, fmt.Errorf("auth file %s maps a token to an identity without an id", path)
+		}
+	}
+	if auth.Anonymous != nil && auth.Anonymous.Id == "" {
+		return nil, fmt.Errorf("auth file %s declares an anonymous identity without an id", path)
+	}
+
+	return &auth, nil
+}
+
+// Identity of a request, false if its token is unknown or it has none and there is no anonymous identity
+func (a *Authenticator) Identify(r *http.Request) (Identity, bool) {
+
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		if a.Anonymous == nil {
+			return Identity{}, false
+		}
+		return *a.Anonymous, true
+	}
+
+	if !strings.HasPrefix(header, "Bearer ") {
+		return Identity{}, false
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+
+	for known, identity := range a.Tokens {
+		if subtle.ConstantTimeCompare([]byte(known), []byte(token)) == 1 {
+			return identity, true
+		}
+	}
+
+	return Identity{}, false
+}
@@ -0,0 +1,85 @@
+package gateway
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/gscdist/GscLabChaincode/mockstub"
+)
+
+// Runs the chaincode in memory on a mockstub.Harness, for development and tests. Calls are serialized as the peer
+// would order them and every submitted call is committed at once.
+type EmbeddedBackend struct {
+	harness    *mockstub.Harness
+	identities map[string][]byte
+	mu         sync.Mutex
+}
+
+// NewEmbeddedBackend starts an in-memory ledger initialized with the demo members and contracts
+func NewEmbeddedBackend() (*EmbeddedBackend, error) {
+
+	h, err := mockstub.NewInitializedHarness()
+	if err != nil {
+		return nil, err
+	}
+
+	return &EmbeddedBackend{harness: h, identities: make(map[string][]byte)}, nil
+}
+
+// Harness of the in-memory ledger, for tests that inspect its state or events
+func (b *EmbeddedBackend) Harness() *mockstub.Harness {
+	return b.harness
+}
+
+// Submit runs a function and commits its writes if it succeeds
+func (b *EmbeddedBackend) Submit(identity Identity, function string, request []byte) ([]byte, error) {
+	return b.run(identity, function, request, true)
+}
+
+// Evaluate runs a function and discards its writes
+func (b *EmbeddedBackend) Evaluate(identity Identity, function string, request []byte) ([]byte, error) {
+	return b.run(identity, function, request, false)
+}
+
+func (b *EmbeddedBackend) run(identity Identity, function string, request []byte, commit bool) ([]byte, error) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	err := b.setIdentity(identity)
+	if err != nil {
+		return nil, err
+	}
+
+	if commit {
+		return b.harness.Invoke(function, string(request))
+	}
+	return b.harness.Query(function, string(request))
+}
+
+// Set the submitter of the next call, reusing the certificate of an identity that was seen before
+func (b *EmbeddedBackend) setIdentity(identity Identity) error {
+
+	names := []string{}
+	for name := range identity.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	key := identity.Id
+	for _, name := range names {
+		key = key + "\x00" + name + "=" + identity.Attributes[name]
+	}
+
+	creator, found := b.identities[key]
+	if !found {
+		var err error
+		creator, err = mockstub.NewIdentity(mockstub.HarnessMSP, identity.Id, identity.Attributes)
+		if err != nil {
+			return err
+		}
+		b.identities[key] = creator
+	}
+	b.harness.Stub.SetCreator(creator)
+
+	return nil
+}
@@ -0,0 +1,432 @@
+// Package gateway serves the Open Points chaincode functions as REST/JSON resources over plain HTTP.
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gscdist/GscLabChaincode/openpoints"
+)
+
+// ============================================================================================================================
+// REST gateway
+//
+// The gateway reads the functions of the chaincode from describeFunctions when it starts and serves every one of them,
+// read functions with GET and write functions with POST:
+//
+//	GET  /v1/functions/<name>?field=value&...   evaluates a read function, query parameters are its request fields
+//	POST /v1/functions/<name>                   submits a write function, the JSON body is its request
+//
+// The most used functions are also served as resources, with the ids in their paths:
+//
+//	GET  /v1/users/{userId}                     getUserAccount
+//	GET  /v1/users/{userId}/transactions        getTxs
+//	POST /v1/transfers                          transferPoints
+//	GET  /v1/contracts                          getAllContracts
+//
+// and the others listed in resourceRoutes. GET /openapi.json describes every route. Requests authenticate with a
+// bearer token of the Authenticator and choose a program with the programId field like any chaincode request.
+//
+// Successful calls answer 200 with the payload of the chaincode, or 204 when it is empty. Failed calls answer the
+// ChaincodeError of the chaincode, {"Code": ..., "Message": ..., "Field": ...}, with the status of its code in
+// errorStatus. Errors of the gateway itself use the same body.
+// ============================================================================================================================
+
+// Codes of errors raised by the gateway rather than the chaincode
+const ERR_UNAUTHENTICATED = "UNAUTHENTICATED"
+const ERR_BACKEND = "BACKEND_UNAVAILABLE"
+
+// Identity the gateway reads the function registry as
+var describeIdentity = Identity{Id: "gateway"}
+
+// Runs chaincode functions as an identity. Chaincode errors are returned as *openpoints.ChaincodeError.
+type Backend interface {
+	Submit(identity Identity, function string, request []byte) ([]byte, error)
+	Evaluate(identity Identity, function string, request []byte) ([]byte, error)
+}
+
+// A route of the gateway to a chaincode function
+type Route struct {
+	Method   string
+	Path     string
+	Function string
+
+	// Set on the resource routes, their operation ids are derived from the path rather than the function
+	resource bool
+	segments []string
+}
+
+// Resource routes of the most used functions, served next to the generic route of every function
+var resourceRoutes = []Route{
+	{Method: http.MethodGet, Path: "/v1/users/{userId}", Function: "getUserAccount"},
+	{Method: http.MethodGet, Path: "/v1/users/{userId}/transactions", Function: "getTxs"},
+	{Method: http.MethodGet, Path: "/v1/users/{userId}/history", Function: "getAccountHistory"},
+	{Method: http.MethodGet, Path: "/v1/users/{userId}/statement", Function: "getStatement"},
+	{Method: http.MethodGet, Path: "/v1/users/{userId}/pending-earnings", Function: "getPendingEarnings"},
+	{Method: http.MethodPost, Path: "/v1/transfers", Function: "transferPoints"},
+	{Method: http.MethodPost, Path: "/v1/transfers/{refNumber}/reversal", Function: "reverseTransaction"},
+	{Method: http.MethodGet, Path: "/v1/contracts", Function: "getAllContracts"},
+	{Method: http.MethodPost, Path: "/v1/contracts", Function: "addSmartContract"},
+	{Method: http.MethodGet, Path: "/v1/settlements", Function: "getSettlementBatches"},
+	{Method: http.MethodGet, Path: "/v1/settlements/{batchId}", Function: "getSettlementBatch"},
+	{Method: http.MethodGet, Path: "/v1/catalog", Function: "getCatalog"},
+	{Method: http.MethodGet, Path: "/v1/orders/{orderId}", Function: "getOrder"},
+	{Method: http.MethodGet, Path: "/v1/programs", Function: "getPrograms"},
+}
+
+// HTTP status of each chaincode error code, any other code answers 400
+var errorStatus = map[string]int{
+	openpoints.ERR_VALIDATION_FAILED:  http.StatusBadRequest,
+	openpoints.ERR_NOT_FOUND:          http.StatusNotFound,
+	openpoints.ERR_UNKNOWN_FUNCTION:   http.StatusNotFound,
+	openpoints.ERR_FORBIDDEN:          http.StatusForbidden,
+	openpoints.ERR_APPROVAL_REQUIRED:  http.StatusForbidden,
+	openpoints.ERR_ALREADY_EXISTS:     http.StatusConflict,
+	openpoints.ERR_INVALID_STATE:      http.StatusConflict,
+	openpoints.ERR_INSUFFICIENT_FUNDS: http.StatusUnprocessableEntity,
+	openpoints.ERR_BUDGET_EXCEEDED:    http.StatusUnprocessableEntity,
+	openpoints.ERR_POOL_LIMIT:         http.StatusUnprocessableEntity,
+	openpoints.ERR_RISK_BLOCKED:       http.StatusUnprocessableEntity,
+	openpoints.ERR_COMPLIANCE_HOLD:    http.StatusUnprocessableEntity,
+	openpoints.ERR_CORRUPT_STATE:      http.StatusInternalServerError,
+	openpoints.ERR_LEDGER:             http.StatusInternalServerError,
+	ERR_UNAUTHENTICATED:               http.StatusUnauthorized,
+	ERR_BACKEND:                       http.StatusBadGateway,
+}
+
+// Serves the chaincode functions over HTTP
+type Server struct {
+	backend Backend
+	auth    *Authenticator
+	api     openpoints.APIDescription
+	specs   map[string]openpoints.FunctionDescription
+	routes  []Route
+	openAPI []byte
+}
+
+// ============================================================================================================================
+// NewServer reads the function registry from the backend and builds the routes. Resource routes of functions the
+// chaincode does not register, or whose method does not match the access of the function, are left out.
+// ============================================================================================================================
+func NewServer(backend Backend, auth *Authenticator) (*Server, error) {
+
+	asBytes, err := backend.Evaluate(describeIdentity, "describeFunctions", []byte("{}"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe the chaincode functions: %s", err)
+	}
+
+	s := &Server{backend: backend, auth: auth, specs: make(map[string]openpoints.FunctionDescription)}
+	err = json.Unmarshal(asBytes, &s.api)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the chaincode functions: %s", err)
+	}
+
+	for _, spec := range s.api.Functions {
+		s.specs[spec.Name] = spec
+	}
+
+	for _, route := range resourceRoutes {
+		spec, found := s.specs[route.Function]
+		if !found || route.Method != accessMethod(spec.Access) {
+			continue
+		}
+		route.resource = true
+		if s.pathFieldsKnown(route, spec) {
+			s.addRoute(route)
+		}
+	}
+	for _, spec := range s.api.Functions {
+		s.addRoute(Route{Method: accessMethod(spec.Access), Path: "/v1/functions/" + spec.Name, Function: spec.Name})
+	}
+
+	s.openAPI, err = json.Marshal(s.buildOpenAPI())
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Routes served, resource routes first
+func (s *Server) Routes() []Route {
+	return s.routes
+}
+
+// OpenAPI returns the OpenAPI description of the routes
+func (s *Server) OpenAPI() []byte {
+	return s.openAPI
+}
+
+func (s *Server) addRoute(route Route) {
+	route.segments = strings.Split(strings.Trim(route.Path, "/"), "/")
+	s.routes = append(s.routes, route)
+}
+
+// Whether every path parameter of a route is a request field of its function
+func (s *Server) pathFieldsKnown(route Route, spec openpoints.FunctionDescription) bool {
+
+	for _, segment := range strings.Split(strings.Trim(route.Path, "/"), "/") {
+		name, ok := pathParam(segment)
+		if ok && fieldOf(spec, name) == nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// HTTP method of the routes of functions with an access
+func accessMethod(access string) string {
+
+	if access == openpoints.ACCESS_READ {
+		return http.MethodGet
+	}
+	return http.MethodPost
+}
+
+// Name of the parameter of a path segment such as {userId}
+func pathParam(segment string) (string, bool) {
+
+	if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+		return segment[1 : len(segment)-1], true
+	}
+	return "", false
+}
+
+func fieldOf(spec openpoints.FunctionDescription, name string) *openpoints.FieldSchema {
+
+	for i := range spec.Request {
+		if spec.Request[i].Name == name {
+			return &spec.Request[i]
+		}
+	}
+	return nil
+}
+
+// Route of a request and the values of its path parameters. A path served only with another method is reported
+// with allowed set.
+func (s *Server) match(method string, path string) (route *Route, params map[string]string, allowed bool) {
+
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i := range s.routes {
+		candidate := &s.routes[i]
+		values, ok := matchSegments(candidate.segments, segments)
+		if !ok {
+			continue
+		}
+		if candidate.Method != method {
+			allowed = true
+			continue
+		}
+		return candidate, values, false
+	}
+
+	return nil, nil, allowed
+}
+
+func matchSegments(pattern []string, segments []string) (map[string]string, bool) {
+
+	if len(pattern) != len(segments) {
+		return nil, false
+	}
+
+	values := make(map[string]string)
+	for i, segment := range pattern {
+		if name, ok := pathParam(segment); ok {
+			if segments[i] == "" {
+				return nil, false
+			}
+			values[name] = segments[i]
+		} else if segment != segments[i] {
+			return nil, false
+		}
+	}
+
+	return values, true
+}
+
+// ============================================================================================================================
+// Serve one request
+// ============================================================================================================================
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.URL.Path == "/openapi.json" && r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(s.openAPI)
+		return
+	}
+
+	route, params, allowed := s.match(r.Method, r.URL.Path)
+	if route == nil && allowed {
+		writeError(w, http.StatusMethodNotAllowed, &openpoints.ChaincodeError{Code: openpoints.ERR_UNKNOWN_FUNCTION,
+			Message: r.Method + " is not served on " + r.URL.Path})
+		return
+	}
+	if route == nil {
+		writeError(w, http.StatusNotFound, &openpoints.ChaincodeError{Code: openpoints.ERR_UNKNOWN_FUNCTION,
+			Message: "no function is served on " + r.URL.Path})
+		return
+	}
+
+	identity, ok := s.auth.Identify(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, 0, &openpoints.ChaincodeError{Code: ERR_UNAUTHENTICATED, Message: "a valid bearer token is required"})
+		return
+	}
+
+	spec := s.specs[route.Function]
+	request, ccErr := s.buildRequest(r, spec, params)
+	if ccErr != nil {
+		writeError(w, 0, ccErr)
+		return
+	}
+
+	var payload []byte
+	var err error
+	if spec.Access == openpoints.ACCESS_READ {
+		payload, err = s.backend.Evaluate(identity, route.Function, request)
+	} else {
+		payload, err = s.backend.Submit(identity, route.Function, request)
+	}
+	if err != nil {
+		if ccErr, ok := err.(*openpoints.ChaincodeError); ok {
+			writeError(w, 0, ccErr)
+		} else {
+			writeError(w, 0, &openpoints.ChaincodeError{Code: ERR_BACKEND, Message: err.Error()})
+		}
+		return
+	}
+
+	if len(payload) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if json.Valid(payload) {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.Write(payload)
+}
+
+// ============================================================================================================================
+// Build the JSON request of a call from the path parameters and the query parameters of a read or the body of a
+// write. Query parameters are converted to the types of the request schema; a list field takes repeated or comma
+// separated values. Fields the function does not declare are passed on for the chaincode to reject.
+// ============================================================================================================================
+func (s *Server) buildRequest(r *http.Request, spec openpoints.FunctionDescription, params map[string]string) ([]byte, *openpoints.ChaincodeError) {
+
+	fields := make(map[string]interface{})
+
+	if r.Method == http.MethodGet {
+		for name, values := range r.URL.Query() {
+			value, ccErr := queryValue(fieldOf(spec, name), name, values)
+			if ccErr != nil {
+				return nil, ccErr
+			}
+			fields[name] = value
+		}
+	} else {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, &openpoints.ChaincodeError{Code: openpoints.ERR_VALIDATION_FAILED, Message: "failed to read the request body: " + err.Error()}
+		}
+		if strings.TrimSpace(string(body)) != "" {
+			var raw map[string]json.RawMessage
+			err = json.Unmarshal(body, &raw)
+			if err != nil || raw == nil {
+				return nil, &openpoints.ChaincodeError{Code: openpoints.ERR_VALIDATION_FAILED, Message: "request body is not a JSON object"}
+			}
+			for name, value := range raw {
+				fields[name] = value
+			}
+		}
+	}
+
+	for name, value := range params {
+		if _, found := fields[name]; found {
+			return nil, &openpoints.ChaincodeError{Code: openpoints.ERR_VALIDATION_FAILED, Field: name,
+				Message: name + " is given in the path and can not be repeated in the request"}
+		}
+		fields[name] = value
+	}
+
+	asBytes, err := json.Marshal(fields)
+	if err != nil {
+		return nil, &openpoints.ChaincodeError{Code: openpoints.ERR_VALIDATION_FAILED, Message: err.Error()}
+	}
+
+	return asBytes, nil
+}
+
+// Value of a query parameter in the type of its field, unknown fields are passed on as strings
+func queryValue(field *openpoints.FieldSchema, name string, values []string) (interface{}, *openpoints.ChaincodeError) {
+
+	invalid := func(format string, args ...interface{}) *openpoints.ChaincodeError {
+		return &openpoints.ChaincodeError{Code: openpoints.ERR_VALIDATION_FAILED, Field: name, Message: fmt.Sprintf(format, args...)}
+	}
+
+	if field != nil && field.Type == openpoints.FIELD_STRING_LIST {
+		list := []string{}
+		for _, value := range values {
+			for _, item := range strings.Split(value, ",") {
+				if item != "" {
+					list = append(list, item)
+				}
+			}
+		}
+		return list, nil
+	}
+
+	if len(values) > 1 {
+		return nil, invalid("%s is given %d times", name, len(values))
+	}
+	value := values[0]
+	if field == nil {
+		return value, nil
+	}
+
+	switch field.Type {
+	case openpoints.FIELD_NUMBER:
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, invalid("%s must be a number", name)
+		}
+		return number, nil
+	case openpoints.FIELD_INTEGER:
+		integer, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, invalid("%s must be an integer", name)
+		}
+		return integer, nil
+	case openpoints.FIELD_BOOLEAN:
+		boolean, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, invalid("%s must be true or false", name)
+		}
+		return boolean, nil
+	}
+
+	return value, nil
+}
+
+// Write an error body, with the status of its code when status is 0
+func writeError(w http.ResponseWriter, status int, ccErr *openpoints.ChaincodeError) {
+
+	if status == 0 {
+		status = http.StatusBadRequest
+		if mapped, found := errorStatus[ccErr.Code]; found {
+			status = mapped
+		}
+	}
+
+	asBytes, _ := json.Marshal(ccErr)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(asBytes)
+}
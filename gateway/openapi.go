@@ -0,0 +1,203 @@
+package gateway
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gscdist/GscLabChaincode/openpoints"
+)
+
+// Version of the OpenAPI specification the gateway describes itself in
+const OPENAPI_VERSION = "3.0.3"
+
+// Parts of an OpenAPI document the gateway uses
+type openAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Security   []map[string][]string                   `json:"security"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+}
+
+type openAPIInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description"`
+}
+
+type openAPIComponents struct {
+	Schemas         map[string]*openAPISchema         `json:"schemas"`
+	SecuritySchemes map[string]map[string]interface{} `json:"securitySchemes"`
+}
+
+type openAPIOperation struct {
+	OperationId string                      `json:"operationId"`
+	Summary     string                      `json:"summary,omitempty"`
+	Description string                      `json:"description"`
+	Tags        []string                    `json:"tags"`
+	Parameters  []openAPIParameter          `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"`
+	Function    string                      `json:"x-chaincode-function"`
+	Role        string                      `json:"x-role"`
+	Delegate    string                      `json:"x-delegate,omitempty"`
+}
+
+type openAPIParameter struct {
+	Name     string         `json:"name"`
+	In       string         `json:"in"`
+	Required bool           `json:"required"`
+	Schema   *openAPISchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIMediaType struct {
+	Schema *openAPISchema `json:"schema"`
+}
+
+type openAPISchema struct {
+	Ref         string                    `json:"$ref,omitempty"`
+	Type        string                    `json:"type,omitempty"`
+	Description string                    `json:"description,omitempty"`
+	Items       *openAPISchema            `json:"items,omitempty"`
+	Enum        []string                  `json:"enum,omitempty"`
+	Minimum     *float64                  `json:"minimum,omitempty"`
+	Maximum     *float64                  `json:"maximum,omitempty"`
+	Properties  map[string]*openAPISchema `json:"properties,omitempty"`
+	Required    []string                  `json:"required,omitempty"`
+}
+
+// ============================================================================================================================
+// Describe every route in OpenAPI, with the request fields of the function as query parameters of a read or as the
+// JSON body of a write. Operations carry the role of their function in x-role.
+// ============================================================================================================================
+func (s *Server) buildOpenAPI() openAPIDocument {
+
+	doc := openAPIDocument{OpenAPI: OPENAPI_VERSION, Paths: make(map[string]map[string]*openAPIOperation)}
+	doc.Info = openAPIInfo{Title: "Open Points gateway", Version: strconv.Itoa(s.api.APIVersion),
+		Description: "REST/JSON resources of the Open Points chaincode functions. Every call runs as the Fabric " +
+			"identity of its bearer token and the chaincode checks its role."}
+	doc.Security = []map[string][]string{{"bearer": {}}}
+	doc.Components.SecuritySchemes = map[string]map[string]interface{}{"bearer": {"type": "http", "scheme": "bearer"}}
+
+	codes := append(append([]string{}, s.api.ErrorCodes...), ERR_UNAUTHENTICATED, ERR_BACKEND)
+	doc.Components.Schemas = map[string]*openAPISchema{
+		"Error": {Type: "object", Required: []string{"Code", "Message"}, Properties: map[string]*openAPISchema{
+			"Code":    {Type: "string", Enum: codes},
+			"Message": {Type: "string"},
+			"Field":   {Type: "string"},
+		}},
+	}
+
+	for _, route := range s.routes {
+		spec := s.specs[route.Function]
+		if doc.Paths[route.Path] == nil {
+			doc.Paths[route.Path] = make(map[string]*openAPIOperation)
+		}
+		doc.Paths[route.Path][strings.ToLower(route.Method)] = s.operation(route, spec)
+	}
+
+	return doc
+}
+
+func (s *Server) operation(route Route, spec openpoints.FunctionDescription) *openAPIOperation {
+
+	op := &openAPIOperation{OperationId: route.Function, Summary: spec.Description, Function: spec.Name,
+		Role: spec.Role, Delegate: spec.Delegate, Tags: []string{"functions"}}
+	op.Description = "Calls " + spec.Name + ", which requires the " + spec.Role + " role"
+	if spec.Delegate != "" {
+		op.Description = op.Description + " or a delegation with the " + spec.Delegate + " permission"
+	}
+	op.Description = op.Description + "."
+	if route.resource {
+		op.OperationId = operationId(route)
+		op.Tags = []string{"resources"}
+	}
+
+	inPath := make(map[string]bool)
+	for _, segment := range route.segments {
+		if name, ok := pathParam(segment); ok {
+			inPath[name] = true
+			op.Parameters = append(op.Parameters, openAPIParameter{Name: name, In: "path", Required: true,
+				Schema: fieldSchema(*fieldOf(spec, name))})
+		}
+	}
+
+	body := &openAPISchema{Type: "object", Properties: make(map[string]*openAPISchema)}
+	for _, field := range spec.Request {
+		if inPath[field.Name] {
+			continue
+		}
+		if route.Method == http.MethodGet {
+			op.Parameters = append(op.Parameters, openAPIParameter{Name: field.Name, In: "query", Required: field.Required,
+				Schema: fieldSchema(field)})
+			continue
+		}
+		body.Properties[field.Name] = fieldSchema(field)
+		if field.Required {
+			body.Required = append(body.Required, field.Name)
+		}
+	}
+	if route.Method != http.MethodGet {
+		op.RequestBody = &openAPIRequestBody{Required: len(body.Required) > 0,
+			Content: map[string]openAPIMediaType{"application/json": {Schema: body}}}
+	}
+
+	errorContent := map[string]openAPIMediaType{"application/json": {Schema: &openAPISchema{Ref: "#/components/schemas/Error"}}}
+	op.Responses = map[string]*openAPIResponse{
+		"200":     {Description: "Response of " + spec.Name, Content: map[string]openAPIMediaType{"application/json": {Schema: &openAPISchema{}}}},
+		"204":     {Description: spec.Name + " returned nothing"},
+		"default": {Description: "The chaincode or the gateway rejected the call", Content: errorContent},
+	}
+
+	return op
+}
+
+// Operation id of a resource route, such as getUsersUserIdTransactions for GET /v1/users/{userId}/transactions
+func operationId(route Route) string {
+
+	id := strings.ToLower(route.Method)
+	for _, segment := range route.segments[1:] {
+		if name, ok := pathParam(segment); ok {
+			segment = name
+		}
+		for _, word := range strings.Split(segment, "-") {
+			if word != "" {
+				id = id + strings.ToUpper(word[:1]) + word[1:]
+			}
+		}
+	}
+
+	return id
+}
+
+// OpenAPI schema of a request field
+func fieldSchema(field openpoints.FieldSchema) *openAPISchema {
+
+	schema := &openAPISchema{Type: "string", Enum: field.OneOf, Minimum: field.Min, Maximum: field.Max}
+	switch field.Type {
+	case openpoints.FIELD_NUMBER:
+		schema.Type = "number"
+	case openpoints.FIELD_INTEGER:
+		schema.Type = "integer"
+	case openpoints.FIELD_BOOLEAN:
+		schema.Type = "boolean"
+	case openpoints.FIELD_DATE:
+		schema.Description = "RFC 3339 date-time or " + openpoints.DATE_LAYOUT + " date"
+	case openpoints.FIELD_STRING_LIST:
+		schema.Type = "array"
+		schema.Items = &openAPISchema{Type: "string"}
+	}
+
+	return schema
+}
@@ -0,0 +1,85 @@
+// Package indexer projects the chaincode events of Open Points into an embedded store that reporting queries run
+// against instead of the peer.
+package indexer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/gscdist/GscLabChaincode/openpoints"
+)
+
+// Indexer settings
+type Config struct {
+	// Chaincode whose events are indexed, events of any chaincode when empty
+	ChaincodeId string
+
+	// Save the store after every SaveEvery indexed events and at the end, only at the end when 0
+	SaveEvery int
+}
+
+// Counts of one indexing run
+type Stats struct {
+	Blocks  int `json:"blocks"`
+	Events  int `json:"events"`
+	Skipped int `json:"skipped"`
+}
+
+// ============================================================================================================================
+// Index reads a source to its end and applies every event after the checkpoint of the store. Blocks and events
+// before the checkpoint were indexed by an earlier run and are skipped, so a source can always be read from genesis;
+// Store.Reset before Index rebuilds the projection from scratch.
+// ============================================================================================================================
+func Index(store *Store, source Source, cfg Config) (Stats, error) {
+
+	var stats Stats
+	unsaved := 0
+
+	for {
+		block, err := source.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, err
+		}
+		stats.Blocks++
+
+		for i, tx := range block.Transactions {
+			if !store.Checkpoint.before(block.Number, i) {
+				continue
+			}
+			if tx.ValidationCode != TX_VALID || tx.EventName != openpoints.EVENT_NAME ||
+				(cfg.ChaincodeId != "" && tx.ChaincodeId != "" && tx.ChaincodeId != cfg.ChaincodeId) {
+				stats.Skipped++
+				continue
+			}
+
+			var ev openpoints.LedgerEvent
+			err = json.Unmarshal(tx.Payload, &ev)
+			if err != nil {
+				return stats, fmt.Errorf("block %d transaction %s: failed to decode event: %s", block.Number, tx.TxId, err)
+			}
+			if ev.SchemaVersion > openpoints.EVENT_SCHEMA_VERSION {
+				return stats, fmt.Errorf("block %d transaction %s: event schema version %d is newer than %d",
+					block.Number, tx.TxId, ev.SchemaVersion, openpoints.EVENT_SCHEMA_VERSION)
+			}
+
+			store.apply(block.Number, ev)
+			store.Checkpoint = Checkpoint{Block: block.Number, Tx: i, TxId: tx.TxId}
+			stats.Events++
+
+			unsaved++
+			if cfg.SaveEvery > 0 && unsaved >= cfg.SaveEvery {
+				err = store.Save()
+				if err != nil {
+					return stats, err
+				}
+				unsaved = 0
+			}
+		}
+	}
+
+	return stats, store.Save()
+}
@@ -0,0 +1,242 @@
+package indexer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/gscdist/GscLabChaincode/mockstub"
+	"github.com/gscdist/GscLabChaincode/openpoints"
+)
+
+// A call of the recorded ledger and the identity that submits it
+type recordedCall struct {
+	role     string
+	account  string
+	function string
+	request  interface{}
+}
+
+var recordedCalls = []recordedCall{
+	{openpoints.ROLE_BUSINESS, "T5940872", "addSmartContract", map[string]interface{}{
+		"id": "Promo1", "businessId": "T5940872", "title": "Promotion", "discountRate": 0.5, "budget": 5000}},
+	{openpoints.ROLE_MEMBER, "T5940872", "transferPoints", map[string]interface{}{
+		"from": "T5940872", "to": "U2974034", "type": "purchase", "amount": 100, "money": 10}},
+	{openpoints.ROLE_MEMBER, "U2974034", "transferPoints", map[string]interface{}{
+		"from": "U2974034", "to": "U3151672", "type": "gift", "amount": 40}},
+	{openpoints.ROLE_ADMIN, "", "incrementReferenceNumber", nil},
+	{openpoints.ROLE_MEMBER, "U3151672", "transferPoints", map[string]interface{}{
+		"from": "U3151672", "to": "T5940872", "type": "purchase", "amount": 25}},
+}
+
+// recordLedger runs the recorded calls on an initialized ledger and returns the harness with an admin submitter
+func recordLedger(t *testing.T) *mockstub.Harness {
+
+	h, err := mockstub.NewInitializedHarness()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, call := range recordedCalls {
+		err = h.SetIdentity(call.role, map[string]string{openpoints.ROLE_ATTRIBUTE: call.role, openpoints.ACCOUNT_ATTRIBUTE: call.account})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = h.Invoke(call.function, call.request)
+		if err != nil {
+			t.Fatalf("%s: %s", call.function, err)
+		}
+	}
+
+	err = h.SetIdentity("admin", map[string]string{openpoints.ROLE_ATTRIBUTE: openpoints.ROLE_ADMIN})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return h
+}
+
+// tables encodes the rows of a store, so stores built by different runs can be compared
+func tables(t *testing.T, store *Store) string {
+
+	asBytes, err := json.Marshal([]interface{}{store.Users, store.Transactions, store.Contracts, store.Settlements})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(asBytes)
+}
+
+func checkReconciled(t *testing.T, store *Store, h *mockstub.Harness) {
+
+	mismatches, err := Reconcile(store, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range mismatches {
+		t.Error(m)
+	}
+}
+
+func TestIndexRecordedSource(t *testing.T) {
+
+	h := recordLedger(t)
+	events := h.Stub.Events()
+
+	store := NewStore()
+	stats, err := Index(store, NewRecordedSource(events), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Blocks != len(events) || stats.Events != len(events) || stats.Skipped != 0 {
+		t.Errorf("stats = %+v, want %d blocks and events", stats, len(events))
+	}
+	if store.Checkpoint.Block != uint64(len(events)) || store.Checkpoint.TxId != events[len(events)-1].TxId {
+		t.Errorf("checkpoint = %+v, want block %d", store.Checkpoint, len(events))
+	}
+
+	checkReconciled(t, store, h)
+
+	if n := len(store.UsersOf("")); n != 4 {
+		t.Errorf("%d users indexed, want 4", n)
+	}
+	if rows := store.FindTransactions(TxQuery{UserId: "U2974034"}); len(rows) != 2 {
+		t.Errorf("%d transactions of U2974034 indexed, want 2", len(rows))
+	}
+	found := false
+	for _, row := range store.ContractsOf("") {
+		found = found || row.ContractId == "Promo1"
+	}
+	if !found {
+		t.Error("contract Promo1 was not indexed")
+	}
+}
+
+func TestIndexResumesFromCheckpoint(t *testing.T) {
+
+	h := recordLedger(t)
+	events := h.Stub.Events()
+
+	full := NewStore()
+	_, err := Index(full, NewRecordedSource(events), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for stop := 1; stop < len(events); stop++ {
+		path := filepath.Join(t.TempDir(), "store.json")
+
+		store, err := OpenStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = Index(store, NewRecordedSource(events[:stop]), Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A later run reads the source from genesis and only applies what the saved store has not seen
+		resumed, err := OpenStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resumed.Checkpoint != store.Checkpoint {
+			t.Fatalf("stop %d: reopened checkpoint = %+v, saved %+v", stop, resumed.Checkpoint, store.Checkpoint)
+		}
+		stats, err := Index(resumed, NewRecordedSource(events), Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Events != len(events)-stop {
+			t.Errorf("stop %d: resumed run applied %d events, want %d", stop, stats.Events, len(events)-stop)
+		}
+		if tables(t, resumed) != tables(t, full) {
+			t.Errorf("stop %d: resumed store differs from a single run", stop)
+		}
+
+		// Nothing is applied twice when the whole source is read again
+		stats, err = Index(resumed, NewRecordedSource(events), Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Events != 0 {
+			t.Errorf("stop %d: indexing an indexed source applied %d events", stop, stats.Events)
+		}
+		checkReconciled(t, resumed, h)
+	}
+}
+
+func TestIndexSavesEvery(t *testing.T) {
+
+	h := recordLedger(t)
+	events := h.Stub.Events()
+	path := filepath.Join(t.TempDir(), "store.json")
+
+	store, err := OpenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Index(store, NewRecordedSource(events), Config{SaveEvery: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := OpenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Checkpoint != store.Checkpoint || tables(t, saved) != tables(t, store) {
+		t.Error("the saved store differs from the indexed one")
+	}
+}
+
+func TestIndexFileSource(t *testing.T) {
+
+	h := recordLedger(t)
+	events := h.Stub.Events()
+
+	var blocks bytes.Buffer
+	err := WriteBlocks(&blocks, NewRecordedSource(events))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A block that failed validation follows the recorded blocks, its event must not be applied
+	invalid, _ := json.Marshal(Block{Number: uint64(len(events) + 1), Transactions: []BlockTx{{TxId: "conflict",
+		ValidationCode: "MVCC_READ_CONFLICT", EventName: openpoints.EVENT_NAME, Payload: events[1].Payload}}})
+	blocks.Write(invalid)
+	blocks.WriteString("\n")
+
+	path := filepath.Join(t.TempDir(), "blocks.jsonl")
+	err = ioutil.WriteFile(path, blocks.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	store := NewStore()
+	stats, err := Index(store, source, Config{ChaincodeId: "openpoints"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Events != len(events) || stats.Skipped != 1 {
+		t.Errorf("stats = %+v, want %d events and 1 skipped", stats, len(events))
+	}
+
+	recorded := NewStore()
+	_, err = Index(recorded, NewRecordedSource(events), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tables(t, store) != tables(t, recorded) {
+		t.Error("the block file indexes differently from the recorded source")
+	}
+	checkReconciled(t, store, h)
+}
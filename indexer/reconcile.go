@@ -0,0 +1,101 @@
+package indexer
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/gscdist/GscLabChaincode/openpoints"
+)
+
+// Largest difference between an indexed and a ledger amount that still counts as equal
+const reconcileTolerance = 1e-6
+
+// Evaluates chaincode functions, such as a mockstub.Harness or a gateway client of the peer
+type Querier interface {
+	Query(function string, request interface{}) ([]byte, error)
+}
+
+// Saved getUserAccount responses keyed by programId/userId, to reconcile against a snapshot of the ledger
+type Accounts map[string]json.RawMessage
+
+// Query answers getUserAccount from the saved responses
+func (a Accounts) Query(function string, request interface{}) ([]byte, error) {
+
+	req, _ := request.(map[string]string)
+	if function != "getUserAccount" || req == nil {
+		return nil, fmt.Errorf("only getUserAccount can be answered from saved accounts")
+	}
+	account, found := a[rowKey(req[openpoints.PROGRAM_FIELD], req["userId"])]
+	if !found {
+		return nil, fmt.Errorf("user %s does not exist", req["userId"])
+	}
+
+	return account, nil
+}
+
+// A member whose indexed account differs from getUserAccount
+type Mismatch struct {
+	ProgramId string  `json:"programId"`
+	UserId    string  `json:"userId"`
+	Field     string  `json:"field"`
+	Indexed   float64 `json:"indexed"`
+	Ledger    float64 `json:"ledger"`
+	Error     string  `json:"error,omitempty"`
+}
+
+func (m Mismatch) String() string {
+	if m.Error != "" {
+		return fmt.Sprintf("%s/%s: %s", m.ProgramId, m.UserId, m.Error)
+	}
+	return fmt.Sprintf("%s/%s: %s is %v in the index and %v on the ledger", m.ProgramId, m.UserId, m.Field, m.Indexed, m.Ledger)
+}
+
+// ============================================================================================================================
+// Reconcile compares the balance, pending balance and wallets of every indexed member with getUserAccount and
+// returns the differences. Members the ledger does not know are reported with the error of the query.
+// ============================================================================================================================
+func Reconcile(store *Store, querier Querier) ([]Mismatch, error) {
+
+	mismatches := []Mismatch{}
+	for _, row := range store.UsersOf("") {
+		request := map[string]string{"userId": row.UserId, openpoints.PROGRAM_FIELD: row.ProgramId}
+		asBytes, err := querier.Query("getUserAccount", request)
+		if err != nil {
+			mismatches = append(mismatches, Mismatch{ProgramId: row.ProgramId, UserId: row.UserId, Error: err.Error()})
+			continue
+		}
+
+		var user openpoints.User
+		err = json.Unmarshal(asBytes, &user)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode the account of %s/%s: %s", row.ProgramId, row.UserId, err)
+		}
+
+		add := func(field string, indexed float64, ledger float64) {
+			if math.Abs(indexed-ledger) > reconcileTolerance {
+				mismatches = append(mismatches, Mismatch{ProgramId: row.ProgramId, UserId: row.UserId, Field: field,
+					Indexed: indexed, Ledger: ledger})
+			}
+		}
+		add("Balance", row.Balance, user.Balance)
+		add("PendingBalance", row.Pending, user.Pending)
+
+		wallets := []string{}
+		for wallet := range row.Wallets {
+			wallets = append(wallets, wallet)
+		}
+		for wallet := range user.Wallets {
+			if _, found := row.Wallets[wallet]; !found {
+				wallets = append(wallets, wallet)
+			}
+		}
+		sort.Strings(wallets)
+		for _, wallet := range wallets {
+			add("Wallets."+wallet, row.Wallets[wallet], user.Wallets[wallet])
+		}
+	}
+
+	return mismatches, nil
+}
@@ -0,0 +1,163 @@
+package indexer
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/gscdist/GscLabChaincode/openpoints"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// ============================================================================================================================
+// Event sources
+//
+// A source hands the indexer committed blocks in order. A block file holds one JSON object per line, either a block
+// exported by a block listener:
+//
+//	{"Number": 12, "Transactions": [{"TxId": "9f2c...", "ValidationCode": "VALID", "ChaincodeId": "openpoints",
+//	  "EventName": "OpenPointsEvent", "Payload": {...LedgerEvent...}}]}
+//
+// or a bare LedgerEvent as delivered by a chaincode event listener, which counts as a block of its own numbered by
+// its line. Transactions that are not VALID and events of other chaincodes are skipped. A recorded source replays
+// the events of a MockStub, one block per committed transaction, so tests index exactly what the chaincode emitted.
+// ============================================================================================================================
+
+// Validation code of committed transactions whose writes were applied
+const TX_VALID = "VALID"
+
+// A committed block
+type Block struct {
+	Number       uint64    `json:"Number"`
+	Transactions []BlockTx `json:"Transactions"`
+}
+
+// A transaction of a committed block and its chaincode event
+type BlockTx struct {
+	TxId           string          `json:"TxId"`
+	ValidationCode string          `json:"ValidationCode"`
+	ChaincodeId    string          `json:"ChaincodeId,omitempty"`
+	EventName      string          `json:"EventName,omitempty"`
+	Payload        json.RawMessage `json:"Payload,omitempty"`
+}
+
+// Source of committed blocks, Next returns io.EOF after the last one
+type Source interface {
+	Next() (*Block, error)
+}
+
+// Blocks read from a block file
+type FileSource struct {
+	file    *os.File
+	scanner *bufio.Scanner
+	line    uint64
+}
+
+// OpenFile opens a block file
+func OpenFile(path string) (*FileSource, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	return &FileSource{file: file, scanner: scanner}, nil
+}
+
+// Next reads the next block of the file, skipping blank lines
+func (f *FileSource) Next() (*Block, error) {
+
+	for f.scanner.Scan() {
+		f.line++
+		line := f.scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var record struct {
+			Number       *uint64         `json:"Number"`
+			Transactions []BlockTx       `json:"Transactions"`
+			TxId         string          `json:"TxId"`
+			Effects      json.RawMessage `json:"Effects"`
+		}
+		err := json.Unmarshal(line, &record)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", f.line, err)
+		}
+
+		if record.Effects != nil {
+			payload := append(json.RawMessage{}, line...)
+			tx := BlockTx{TxId: record.TxId, ValidationCode: TX_VALID, EventName: openpoints.EVENT_NAME, Payload: payload}
+			return &Block{Number: f.line, Transactions: []BlockTx{tx}}, nil
+		}
+		if record.Number == nil {
+			return nil, fmt.Errorf("line %d is neither a block nor a ledger event", f.line)
+		}
+		return &Block{Number: *record.Number, Transactions: record.Transactions}, nil
+	}
+
+	err := f.scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// Close closes the block file
+func (f *FileSource) Close() error {
+	return f.file.Close()
+}
+
+// Blocks replayed from recorded chaincode events
+type RecordedSource struct {
+	blocks []Block
+}
+
+// NewRecordedSource replays chaincode events, such as those of MockStub.Events, as blocks numbered from 1
+func NewRecordedSource(events []*pb.ChaincodeEvent) *RecordedSource {
+
+	r := &RecordedSource{}
+	for i, event := range events {
+		tx := BlockTx{TxId: event.TxId, ValidationCode: TX_VALID, ChaincodeId: event.ChaincodeId,
+			EventName: event.EventName, Payload: event.Payload}
+		r.blocks = append(r.blocks, Block{Number: uint64(i + 1), Transactions: []BlockTx{tx}})
+	}
+
+	return r
+}
+
+// Next returns the next recorded block
+func (r *RecordedSource) Next() (*Block, error) {
+
+	if len(r.blocks) == 0 {
+		return nil, io.EOF
+	}
+	block := r.blocks[0]
+	r.blocks = r.blocks[1:]
+
+	return &block, nil
+}
+
+// WriteBlocks writes the remaining blocks of a source as a block file
+func WriteBlocks(w io.Writer, source Source) error {
+
+	encoder := json.NewEncoder(w)
+	for {
+		block, err := source.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = encoder.Encode(block)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package indexer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/gscdist/GscLabChaincode/openpoints"
+)
+
+// ============================================================================================================================
+// Projection store
+//
+// The projection is an embedded store with one table per record type, keyed like the rows of a SQLite schema:
+//
+//	users         (ProgramId, UserId)      member records with their balances and wallets
+//	transactions  (ProgramId, RefNumber)   posted transactions, with the reversal that undid them
+//	contracts     (ProgramId, ContractId)  smart contracts that have not been removed
+//	settlements   (ProgramId, BatchId)     settlement batches in their latest status
+//
+// Every row records the block and transaction id of the event that last wrote it. The store is saved to a single
+// JSON file together with the checkpoint of the last event it holds, so the indexer resumes where it stopped.
+//
+// The tables are kept in memory rather than in an embedded SQL database. The indexer shares its module with the
+// chaincode, and the chaincode is packaged with its vendored dependencies: mattn/go-sqlite3 would make every build
+// of the chaincode need cgo, and the pure Go modernc.org/sqlite would add a transpiled SQLite to every chaincode
+// package. A projection the size of one channel fits in memory, and the queries below only look rows up by key or
+// filter one table. Because the tables are keyed like the schema above, moving them to SQLite changes this file only.
+// ============================================================================================================================
+
+// Version of the store file format
+const STORE_VERSION = 1
+
+// Position of the last indexed event
+type Checkpoint struct {
+	Block uint64 `json:"Block"`
+	Tx    int    `json:"Tx"`
+	TxId  string `json:"TxId,omitempty"`
+}
+
+// Whether a position is after the checkpoint, every position is after the zero checkpoint
+func (cp Checkpoint) before(block uint64, tx int) bool {
+	if cp.TxId == "" {
+		return true
+	}
+	return block > cp.Block || (block == cp.Block && tx > cp.Tx)
+}
+
+// Row of the users table
+type UserRow struct {
+	ProgramId string             `json:"ProgramId"`
+	UserId    string             `json:"UserId"`
+	Name      string             `json:"Name"`
+	Balance   float64            `json:"Balance"`
+	Pending   float64            `json:"PendingBalance"`
+	Wallets   map[string]float64 `json:"Wallets"`
+	NumTxs    int                `json:"NumberOfTransactions"`
+	Status    string             `json:"Status"`
+	Modified  time.Time          `json:"Modified"`
+	Block     uint64             `json:"Block"`
+	TxId      string             `json:"TxId"`
+}
+
+// Row of the transactions table
+type TransactionRow struct {
+	ProgramId  string    `json:"ProgramId"`
+	RefNumber  string    `json:"RefNumber"`
+	Date       time.Time `json:"Date"`
+	Type       string    `json:"Type"`
+	From       string    `json:"FromUserid"`
+	To         string    `json:"ToUserid"`
+	Amount     float64   `json:"Amount"`
+	Money      float64   `json:"Money"`
+	Earned     float64   `json:"Earned"`
+	ContractId string    `json:"ContractId"`
+	LinkedRef  string    `json:"LinkedRef,omitempty"`
+	ReversedBy string    `json:"ReversedBy,omitempty"`
+	Block      uint64    `json:"Block"`
+	TxId       string    `json:"TxId"`
+}
+
+// Row of the contracts table
+type ContractRow struct {
+	ProgramId    string    `json:"ProgramId"`
+	ContractId   string    `json:"ContractId"`
+	BusinessId   string    `json:"BusinessId"`
+	Title        string    `json:"Title"`
+	Method       string    `json:"Method"`
+	DiscountRate float64   `json:"DiscountRate"`
+	Budget       float64   `json:"Budget"`
+	PointsUsed   float64   `json:"PointsUsed"`
+	StartDate    time.Time `json:"StartDate"`
+	EndDate      time.Time `json:"EndDate"`
+	Block        uint64    `json:"Block"`
+	TxId         string    `json:"TxId"`
+}
+
+// Row of the settlements table
+type SettlementRow struct {
+	ProgramId  string    `json:"ProgramId"`
+	BatchId    string    `json:"BatchId"`
+	BusinessId string    `json:"BusinessId"`
+	Status     string    `json:"Status"`
+	NetAmount  float64   `json:"NetAmount"`
+	From       time.Time `json:"From"`
+	To         time.Time `json:"To"`
+	Created    time.Time `json:"Created"`
+	Paid       time.Time `json:"Paid"`
+	Block      uint64    `json:"Block"`
+	TxId       string    `json:"TxId"`
+}
+
+// Filter of Store.FindTransactions, empty fields match every row
+type TxQuery struct {
+	ProgramId string
+	UserId    string
+	Type      string
+	From      time.Time
+	To        time.Time
+}
+
+// Embedded projection of the ledger
+type Store struct {
+	Version      int                       `json:"Version"`
+	Checkpoint   Checkpoint                `json:"Checkpoint"`
+	Users        map[string]UserRow        `json:"Users"`
+	Transactions map[string]TransactionRow `json:"Transactions"`
+	Contracts    map[string]ContractRow    `json:"Contracts"`
+	Settlements  map[string]SettlementRow  `json:"Settlements"`
+
+	path string
+}
+
+// NewStore creates an empty store that is not saved to a file
+func NewStore() *Store {
+
+	s := &Store{}
+	s.Reset()
+
+	return s
+}
+
+// OpenStore loads the store saved at path, or creates an empty one if there is no file yet
+func OpenStore(path string) (*Store, error) {
+
+	s := NewStore()
+	s.path = path
+
+	asBytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(asBytes, s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode store %s: %s", path, err)
+	}
+	if s.Version != STORE_VERSION {
+		return nil, fmt.Errorf("store %s has version %d, expected %d", path, s.Version, STORE_VERSION)
+	}
+
+	return s, nil
+}
+
+// Reset empties every table and rewinds the checkpoint to genesis
+func (s *Store) Reset() {
+
+	s.Version = STORE_VERSION
+	s.Checkpoint = Checkpoint{}
+	s.Users = map[string]UserRow{}
+	s.Transactions = map[string]TransactionRow{}
+	s.Contracts = map[string]ContractRow{}
+	s.Settlements = map[string]SettlementRow{}
+}
+
+// Save writes the store to its file, replacing the previous one only once the new one is complete
+func (s *Store) Save() error {
+
+	if s.path == "" {
+		return nil
+	}
+
+	asBytes, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(asBytes)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func rowKey(programId string, id string) string {
+	return programId + "/" + id
+}
+
+// User returns the row of a member and whether there is one
+func (s *Store) User(programId string, userId string) (UserRow, bool) {
+	row, found := s.Users[rowKey(programId, userId)]
+	return row, found
+}
+
+// UsersOf lists the members of a program by id, every member when programId is empty
+func (s *Store) UsersOf(programId string) []UserRow {
+
+	rows := []UserRow{}
+	for _, row := range s.Users {
+		if programId == "" || row.ProgramId == programId {
+			rows = append(rows, row)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rowKey(rows[i].ProgramId, rows[i].UserId) < rowKey(rows[j].ProgramId, rows[j].UserId)
+	})
+
+	return rows
+}
+
+// FindTransactions lists the transactions matching a filter by date. The To date is exclusive.
+func (s *Store) FindTransactions(q TxQuery) []TransactionRow {
+
+	rows := []TransactionRow{}
+	for _, row := range s.Transactions {
+		if q.ProgramId != "" && row.ProgramId != q.ProgramId {
+			continue
+		}
+		if q.UserId != "" && row.From != q.UserId && row.To != q.UserId {
+			continue
+		}
+		if q.Type != "" && row.Type != q.Type {
+			continue
+		}
+		if !q.From.IsZero() && row.Date.Before(q.From) {
+			continue
+		}
+		if !q.To.IsZero() && !row.Date.Before(q.To) {
+			continue
+		}
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if !rows[i].Date.Equal(rows[j].Date) {
+			return rows[i].Date.Before(rows[j].Date)
+		}
+		return rows[i].Block < rows[j].Block || (rows[i].Block == rows[j].Block && rows[i].RefNumber < rows[j].RefNumber)
+	})
+
+	return rows
+}
+
+// ContractsOf lists the contracts of a program by id, every contract when programId is empty
+func (s *Store) ContractsOf(programId string) []ContractRow {
+
+	rows := []ContractRow{}
+	for _, row := range s.Contracts {
+		if programId == "" || row.ProgramId == programId {
+			rows = append(rows, row)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rowKey(rows[i].ProgramId, rows[i].ContractId) < rowKey(rows[j].ProgramId, rows[j].ContractId)
+	})
+
+	return rows
+}
+
+// SettlementsOf lists the settlement batches of a business by creation date, every batch when businessId is empty
+func (s *Store) SettlementsOf(programId string, businessId string) []SettlementRow {
+
+	rows := []SettlementRow{}
+	for _, row := range s.Settlements {
+		if programId != "" && row.ProgramId != programId {
+			continue
+		}
+		if businessId != "" && row.BusinessId != businessId {
+			continue
+		}
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if !rows[i].Created.Equal(rows[j].Created) {
+			return rows[i].Created.Before(rows[j].Created)
+		}
+		return rows[i].BatchId < rows[j].BatchId
+	})
+
+	return rows
+}
+
+// ============================================================================================================================
+// Apply the effects of one committed event to the tables
+// ============================================================================================================================
+func (s *Store) apply(block uint64, ev openpoints.LedgerEvent) {
+
+	for _, effect := range ev.Effects {
+		programId := ev.ProgramId
+		if effect.ProgramId != "" {
+			programId = effect.ProgramId
+		}
+		// The originator of a created program is a member of that program, not of the program of the call
+		if effect.Type == openpoints.EFFECT_PROGRAM_CHANGED && effect.Program != nil {
+			programId = effect.Program.ProgramId
+		}
+
+		if effect.User != nil {
+			s.putUser(programId, block, ev, *effect.User)
+		}
+		if effect.Transaction != nil {
+			s.putTransaction(programId, block, ev, *effect.Transaction)
+		}
+
+		switch effect.Type {
+		case openpoints.EFFECT_REVERSAL:
+			key := rowKey(programId, effect.ReversedRef)
+			if row, found := s.Transactions[key]; found && effect.Transaction != nil {
+				row.ReversedBy = effect.Transaction.RefNumber
+				s.Transactions[key] = row
+			}
+
+		case openpoints.EFFECT_CONTRACT_ADDED, openpoints.EFFECT_CONTRACT_UPDATED:
+			if effect.Contract != nil {
+				contract := effect.Contract
+				s.Contracts[rowKey(programId, contract.Id)] = ContractRow{ProgramId: programId, ContractId: contract.Id,
+					BusinessId: contract.BusinessId, Title: contract.Title, Method: contract.Method,
+					DiscountRate: contract.DiscountRate, Budget: contract.Budget, PointsUsed: contract.PointsUsed,
+					StartDate: contract.StartDate, EndDate: contract.EndDate, Block: block, TxId: ev.TxId}
+			}
+
+		case openpoints.EFFECT_CONTRACT_REMOVED:
+			delete(s.Contracts, rowKey(programId, effect.ContractId))
+
+		case openpoints.EFFECT_SETTLEMENT_CHANGED:
+			if effect.Settlement != nil {
+				batch := effect.Settlement
+				s.Settlements[rowKey(programId, batch.BatchId)] = SettlementRow{ProgramId: programId, BatchId: batch.BatchId,
+					BusinessId: batch.BusinessId, Status: batch.Status, NetAmount: batch.NetAmount, From: batch.From,
+					To: batch.To, Created: batch.Created, Paid: batch.Paid, Block: block, TxId: ev.TxId}
+			}
+		}
+	}
+}
+
+func (s *Store) putUser(programId string, block uint64, ev openpoints.LedgerEvent, user openpoints.User) {
+
+	// Balances older than wallets count as earned, as getUserAccount reports them
+	wallets := map[string]float64{}
+	allocated := 0.0
+	for wallet, amount := range user.Wallets {
+		wallets[wallet] = amount
+		allocated = allocated + amount
+	}
+	wallets[openpoints.WALLET_EARNED] = wallets[openpoints.WALLET_EARNED] + user.Balance - allocated
+
+	s.Users[rowKey(programId, user.UserId)] = UserRow{ProgramId: programId, UserId: user.UserId, Name: user.Name,
+		Balance: user.Balance, Pending: user.Pending, Wallets: wallets, NumTxs: user.NumTxs, Status: user.Status,
+		Modified: ev.Timestamp, Block: block, TxId: ev.TxId}
+}
+
+func (s *Store) putTransaction(programId string, block uint64, ev openpoints.LedgerEvent, tx openpoints.Transaction) {
+
+	key := rowKey(programId, tx.RefNumber)
+	s.Transactions[key] = TransactionRow{ProgramId: programId, RefNumber: tx.RefNumber, Date: tx.Date, Type: tx.Type,
+		From: tx.From, To: tx.To, Amount: tx.Amount, Money: tx.Money, Earned: tx.Earned, ContractId: tx.ContractId,
+		LinkedRef: tx.LinkedRef, ReversedBy: s.Transactions[key].ReversedBy, Block: block, TxId: ev.TxId}
+}
@@ -0,0 +1,128 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	"github.com/gscdist/GscLabChaincode/openpoints"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ============================================================================================================================
+// Main
+//
+// Without CHAINCODE_SERVER_ADDRESS the chaincode is launched by the peer and connects back to it. With it, the
+// chaincode runs as an external chaincode server (chaincode-as-a-service) that the peer connects to, configured by:
+//
+//	CHAINCODE_SERVER_ADDRESS   host:port to listen on, for example 0.0.0.0:9999
+//	CHAINCODE_ID               package id printed by peer lifecycle chaincode install
+//	CHAINCODE_TLS_DISABLED     "true" to serve without TLS, the default
+//	CHAINCODE_TLS_KEY          server private key file
+//	CHAINCODE_TLS_CERT         server certificate file
+//	CHAINCODE_CLIENT_CA_CERT   CA certificate file used to verify the peer
+//
+// ============================================================================================================================
+func main() {
+
+	chaincode, err := contractapi.NewChaincode(openpoints.NewContract())
+	if err != nil {
+		fmt.Println("Error creating Open Points chaincode: ", err)
+		os.Exit(1)
+	}
+
+	address := os.Getenv("CHAINCODE_SERVER_ADDRESS")
+	if address == "" {
+		err = chaincode.Start()
+	} else {
+		err = startServer(chaincode, address)
+	}
+
+	if err != nil {
+		fmt.Println("Error starting Open Points chaincode: ", err)
+		os.Exit(1)
+	}
+}
+
+// ============================================================================================================================
+// Run the chaincode as an external chaincode server
+// ============================================================================================================================
+func startServer(chaincode *contractapi.ContractChaincode, address string) error {
+
+	tlsProps, err := tlsProperties()
+	if err != nil {
+		return err
+	}
+
+	server := &shim.ChaincodeServer{
+		CCID:     os.Getenv("CHAINCODE_ID"),
+		Address:  address,
+		CC:       chaincode,
+		TLSProps: tlsProps,
+	}
+
+	fmt.Println("Open Points chaincode server listening on " + address)
+	return server.Start()
+}
+
+func tlsProperties() (shim.TLSProperties, error) {
+
+	var props shim.TLSProperties
+
+	disabled, err := strconv.ParseBool(getEnvOrDefault("CHAINCODE_TLS_DISABLED", "true"))
+	if err != nil {
+		return props, fmt.Errorf("invalid CHAINCODE_TLS_DISABLED: %s", err)
+	}
+	props.Disabled = disabled
+	if disabled {
+		return props, nil
+	}
+
+	props.Key, err = ioutil.ReadFile(os.Getenv("CHAINCODE_TLS_KEY"))
+	if err != nil {
+		return props, fmt.Errorf("failed to read CHAINCODE_TLS_KEY: %s", err)
+	}
+	props.Cert, err = ioutil.ReadFile(os.Getenv("CHAINCODE_TLS_CERT"))
+	if err != nil {
+		return props, fmt.Errorf("failed to read CHAINCODE_TLS_CERT: %s", err)
+	}
+
+	clientCA := os.Getenv("CHAINCODE_CLIENT_CA_CERT")
+	if clientCA != "" {
+		props.ClientCACerts, err = ioutil.ReadFile(clientCA)
+		if err != nil {
+			return props, fmt.Errorf("failed to read CHAINCODE_CLIENT_CA_CERT: %s", err)
+		}
+	}
+
+	return props, nil
+}
+
+func getEnvOrDefault(name string, defaultValue string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
@@ -0,0 +1,155 @@
+package mockstub
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gscdist/GscLabChaincode/openpoints"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// MSP of the identities created by the harness
+const HarnessMSP = "Org1MSP"
+
+// Harness runs the Open Points chaincode on a MockStub through the contract API, the same path a peer uses
+type Harness struct {
+	Stub      *MockStub
+	Chaincode *contractapi.ContractChaincode
+
+	// Clock is the timestamp of the next transaction, it advances by Step after each one
+	Clock time.Time
+	Step  time.Duration
+
+	txCount int
+}
+
+// NewHarness creates a harness over an empty ledger, with an admin submitter
+func NewHarness() (*Harness, error) {
+
+	chaincode, err := contractapi.NewChaincode(openpoints.NewContract())
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Harness{
+		Stub:      NewMockStub("openpoints"),
+		Chaincode: chaincode,
+		Clock:     time.Date(2017, 5, 6, 12, 0, 0, 0, time.UTC),
+		Step:      time.Minute,
+	}
+
+	err = h.SetIdentity("admin", map[string]string{"role": "admin"})
+	if err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// NewInitializedHarness creates a harness and runs init on it
+func NewInitializedHarness() (*Harness, error) {
+
+	h, err := NewHarness()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = h.Invoke("init", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// SetIdentity sets the submitter of the following transactions
+func (h *Harness) SetIdentity(commonName string, attrs map[string]string) error {
+
+	creator, err := NewIdentity(HarnessMSP, commonName, attrs)
+	if err != nil {
+		return err
+	}
+
+	h.Stub.SetCreator(creator)
+	return nil
+}
+
+// Invoke submits a function and commits its writes if it succeeds. request is a JSON string, a value encoded as
+// JSON, or nil for an empty request. Chaincode errors are returned as *openpoints.ChaincodeError.
+func (h *Harness) Invoke(function string, request interface{}) ([]byte, error) {
+	return h.run(function, request, true)
+}
+
+// Query evaluates a function, its writes are always discarded
+func (h *Harness) Query(function string, request interface{}) ([]byte, error) {
+	return h.run(function, request, false)
+}
+
+// LastEvent decodes the chaincode event of the most recent committed transaction
+func (h *Harness) LastEvent() (*openpoints.LedgerEvent, error) {
+
+	events := h.Stub.Events()
+	if len(events) == 0 {
+		return nil, errors.New("no events have been emitted")
+	}
+
+	var ev openpoints.LedgerEvent
+	err := json.Unmarshal(events[len(events)-1].Payload, &ev)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ev, nil
+}
+
+func (h *Harness) run(function string, request interface{}, commit bool) ([]byte, error) {
+
+	requestStr, err := encodeRequest(request)
+	if err != nil {
+		return nil, err
+	}
+
+	h.txCount++
+	txID := "tx" + strconv.Itoa(h.txCount)
+	args := [][]byte{[]byte(function), []byte(requestStr)}
+
+	txTimestamp := h.Clock
+	h.Clock = h.Clock.Add(h.Step)
+
+	var res pb.Response
+	if commit {
+		res = h.Stub.MockInvoke(txID, txTimestamp, args, h.Chaincode)
+	} else {
+		res = h.Stub.MockQuery(txID, txTimestamp, args, h.Chaincode)
+	}
+
+	if res.Status >= shim.ERRORTHRESHOLD {
+		var ccErr openpoints.ChaincodeError
+		if json.Unmarshal([]byte(res.Message), &ccErr) == nil && ccErr.Code != "" {
+			return nil, &ccErr
+		}
+		return nil, errors.New(res.Message)
+	}
+
+	return res.Payload, nil
+}
+
+func encodeRequest(request interface{}) (string, error) {
+
+	if request == nil {
+		return "{}", nil
+	}
+	if s, ok := request.(string); ok {
+		return s, nil
+	}
+
+	asBytes, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+	return string(asBytes), nil
+}
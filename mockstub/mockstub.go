@@ -0,0 +1,509 @@
+// Package mockstub is an in-memory implementation of the chaincode stub used to run the Open Points chaincode
+// without a peer. It keeps world state, key history, composite keys, the chaincode event of each transaction and the
+// identity of the submitter, and applies the writes of a transaction only when it commits, as a peer does.
+package mockstub
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// Separators used by composite keys, the same as the peer uses
+const compositeKeyNamespace = "\x00"
+const minUnicodeRuneValue = 0
+const maxUnicodeRuneValue = utf8.MaxRune
+
+var errNotSupported = errors.New("not supported by MockStub")
+
+// MockStub implements shim.ChaincodeStubInterface in memory
+type MockStub struct {
+	Name      string
+	ChannelID string
+
+	state   map[string][]byte
+	history map[string][]*queryresult.KeyModification
+	events  []*pb.ChaincodeEvent
+
+	// current transaction
+	txID        string
+	txTimestamp time.Time
+	args        [][]byte
+	creator     []byte
+	transient   map[string][]byte
+	writes      map[string][]byte
+	deletes     map[string]bool
+	event       *pb.ChaincodeEvent
+}
+
+// NewMockStub creates an empty ledger
+func NewMockStub(name string) *MockStub {
+	return &MockStub{
+		Name:      name,
+		ChannelID: "mychannel",
+		state:     make(map[string][]byte),
+		history:   make(map[string][]*queryresult.KeyModification),
+	}
+}
+
+// SetCreator sets the serialized identity returned by GetCreator for the following transactions
+func (s *MockStub) SetCreator(creator []byte) {
+	s.creator = creator
+}
+
+// SetTransient sets the transient map of the next transaction
+func (s *MockStub) SetTransient(transient map[string][]byte) {
+	s.transient = transient
+}
+
+// MockTransactionStart begins a transaction, its writes are buffered until MockTransactionEnd
+func (s *MockStub) MockTransactionStart(txID string, txTimestamp time.Time, args [][]byte) {
+	s.txID = txID
+	s.txTimestamp = txTimestamp
+	s.args = args
+	s.writes = make(map[string][]byte)
+	s.deletes = make(map[string]bool)
+	s.event = nil
+}
+
+// MockTransactionEnd commits or discards the writes and the event of the current transaction
+func (s *MockStub) MockTransactionEnd(commit bool) {
+
+	if commit {
+		ts := &timestamp.Timestamp{Seconds: s.txTimestamp.Unix(), Nanos: int32(s.txTimestamp.Nanosecond())}
+
+		keys := make([]string, 0, len(s.writes)+len(s.deletes))
+		for key := range s.writes {
+			keys = append(keys, key)
+		}
+		for key := range s.deletes {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			value, written := s.writes[key]
+			if written {
+				s.state[key] = value
+			} else {
+				delete(s.state, key)
+			}
+			s.history[key] = append(s.history[key], &queryresult.KeyModification{
+				TxId: s.txID, Value: value, Timestamp: ts, IsDelete: !written,
+			})
+		}
+
+		if s.event != nil {
+			s.events = append(s.events, s.event)
+		}
+	}
+
+	s.txID = ""
+	s.args = nil
+	s.transient = nil
+	s.writes = nil
+	s.deletes = nil
+	s.event = nil
+}
+
+// MockInvoke runs one transaction against cc and commits it if it succeeds
+func (s *MockStub) MockInvoke(txID string, txTimestamp time.Time, args [][]byte, cc shim.Chaincode) pb.Response {
+	s.MockTransactionStart(txID, txTimestamp, args)
+	res := cc.Invoke(s)
+	s.MockTransactionEnd(res.Status < shim.ERRORTHRESHOLD)
+	return res
+}
+
+// MockQuery runs one transaction against cc and always discards its writes, like an evaluated transaction
+func (s *MockStub) MockQuery(txID string, txTimestamp time.Time, args [][]byte, cc shim.Chaincode) pb.Response {
+	s.MockTransactionStart(txID, txTimestamp, args)
+	res := cc.Invoke(s)
+	s.MockTransactionEnd(false)
+	return res
+}
+
+// Events returns the events of every committed transaction, oldest first
+func (s *MockStub) Events() []*pb.ChaincodeEvent {
+	return s.events
+}
+
+// Keys returns every key in world state, composite keys included, in sorted order
+func (s *MockStub) Keys() []string {
+	keys := make([]string, 0, len(s.state))
+	for key := range s.state {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Snapshot returns a copy of world state
+func (s *MockStub) Snapshot() map[string][]byte {
+	snapshot := make(map[string][]byte, len(s.state))
+	for key, value := range s.state {
+		snapshot[key] = append([]byte(nil), value...)
+	}
+	return snapshot
+}
+
+// ============================================================================================================================
+// Arguments and transaction metadata
+// ============================================================================================================================
+
+func (s *MockStub) GetArgs() [][]byte {
+	return s.args
+}
+
+func (s *MockStub) GetStringArgs() []string {
+	strargs := make([]string, 0, len(s.args))
+	for _, arg := range s.args {
+		strargs = append(strargs, string(arg))
+	}
+	return strargs
+}
+
+func (s *MockStub) GetFunctionAndParameters() (string, []string) {
+	allargs := s.GetStringArgs()
+	if len(allargs) == 0 {
+		return "", []string{}
+	}
+	return allargs[0], allargs[1:]
+}
+
+func (s *MockStub) GetArgsSlice() ([]byte, error) {
+	var slice []byte
+	for _, arg := range s.args {
+		slice = append(slice, arg...)
+	}
+	return slice, nil
+}
+
+func (s *MockStub) GetTxID() string {
+	return s.txID
+}
+
+func (s *MockStub) GetChannelID() string {
+	return s.ChannelID
+}
+
+func (s *MockStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	if s.txTimestamp.IsZero() {
+		return nil, errors.New("no transaction in progress")
+	}
+	return &timestamp.Timestamp{Seconds: s.txTimestamp.Unix(), Nanos: int32(s.txTimestamp.Nanosecond())}, nil
+}
+
+func (s *MockStub) GetCreator() ([]byte, error) {
+	return s.creator, nil
+}
+
+func (s *MockStub) GetTransient() (map[string][]byte, error) {
+	return s.transient, nil
+}
+
+func (s *MockStub) GetBinding() ([]byte, error) {
+	return nil, errNotSupported
+}
+
+func (s *MockStub) GetDecorations() map[string][]byte {
+	return nil
+}
+
+func (s *MockStub) GetSignedProposal() (*pb.SignedProposal, error) {
+	return nil, errNotSupported
+}
+
+func (s *MockStub) InvokeChaincode(chaincodeName string, args [][]byte, channel string) pb.Response {
+	return shim.Error("InvokeChaincode is not supported by MockStub")
+}
+
+// ============================================================================================================================
+// Events
+// ============================================================================================================================
+
+// SetEvent replaces the event of the current transaction, as the peer keeps only the last one
+func (s *MockStub) SetEvent(name string, payload []byte) error {
+	if name == "" {
+		return errors.New("event name can not be empty string")
+	}
+	s.event = &pb.ChaincodeEvent{ChaincodeId: s.Name, TxId: s.txID, EventName: name, Payload: payload}
+	return nil
+}
+
+// ============================================================================================================================
+// World state. Reads see committed state only, never the writes of the current transaction.
+// ============================================================================================================================
+
+func (s *MockStub) GetState(key string) ([]byte, error) {
+	value, ok := s.state[key]
+	if !ok {
+		return nil, nil
+	}
+	return append([]byte(nil), value...), nil
+}
+
+func (s *MockStub) PutState(key string, value []byte) error {
+	if s.writes == nil {
+		return errors.New("no transaction in progress")
+	}
+	if key == "" {
+		return errors.New("key must not be an empty string")
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	delete(s.deletes, key)
+	s.writes[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (s *MockStub) DelState(key string) error {
+	if s.writes == nil {
+		return errors.New("no transaction in progress")
+	}
+	delete(s.writes, key)
+	s.deletes[key] = true
+	return nil
+}
+
+func (s *MockStub) SetStateValidationParameter(key string, ep []byte) error {
+	return errNotSupported
+}
+
+func (s *MockStub) GetStateValidationParameter(key string) ([]byte, error) {
+	return nil, errNotSupported
+}
+
+// GetStateByRange iterates simple keys in [startKey, endKey), an empty bound is open
+func (s *MockStub) GetStateByRange(startKey, endKey string) (shim.StateQueryIteratorInterface, error) {
+	if strings.HasPrefix(startKey, compositeKeyNamespace) || strings.HasPrefix(endKey, compositeKeyNamespace) {
+		return nil, errors.New("range query keys must not be composite keys")
+	}
+	if endKey == "" {
+		endKey = compositeKeyNamespace + string(utf8.MaxRune)
+	}
+	return s.rangeIterator(startKey, endKey, false), nil
+}
+
+func (s *MockStub) GetStateByRangeWithPagination(startKey, endKey string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	if bookmark != "" {
+		startKey = bookmark
+	}
+	iter, err := s.GetStateByRange(startKey, endKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return paginate(iter.(*stateIterator), pageSize)
+}
+
+func (s *MockStub) GetStateByPartialCompositeKey(objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	startKey, err := s.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	return s.rangeIterator(startKey, startKey+string(utf8.MaxRune), true), nil
+}
+
+func (s *MockStub) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	startKey, err := s.CreateCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	endKey := startKey + string(utf8.MaxRune)
+	if bookmark != "" {
+		startKey = bookmark
+	}
+	return paginate(s.rangeIterator(startKey, endKey, true), pageSize)
+}
+
+func (s *MockStub) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+	return nil, errors.New("rich queries are not supported by MockStub")
+}
+
+func (s *MockStub) GetQueryResultWithPagination(query string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	return nil, nil, errors.New("rich queries are not supported by MockStub")
+}
+
+// GetHistoryForKey returns the committed versions of key, newest first
+func (s *MockStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	versions := s.history[key]
+	var mods []*queryresult.KeyModification
+	for i := len(versions) - 1; i >= 0; i-- {
+		mods = append(mods, versions[i])
+	}
+	return &historyIterator{mods: mods}, nil
+}
+
+func (s *MockStub) rangeIterator(startKey, endKey string, composite bool) *stateIterator {
+	var kvs []*queryresult.KV
+	for _, key := range s.Keys() {
+		if key < startKey || key >= endKey {
+			continue
+		}
+		if !composite && strings.HasPrefix(key, compositeKeyNamespace) {
+			continue
+		}
+		kvs = append(kvs, &queryresult.KV{Namespace: s.Name, Key: key, Value: s.state[key]})
+	}
+	return &stateIterator{kvs: kvs}
+}
+
+func paginate(iter *stateIterator, pageSize int32) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	var metadata pb.QueryResponseMetadata
+	if pageSize > 0 && len(iter.kvs) > int(pageSize) {
+		metadata.Bookmark = iter.kvs[pageSize].Key
+		iter.kvs = iter.kvs[:pageSize]
+	}
+	metadata.FetchedRecordsCount = int32(len(iter.kvs))
+	return iter, &metadata, nil
+}
+
+// ============================================================================================================================
+// Composite keys
+// ============================================================================================================================
+
+func (s *MockStub) CreateCompositeKey(objectType string, attributes []string) (string, error) {
+	err := validateCompositeKeyAttribute(objectType)
+	if err != nil {
+		return "", err
+	}
+	ck := compositeKeyNamespace + objectType + string(rune(minUnicodeRuneValue))
+	for _, att := range attributes {
+		err = validateCompositeKeyAttribute(att)
+		if err != nil {
+			return "", err
+		}
+		ck += att + string(rune(minUnicodeRuneValue))
+	}
+	return ck, nil
+}
+
+func (s *MockStub) SplitCompositeKey(compositeKey string) (string, []string, error) {
+	componentIndex := 1
+	components := []string{}
+	for i := 1; i < len(compositeKey); i++ {
+		if compositeKey[i] == minUnicodeRuneValue {
+			components = append(components, compositeKey[componentIndex:i])
+			componentIndex = i + 1
+		}
+	}
+	if len(components) == 0 {
+		return "", nil, fmt.Errorf("%q is not a composite key", compositeKey)
+	}
+	return components[0], components[1:], nil
+}
+
+func validateCompositeKeyAttribute(str string) error {
+	if !utf8.ValidString(str) {
+		return fmt.Errorf("not a valid utf8 string: [%x]", str)
+	}
+	for index, runeValue := range str {
+		if runeValue == minUnicodeRuneValue || runeValue == maxUnicodeRuneValue {
+			return fmt.Errorf("input contains unicode %#U starting at position [%d], %#U and %#U are not allowed in the input attribute of a composite key",
+				runeValue, index, minUnicodeRuneValue, maxUnicodeRuneValue)
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Private data is not used by the chaincode
+// ============================================================================================================================
+
+func (s *MockStub) GetPrivateData(collection, key string) ([]byte, error) {
+	return nil, errNotSupported
+}
+
+func (s *MockStub) GetPrivateDataHash(collection, key string) ([]byte, error) {
+	return nil, errNotSupported
+}
+
+func (s *MockStub) PutPrivateData(collection string, key string, value []byte) error {
+	return errNotSupported
+}
+
+func (s *MockStub) DelPrivateData(collection, key string) error {
+	return errNotSupported
+}
+
+func (s *MockStub) PurgePrivateData(collection, key string) error {
+	return errNotSupported
+}
+
+func (s *MockStub) SetPrivateDataValidationParameter(collection, key string, ep []byte) error {
+	return errNotSupported
+}
+
+func (s *MockStub) GetPrivateDataValidationParameter(collection, key string) ([]byte, error) {
+	return nil, errNotSupported
+}
+
+func (s *MockStub) GetPrivateDataByRange(collection, startKey, endKey string) (shim.StateQueryIteratorInterface, error) {
+	return nil, errNotSupported
+}
+
+func (s *MockStub) GetPrivateDataByPartialCompositeKey(collection, objectType string, keys []string) (shim.StateQueryIteratorInterface, error) {
+	return nil, errNotSupported
+}
+
+func (s *MockStub) GetPrivateDataQueryResult(collection, query string) (shim.StateQueryIteratorInterface, error) {
+	return nil, errNotSupported
+}
+
+// ============================================================================================================================
+// Iterators
+// ============================================================================================================================
+
+type stateIterator struct {
+	kvs    []*queryresult.KV
+	closed bool
+}
+
+func (it *stateIterator) HasNext() bool {
+	return !it.closed && len(it.kvs) > 0
+}
+
+func (it *stateIterator) Next() (*queryresult.KV, error) {
+	if !it.HasNext() {
+		return nil, errors.New("no more results")
+	}
+	kv := it.kvs[0]
+	it.kvs = it.kvs[1:]
+	return kv, nil
+}
+
+func (it *stateIterator) Close() error {
+	it.closed = true
+	return nil
+}
+
+type historyIterator struct {
+	mods   []*queryresult.KeyModification
+	closed bool
+}
+
+func (it *historyIterator) HasNext() bool {
+	return !it.closed && len(it.mods) > 0
+}
+
+func (it *historyIterator) Next() (*queryresult.KeyModification, error) {
+	if !it.HasNext() {
+		return nil, errors.New("no more results")
+	}
+	mod := it.mods[0]
+	it.mods = it.mods[1:]
+	return mod, nil
+}
+
+func (it *historyIterator) Close() error {
+	it.closed = true
+	return nil
+}
@@ -0,0 +1,553 @@
+package openpoints
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// ============================================================================================================================
+// Multi-signature approvals
+//
+// An approval policy puts a write function behind Threshold approvals out of a list of approver identities, for
+// example transferPoints from B1928564 of more than 100000 points, 2 of 3 treasury approvers. A policy matches a call
+// of its function when:
+//
+//	Account    is empty, or equals the from, userId or businessId field of the request, the first one present
+//	MinAmount  is 0, or the amount, points or budget field of the request, the first one present, is above it
+//
+// A matching call fails with APPROVAL_REQUIRED. It is submitted with proposeOperation instead, which checks the
+// request and the role of the proposer and stores it as a PENDING operation. Approvers call approveOperation or
+// rejectOperation with the client identity listed in the policy. The approval that meets the threshold runs the
+// operation in its own transaction, with the role and account of the proposer, and marks it EXECUTED; if the
+// operation fails, so does the approval, and the operation stays pending. Enough rejections to make the threshold
+// unreachable mark it REJECTED. Once its deadline passes a pending operation is EXPIRED by the next approval,
+// rejection or expireOperations.
+//
+// Policies of transferPoints also hold every other transfer from their account, whichever function posts it: a
+// purchase, a scheduled run or a pool spend matching one fails with APPROVAL_REQUIRED, matched on its priced amount,
+// unless it is posted by an approved operation. Reversals, refunds and expiries, which only the chaincode posts,
+// need no approvals.
+//
+// Roles come from certificate attributes issued by the Fabric CA, so role changes are approved there, not here.
+// ============================================================================================================================
+
+// Operation statuses
+const OPERATION_PENDING = "PENDING"
+const OPERATION_EXECUTED = "EXECUTED"
+const OPERATION_REJECTED = "REJECTED"
+const OPERATION_EXPIRED = "EXPIRED"
+
+// Composite key object types
+const approvalPolicyObject = "approvalPolicy"
+const operationObject = "operation"
+
+// Request fields a policy reads the account and the amount of a call from, in order of precedence
+var policyAccountFields = []string{"from", "userId", "businessId"}
+var policyAmountFields = []string{"amount", "points", "budget"}
+
+// Functions that manage approvals and are never put behind a policy themselves
+var approvalFunctions = []string{"proposeOperation", "approveOperation", "rejectOperation", "expireOperations"}
+
+// Approvals a write function needs
+type ApprovalPolicy struct {
+	PolicyId  string   `json:"PolicyId"`
+	Function  string   `json:"Function"`
+	Account   string   `json:"Account,omitempty"`
+	MinAmount float64  `json:"MinAmount,omitempty"`
+	Approvers []string `json:"Approvers"`
+	Threshold int      `json:"Threshold"`
+	TTLHours  int      `json:"TTLHours"`
+	Active    bool     `json:"Active"`
+}
+
+// An approval or rejection of an operation
+type OperationVote struct {
+	Approver string    `json:"Approver"`
+	Voted    time.Time `json:"Voted"`
+	Notes    string    `json:"Notes,omitempty"`
+}
+
+// A proposed call of a function that needs approvals, keyed by the id of the proposing transaction
+type Operation struct {
+	OperationId     string          `json:"OperationId"`
+	PolicyId        string          `json:"PolicyId"`
+	Function        string          `json:"Function"`
+	Request         string          `json:"Request"`
+	Threshold       int             `json:"Threshold"`
+	ProposedBy      string          `json:"ProposedBy"`
+	ProposerRole    string          `json:"ProposerRole"`
+	ProposerAccount string          `json:"ProposerAccount,omitempty"`
+	Proposed        time.Time       `json:"Proposed"`
+	Deadline        time.Time       `json:"Deadline"`
+	Approvals       []OperationVote `json:"Approvals"`
+	Rejections      []OperationVote `json:"Rejections"`
+	Status          string          `json:"Status"`
+	Closed          time.Time       `json:"Closed"`
+	Result          string          `json:"Result,omitempty"`
+}
+
+// Request for setApprovalPolicy
+type approvalPolicyRequest struct {
+	PolicyId  string   `json:"policyId" validate:"required"`
+	Function  string   `json:"function" validate:"required"`
+	Account   string   `json:"account"`
+	MinAmount float64  `json:"minAmount" validate:"min=0"`
+	Approvers []string `json:"approvers" validate:"required"`
+	Threshold int      `json:"threshold" validate:"required,min=1"`
+	TTLHours  int      `json:"ttlHours" validate:"required,min=1"`
+	Active    bool     `json:"active"`
+}
+
+// Request for proposeOperation, request is the JSON request of the function
+type proposeOperationRequest struct {
+	Function string `json:"function" validate:"required"`
+	Request  string `json:"request"`
+}
+
+// Request for approveOperation and rejectOperation
+type operationVoteRequest struct {
+	OperationId string `json:"operationId" validate:"required"`
+	Notes       string `json:"notes"`
+}
+
+// Request for getOperations
+type operationsRequest struct {
+	Function string `json:"function"`
+	Status   string `json:"status" validate:"oneof=PENDING|EXECUTED|REJECTED|EXPIRED"`
+}
+
+// ============================================================================================================================
+// Create or replace an approval policy
+// ============================================================================================================================
+func (t *SimpleChaincode) setApprovalPolicy(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*approvalPolicyRequest)
+	stub := ctx.GetStub()
+
+	spec, ok := functionsByName[req.Function]
+	if !ok || spec.Access != ACCESS_WRITE || containsString(approvalFunctions, req.Function) {
+		return nil, fieldError("function", "%s is not a write function that can need approvals", req.Function)
+	}
+	if req.Threshold > len(req.Approvers) {
+		return nil, fieldError("threshold", "threshold %d is more than the %d approvers", req.Threshold, len(req.Approvers))
+	}
+
+	policy := ApprovalPolicy{PolicyId: req.PolicyId, Function: req.Function, Account: req.Account, MinAmount: req.MinAmount,
+		Approvers: req.Approvers, Threshold: req.Threshold, TTLHours: req.TTLHours, Active: req.Active}
+
+	key, err := compositeKey(stub, approvalPolicyObject, policy.PolicyId)
+	if err != nil {
+		return nil, err
+	}
+	err = writeState(stub, key, policy)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Event().approvalPolicySet(policy)
+
+	asBytes, _ := json.Marshal(policy)
+	return asBytes, nil
+}
+
+func loadApprovalPolicies(stub shim.ChaincodeStubInterface) ([]ApprovalPolicy, error) {
+
+	iter, err := stub.GetStateByPartialCompositeKey(approvalPolicyObject, []string{})
+	if err != nil {
+		return nil, newError(ERR_LEDGER, "failed to list approval policies: %s", err)
+	}
+	defer iter.Close()
+
+	policies := []ApprovalPolicy{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, newError(ERR_LEDGER, "failed to list approval policies: %s", err)
+		}
+
+		var policy ApprovalPolicy
+		err = json.Unmarshal(kv.Value, &policy)
+		if err != nil {
+			return nil, newError(ERR_CORRUPT_STATE, "failed to decode approval policy %s: %s", kv.Key, err)
+		}
+		policies = append(policies, policy)
+	}
+
+	sort.Slice(policies, func(i, j int) bool { return policies[i].PolicyId < policies[j].PolicyId })
+	return policies, nil
+}
+
+// ============================================================================================================================
+// Get every approval policy
+// ============================================================================================================================
+func (t *SimpleChaincode) getApprovalPolicies(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	policies, err := loadApprovalPolicies(ctx.GetStub())
+	if err != nil {
+		return nil, err
+	}
+
+	asBytes, _ := json.Marshal(policies)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Policy with the highest threshold matching a call, nil if the call needs no approvals
+// ============================================================================================================================
+func matchApprovalPolicy(ctx *TransactionContext, function string, request interface{}) (*ApprovalPolicy, error) {
+
+	if containsString(approvalFunctions, function) {
+		return nil, nil
+	}
+
+	policies, err := loadApprovalPolicies(ctx.GetStub())
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]interface{}
+	asBytes, _ := json.Marshal(request)
+	json.Unmarshal(asBytes, &fields)
+
+	account, _ := firstField(fields, policyAccountFields).(string)
+	amount, _ := firstField(fields, policyAmountFields).(float64)
+
+	return strongestPolicy(policies, function, account, amount), nil
+}
+
+// Active policy of a function with the highest threshold covering an account and amount, nil if there is none
+func strongestPolicy(policies []ApprovalPolicy, function string, account string, amount float64) *ApprovalPolicy {
+
+	var match *ApprovalPolicy
+	for i := range policies {
+		policy := &policies[i]
+		if !policy.Active || policy.Function != function {
+			continue
+		}
+		if (policy.Account != "" && account != policy.Account) || (policy.MinAmount > 0 && amount <= policy.MinAmount) {
+			continue
+		}
+
+		if match == nil || policy.Threshold > match.Threshold {
+			match = policy
+		}
+	}
+
+	return match
+}
+
+// ============================================================================================================================
+// Fail with APPROVAL_REQUIRED if a priced transfer matches a policy of transferPoints, whichever function posts it
+// ============================================================================================================================
+func checkTransferApproval(stub shim.ChaincodeStubInterface, ev *LedgerEvent, tx Transaction) error {
+
+	if ev.approved || tx.From == "" || screenExempt(tx) {
+		return nil
+	}
+
+	policies, err := loadApprovalPolicies(stub)
+	if err != nil {
+		return err
+	}
+
+	policy := strongestPolicy(policies, "transferPoints", tx.From, tx.Amount)
+	if policy != nil {
+		return newError(ERR_APPROVAL_REQUIRED, "transfer of %v points from %s needs %d approvals under policy %s, submit %s with proposeOperation",
+			tx.Amount, tx.From, policy.Threshold, policy.PolicyId, ev.Function)
+	}
+
+	return nil
+}
+
+func firstField(fields map[string]interface{}, names []string) interface{} {
+
+	for _, name := range names {
+		if value, ok := fields[name]; ok {
+			return value
+		}
+	}
+
+	return nil
+}
+
+// ============================================================================================================================
+// Propose a call that needs approvals
+// ============================================================================================================================
+func (t *SimpleChaincode) proposeOperation(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*proposeOperationRequest)
+	stub := ctx.GetStub()
+	ev := ctx.Event()
+
+	spec, ok := functionsByName[req.Function]
+	if !ok || spec.Access != ACCESS_WRITE {
+		return nil, fieldError("function", "%s is not a write function", req.Function)
+	}
+	if roleRank[ctx.Role()] < roleRank[spec.Role] {
+		return nil, newError(ERR_FORBIDDEN, "%s requires the %s role, caller has %s", req.Function, spec.Role, ctx.Role())
+	}
+
+	call := reflect.New(reflect.TypeOf(spec.Request)).Interface()
+	err := parseRequest([]string{req.Request}, call)
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := matchApprovalPolicy(ctx, req.Function, call)
+	if err != nil {
+		return nil, err
+	}
+	if policy == nil {
+		return nil, newError(ERR_INVALID_STATE, "%s needs no approvals for this request, call it directly", req.Function)
+	}
+
+	operation := Operation{OperationId: stub.GetTxID(), PolicyId: policy.PolicyId, Function: req.Function, Request: req.Request,
+		Threshold: policy.Threshold, ProposedBy: callerId(ctx), ProposerRole: ctx.Role(), ProposerAccount: ctx.Account(),
+		Proposed: ev.Timestamp,
+		Deadline: ev.Timestamp.Add(time.Duration(policy.TTLHours) * time.Hour), Approvals: []OperationVote{},
+		Rejections: []OperationVote{}, Status: OPERATION_PENDING}
+
+	err = saveOperation(ctx, operation)
+	if err != nil {
+		return nil, err
+	}
+
+	asBytes, _ := json.Marshal(operation)
+	return asBytes, nil
+}
+
+func loadOperation(ctx *TransactionContext, operationId string) (*Operation, error) {
+
+	key, err := compositeKey(ctx.GetStub(), operationObject, operationId)
+	if err != nil {
+		return nil, err
+	}
+
+	var operation Operation
+	found, err := readState(ctx.GetStub(), key, &operation)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, newError(ERR_NOT_FOUND, "operation %s does not exist", operationId)
+	}
+
+	return &operation, nil
+}
+
+func saveOperation(ctx *TransactionContext, operation Operation) error {
+
+	key, err := compositeKey(ctx.GetStub(), operationObject, operation.OperationId)
+	if err != nil {
+		return err
+	}
+	err = writeState(ctx.GetStub(), key, operation)
+	if err != nil {
+		return err
+	}
+	ctx.Event().operationChanged(operation)
+
+	return nil
+}
+
+// ============================================================================================================================
+// Load a pending operation for a vote by the caller. An operation past its deadline is expired and returned with
+// voter empty.
+// ============================================================================================================================
+func operationForVote(ctx *TransactionContext, operationId string) (*Operation, *ApprovalPolicy, string, error) {
+
+	operation, err := loadOperation(ctx, operationId)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if operation.Status != OPERATION_PENDING {
+		return nil, nil, "", newError(ERR_INVALID_STATE, "operation %s is %s", operationId, operation.Status)
+	}
+
+	now := ctx.Event().Timestamp
+	if !now.Before(operation.Deadline) {
+		operation.Status = OPERATION_EXPIRED
+		operation.Closed = now
+		return operation, nil, "", saveOperation(ctx, *operation)
+	}
+
+	key, err := compositeKey(ctx.GetStub(), approvalPolicyObject, operation.PolicyId)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	var policy ApprovalPolicy
+	_, err = readState(ctx.GetStub(), key, &policy)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	voter := callerId(ctx)
+	if voter == "" || !containsString(policy.Approvers, voter) {
+		return nil, nil, "", newError(ERR_FORBIDDEN, "caller is not an approver of policy %s", policy.PolicyId)
+	}
+	for _, vote := range append(operation.Approvals, operation.Rejections...) {
+		if vote.Approver == voter {
+			return nil, nil, "", newError(ERR_ALREADY_EXISTS, "caller already voted on operation %s", operationId)
+		}
+	}
+
+	return operation, &policy, voter, nil
+}
+
+// ============================================================================================================================
+// Approve a pending operation, running it once the threshold is met
+// ============================================================================================================================
+func (t *SimpleChaincode) approveOperation(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*operationVoteRequest)
+	ev := ctx.Event()
+
+	operation, _, voter, err := operationForVote(ctx, req.OperationId)
+	if err != nil {
+		return nil, err
+	}
+
+	if voter != "" {
+		operation.Approvals = append(operation.Approvals, OperationVote{Approver: voter, Voted: ev.Timestamp, Notes: req.Notes})
+
+		if len(operation.Approvals) >= operation.Threshold {
+			spec := functionsByName[operation.Function]
+			call := reflect.New(reflect.TypeOf(spec.Request)).Interface()
+			err = parseRequest([]string{operation.Request}, call)
+			if err != nil {
+				return nil, err
+			}
+
+			// Run as the proposer, the approvals stand in for the policy but not for the rights of the caller
+			role, account := ctx.role, ctx.account
+			ctx.role, ctx.account = operation.ProposerRole, operation.ProposerAccount
+			ev.role, ev.approved = operation.ProposerRole, true
+			res, err := spec.Handler(t, ctx, call)
+			ctx.role, ctx.account = role, account
+			ev.role, ev.approved = role, false
+			if err != nil {
+				return nil, err
+			}
+			operation.Status = OPERATION_EXECUTED
+			operation.Closed = ev.Timestamp
+			operation.Result = string(res)
+		}
+
+		err = saveOperation(ctx, *operation)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	asBytes, _ := json.Marshal(operation)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Reject a pending operation, closing it once the threshold can no longer be met
+// ============================================================================================================================
+func (t *SimpleChaincode) rejectOperation(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*operationVoteRequest)
+	ev := ctx.Event()
+
+	operation, policy, voter, err := operationForVote(ctx, req.OperationId)
+	if err != nil {
+		return nil, err
+	}
+
+	if voter != "" {
+		operation.Rejections = append(operation.Rejections, OperationVote{Approver: voter, Voted: ev.Timestamp, Notes: req.Notes})
+		if len(policy.Approvers)-len(operation.Rejections) < operation.Threshold {
+			operation.Status = OPERATION_REJECTED
+			operation.Closed = ev.Timestamp
+		}
+
+		err = saveOperation(ctx, *operation)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	asBytes, _ := json.Marshal(operation)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Expire every pending operation past its deadline
+// ============================================================================================================================
+func (t *SimpleChaincode) expireOperations(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	operations, err := loadOperations(ctx, "", OPERATION_PENDING)
+	if err != nil {
+		return nil, err
+	}
+
+	now := ctx.Event().Timestamp
+	expired := []Operation{}
+	for _, operation := range operations {
+		if now.Before(operation.Deadline) {
+			continue
+		}
+		operation.Status = OPERATION_EXPIRED
+		operation.Closed = now
+		err = saveOperation(ctx, operation)
+		if err != nil {
+			return nil, err
+		}
+		expired = append(expired, operation)
+	}
+
+	asBytes, _ := json.Marshal(expired)
+	return asBytes, nil
+}
+
+func loadOperations(ctx *TransactionContext, function string, status string) ([]Operation, error) {
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(operationObject, []string{})
+	if err != nil {
+		return nil, newError(ERR_LEDGER, "failed to list operations: %s", err)
+	}
+	defer iter.Close()
+
+	operations := []Operation{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, newError(ERR_LEDGER, "failed to list operations: %s", err)
+		}
+
+		var operation Operation
+		err = json.Unmarshal(kv.Value, &operation)
+		if err != nil {
+			return nil, newError(ERR_CORRUPT_STATE, "failed to decode operation %s: %s", kv.Key, err)
+		}
+
+		if (function != "" && operation.Function != function) || (status != "" && operation.Status != status) {
+			continue
+		}
+		operations = append(operations, operation)
+	}
+
+	sort.SliceStable(operations, func(i, j int) bool { return operations[i].Proposed.Before(operations[j].Proposed) })
+	return operations, nil
+}
+
+// ============================================================================================================================
+// List operations, optionally of one function and in one status, oldest first
+// ============================================================================================================================
+func (t *SimpleChaincode) getOperations(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*operationsRequest)
+
+	operations, err := loadOperations(ctx, req.Function, req.Status)
+	if err != nil {
+		return nil, err
+	}
+
+	asBytes, _ := json.Marshal(operations)
+	return asBytes, nil
+}
@@ -0,0 +1,586 @@
+package openpoints
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// ============================================================================================================================
+// Reward catalog and orders
+//
+// Businesses list the items members can redeem points for. redeemItem prices an item through the best active
+// contract of its business, debits the member, takes the item from stock and opens an order. The redemption is a
+// contract transaction from the member to the business, so it is settled like any other. An order moves from PLACED
+// to FULFILLED or CANCELLED. Cancelling refunds the points with a TX_TYPE_REFUND transaction under the same contract,
+// gives them back to the contract budget and returns the items to stock.
+// ============================================================================================================================
+
+// Transaction type of a catalog redemption
+const TX_TYPE_REDEEM = "redeem"
+
+// Order statuses
+const ORDER_PLACED = "PLACED"
+const ORDER_FULFILLED = "FULFILLED"
+const ORDER_CANCELLED = "CANCELLED"
+
+// Composite key object types
+const catalogItemObject = "catalogItem"
+const orderObject = "order"
+
+// A redeemable item
+type CatalogItem struct {
+	Sku           string   `json:"Sku"`
+	BusinessId    string   `json:"BusinessId"`
+	Title         string   `json:"Title"`
+	Description   string   `json:"Description"`
+	PointPrice    float64  `json:"PointPrice"`
+	MoneyCopay    float64  `json:"MoneyCopay"`
+	Stock         int      `json:"Stock"`
+	EligibleTiers []string `json:"EligibleTiers"`
+	Active        bool     `json:"Active"`
+}
+
+// A redemption of catalog items by a member
+type Order struct {
+	OrderId     string    `json:"OrderId"`
+	UserId      string    `json:"UserId"`
+	BusinessId  string    `json:"BusinessId"`
+	Sku         string    `json:"Sku"`
+	Title       string    `json:"Title"`
+	Quantity    int       `json:"Quantity"`
+	ListPoints  float64   `json:"ListPoints"`
+	PointsPaid  float64   `json:"PointsPaid"`
+	MoneyCopay  float64   `json:"MoneyCopay"`
+	ContractId  string    `json:"ContractId"`
+	RefNumber   string    `json:"RefNumber"`
+	Status      string    `json:"Status"`
+	Created     time.Time `json:"Created"`
+	Updated     time.Time `json:"Updated"`
+	Reference   string    `json:"Reference,omitempty"`
+	RefundRef   string    `json:"RefundRef,omitempty"`
+	StatusNotes string    `json:"StatusNotes,omitempty"`
+}
+
+// Request for setCatalogItem
+type catalogItemRequest struct {
+	Sku           string   `json:"sku" validate:"required"`
+	BusinessId    string   `json:"businessId" validate:"required"`
+	Title         string   `json:"title" validate:"required"`
+	Description   string   `json:"description"`
+	PointPrice    float64  `json:"pointPrice" validate:"required,min=0"`
+	MoneyCopay    float64  `json:"moneyCopay" validate:"min=0"`
+	Stock         int      `json:"stock" validate:"required,min=0"`
+	EligibleTiers []string `json:"eligibleTiers"`
+	Active        bool     `json:"active"`
+}
+
+// Request for getCatalog, tier only lists items a member of that tier may redeem
+type catalogRequest struct {
+	BusinessId string `json:"businessId"`
+	Tier       string `json:"tier"`
+}
+
+// Request for redeemItem
+type redeemItemRequest struct {
+	UserId   string `json:"userId" validate:"required"`
+	Sku      string `json:"sku" validate:"required"`
+	Quantity int    `json:"quantity" validate:"required,min=1"`
+}
+
+// Request for fulfillOrder and cancelOrder
+type orderStatusRequest struct {
+	OrderId   string `json:"orderId" validate:"required"`
+	Reference string `json:"reference"`
+	Notes     string `json:"notes"`
+}
+
+// Request for getOrder
+type orderRequest struct {
+	OrderId string `json:"orderId" validate:"required"`
+}
+
+// Request for getOrders
+type ordersRequest struct {
+	UserId     string `json:"userId"`
+	BusinessId string `json:"businessId"`
+	Status     string `json:"status" validate:"oneof=PLACED|FULFILLED|CANCELLED"`
+}
+
+// ============================================================================================================================
+// Create or replace a catalog item
+// ============================================================================================================================
+func (t *SimpleChaincode) setCatalogItem(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*catalogItemRequest)
+	stub := ctx.GetStub()
+
+	err := checkAccount(ctx, req.BusinessId)
+	if err != nil {
+		return nil, err
+	}
+
+	var business User
+	found, err := readState(stub, req.BusinessId, &business)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, newError(ERR_NOT_FOUND, "business %s does not exist", req.BusinessId)
+	}
+	for _, tier := range req.EligibleTiers {
+		if !containsString(ctx.Program().Tiers, tier) {
+			return nil, fieldError("eligibleTiers", "tier %s does not exist in program %s", tier, ctx.Program().ProgramId)
+		}
+	}
+
+	item := CatalogItem{Sku: req.Sku, BusinessId: req.BusinessId, Title: req.Title, Description: req.Description,
+		PointPrice: req.PointPrice, MoneyCopay: req.MoneyCopay, Stock: req.Stock, EligibleTiers: req.EligibleTiers, Active: req.Active}
+	if item.EligibleTiers == nil {
+		item.EligibleTiers = []string{}
+	}
+
+	key, err := compositeKey(stub, catalogItemObject, item.Sku)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the business that offers an item replaces it
+	var existing CatalogItem
+	found, err = readState(stub, key, &existing)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		err = checkAccount(ctx, existing.BusinessId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = writeState(stub, key, item)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Event().catalogItemChanged(item)
+
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Get the active catalog items, optionally of one business and redeemable by one tier
+// ============================================================================================================================
+func (t *SimpleChaincode) getCatalog(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*catalogRequest)
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(catalogItemObject, []string{})
+	if err != nil {
+		return nil, newError(ERR_LEDGER, "failed to list catalog: %s", err)
+	}
+	defer iter.Close()
+
+	items := []CatalogItem{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, newError(ERR_LEDGER, "failed to list catalog: %s", err)
+		}
+
+		var item CatalogItem
+		err = json.Unmarshal(kv.Value, &item)
+		if err != nil {
+			return nil, newError(ERR_CORRUPT_STATE, "failed to decode catalog item %s: %s", kv.Key, err)
+		}
+
+		if !item.Active || (req.BusinessId != "" && item.BusinessId != req.BusinessId) {
+			continue
+		}
+		if req.Tier != "" && len(item.EligibleTiers) > 0 && !containsString(item.EligibleTiers, req.Tier) {
+			continue
+		}
+		items = append(items, item)
+	}
+
+	asBytes, _ := json.Marshal(items)
+	return asBytes, nil
+}
+
+// Whether a contract prices transactions at a point in time and has budget left
+func contractActive(contract Contract, at time.Time) bool {
+
+	if !contract.StartDate.IsZero() && at.Before(contract.StartDate) {
+		return false
+	}
+	if !contract.EndDate.IsZero() && !at.Before(contract.EndDate) {
+		return false
+	}
+
+	return contract.Budget == 0 || contract.PointsUsed < contract.Budget
+}
+
+// ============================================================================================================================
+// Lowest price of tx under the active contracts of a business. Returns the contract id, empty if no contract lowers
+// the list price, and the price. Earn contracts never price a redemption.
+// ============================================================================================================================
+func bestContractPrice(stub shim.ChaincodeStubInterface, tx Transaction, businessId string) (string, float64, error) {
+
+	var contractIds []string
+	_, err := readState(stub, "contractIds", &contractIds)
+	if err != nil {
+		return "", 0, err
+	}
+
+	bestId := ""
+	best := tx.Amount
+	for _, contractId := range contractIds {
+		if contractId == FEEDBACK_CONTRACT {
+			continue
+		}
+
+		var contract Contract
+		found, err := readState(stub, contractId, &contract)
+		if err != nil {
+			return "", 0, err
+		}
+		if !found || contract.BusinessId != businessId || !contractActive(contract, tx.Date) {
+			continue
+		}
+
+		tx.ContractId = contractId
+		price, err := priceTransaction(tx, stub)
+		if err != nil {
+			return "", 0, err
+		}
+		if price < best && (contract.Budget == 0 || contract.PointsUsed+price <= contract.Budget) {
+			bestId = contractId
+			best = price
+		}
+	}
+
+	return bestId, best, nil
+}
+
+// ============================================================================================================================
+// Redeem catalog items for points
+// ============================================================================================================================
+func (t *SimpleChaincode) redeemItem(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*redeemItemRequest)
+	stub := ctx.GetStub()
+	ev := ctx.Event()
+
+	err := checkAccount(ctx, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+	itemKey, err := compositeKey(stub, catalogItemObject, req.Sku)
+	if err != nil {
+		return nil, err
+	}
+	var item CatalogItem
+	found, err := readState(stub, itemKey, &item)
+	if err != nil {
+		return nil, err
+	}
+	if !found || !item.Active {
+		return nil, newError(ERR_NOT_FOUND, "catalog item %s does not exist", req.Sku)
+	}
+	if item.Stock < req.Quantity {
+		return nil, newError(ERR_INVALID_STATE, "%d of %s left, %d requested", item.Stock, item.Sku, req.Quantity)
+	}
+
+	var member User
+	found, err = readState(stub, req.UserId, &member)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, newError(ERR_NOT_FOUND, "user %s does not exist", req.UserId)
+	}
+	if len(item.EligibleTiers) > 0 && !containsString(item.EligibleTiers, member.Status) {
+		return nil, newError(ERR_FORBIDDEN, "%s can not be redeemed by %s members", item.Sku, member.Status)
+	}
+
+	var tx Transaction
+	tx.Date = ev.Timestamp.Truncate(time.Minute)
+	tx.Type = TX_TYPE_REDEEM
+	tx.From = req.UserId
+	tx.To = item.BusinessId
+	tx.Description = fmt.Sprintf("%d x %s (%s)", req.Quantity, item.Title, item.Sku)
+	tx.Amount = item.PointPrice * float64(req.Quantity)
+	tx.ListAmount = tx.Amount
+	tx.Money = item.MoneyCopay * float64(req.Quantity)
+	tx.StatusCode = 1
+	tx.StatusMsg = "Transaction Completed"
+	tx.TxId = stub.GetTxID()
+
+	tx.ContractId, tx.Amount, err = bestContractPrice(stub, tx, item.BusinessId)
+	if err != nil {
+		return nil, err
+	}
+	if tx.ContractId != "" {
+		err = chargeContract(stub, ev, tx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tx.RefNumber, err = nextRefNumber(stub, ev)
+	if err != nil {
+		return nil, err
+	}
+	err = postTransfer(stub, ev, &tx)
+	if err != nil {
+		return nil, err
+	}
+
+	item.Stock = item.Stock - req.Quantity
+	err = writeState(stub, itemKey, item)
+	if err != nil {
+		return nil, err
+	}
+	ev.catalogItemChanged(item)
+
+	var order Order
+	order.OrderId = "O" + tx.RefNumber
+	order.UserId = req.UserId
+	order.BusinessId = item.BusinessId
+	order.Sku = item.Sku
+	order.Title = item.Title
+	order.Quantity = req.Quantity
+	order.ListPoints = tx.ListAmount
+	order.PointsPaid = tx.Amount
+	order.MoneyCopay = tx.Money
+	order.ContractId = tx.ContractId
+	order.RefNumber = tx.RefNumber
+	order.Status = ORDER_PLACED
+	order.Created = ev.Timestamp
+	order.Updated = ev.Timestamp
+
+	err = saveOrder(ctx, order)
+	if err != nil {
+		return nil, err
+	}
+
+	asBytes, _ := json.Marshal(order)
+	return asBytes, nil
+}
+
+func loadOrder(ctx *TransactionContext, orderId string) (*Order, error) {
+
+	key, err := compositeKey(ctx.GetStub(), orderObject, orderId)
+	if err != nil {
+		return nil, err
+	}
+
+	var order Order
+	found, err := readState(ctx.GetStub(), key, &order)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, newError(ERR_NOT_FOUND, "order %s does not exist", orderId)
+	}
+
+	return &order, nil
+}
+
+func saveOrder(ctx *TransactionContext, order Order) error {
+
+	key, err := compositeKey(ctx.GetStub(), orderObject, order.OrderId)
+	if err != nil {
+		return err
+	}
+	err = writeState(ctx.GetStub(), key, order)
+	if err != nil {
+		return err
+	}
+	ctx.Event().orderChanged(order)
+
+	return nil
+}
+
+// ============================================================================================================================
+// Mark a placed order as delivered
+// ============================================================================================================================
+func (t *SimpleChaincode) fulfillOrder(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*orderStatusRequest)
+
+	order, err := loadOrder(ctx, req.OrderId)
+	if err != nil {
+		return nil, err
+	}
+	err = checkAccount(ctx, order.BusinessId)
+	if err != nil {
+		return nil, err
+	}
+	if order.Status != ORDER_PLACED {
+		return nil, newError(ERR_INVALID_STATE, "order %s is %s", order.OrderId, order.Status)
+	}
+
+	order.Status = ORDER_FULFILLED
+	order.Updated = ctx.Event().Timestamp
+	order.Reference = req.Reference
+	order.StatusNotes = req.Notes
+
+	err = saveOrder(ctx, *order)
+	if err != nil {
+		return nil, err
+	}
+
+	asBytes, _ := json.Marshal(order)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Cancel a placed order, refunding the points and restocking the items
+// ============================================================================================================================
+func (t *SimpleChaincode) cancelOrder(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*orderStatusRequest)
+	stub := ctx.GetStub()
+	ev := ctx.Event()
+
+	order, err := loadOrder(ctx, req.OrderId)
+	if err != nil {
+		return nil, err
+	}
+
+	// The business refunds the order, or its delegate with the refund permission
+	err = checkBusiness(ctx, order.BusinessId, DELEGATE_REFUND)
+	if err != nil {
+		return nil, err
+	}
+	if order.Status != ORDER_PLACED {
+		return nil, newError(ERR_INVALID_STATE, "order %s is %s", order.OrderId, order.Status)
+	}
+
+	var refund Transaction
+	refund.Date = ev.Timestamp.Truncate(time.Minute)
+	refund.Type = TX_TYPE_REFUND
+	refund.From = order.BusinessId
+	refund.To = order.UserId
+	refund.Description = "Refund of order " + order.OrderId
+	refund.ContractId = order.ContractId
+	refund.Amount = order.PointsPaid
+	refund.ListAmount = order.ListPoints
+	refund.Money = order.MoneyCopay
+	refund.StatusCode = 1
+	refund.StatusMsg = "Transaction Completed"
+	refund.TxId = stub.GetTxID()
+	refund.LinkedRef = ctx.Program().ProgramId + "/" + order.RefNumber
+
+	if refund.ContractId != "" {
+		err = releaseContract(stub, ev, refund)
+		if err != nil {
+			return nil, err
+		}
+	}
+	refund.RefNumber, err = nextRefNumber(stub, ev)
+	if err != nil {
+		return nil, err
+	}
+	err = postTransfer(stub, ev, &refund)
+	if err != nil {
+		return nil, err
+	}
+
+	itemKey, err := compositeKey(stub, catalogItemObject, order.Sku)
+	if err != nil {
+		return nil, err
+	}
+	var item CatalogItem
+	found, err := readState(stub, itemKey, &item)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		item.Stock = item.Stock + order.Quantity
+		err = writeState(stub, itemKey, item)
+		if err != nil {
+			return nil, err
+		}
+		ev.catalogItemChanged(item)
+	}
+
+	order.Status = ORDER_CANCELLED
+	order.Updated = ev.Timestamp
+	order.RefundRef = refund.RefNumber
+	order.StatusNotes = req.Notes
+
+	err = saveOrder(ctx, *order)
+	if err != nil {
+		return nil, err
+	}
+
+	asBytes, _ := json.Marshal(order)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Get one order
+// ============================================================================================================================
+func (t *SimpleChaincode) getOrder(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*orderRequest)
+
+	order, err := loadOrder(ctx, req.OrderId)
+	if err != nil {
+		return nil, err
+	}
+
+	asBytes, _ := json.Marshal(order)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// List orders, optionally of one member or business and in one status, oldest first
+// ============================================================================================================================
+func (t *SimpleChaincode) getOrders(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*ordersRequest)
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(orderObject, []string{})
+	if err != nil {
+		return nil, newError(ERR_LEDGER, "failed to list orders: %s", err)
+	}
+	defer iter.Close()
+
+	orders := []Order{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, newError(ERR_LEDGER, "failed to list orders: %s", err)
+		}
+
+		var order Order
+		err = json.Unmarshal(kv.Value, &order)
+		if err != nil {
+			return nil, newError(ERR_CORRUPT_STATE, "failed to decode order %s: %s", kv.Key, err)
+		}
+
+		if (req.UserId != "" && order.UserId != req.UserId) || (req.BusinessId != "" && order.BusinessId != req.BusinessId) {
+			continue
+		}
+		if req.Status != "" && order.Status != req.Status {
+			continue
+		}
+		orders = append(orders, order)
+	}
+
+	// Order ids follow reference numbers, which only grow
+	sort.Slice(orders, func(i, j int) bool {
+		a, _ := strconv.Atoi(orders[i].RefNumber)
+		b, _ := strconv.Atoi(orders[j].RefNumber)
+		return a < b
+	})
+
+	asBytes, _ := json.Marshal(orders)
+	return asBytes, nil
+}
@@ -0,0 +1,1063 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package openpoints
+
+import (
+	"encoding/json"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SimpleChaincode is the Open Points contract. Its only public transaction is InitLedger, every other function
+// is looked up by name in the function registry through UnknownTransaction, so clients keep calling
+// transferPoints, getTxs and the rest with a single JSON request argument.
+type SimpleChaincode struct {
+	contractapi.Contract
+}
+
+// Name of the contract
+const CONTRACT_NAME = "OpenPoints"
+
+// Maximum number of transactions to return
+const NUM_TX_TO_RETURN = 27
+
+// User id of the bank that originates all points
+const ORIGINATOR_ID = "B1928564"
+
+// Smart Contract Id numbers
+const RETAIL_CONTRACT = "Sonic"
+const FEEDBACK_CONTRACT = "Feedback"
+
+// Blockchain point transaction record
+type Transaction struct {
+	RefNumber     string    `json:"RefNumber"`
+	Date          time.Time `json:"Date"`
+	Description   string    `json:"description"`
+	Type          string    `json:"Type"`
+	Amount        float64   `json:"Amount"`
+	Money         float64   `json:"Money"`
+	Activities    int       `json:"FeedbackActivitiesDone"`
+	To            string    `json:"ToUserid"`
+	From          string    `json:"FromUserid"`
+	ToName        string    `json:"ToName"`
+	FromName      string    `json:"FromName"`
+	ContractId    string    `json:"ContractId"`
+	StatusCode    int       `json:"StatusCode"`
+	StatusMsg     string    `json:"StatusMsg"`
+	TxId          string    `json:"TxId,omitempty"`
+	ListAmount    float64   `json:"ListAmount,omitempty"`
+	LinkedRef     string    `json:"LinkedRef,omitempty"`
+	EarnRate      float64   `json:"EarnRate,omitempty"`
+	Earned        float64   `json:"Earned,omitempty"`
+	VoucherId     string    `json:"VoucherId,omitempty"`
+	RiskFlags     []string  `json:"RiskFlags,omitempty"`
+	ScheduleId    string    `json:"ScheduleId,omitempty"`
+	EarnedPending bool      `json:"EarnedPending,omitempty"`
+	SpentBy       string    `json:"SpentBy,omitempty"`
+	Delegate      string    `json:"Delegate,omitempty"`
+}
+
+// Transaction types with a meaning to the chaincode, any other type is free text. Expiries, reversals and refunds
+// are only posted by the chaincode itself, transferPoints refuses them.
+const TX_TYPE_EXPIRE = "expire"
+const TX_TYPE_REVERSAL = "reversal"
+const TX_TYPE_REFUND = "refund"
+
+// Smart contract metadata record
+type Contract struct {
+	Id           string    `json:"ID"`
+	BusinessId   string    `json:"BusinessId"`
+	BusinessName string    `json:"BusinessName"`
+	Title        string    `json:"Title"`
+	Description  string    `json:"Description"`
+	Conditions   []string  `json:"Conditions"`
+	Icon         string    `json:"Icon"`
+	StartDate    time.Time `json:"StartDate"`
+	EndDate      time.Time `json:"EndDate"`
+	Method       string    `json:"Method"`
+	DiscountRate float64   `json:"DiscountRate"`
+	Budget       float64   `json:"Budget,omitempty"`
+	PointsUsed   float64   `json:"PointsUsed,omitempty"`
+	MaturityDays int       `json:"MaturityDays,omitempty"`
+	Wallet       string    `json:"Wallet,omitempty"`
+}
+
+// Open Points member record
+type User struct {
+	UserId     string             `json:"UserId"`
+	Name       string             `json:"Name"`
+	Balance    float64            `json:"Balance"`
+	Pending    float64            `json:"PendingBalance,omitempty"`
+	Wallets    map[string]float64 `json:"Wallets,omitempty"`
+	NumTxs     int                `json:"NumberOfTransactions"`
+	Status     string             `json:"Status"`
+	Expiration string             `json:"ExpirationDate"`
+	Join       string             `json:"JoinDate"`
+	Modified   string             `json:"LastModifiedDate"`
+}
+
+// Array for storing all open points transactions
+type AllTransactions struct {
+	Transactions []Transaction `json:"transactions"`
+}
+
+// ============================================================================================================================
+// NewContract - the Open Points contract, ready to be passed to contractapi.NewChaincode
+// ============================================================================================================================
+func NewContract() *SimpleChaincode {
+
+	t := new(SimpleChaincode)
+	t.Name = CONTRACT_NAME
+	t.Info.Title = "Open Points Network"
+	t.Info.Version = "2.0.0"
+	t.TransactionContextHandler = new(TransactionContext)
+	t.UnknownTransaction = t.invokeByName
+
+	return t
+}
+
+// ============================================================================================================================
+// InitLedger - reset all the things, same as calling init
+// ============================================================================================================================
+func (t *SimpleChaincode) InitLedger(ctx *TransactionContext) (string, error) {
+	res, err := t.dispatch(ctx, "init", nil)
+	return string(res), err
+}
+
+// ============================================================================================================================
+// invokeByName - Our entry point for every function other than InitLedger, the function name and JSON request are
+// read from the proposal
+// ============================================================================================================================
+func (t *SimpleChaincode) invokeByName(ctx *TransactionContext) (string, error) {
+
+	function, args := ctx.GetStub().GetFunctionAndParameters()
+	function = strings.TrimPrefix(function, CONTRACT_NAME+":")
+
+	res, err := t.dispatch(ctx, function, args)
+	return string(res), err
+}
+
+// ============================================================================================================================
+// Reset the ledger to the initial members, contracts and reference number
+// ============================================================================================================================
+func (t *SimpleChaincode) resetLedger(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	var err error
+	stub := ctx.GetStub()
+	ev := ctx.Event()
+
+	if ctx.Program().ProgramId != DEFAULT_PROGRAM {
+		return nil, newError(ERR_INVALID_STATE, "init only resets the %s program, %s was set up by createProgram", DEFAULT_PROGRAM, ctx.Program().ProgramId)
+	}
+
+	// Remove contracts added since the last reset, the built in ones are recreated below
+	var oldContractIds []string
+	_, err = readState(stub, "contractIds", &oldContractIds)
+	if err != nil {
+		return nil, err
+	}
+	for i := range oldContractIds {
+		if oldContractIds[i] == RETAIL_CONTRACT || oldContractIds[i] == FEEDBACK_CONTRACT {
+			continue
+		}
+		err = stub.DelState(oldContractIds[i])
+		if err != nil {
+			return nil, newError(ERR_LEDGER, "failed to remove contract %s: %s", oldContractIds[i], err)
+		}
+		ev.contractRemoved(oldContractIds[i])
+	}
+
+	// Create the 'Bank' user and add it to the blockchain
+	var bank User
+	bank.UserId = ORIGINATOR_ID
+	bank.Name = "OpenFN"
+	bank.Balance = 1000000
+	bank.Status = "Originator"
+	bank.Expiration = "2099-12-31"
+	bank.Join = "2015-01-01"
+	bank.Modified = "2017-05-06"
+	bank.NumTxs = 0
+
+	err = writeState(stub, bank.UserId, bank)
+	if err != nil {
+		return nil, err
+	}
+	ev.userWritten(nil, bank)
+
+	// Create the 'Retail Agency' user and add it to the blockchain
+	var retail User
+	retail.UserId = "T5940872"
+	retail.Name = "OpenRetail"
+	retail.Balance = 500000
+	retail.Status = "Member"
+	retail.Expiration = "2099-12-31"
+	retail.Join = "2015-01-01"
+	retail.Modified = "2017-05-06"
+	retail.NumTxs = 0
+
+	err = writeState(stub, retail.UserId, retail)
+	if err != nil {
+		return nil, err
+	}
+	ev.userWritten(nil, retail)
+
+	// Create the 'Natalie' user and add her to the blockchain
+	var natalie User
+	natalie.UserId = "U2974034"
+	natalie.Name = "Natalie"
+	natalie.Balance = 1000
+	natalie.Status = "Platinum"
+	natalie.Expiration = "2017-06-01"
+	natalie.Join = "2015-05-31"
+	natalie.Modified = "2017-05-06"
+	natalie.NumTxs = 0
+
+	err = writeState(stub, natalie.UserId, natalie)
+	if err != nil {
+		return nil, err
+	}
+	ev.userWritten(nil, natalie)
+
+	// Create the 'Anthony' user and add him to the blockchain
+	var anthony User
+	anthony.UserId = "U3151672"
+	anthony.Name = "Anthony"
+	anthony.Balance = 50000
+	anthony.Status = "Silver"
+	anthony.Expiration = "2017-03-15"
+	anthony.Join = "2015-08-15"
+	anthony.Modified = "2017-04-17"
+	anthony.NumTxs = 0
+
+	err = writeState(stub, anthony.UserId, anthony)
+	if err != nil {
+		return nil, err
+	}
+	ev.userWritten(nil, anthony)
+
+	// Create an array for storing all transactions, and store the array on the blockchain
+	var transactions AllTransactions
+	err = writeState(stub, "allTx", transactions)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create transaction reference number and store it on the blockchain
+	var refNumber int
+
+	refNumber = 2985674978
+	err = writeState(stub, "refNumber", refNumber)
+	if err != nil {
+		return nil, err
+	}
+	ev.referenceNumber(refNumber)
+
+	// Create contract metadata for double points and add it to the blockchain
+	var double Contract
+	double.Id = RETAIL_CONTRACT
+	double.BusinessId = "T5940872"
+	double.BusinessName = "OpenRetail"
+	double.Title = "Sonic for Less"
+	double.Description = "All Sonic purchases are 20% off the stated point price"
+	double.Conditions = append(double.Conditions, "20% off all Sonic purchases")
+	double.Conditions = append(double.Conditions, "Valid from Janurary 11, 2017")
+	double.Icon = ""
+	double.Method = "retailContract"
+
+	startDate, err := time.Parse(time.RFC822, "11 Jan 17 12:00 UTC")
+	if err != nil {
+		return nil, newError(ERR_VALIDATION_FAILED, "invalid contract start date: %s", err)
+	}
+	double.StartDate = startDate
+	endDate, err := time.Parse(time.RFC822, "31 Dec 60 11:59 UTC")
+	if err != nil {
+		return nil, newError(ERR_VALIDATION_FAILED, "invalid contract end date: %s", err)
+	}
+	double.EndDate = endDate
+
+	err = writeState(stub, RETAIL_CONTRACT, double)
+	if err != nil {
+		return nil, err
+	}
+	ev.contractWritten(double, false)
+
+	// Create contract metadata for feedback points and add it to the blockchain
+	var feedback Contract
+	feedback.Id = FEEDBACK_CONTRACT
+	feedback.BusinessId = "T5940872"
+	feedback.BusinessName = "OpenRetail"
+	feedback.Title = "Points for Feedback"
+	feedback.Description = "Earn points by sharing your thoughts on retail packages"
+	feedback.Conditions = append(feedback.Conditions, "1,000 points for retail package ")
+	feedback.Conditions = append(feedback.Conditions, "Valid from Janurary 24, 2017")
+	feedback.Icon = ""
+	feedback.Method = "feedbackContract"
+	feedback.Wallet = WALLET_PROMOTIONAL
+	startDate, err = time.Parse(time.RFC822, "24 Jan 17 12:00 UTC")
+	if err != nil {
+		return nil, newError(ERR_VALIDATION_FAILED, "invalid contract start date: %s", err)
+	}
+	feedback.StartDate = startDate
+	endDate, err = time.Parse(time.RFC822, "31 Dec 60 11:59 UTC")
+	if err != nil {
+		return nil, newError(ERR_VALIDATION_FAILED, "invalid contract end date: %s", err)
+	}
+	feedback.EndDate = endDate
+
+	err = writeState(stub, FEEDBACK_CONTRACT, feedback)
+	if err != nil {
+		return nil, err
+	}
+	ev.contractWritten(feedback, false)
+
+	// Create an array of contract ids to keep track of all contracts
+	var contractIds []string
+	contractIds = append(contractIds, RETAIL_CONTRACT)
+	contractIds = append(contractIds, FEEDBACK_CONTRACT)
+
+	err = writeState(stub, "contractIds", contractIds)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// Request naming a single member
+type userRequest struct {
+	UserId string `json:"userId" validate:"required"`
+}
+
+// Request for functions that take no arguments
+type emptyRequest struct {
+}
+
+// ============================================================================================================================
+// Get Open Points member account from the blockchain
+// ============================================================================================================================
+func (t *SimpleChaincode) getUserAccount(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*userRequest)
+	stub := ctx.GetStub()
+
+	//get the User index
+	fdAsBytes, err := stub.GetState(req.UserId)
+	if err != nil {
+		return nil, newError(ERR_LEDGER, "Failed to get user account from blockchain")
+	}
+	if fdAsBytes == nil {
+		return nil, newError(ERR_NOT_FOUND, "user %s does not exist", req.UserId)
+	}
+
+	// Break the balance down into its wallets
+	var user User
+	err = json.Unmarshal(fdAsBytes, &user)
+	if err != nil {
+		return nil, newError(ERR_CORRUPT_STATE, "failed to decode %s: %s", req.UserId, err)
+	}
+	user.normalizeWallets()
+
+	asBytes, _ := json.Marshal(user)
+	return asBytes, nil
+
+}
+
+// ============================================================================================================================
+// Get all transactions that involve a particular user
+// ============================================================================================================================
+func (t *SimpleChaincode) getTxs(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*userRequest)
+	stub := ctx.GetStub()
+
+	var res AllTransactions
+
+	//get the AllTransactions index
+	var txs AllTransactions
+	_, err := readState(stub, "allTx", &txs)
+	if err != nil {
+		return nil, err
+	}
+	numTxs := len(txs.Transactions)
+
+	for i := numTxs - 1; i >= 0; i-- {
+		if txs.Transactions[i].From == req.UserId {
+			res.Transactions = append(res.Transactions, txs.Transactions[i])
+		}
+
+		if txs.Transactions[i].To == req.UserId {
+			res.Transactions = append(res.Transactions, txs.Transactions[i])
+		}
+
+		if len(res.Transactions) >= NUM_TX_TO_RETURN {
+			break
+		}
+	}
+
+	resAsBytes, _ := json.Marshal(res)
+
+	return resAsBytes, nil
+
+}
+
+// ============================================================================================================================
+// Get the smart contract metadata from the blockchain
+// ============================================================================================================================
+func (t *SimpleChaincode) getAllContracts(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	stub := ctx.GetStub()
+
+	var contractIds []string
+	_, err := readState(stub, "contractIds", &contractIds)
+	if err != nil {
+		return nil, err
+	}
+
+	var allContracts []Contract
+	for i := range contractIds {
+		var thisContract Contract
+		found, err := readState(stub, contractIds[i], &thisContract)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, newError(ERR_CORRUPT_STATE, "contract %s is listed but does not exist", contractIds[i])
+		}
+		allContracts = append(allContracts, thisContract)
+	}
+
+	asBytes, _ := json.Marshal(allContracts)
+	return asBytes, nil
+
+}
+
+func (t *SimpleChaincode) incrementReferenceNumber(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	stub := ctx.GetStub()
+	ev := ctx.Event()
+
+	var refNumber int
+	found, err := readState(stub, "refNumber", &refNumber)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, newError(ERR_NOT_FOUND, "reference number has not been initialized")
+	}
+
+	refNumber = refNumber + 1
+	err = writeState(stub, "refNumber", refNumber)
+	if err != nil {
+		return nil, err
+	}
+	ev.referenceNumber(refNumber)
+
+	return nil, nil
+}
+
+func (t *SimpleChaincode) getReferenceNumber(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	stub := ctx.GetStub()
+
+	refNumberBytes, numErr := stub.GetState("refNumber")
+	if numErr != nil {
+		return nil, newError(ERR_LEDGER, "failed to read refNumber: %s", numErr)
+	}
+
+	return refNumberBytes, nil
+
+}
+
+// ============================================================================================================================
+// Smart contract for giving user double points
+// ============================================================================================================================
+func retailContract(tx Transaction, stub shim.ChaincodeStubInterface) (float64, error) {
+
+	var contract Contract
+	found, err := readState(stub, RETAIL_CONTRACT, &contract)
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, newError(ERR_NOT_FOUND, "contract %s does not exist", RETAIL_CONTRACT)
+	}
+
+	var pointsToTransfer float64
+	pointsToTransfer = tx.Amount
+
+	if tx.Date.After(contract.StartDate) && tx.Date.Before(contract.EndDate) {
+		pointsToTransfer = pointsToTransfer * 0.8
+	}
+
+	return pointsToTransfer, nil
+
+}
+
+// ============================================================================================================================
+// Smart contract for giving user points for completing feedback surveys
+// ============================================================================================================================
+func feedbackContract(tx Transaction, stub shim.ChaincodeStubInterface) (float64, error) {
+
+	var contract Contract
+	found, err := readState(stub, FEEDBACK_CONTRACT, &contract)
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, newError(ERR_NOT_FOUND, "contract %s does not exist", FEEDBACK_CONTRACT)
+	}
+
+	var pointsToTransfer float64
+	pointsToTransfer = 0
+
+	if tx.Date.After(contract.StartDate) && tx.Date.Before(contract.EndDate) {
+		pointsToTransfer = 1000
+		/*
+			 if (tx.Activities > 0) {
+				pointsToTransfer = pointsToTransfer + float64(tx.Activities)*100
+			 }
+		*/
+	}
+
+	return pointsToTransfer, nil
+
+}
+
+// ============================================================================================================================
+// Smart contract for any other contract id, discounts the point price by the contract DiscountRate
+// ============================================================================================================================
+func discountContract(tx Transaction, stub shim.ChaincodeStubInterface) (float64, error) {
+
+	var contract Contract
+	found, err := readState(stub, tx.ContractId, &contract)
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, newError(ERR_NOT_FOUND, "contract %s does not exist", tx.ContractId)
+	}
+
+	return tx.Amount - (tx.Amount * contract.DiscountRate), nil
+}
+
+// ============================================================================================================================
+// Points to transfer for a transaction, as priced by its contract
+// ============================================================================================================================
+func priceTransaction(tx Transaction, stub shim.ChaincodeStubInterface) (float64, error) {
+
+	if tx.ContractId == RETAIL_CONTRACT {
+		return retailContract(tx, stub)
+	} else if tx.ContractId == FEEDBACK_CONTRACT {
+		return feedbackContract(tx, stub)
+	} else if tx.ContractId != "" {
+		return discountContract(tx, stub)
+	}
+
+	return tx.Amount, nil
+}
+
+// ============================================================================================================================
+// Add the points of a transaction to the points used by its contract, failing if that exceeds the contract budget
+// ============================================================================================================================
+func chargeContract(stub shim.ChaincodeStubInterface, ev *LedgerEvent, tx Transaction) error {
+
+	var contract Contract
+	found, err := readState(stub, tx.ContractId, &contract)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return newError(ERR_NOT_FOUND, "contract %s does not exist", tx.ContractId)
+	}
+
+	if contract.Budget > 0 && contract.PointsUsed+tx.Amount > contract.Budget {
+		return newError(ERR_BUDGET_EXCEEDED, "contract %s has %v of its %v point budget left, %v required",
+			contract.Id, contract.Budget-contract.PointsUsed, contract.Budget, tx.Amount)
+	}
+
+	contract.PointsUsed = contract.PointsUsed + tx.Amount
+	err = writeState(stub, contract.Id, contract)
+	if err != nil {
+		return err
+	}
+	ev.contractWritten(contract, true)
+
+	return nil
+}
+
+// ============================================================================================================================
+// Give the points of a refunded transaction back to the budget of its contract
+// ============================================================================================================================
+func releaseContract(stub shim.ChaincodeStubInterface, ev *LedgerEvent, tx Transaction) error {
+
+	var contract Contract
+	found, err := readState(stub, tx.ContractId, &contract)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return newError(ERR_NOT_FOUND, "contract %s does not exist", tx.ContractId)
+	}
+
+	contract.PointsUsed = contract.PointsUsed - tx.Amount
+	err = writeState(stub, contract.Id, contract)
+	if err != nil {
+		return err
+	}
+	ev.contractWritten(contract, true)
+
+	return nil
+}
+
+// Request for addSmartContract
+type addSmartContractRequest struct {
+	Id           string   `json:"id" validate:"required"`
+	BusinessId   string   `json:"businessId" validate:"required"`
+	Title        string   `json:"title" validate:"required"`
+	Conditions   []string `json:"conditions"`
+	DiscountRate float64  `json:"discountRate" validate:"required,min=0,max=1"`
+	Budget       float64  `json:"budget" validate:"min=0"`
+	MaturityDays int      `json:"maturityDays" validate:"min=0"`
+	Wallet       string   `json:"wallet" validate:"oneof=earned|promotional|purchased"`
+}
+
+// Keys that can never be used as contract ids
+var reservedKeys = []string{"allTx", "refNumber", "contractIds"}
+
+func (t *SimpleChaincode) addSmartContract(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*addSmartContractRequest)
+	stub := ctx.GetStub()
+	ev := ctx.Event()
+
+	// The business pays for the discounts of the contract
+	err := checkAccount(ctx, req.BusinessId)
+	if err != nil {
+		return nil, err
+	}
+	var business User
+	found, err := readState(stub, req.BusinessId, &business)
+	if err != nil {
+		return nil, err
+	}
+	if !found || business.UserId != req.BusinessId {
+		return nil, newError(ERR_NOT_FOUND, "business %s does not exist", req.BusinessId)
+	}
+
+	// Create new smart contract based on user input
+	var smartContract Contract
+	smartContract.Id = req.Id
+	smartContract.BusinessId = business.UserId
+	smartContract.BusinessName = business.Name
+	smartContract.Title = req.Title
+	smartContract.Description = ""
+	smartContract.Conditions = req.Conditions
+	smartContract.Icon = ""
+	smartContract.Method = "retailContract"
+	smartContract.DiscountRate = req.DiscountRate
+	smartContract.Budget = req.Budget
+	smartContract.MaturityDays = req.MaturityDays
+	smartContract.Wallet = req.Wallet
+
+	if containsString(reservedKeys, smartContract.Id) {
+		return nil, fieldError("id", "%s is reserved", smartContract.Id)
+	}
+
+	// Contracts share the key space with users, never overwrite anything that is not a contract
+	existingAsBytes, err := stub.GetState(smartContract.Id)
+	if err != nil {
+		return nil, newError(ERR_LEDGER, "failed to read %s: %s", smartContract.Id, err)
+	}
+	existed := existingAsBytes != nil
+	if existed {
+		var existing Contract
+		err = json.Unmarshal(existingAsBytes, &existing)
+		if err != nil || existing.Id != smartContract.Id {
+			return nil, fieldError("id", "%s is already used by another record", smartContract.Id)
+		}
+		if existing.BusinessId != smartContract.BusinessId {
+			return nil, fieldError("businessId", "%s belongs to %s", smartContract.Id, existing.BusinessId)
+		}
+		smartContract.PointsUsed = existing.PointsUsed
+		if smartContract.Budget > 0 && smartContract.Budget < smartContract.PointsUsed {
+			return nil, fieldError("budget", "%s has already used %v points, the budget can not be lower", smartContract.Id, smartContract.PointsUsed)
+		}
+	}
+
+	err = writeState(stub, smartContract.Id, smartContract)
+	if err != nil {
+		return nil, err
+	}
+	ev.contractWritten(smartContract, existed)
+
+	var contractIds []string
+	_, err = readState(stub, "contractIds", &contractIds)
+	if err != nil {
+		return nil, err
+	}
+
+	if !containsString(contractIds, smartContract.Id) {
+		contractIds = append(contractIds, smartContract.Id)
+	}
+
+	err = writeState(stub, "contractIds", contractIds)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+
+}
+
+// Request for transferPoints
+type transferPointsRequest struct {
+	To          string  `json:"to" validate:"required"`
+	From        string  `json:"from" validate:"required"`
+	Type        string  `json:"type" validate:"required"`
+	Description string  `json:"description"`
+	ContractId  string  `json:"contractId"`
+	Activities  int     `json:"activities" validate:"min=0"`
+	Amount      float64 `json:"amount" validate:"min=0"`
+	Money       float64 `json:"money" validate:"min=0"`
+	VoucherId   string  `json:"voucherId"`
+	VoucherCode string  `json:"voucherCode"`
+	// Payment authorization of the sender, when its business or a delegate takes the points
+	AuthorizationId string `json:"authorizationId"`
+}
+
+// ============================================================================================================================
+// Transfer points between members of the Open Points Network. The caller acts for the sender, spends from a pool it
+// is a member of, or acts for the business receiving the points with a payment authorization of the sender.
+// ============================================================================================================================
+func (t *SimpleChaincode) transferPoints(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*transferPointsRequest)
+	stub := ctx.GetStub()
+	ev := ctx.Event()
+
+	if req.To == req.From {
+		return nil, fieldError("to", "cannot transfer points from %s to itself", req.From)
+	}
+
+	currentDateStr := ev.Timestamp.Format(time.RFC822)
+	startDate, _ := time.Parse(time.RFC822, currentDateStr)
+
+	var tx Transaction
+	tx.Date = startDate
+	tx.To = req.To
+	tx.From = req.From
+	tx.Type = req.Type
+	tx.Description = req.Description
+	tx.ContractId = req.ContractId
+	tx.Activities = req.Activities
+	tx.Amount = req.Amount
+	tx.ListAmount = req.Amount
+	tx.Money = req.Money
+	tx.StatusCode = 1
+	tx.StatusMsg = "Transaction Completed"
+	tx.TxId = stub.GetTxID()
+	tx.VoucherId = req.VoucherId
+
+	// The types exempt from the risk rules, approvals and pool rules give back points the chaincode moved before
+	if screenExempt(tx) {
+		return nil, fieldError("type", "%s transactions are only posted by the chaincode", tx.Type)
+	}
+
+	// A spend from a pool is charged to the member the caller acts for, who must be allowed to spend
+	pool, err := loadPool(stub, req.From)
+	if err != nil {
+		return nil, err
+	}
+	if pool != nil {
+		spender := pool.member(ctx.Account())
+		if spender == nil || !spender.CanSpend {
+			return nil, newError(ERR_FORBIDDEN, "caller may not spend from pool %s", pool.PoolId)
+		}
+		tx.SpentBy = spender.UserId
+	} else {
+		err = checkPayer(ctx, req.From, req.To, req.AuthorizationId, req.Amount)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Get the current reference number and update it
+	refNumber, err := nextRefNumber(stub, ev)
+	if err != nil {
+		return nil, err
+	}
+	tx.RefNumber = refNumber
+
+	// Determine point amount to transfer based on contract type
+	tx.Amount, err = priceTransaction(tx, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// Take the voucher discount off the priced amount, the voucher is redeemed when the transfer posts
+	if tx.VoucherId != "" {
+		err = applyVoucher(stub, ev, &tx, req.VoucherCode)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Check the approval policies on the priced amount, then the risk rules, a held transfer waits for review
+	err = checkTransferApproval(stub, ev, tx)
+	if err != nil {
+		return nil, err
+	}
+	screening, err := screenTransfer(stub, ev, &tx)
+	if err != nil {
+		return nil, err
+	}
+	if screening.Severity == RISK_HOLD {
+		riskCase, err := holdTransfer(stub, ev, tx, screening)
+		if err != nil {
+			return nil, err
+		}
+		asBytes, _ := json.Marshal(riskCase)
+		return asBytes, nil
+	}
+
+	// Charge the points to the contract budget
+	if tx.ContractId != "" {
+		err = chargeContract(stub, ev, tx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = postScreenedTransfer(stub, ev, &tx, screening)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reward a pending referral the transfer qualifies
+	err = qualifyReferral(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+
+}
+
+// ============================================================================================================================
+// Take the next transaction reference number
+// ============================================================================================================================
+func nextRefNumber(stub shim.ChaincodeStubInterface, ev *LedgerEvent) (string, error) {
+
+	var refNumber int
+	found, err := readState(stub, "refNumber", &refNumber)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", newError(ERR_NOT_FOUND, "reference number has not been initialized")
+	}
+
+	err = writeState(stub, "refNumber", refNumber+1)
+	if err != nil {
+		return "", err
+	}
+	ev.referenceNumber(refNumber + 1)
+
+	return strconv.Itoa(refNumber), nil
+}
+
+// ============================================================================================================================
+// Check a priced transaction against the approval policies and the risk rules and post it. A transaction a rule would
+// hold fails with RISK_BLOCKED, only transferPoints and scheduled runs keep held transfers for review.
+// ============================================================================================================================
+func postTransfer(stub shim.ChaincodeStubInterface, ev *LedgerEvent, tx *Transaction) error {
+
+	err := checkTransferApproval(stub, ev, *tx)
+	if err != nil {
+		return err
+	}
+	screening, err := screenTransfer(stub, ev, tx)
+	if err != nil {
+		return err
+	}
+	if screening.Severity == RISK_HOLD {
+		return newError(ERR_RISK_BLOCKED, "transfer from %s needs review by %s", tx.From, screening.reasons(RISK_HOLD))
+	}
+
+	return postScreenedTransfer(stub, ev, tx, screening)
+}
+
+// ============================================================================================================================
+// Move the points of a priced and screened transaction from its sender to its receiver and append it to the
+// transaction index. A transaction without a receiver burns the points, one without a sender mints them. Earned
+// points go back from the receiver to the sender once the sender has paid, into its pending balance when they are
+// EarnedPending. The transfer counts in the risk usage of its sender and redeems its voucher.
+// ============================================================================================================================
+func postScreenedTransfer(stub shim.ChaincodeStubInterface, ev *LedgerEvent, tx *Transaction, screening *RiskScreening) error {
+
+	modified := tx.Date.Format(time.RFC822)
+	net := tx.Amount - tx.Earned
+
+	// Pending earnings skip the balance of the member, the sender of a purchase or the receiver of its reversal
+	senderNet, receiverNet := net, net
+	senderPending, receiverPending := 0.0, 0.0
+	if tx.EarnedPending && tx.Type == TX_TYPE_REVERSAL {
+		receiverNet = tx.Amount
+		receiverPending = -tx.Earned
+	} else if tx.EarnedPending {
+		senderNet = tx.Amount
+		senderPending = tx.Earned
+	}
+
+	// Delegates act within their delegation and are recorded on the transaction
+	if err := checkDelegate(stub, ev, tx); err != nil {
+		return err
+	}
+
+	// Frozen and listed accounts can neither send nor receive, nor spend from a pool or act as a delegate
+	if err := checkCompliance(stub, *tx); err != nil {
+		return err
+	}
+
+	// Pools only take contributions from their members and pay out to members allowed to spend
+	if err := applyPoolTransfer(stub, ev, *tx); err != nil {
+		return err
+	}
+
+	// Get Receiver and Sender accounts from BC
+	var receiver User
+	if tx.To != "" {
+		found, err := readState(stub, tx.To, &receiver)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return newError(ERR_NOT_FOUND, "receiver %s does not exist", tx.To)
+		}
+
+		if receiver.Balance+receiverNet < 0 {
+			return newError(ERR_INSUFFICIENT_FUNDS, "user %s has %v points, %v required", receiver.UserId, receiver.Balance+tx.Amount, tx.Earned)
+		}
+		if receiver.Pending+receiverPending < 0 {
+			return newError(ERR_INSUFFICIENT_FUNDS, "user %s has %v pending points, %v required", receiver.UserId, receiver.Pending, tx.Earned)
+		}
+	}
+
+	var sender User
+	if tx.From != "" {
+		found, err := readState(stub, tx.From, &sender)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return newError(ERR_NOT_FOUND, "sender %s does not exist", tx.From)
+		}
+
+		if sender.Balance < tx.Amount {
+			return newError(ERR_INSUFFICIENT_FUNDS, "user %s has %v points, %v required", sender.UserId, sender.Balance, tx.Amount)
+		}
+	}
+
+	// Move the points between wallets, the sender spends its wallets in the spend order of the program
+	order, err := spendOrder(stub)
+	if err != nil {
+		return err
+	}
+	credit, err := creditWallet(stub, *tx)
+	if err != nil {
+		return err
+	}
+	moved := map[string]float64{}
+	if tx.From != "" {
+		sender.normalizeWallets()
+		moved = sender.debitWallets(tx.Amount, order)
+		if senderPending == 0 {
+			sender.creditWallets(map[string]float64{WALLET_EARNED: tx.Earned})
+		}
+	}
+	if tx.To != "" {
+		if credit != "" {
+			moved = map[string]float64{credit: tx.Amount}
+		}
+		receiver.normalizeWallets()
+		receiver.creditWallets(moved)
+		if receiverPending == 0 {
+			receiver.debitWallets(tx.Earned, order)
+		}
+	}
+
+	// Update receiver point balance and commit to ledger
+	if tx.To != "" {
+		receiver.Balance = receiver.Balance + receiverNet
+		receiver.Pending = receiver.Pending + receiverPending
+		receiver.Modified = modified
+		receiver.NumTxs = receiver.NumTxs + 1
+		tx.ToName = receiver.Name
+
+		err := writeState(stub, tx.To, receiver)
+		if err != nil {
+			return err
+		}
+		ev.balanceChanged(receiver, receiverNet)
+	}
+
+	// Update sender point balance and commit to ledger
+	if tx.From != "" {
+		sender.Balance = sender.Balance - senderNet
+		sender.Pending = sender.Pending + senderPending
+		sender.Modified = modified
+		sender.NumTxs = sender.NumTxs + 1
+		tx.FromName = sender.Name
+
+		err := writeState(stub, tx.From, sender)
+		if err != nil {
+			return err
+		}
+		ev.balanceChanged(sender, -senderNet)
+	}
+
+	//get the AllTransactions index
+	var txs AllTransactions
+	_, err = readState(stub, "allTx", &txs)
+	if err != nil {
+		return err
+	}
+
+	//Update transactions arrary and commit to BC
+	txs.Transactions = append(txs.Transactions, *tx)
+	err = writeState(stub, "allTx", txs)
+	if err != nil {
+		return err
+	}
+	ev.transfer(*tx)
+
+	// Refunds and reversals carry the voucher of the transfer they give back, which stays redeemed
+	if tx.VoucherId != "" && !screenExempt(*tx) {
+		err = recordRedemption(stub, ev, *tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return trackTransfer(stub, ev, *tx, screening)
+}
@@ -0,0 +1,323 @@
+package openpoints_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/gscdist/GscLabChaincode/mockstub"
+	"github.com/gscdist/GscLabChaincode/openpoints"
+)
+
+// ============================================================================================================================
+// Legacy compatibility
+//
+// testdata/legacy_replay.json holds the invocations clients send today, as positional arguments, and what the legacy
+// chaincode (chaincode.go of the baseline commit, on the Init/Invoke/Query shim) answered: the error, the query
+// payload and the world state after every invoke. TestLegacyReplay sends the same invocations to the contract API
+// dispatch as JSON requests and requires every legacy record to read the same, field by field. Fields added since
+// may appear anywhere. Fields that depend on the wall clock, and the changes listed in legacyChanges, are skipped.
+// Invocations listed in legacyRejections must now fail with their error code and leave the ledger unchanged. The
+// records the legacy chaincode changed on such an invocation read differently from then on, later steps skip them
+// in the state and skip the queries that answer from them.
+//
+// testdata/legacy/record_test.go records the fixture from the legacy chaincode, its header says how to run it.
+// ============================================================================================================================
+
+// A recorded invocation and the answer of the legacy chaincode
+type legacyStep struct {
+	Kind     string                     `json:"kind"`
+	Function string                     `json:"function"`
+	Args     []string                   `json:"args"`
+	Error    string                     `json:"error"`
+	Payload  json.RawMessage            `json:"payload"`
+	State    map[string]json.RawMessage `json:"state"`
+}
+
+// Fields the legacy chaincode set from the wall clock of the peer, the dispatch uses the transaction timestamp
+var legacyClockFields = map[string]bool{"Date": true, "LastModifiedDate": true}
+
+// Fields that deliberately read differently, by record id and field
+var legacyChanges = map[string]string{
+	// The legacy init misspelled the month of both start dates, so they failed to parse and were stored as zero
+	"Sonic.StartDate":    "Sonic starts on 2017-01-11 instead of the zero time",
+	"Feedback.StartDate": "Feedback starts on 2017-01-24 instead of the zero time",
+}
+
+// An invocation the legacy chaincode accepted that now fails
+type legacyRejection struct {
+	Reason string
+	Code   string
+	Match  func(step legacyStep) bool
+}
+
+var legacyRejections = []legacyRejection{
+	{
+		Reason: "discountContract prices a transfer only by a contract that exists, the legacy chaincode ignored an " +
+			"unknown contractId and transferred the full amount",
+		Code: openpoints.ERR_NOT_FOUND,
+		Match: func(step legacyStep) bool {
+			return step.Function == "transferPoints" && step.Args[4] == "Promo9"
+		},
+	},
+}
+
+func findRejection(step legacyStep) *legacyRejection {
+	for i := range legacyRejections {
+		if legacyRejections[i].Match(step) {
+			return &legacyRejections[i]
+		}
+	}
+	return nil
+}
+
+// legacyReads lists the legacy records a query answers from
+func legacyReads(step legacyStep, state map[string]json.RawMessage) []string {
+
+	switch step.Function {
+	case "getUserAccount", "getTxs":
+		return []string{step.Args[1]}
+	case "getReferenceNumber":
+		return []string{"refNumber"}
+	case "getAllContracts":
+		var ids []string
+		json.Unmarshal(state["contractIds"], &ids)
+		return append(ids, "contractIds")
+	}
+
+	return nil
+}
+
+// legacyRequest maps the positional arguments of a legacy invocation to the JSON request of the same function
+func legacyRequest(step legacyStep) (interface{}, error) {
+
+	args := step.Args
+	switch step.Function {
+	case "init", "incrementReferenceNumber", "getAllContracts", "getReferenceNumber":
+		return nil, nil
+	case "getUserAccount", "getTxs":
+		return map[string]interface{}{"userId": args[1]}, nil
+	case "addSmartContract":
+		discountRate, err := strconv.ParseFloat(args[4], 64)
+		if err != nil {
+			return nil, err
+		}
+		// The legacy chaincode assigned every contract to OpenRetail
+		return map[string]interface{}{"id": args[0], "businessId": "T5940872", "title": args[1],
+			"conditions": []string{args[2], args[3]}, "discountRate": discountRate}, nil
+	case "transferPoints":
+		activities, err := strconv.Atoi(args[5])
+		if err != nil {
+			return nil, err
+		}
+		amount, err := strconv.ParseFloat(args[6], 64)
+		if err != nil {
+			return nil, err
+		}
+		money, err := strconv.ParseFloat(args[7], 64)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"to": args[0], "from": args[1], "type": args[2], "description": args[3],
+			"contractId": args[4], "activities": activities, "amount": amount, "money": money}, nil
+	}
+
+	return nil, fmt.Errorf("no request mapping for %s", step.Function)
+}
+
+// compareLegacy reports every field of a legacy value that the new value lacks or holds differently
+func compareLegacy(t *testing.T, path string, legacy interface{}, current interface{}) {
+
+	t.Helper()
+	switch legacy := legacy.(type) {
+	case map[string]interface{}:
+		// Contracts are named by their id, so a change reads the same in the state and in query payloads
+		if id, ok := legacy["ID"].(string); ok {
+			path = id
+		}
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			t.Errorf("%s: legacy object read as %v", path, current)
+			return
+		}
+		for field, value := range legacy {
+			if _, changed := legacyChanges[path+"."+field]; changed || legacyClockFields[field] {
+				continue
+			}
+			currentValue, found := object[field]
+			if !found {
+				t.Errorf("%s.%s: missing, legacy value %v", path, field, value)
+				continue
+			}
+			compareLegacy(t, path+"."+field, value, currentValue)
+		}
+	case []interface{}:
+		list, ok := current.([]interface{})
+		if !ok || len(list) != len(legacy) {
+			t.Errorf("%s: legacy list of %d read as %v", path, len(legacy), current)
+			return
+		}
+		for i := range legacy {
+			compareLegacy(t, fmt.Sprintf("%s[%d]", path, i), legacy[i], list[i])
+		}
+	default:
+		if !reflect.DeepEqual(legacy, current) {
+			t.Errorf("%s: %v, legacy %v", path, current, legacy)
+		}
+	}
+}
+
+func compareLegacyJSON(t *testing.T, path string, legacy []byte, current []byte) {
+
+	t.Helper()
+	var legacyValue, currentValue interface{}
+	if err := json.Unmarshal(legacy, &legacyValue); err != nil {
+		t.Fatalf("%s: legacy value: %s", path, err)
+	}
+	if err := json.Unmarshal(current, &currentValue); err != nil {
+		t.Errorf("%s: %s", path, err)
+		return
+	}
+	compareLegacy(t, path, legacyValue, currentValue)
+}
+
+func loadLegacySteps(t *testing.T) []legacyStep {
+
+	asBytes, err := ioutil.ReadFile("testdata/legacy_replay.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var steps []legacyStep
+	err = json.Unmarshal(asBytes, &steps)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return steps
+}
+
+func TestLegacyReplay(t *testing.T) {
+
+	steps := loadLegacySteps(t)
+
+	// The legacy chaincode had no access control, today's clients map to an administrator
+	h, err := mockstub.NewHarness()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var legacyState map[string]json.RawMessage
+	diverged := map[string]bool{}
+	for i, step := range steps {
+		name := fmt.Sprintf("step %d %s%v", i, step.Function, step.Args)
+
+		request, err := legacyRequest(step)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		// A rejected invocation leaves the ledger as the legacy chaincode left it before, the records the legacy
+		// chaincode changed there no longer compare after it
+		expected := step.State
+		var changed []string
+
+		var payload []byte
+		if step.Kind == "invoke" {
+			payload, err = h.Invoke(step.Function, request)
+		} else {
+			payload, err = h.Query(step.Function, request)
+		}
+		if rejection := findRejection(step); rejection != nil {
+			ccErr, ok := err.(*openpoints.ChaincodeError)
+			if !ok || ccErr.Code != rejection.Code {
+				t.Errorf("%s: returned %v, want %s because %s", name, err, rejection.Code, rejection.Reason)
+			}
+			for key, legacy := range step.State {
+				if before, found := legacyState[key]; !found || !bytes.Equal(before, legacy) {
+					changed = append(changed, key)
+				}
+			}
+			for key := range legacyState {
+				if _, found := step.State[key]; !found {
+					changed = append(changed, key)
+				}
+			}
+			expected = legacyState
+		} else if step.Error != "" {
+			if err == nil {
+				t.Errorf("%s: succeeded, the legacy chaincode failed with %s", name, step.Error)
+			}
+			continue
+		} else if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		} else if step.Kind == "query" && !readsDiverged(step, legacyState, diverged) {
+			compareLegacyJSON(t, name, step.Payload, payload)
+		}
+
+		for key, legacy := range expected {
+			if diverged[key] {
+				continue
+			}
+			current, found := h.Stub.Snapshot()[key]
+			if !found {
+				t.Errorf("%s: key %s is missing", name, key)
+				continue
+			}
+			compareLegacyJSON(t, key, legacy, current)
+		}
+		for _, key := range changed {
+			diverged[key] = true
+		}
+		if step.State != nil {
+			legacyState = step.State
+		}
+	}
+}
+
+func readsDiverged(step legacyStep, state map[string]json.RawMessage, diverged map[string]bool) bool {
+	for _, key := range legacyReads(step, state) {
+		if diverged[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// Every invocation of the replay still names a registered function
+func TestLegacyReplayFunctionsRegistered(t *testing.T) {
+
+	steps := loadLegacySteps(t)
+
+	h, err := mockstub.NewHarness()
+	if err != nil {
+		t.Fatal(err)
+	}
+	asBytes, err := h.Query("describeFunctions", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var api openpoints.APIDescription
+	err = json.Unmarshal(asBytes, &api)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registered := map[string]openpoints.FunctionDescription{}
+	for _, desc := range api.Functions {
+		registered[desc.Name] = desc
+	}
+	for _, step := range steps {
+		spec, found := registered[step.Function]
+		if !found {
+			t.Errorf("%s is not registered", step.Function)
+			continue
+		}
+		if (step.Kind == "invoke") != (spec.Access == openpoints.ACCESS_WRITE) {
+			t.Errorf("%s was a legacy %s but is registered as %s", step.Function, step.Kind, spec.Access)
+		}
+	}
+}
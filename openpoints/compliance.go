@@ -0,0 +1,390 @@
+package openpoints
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// ============================================================================================================================
+// Compliance holds
+//
+// Compliance officers freeze and unfreeze member accounts and keep a sanctions list of identities. A listed identity
+// is either a member id or the client identity of a caller. postTransfer rejects every posting from or to a frozen
+// account or a listed member id with COMPLIANCE_HOLD, whatever function makes it, as well as every posting spent from
+// a pool by a frozen or listed member or made by a listed delegate. Callers below the compliance role can not invoke
+// any write function through a listed client identity. Every freeze, unfreeze, listing and
+// delisting is kept as a ComplianceAction with the identity that took it.
+// ============================================================================================================================
+
+// Compliance actions
+const COMPLIANCE_FREEZE = "freeze"
+const COMPLIANCE_UNFREEZE = "unfreeze"
+const COMPLIANCE_LIST = "list"
+const COMPLIANCE_DELIST = "delist"
+
+// Composite key object types
+const accountFreezeObject = "accountFreeze"
+const sanctionObject = "sanction"
+const complianceActionObject = "complianceAction"
+
+// A frozen account
+type AccountFreeze struct {
+	UserId     string    `json:"UserId"`
+	ReasonCode string    `json:"ReasonCode"`
+	FrozenBy   string    `json:"FrozenBy"`
+	Frozen     time.Time `json:"Frozen"`
+}
+
+// An identity on the sanctions list
+type Sanction struct {
+	Identity   string    `json:"Identity"`
+	ReasonCode string    `json:"ReasonCode"`
+	ListedBy   string    `json:"ListedBy"`
+	Listed     time.Time `json:"Listed"`
+}
+
+// One compliance action, Subject is the member id or identity it applies to
+type ComplianceAction struct {
+	Action     string    `json:"Action"`
+	Subject    string    `json:"Subject"`
+	ReasonCode string    `json:"ReasonCode"`
+	Notes      string    `json:"Notes,omitempty"`
+	TakenBy    string    `json:"TakenBy"`
+	Taken      time.Time `json:"Taken"`
+	TxId       string    `json:"TxId"`
+}
+
+// Request for freezeAccount and unfreezeAccount
+type accountFreezeRequest struct {
+	UserId     string `json:"userId" validate:"required"`
+	ReasonCode string `json:"reasonCode" validate:"required"`
+	Notes      string `json:"notes"`
+}
+
+// Request for listIdentity and delistIdentity
+type sanctionRequest struct {
+	Identity   string `json:"identity" validate:"required"`
+	ReasonCode string `json:"reasonCode" validate:"required"`
+	Notes      string `json:"notes"`
+}
+
+// Request for getComplianceActions
+type complianceActionsRequest struct {
+	Subject string `json:"subject"`
+	Action  string `json:"action" validate:"oneof=freeze|unfreeze|list|delist"`
+}
+
+// ============================================================================================================================
+// Reject a posting from or to a frozen account or a listed member id, or spent or made by one
+// ============================================================================================================================
+func checkCompliance(stub shim.ChaincodeStubInterface, tx Transaction) error {
+
+	for _, userId := range []string{tx.From, tx.To, tx.SpentBy, tx.Delegate} {
+		if userId == "" {
+			continue
+		}
+
+		freezeKey, err := compositeKey(stub, accountFreezeObject, userId)
+		if err != nil {
+			return err
+		}
+		var freeze AccountFreeze
+		found, err := readState(stub, freezeKey, &freeze)
+		if err != nil {
+			return err
+		}
+		if found {
+			return newError(ERR_COMPLIANCE_HOLD, "account %s is frozen (%s)", userId, freeze.ReasonCode)
+		}
+
+		sanction, err := loadSanction(stub, userId)
+		if err != nil {
+			return err
+		}
+		if sanction != nil {
+			return newError(ERR_COMPLIANCE_HOLD, "%s is on the sanctions list (%s)", userId, sanction.ReasonCode)
+		}
+	}
+
+	return nil
+}
+
+// Reject a write by a caller whose client identity is on the sanctions list
+func checkCaller(ctx *TransactionContext) error {
+
+	id := callerId(ctx)
+	if id == "" {
+		return nil
+	}
+
+	sanction, err := loadSanction(ctx.GetStub(), id)
+	if err != nil {
+		return err
+	}
+	if sanction != nil {
+		return newError(ERR_COMPLIANCE_HOLD, "caller identity is on the sanctions list (%s)", sanction.ReasonCode)
+	}
+
+	return nil
+}
+
+func loadSanction(stub shim.ChaincodeStubInterface, identity string) (*Sanction, error) {
+
+	key, err := compositeKey(stub, sanctionObject, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	var sanction Sanction
+	found, err := readState(stub, key, &sanction)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return &sanction, nil
+}
+
+func recordComplianceAction(ctx *TransactionContext, action string, subject string, reasonCode string, notes string) (*ComplianceAction, error) {
+
+	stub := ctx.GetStub()
+	ev := ctx.Event()
+
+	record := ComplianceAction{Action: action, Subject: subject, ReasonCode: reasonCode, Notes: notes, TakenBy: callerId(ctx),
+		Taken: ev.Timestamp, TxId: stub.GetTxID()}
+
+	key, err := compositeKey(stub, complianceActionObject, subject, ev.Timestamp.Format(time.RFC3339Nano), stub.GetTxID())
+	if err != nil {
+		return nil, err
+	}
+	err = writeState(stub, key, record)
+	if err != nil {
+		return nil, err
+	}
+	ev.complianceAction(record)
+
+	return &record, nil
+}
+
+// ============================================================================================================================
+// Freeze a member account, it can neither send nor receive points until unfrozen
+// ============================================================================================================================
+func (t *SimpleChaincode) freezeAccount(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*accountFreezeRequest)
+	stub := ctx.GetStub()
+
+	var user User
+	found, err := readState(stub, req.UserId, &user)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, newError(ERR_NOT_FOUND, "user %s does not exist", req.UserId)
+	}
+
+	key, err := compositeKey(stub, accountFreezeObject, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+	var freeze AccountFreeze
+	found, err = readState(stub, key, &freeze)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return nil, newError(ERR_INVALID_STATE, "account %s is already frozen (%s)", req.UserId, freeze.ReasonCode)
+	}
+
+	freeze = AccountFreeze{UserId: req.UserId, ReasonCode: req.ReasonCode, FrozenBy: callerId(ctx), Frozen: ctx.Event().Timestamp}
+	err = writeState(stub, key, freeze)
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := recordComplianceAction(ctx, COMPLIANCE_FREEZE, req.UserId, req.ReasonCode, req.Notes)
+	if err != nil {
+		return nil, err
+	}
+
+	asBytes, _ := json.Marshal(record)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Unfreeze a frozen member account
+// ============================================================================================================================
+func (t *SimpleChaincode) unfreezeAccount(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*accountFreezeRequest)
+	stub := ctx.GetStub()
+
+	key, err := compositeKey(stub, accountFreezeObject, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+	var freeze AccountFreeze
+	found, err := readState(stub, key, &freeze)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, newError(ERR_INVALID_STATE, "account %s is not frozen", req.UserId)
+	}
+
+	err = stub.DelState(key)
+	if err != nil {
+		return nil, newError(ERR_LEDGER, "failed to delete %s: %s", key, err)
+	}
+
+	record, err := recordComplianceAction(ctx, COMPLIANCE_UNFREEZE, req.UserId, req.ReasonCode, req.Notes)
+	if err != nil {
+		return nil, err
+	}
+
+	asBytes, _ := json.Marshal(record)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Put a member id or client identity on the sanctions list
+// ============================================================================================================================
+func (t *SimpleChaincode) listIdentity(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*sanctionRequest)
+	stub := ctx.GetStub()
+
+	existing, err := loadSanction(stub, req.Identity)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, newError(ERR_ALREADY_EXISTS, "%s is already on the sanctions list (%s)", req.Identity, existing.ReasonCode)
+	}
+
+	key, err := compositeKey(stub, sanctionObject, req.Identity)
+	if err != nil {
+		return nil, err
+	}
+	sanction := Sanction{Identity: req.Identity, ReasonCode: req.ReasonCode, ListedBy: callerId(ctx), Listed: ctx.Event().Timestamp}
+	err = writeState(stub, key, sanction)
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := recordComplianceAction(ctx, COMPLIANCE_LIST, req.Identity, req.ReasonCode, req.Notes)
+	if err != nil {
+		return nil, err
+	}
+
+	asBytes, _ := json.Marshal(record)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Take an identity off the sanctions list
+// ============================================================================================================================
+func (t *SimpleChaincode) delistIdentity(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*sanctionRequest)
+	stub := ctx.GetStub()
+
+	existing, err := loadSanction(stub, req.Identity)
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil {
+		return nil, newError(ERR_NOT_FOUND, "%s is not on the sanctions list", req.Identity)
+	}
+
+	key, err := compositeKey(stub, sanctionObject, req.Identity)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.DelState(key)
+	if err != nil {
+		return nil, newError(ERR_LEDGER, "failed to delete %s: %s", key, err)
+	}
+
+	record, err := recordComplianceAction(ctx, COMPLIANCE_DELIST, req.Identity, req.ReasonCode, req.Notes)
+	if err != nil {
+		return nil, err
+	}
+
+	asBytes, _ := json.Marshal(record)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Get the sanctions list
+// ============================================================================================================================
+func (t *SimpleChaincode) getSanctionsList(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(sanctionObject, []string{})
+	if err != nil {
+		return nil, newError(ERR_LEDGER, "failed to list sanctions: %s", err)
+	}
+	defer iter.Close()
+
+	sanctions := []Sanction{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, newError(ERR_LEDGER, "failed to list sanctions: %s", err)
+		}
+
+		var sanction Sanction
+		err = json.Unmarshal(kv.Value, &sanction)
+		if err != nil {
+			return nil, newError(ERR_CORRUPT_STATE, "failed to decode sanction %s: %s", kv.Key, err)
+		}
+		sanctions = append(sanctions, sanction)
+	}
+
+	asBytes, _ := json.Marshal(sanctions)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// List compliance actions, optionally on one subject and of one kind, oldest first
+// ============================================================================================================================
+func (t *SimpleChaincode) getComplianceActions(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*complianceActionsRequest)
+
+	attributes := []string{}
+	if req.Subject != "" {
+		attributes = append(attributes, req.Subject)
+	}
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(complianceActionObject, attributes)
+	if err != nil {
+		return nil, newError(ERR_LEDGER, "failed to list compliance actions: %s", err)
+	}
+	defer iter.Close()
+
+	actions := []ComplianceAction{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, newError(ERR_LEDGER, "failed to list compliance actions: %s", err)
+		}
+
+		var action ComplianceAction
+		err = json.Unmarshal(kv.Value, &action)
+		if err != nil {
+			return nil, newError(ERR_CORRUPT_STATE, "failed to decode compliance action %s: %s", kv.Key, err)
+		}
+		if req.Action != "" && action.Action != req.Action {
+			continue
+		}
+		actions = append(actions, action)
+	}
+
+	sort.SliceStable(actions, func(i, j int) bool { return actions[i].Taken.Before(actions[j].Taken) })
+
+	asBytes, _ := json.Marshal(actions)
+	return asBytes, nil
+}
@@ -0,0 +1,132 @@
+package openpoints_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gscdist/GscLabChaincode/openpoints"
+)
+
+// A transfer under a contract at a time and the points it moves
+type contractCase struct {
+	name       string
+	contractId string
+	at         time.Time
+	from       string
+	to         string
+	amount     float64
+	points     float64
+}
+
+// The windows init gives Sonic and Feedback, a transfer at the first instant prices as outside
+var (
+	sonicStart    = time.Date(2017, 1, 11, 12, 0, 0, 0, time.UTC)
+	feedbackStart = time.Date(2017, 1, 24, 12, 0, 0, 0, time.UTC)
+	contractsEnd  = time.Date(2060, 12, 31, 11, 59, 0, 0, time.UTC)
+)
+
+var contractCases = []contractCase{
+	{"Sonic before", openpoints.RETAIL_CONTRACT, sonicStart.AddDate(0, -1, 0), natalieId, retailId, 100, 100},
+	{"Sonic at start", openpoints.RETAIL_CONTRACT, sonicStart, natalieId, retailId, 100, 100},
+	{"Sonic after start", openpoints.RETAIL_CONTRACT, sonicStart.Add(time.Minute), natalieId, retailId, 100, 80},
+	{"Sonic inside", openpoints.RETAIL_CONTRACT, time.Date(2017, 5, 6, 12, 0, 0, 0, time.UTC), natalieId, retailId, 250, 200},
+	{"Sonic before end", openpoints.RETAIL_CONTRACT, contractsEnd.Add(-time.Minute), natalieId, retailId, 100, 80},
+	{"Sonic at end", openpoints.RETAIL_CONTRACT, contractsEnd, natalieId, retailId, 100, 100},
+	{"Sonic after", openpoints.RETAIL_CONTRACT, contractsEnd.AddDate(1, 0, 0), natalieId, retailId, 100, 100},
+
+	{"Feedback before", openpoints.FEEDBACK_CONTRACT, feedbackStart.AddDate(0, 0, -1), retailId, natalieId, 1, 0},
+	{"Feedback at start", openpoints.FEEDBACK_CONTRACT, feedbackStart, retailId, natalieId, 1, 0},
+	{"Feedback after start", openpoints.FEEDBACK_CONTRACT, feedbackStart.Add(time.Minute), retailId, natalieId, 1, 1000},
+	{"Feedback inside", openpoints.FEEDBACK_CONTRACT, time.Date(2017, 5, 6, 12, 0, 0, 0, time.UTC), retailId, natalieId, 5, 1000},
+	{"Feedback at end", openpoints.FEEDBACK_CONTRACT, contractsEnd, retailId, natalieId, 1, 0},
+	{"Feedback after", openpoints.FEEDBACK_CONTRACT, contractsEnd.AddDate(1, 0, 0), retailId, natalieId, 1, 0},
+}
+
+func TestContractWindows(t *testing.T) {
+
+	for _, c := range contractCases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			l := newLedger(t)
+			before := l.user(c.to).Balance
+
+			l.h.Clock = c.at
+			l.as(openpoints.ROLE_MEMBER, c.from).must("transferPoints", request{"from": c.from, "to": c.to,
+				"type": "purchase", "contractId": c.contractId, "amount": c.amount})
+			l.admin()
+
+			if got := l.user(c.to).Balance - before; got != c.points {
+				t.Errorf("%s received %v points, want %v", c.to, got, c.points)
+			}
+		})
+	}
+}
+
+// A contract added by a business and a transfer priced by discountContract
+type discountCase struct {
+	name         string
+	discountRate float64
+	amount       float64
+	points       float64
+}
+
+var discountCases = []discountCase{
+	{"no discount", 0, 100, 100},
+	{"tenth", 0.1, 100, 90},
+	{"half", 0.5, 300, 150},
+	{"quarter of a fraction", 0.25, 10, 7.5},
+	{"free", 1, 100, 0},
+}
+
+func TestDiscountContract(t *testing.T) {
+
+	for _, c := range discountCases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			l := newLedger(t)
+			l.must("addSmartContract", request{"id": "Promo1", "businessId": retailId, "title": c.name,
+				"discountRate": c.discountRate})
+
+			l.as(openpoints.ROLE_MEMBER, natalieId).must("transferPoints", request{"from": natalieId, "to": retailId,
+				"type": "purchase", "contractId": "Promo1", "amount": c.amount})
+			l.admin()
+
+			if got := 1000 - l.user(natalieId).Balance; got != c.points {
+				t.Errorf("Natalie paid %v points, want %v", got, c.points)
+			}
+		})
+	}
+}
+
+// The points a discount contract prices count against its budget, the transfer that would exceed it fails
+func TestDiscountContractBudget(t *testing.T) {
+
+	l := newLedger(t)
+	l.must("addSmartContract", request{"id": "Promo1", "businessId": retailId, "title": "Half off",
+		"discountRate": 0.5, "budget": 100})
+
+	l.as(openpoints.ROLE_MEMBER, natalieId)
+	l.must("transferPoints", request{"from": natalieId, "to": retailId, "type": "purchase", "contractId": "Promo1",
+		"amount": 120})
+	l.mustFail("transferPoints", request{"from": natalieId, "to": retailId, "type": "purchase", "contractId": "Promo1",
+		"amount": 120}, openpoints.ERR_BUDGET_EXCEEDED)
+	l.must("transferPoints", request{"from": natalieId, "to": retailId, "type": "purchase", "contractId": "Promo1",
+		"amount": 80})
+	l.admin()
+
+	if balance := l.user(natalieId).Balance; balance != 900 {
+		t.Errorf("Natalie has %v points, want 900", balance)
+	}
+}
+
+func TestDiscountContractUnknown(t *testing.T) {
+
+	l := newLedger(t)
+	l.as(openpoints.ROLE_MEMBER, natalieId).mustFail("transferPoints", request{"from": natalieId, "to": retailId,
+		"type": "purchase", "contractId": "Promo9", "amount": 100}, openpoints.ERR_NOT_FOUND)
+	l.admin()
+
+	if balance := l.user(natalieId).Balance; balance != 1000 {
+		t.Errorf("Natalie has %v points, want 1000", balance)
+	}
+}
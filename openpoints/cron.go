@@ -0,0 +1,146 @@
+package openpoints
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================================================================================
+// Cron recurrences
+//
+// A recurrence has the five cron fields minute, hour, day of month, month and day of week, each *, a number, a
+// range a-b, a list a,b,c or any of those with a step /n. Days of week run from 0 for Sunday to 6. As in cron, a
+// time matches either day field when both are restricted. The shortcuts @hourly, @daily, @weekly, @monthly and
+// @yearly stand for their usual expressions. Times are in UTC.
+// ============================================================================================================================
+
+var cronShortcuts = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+// Parsed recurrence, one set of allowed values per field
+type cronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+	domAny, dowAny                bool
+}
+
+// How far ahead next looks before giving up, so an impossible date like 30 February ends
+const cronHorizonYears = 5
+
+func parseCron(expr string) (*cronSchedule, error) {
+
+	if shortcut, ok := cronShortcuts[strings.TrimSpace(expr)]; ok {
+		expr = shortcut
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+
+	var schedule cronSchedule
+	var err error
+	bounds := []struct {
+		set      *map[int]bool
+		min, max int
+	}{{&schedule.minute, 0, 59}, {&schedule.hour, 0, 23}, {&schedule.dom, 1, 31}, {&schedule.month, 1, 12}, {&schedule.dow, 0, 6}}
+
+	for i, b := range bounds {
+		*b.set, err = parseCronField(fields[i], b.min, b.max)
+		if err != nil {
+			return nil, fmt.Errorf("field %d: %s", i+1, err)
+		}
+	}
+	schedule.domAny = fields[2] == "*"
+	schedule.dowAny = fields[4] == "*"
+
+	return &schedule, nil
+}
+
+func parseCronField(field string, min int, max int) (map[int]bool, error) {
+
+	set := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("bad step in %s", part)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			lo, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, fmt.Errorf("bad value %s", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				hi, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return nil, fmt.Errorf("bad range %s", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%s is outside %d-%d", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+
+	return set, nil
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+
+	dom := c.dom[t.Day()]
+	dow := c.dow[int(t.Weekday())]
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// First time matching the recurrence strictly after t, zero if there is none within the horizon
+func (c *cronSchedule) next(t time.Time) time.Time {
+
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(cronHorizonYears, 0, 0)
+
+	for t.Before(limit) {
+		if !c.month[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !c.hour[t.Hour()] {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if !c.minute[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
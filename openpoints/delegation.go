@@ -0,0 +1,492 @@
+package openpoints
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// ============================================================================================================================
+// Delegated business operators
+//
+// A business grants staff identities, such as cashiers, scoped permissions to act on its account without the
+// business role. A delegation names the business, the client identity of the delegate, its permissions and an
+// optional expiry, and can be revoked at any time:
+//
+//	redeem   accept points into the business account, up to RedeemLimit per transaction
+//	refund   issue refunds and reversals out of the business account, up to RefundLimit per transaction
+//
+// No permission moves points out of the business account any other way. A limit of 0 means no limit. A registered
+// function that declares a Delegate permission, such as reverseTransaction, is open to callers below its role that
+// hold an active delegation with that permission, and checks with checkBusiness that the delegation is one of the
+// business it acts on. postTransfer binds every caller below the business role that is a delegate of the sender or
+// receiver to its delegation, even an expired or revoked one, and records the caller identity on the transaction as
+// Delegate next to From and To. Only the business itself, or an admin, grants and revokes its delegations.
+//
+// Neither a business nor its delegates take points from a member on their own. At the point of sale the member
+// first calls authorizePayment for the business, naming the most points it may take before contract discounts and
+// until when. The business or a delegate with the redeem permission then names the authorization in transferPoints
+// or purchase, which uses it up, even when the transfer is held for review.
+// ============================================================================================================================
+
+// Delegation permissions
+const DELEGATE_REDEEM = "redeem"
+const DELEGATE_REFUND = "refund"
+
+// Every delegation permission
+var delegatePermissions = []string{DELEGATE_REDEEM, DELEGATE_REFUND}
+
+// Delegation statuses
+const DELEGATION_ACTIVE = "ACTIVE"
+const DELEGATION_REVOKED = "REVOKED"
+
+// Composite key object type of delegations, keyed by delegate and business
+const delegationObject = "delegation"
+
+// Payment authorization statuses
+const PAYMENT_AUTHORIZED = "AUTHORIZED"
+const PAYMENT_USED = "USED"
+
+// Composite key object type of payment authorizations, keyed by member and authorization
+const paymentAuthorizationObject = "paymentAuthorization"
+
+// Permissions a business grants a staff identity
+type Delegation struct {
+	BusinessId  string    `json:"BusinessId"`
+	Delegate    string    `json:"Delegate"`
+	Permissions []string  `json:"Permissions"`
+	RedeemLimit float64   `json:"RedeemLimit"`
+	RefundLimit float64   `json:"RefundLimit"`
+	Expires     time.Time `json:"Expires"`
+	Status      string    `json:"Status"`
+	GrantedBy   string    `json:"GrantedBy"`
+	Granted     time.Time `json:"Granted"`
+	RevokedBy   string    `json:"RevokedBy,omitempty"`
+	Revoked     time.Time `json:"Revoked"`
+}
+
+// Consent of a member to one payment to a business made by the business or its delegates
+type PaymentAuthorization struct {
+	AuthorizationId string    `json:"AuthorizationId"`
+	UserId          string    `json:"UserId"`
+	BusinessId      string    `json:"BusinessId"`
+	MaxAmount       float64   `json:"MaxAmount"`
+	Expires         time.Time `json:"Expires"`
+	Status          string    `json:"Status"`
+	Created         time.Time `json:"Created"`
+	UsedBy          string    `json:"UsedBy,omitempty"`
+	UsedTxId        string    `json:"UsedTxId,omitempty"`
+	Used            time.Time `json:"Used"`
+}
+
+// Request for grantDelegation, replacing any earlier delegation of the business to the same identity
+type grantDelegationRequest struct {
+	BusinessId  string    `json:"businessId" validate:"required"`
+	Delegate    string    `json:"delegate" validate:"required"`
+	Permissions []string  `json:"permissions" validate:"required"`
+	RedeemLimit float64   `json:"redeemLimit" validate:"min=0"`
+	RefundLimit float64   `json:"refundLimit" validate:"min=0"`
+	Expires     time.Time `json:"expires"`
+}
+
+// Request for revokeDelegation
+type revokeDelegationRequest struct {
+	BusinessId string `json:"businessId" validate:"required"`
+	Delegate   string `json:"delegate" validate:"required"`
+}
+
+// Request for getDelegations
+type delegationsRequest struct {
+	BusinessId string `json:"businessId" validate:"required"`
+}
+
+// Request for authorizePayment
+type authorizePaymentRequest struct {
+	AuthorizationId string    `json:"authorizationId" validate:"required"`
+	UserId          string    `json:"userId" validate:"required"`
+	BusinessId      string    `json:"businessId" validate:"required"`
+	MaxAmount       float64   `json:"maxAmount" validate:"required,min=0"`
+	Expires         time.Time `json:"expires" validate:"required"`
+}
+
+// Whether a delegation can be used at a point in time
+func (delegation Delegation) active(at time.Time) bool {
+	return delegation.Status == DELEGATION_ACTIVE && (delegation.Expires.IsZero() || at.Before(delegation.Expires))
+}
+
+// Delegation of a business to an identity, nil if there is none
+func loadDelegation(stub shim.ChaincodeStubInterface, businessId string, delegate string) (*Delegation, error) {
+
+	key, err := compositeKey(stub, delegationObject, delegate, businessId)
+	if err != nil {
+		return nil, err
+	}
+
+	var delegation Delegation
+	found, err := readState(stub, key, &delegation)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return &delegation, nil
+}
+
+func saveDelegation(ctx *TransactionContext, delegation Delegation) error {
+
+	key, err := compositeKey(ctx.GetStub(), delegationObject, delegation.Delegate, delegation.BusinessId)
+	if err != nil {
+		return err
+	}
+	err = writeState(ctx.GetStub(), key, delegation)
+	if err != nil {
+		return err
+	}
+	ctx.Event().delegationChanged(delegation)
+
+	return nil
+}
+
+// Whether the caller holds an active delegation with a permission from any business. This only lets the caller into
+// a function, which checks the delegation of the business it acts on with checkBusiness.
+func holdsDelegation(ctx *TransactionContext, permission string) (bool, error) {
+
+	id := callerId(ctx)
+	if id == "" {
+		return false, nil
+	}
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(delegationObject, []string{id})
+	if err != nil {
+		return false, newError(ERR_LEDGER, "failed to list delegations: %s", err)
+	}
+	defer iter.Close()
+
+	now, err := txTimestamp(ctx.GetStub())
+	if err != nil {
+		return false, err
+	}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return false, newError(ERR_LEDGER, "failed to list delegations: %s", err)
+		}
+
+		var delegation Delegation
+		err = json.Unmarshal(kv.Value, &delegation)
+		if err != nil {
+			return false, newError(ERR_CORRUPT_STATE, "failed to decode delegation %s: %s", kv.Key, err)
+		}
+		if delegation.active(now) && containsString(delegation.Permissions, permission) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// ============================================================================================================================
+// Hold a posting made by a delegate to the delegation of each account it acts for and record the delegate on it
+// ============================================================================================================================
+func checkDelegate(stub shim.ChaincodeStubInterface, ev *LedgerEvent, tx *Transaction) error {
+
+	if ev.Caller == "" || roleRank[ev.role] >= roleRank[ROLE_BUSINESS] {
+		return nil
+	}
+	refund := tx.Type == TX_TYPE_REFUND || tx.Type == TX_TYPE_REVERSAL
+
+	for _, businessId := range []string{tx.To, tx.From} {
+		if businessId == "" {
+			continue
+		}
+		delegation, err := loadDelegation(stub, businessId, ev.Caller)
+		if err != nil {
+			return err
+		}
+		if delegation == nil {
+			continue
+		}
+		if !delegation.active(ev.Timestamp) {
+			return newError(ERR_FORBIDDEN, "the delegation of %s to the caller is %s", businessId, delegationState(*delegation))
+		}
+
+		permission, limit := DELEGATE_REDEEM, delegation.RedeemLimit
+		if businessId == tx.From {
+			if !refund {
+				return newError(ERR_FORBIDDEN, "delegates of %s can not move points out of it", businessId)
+			}
+			permission, limit = DELEGATE_REFUND, delegation.RefundLimit
+		}
+		if !containsString(delegation.Permissions, permission) {
+			return newError(ERR_FORBIDDEN, "the delegation of %s to the caller does not allow %s", businessId, permission)
+		}
+		if limit > 0 && tx.Amount > limit {
+			return newError(ERR_FORBIDDEN, "the delegation of %s to the caller allows %s of at most %v points, %v required",
+				businessId, permission, limit, tx.Amount)
+		}
+		tx.Delegate = ev.Caller
+	}
+
+	// A caller let in by its delegation must act for one of the accounts
+	if ev.delegated && tx.Delegate == "" {
+		return newError(ERR_FORBIDDEN, "the caller is not a delegate of %s or %s", tx.From, tx.To)
+	}
+
+	return nil
+}
+
+// ============================================================================================================================
+// Check the caller acts for a business: it acts for the business account, or it holds an active delegation of that
+// business with the permission. postTransfer holds a delegate to the limit of its permission.
+// ============================================================================================================================
+func checkBusiness(ctx *TransactionContext, businessId string, permission string) error {
+
+	if checkAccount(ctx, businessId) == nil {
+		return nil
+	}
+
+	delegation, err := loadDelegation(ctx.GetStub(), businessId, callerId(ctx))
+	if err != nil {
+		return err
+	}
+	if delegation != nil && delegation.active(ctx.Event().Timestamp) && containsString(delegation.Permissions, permission) {
+		return nil
+	}
+
+	return newError(ERR_FORBIDDEN, "the caller does not act for %s", businessId)
+}
+
+// ============================================================================================================================
+// Check the caller may take amount points, before contract discounts, out of an account to pay a business: it acts
+// for the account, or it acts for the business paid with the redeem permission and uses up a payment authorization
+// the account gave the business
+// ============================================================================================================================
+func checkPayer(ctx *TransactionContext, payerId string, businessId string, authorizationId string, amount float64) error {
+
+	if checkAccount(ctx, payerId) == nil {
+		return nil
+	}
+	if authorizationId == "" {
+		return newError(ERR_FORBIDDEN, "the caller does not act for %s", payerId)
+	}
+	err := checkBusiness(ctx, businessId, DELEGATE_REDEEM)
+	if err != nil {
+		return err
+	}
+
+	stub := ctx.GetStub()
+	now := ctx.Event().Timestamp
+	key, err := compositeKey(stub, paymentAuthorizationObject, payerId, authorizationId)
+	if err != nil {
+		return err
+	}
+	var authorization PaymentAuthorization
+	found, err := readState(stub, key, &authorization)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return newError(ERR_NOT_FOUND, "%s gave no payment authorization %s", payerId, authorizationId)
+	}
+	if authorization.BusinessId != businessId {
+		return newError(ERR_FORBIDDEN, "payment authorization %s is for %s", authorizationId, authorization.BusinessId)
+	}
+	if authorization.Status != PAYMENT_AUTHORIZED {
+		return newError(ERR_INVALID_STATE, "payment authorization %s is %s", authorizationId, authorization.Status)
+	}
+	if !now.Before(authorization.Expires) {
+		return newError(ERR_INVALID_STATE, "payment authorization %s expired on %s", authorizationId, authorization.Expires.Format(time.RFC3339))
+	}
+	if amount > authorization.MaxAmount {
+		return newError(ERR_FORBIDDEN, "payment authorization %s allows at most %v points, %v required", authorizationId, authorization.MaxAmount, amount)
+	}
+
+	authorization.Status = PAYMENT_USED
+	authorization.UsedBy = callerId(ctx)
+	authorization.UsedTxId = stub.GetTxID()
+	authorization.Used = now
+	err = writeState(stub, key, authorization)
+	if err != nil {
+		return err
+	}
+	ctx.Event().paymentAuthorizationChanged(authorization)
+
+	return nil
+}
+
+// Why a delegation can not be used
+func delegationState(delegation Delegation) string {
+
+	if delegation.Status == DELEGATION_REVOKED {
+		return "revoked"
+	}
+	return "expired"
+}
+
+// ============================================================================================================================
+// Grant a staff identity scoped permissions on a business account
+// ============================================================================================================================
+func (t *SimpleChaincode) grantDelegation(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*grantDelegationRequest)
+	stub := ctx.GetStub()
+	now := ctx.Event().Timestamp
+
+	for _, permission := range req.Permissions {
+		if !containsString(delegatePermissions, permission) {
+			return nil, fieldError("permissions", "%s is not a delegation permission, expected one of %v", permission, delegatePermissions)
+		}
+	}
+	if !req.Expires.IsZero() && !req.Expires.After(now) {
+		return nil, fieldError("expires", "expires must be in the future")
+	}
+	err := checkAccount(ctx, req.BusinessId)
+	if err != nil {
+		return nil, err
+	}
+
+	var business User
+	found, err := readState(stub, req.BusinessId, &business)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, newError(ERR_NOT_FOUND, "business %s does not exist", req.BusinessId)
+	}
+
+	delegation := Delegation{BusinessId: req.BusinessId, Delegate: req.Delegate, Permissions: req.Permissions,
+		RedeemLimit: req.RedeemLimit, RefundLimit: req.RefundLimit, Expires: req.Expires, Status: DELEGATION_ACTIVE,
+		GrantedBy: callerId(ctx), Granted: now}
+	err = saveDelegation(ctx, delegation)
+	if err != nil {
+		return nil, err
+	}
+
+	asBytes, _ := json.Marshal(delegation)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Revoke the delegation of a business to a staff identity
+// ============================================================================================================================
+func (t *SimpleChaincode) revokeDelegation(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*revokeDelegationRequest)
+
+	err := checkAccount(ctx, req.BusinessId)
+	if err != nil {
+		return nil, err
+	}
+	delegation, err := loadDelegation(ctx.GetStub(), req.BusinessId, req.Delegate)
+	if err != nil {
+		return nil, err
+	}
+	if delegation == nil {
+		return nil, newError(ERR_NOT_FOUND, "%s has no delegation to %s", req.BusinessId, req.Delegate)
+	}
+	if delegation.Status == DELEGATION_REVOKED {
+		return nil, newError(ERR_INVALID_STATE, "the delegation of %s to %s is already revoked", req.BusinessId, req.Delegate)
+	}
+
+	delegation.Status = DELEGATION_REVOKED
+	delegation.RevokedBy = callerId(ctx)
+	delegation.Revoked = ctx.Event().Timestamp
+	err = saveDelegation(ctx, *delegation)
+	if err != nil {
+		return nil, err
+	}
+
+	asBytes, _ := json.Marshal(delegation)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// List the delegations of a business by delegate
+// ============================================================================================================================
+func (t *SimpleChaincode) getDelegations(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*delegationsRequest)
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(delegationObject, []string{})
+	if err != nil {
+		return nil, newError(ERR_LEDGER, "failed to list delegations: %s", err)
+	}
+	defer iter.Close()
+
+	delegations := []Delegation{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, newError(ERR_LEDGER, "failed to list delegations: %s", err)
+		}
+
+		var delegation Delegation
+		err = json.Unmarshal(kv.Value, &delegation)
+		if err != nil {
+			return nil, newError(ERR_CORRUPT_STATE, "failed to decode delegation %s: %s", kv.Key, err)
+		}
+		if delegation.BusinessId == req.BusinessId {
+			delegations = append(delegations, delegation)
+		}
+	}
+
+	sort.Slice(delegations, func(i, j int) bool { return delegations[i].Delegate < delegations[j].Delegate })
+
+	asBytes, _ := json.Marshal(delegations)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Let a business or its delegates take points from a member once, at the point of sale
+// ============================================================================================================================
+func (t *SimpleChaincode) authorizePayment(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*authorizePaymentRequest)
+	stub := ctx.GetStub()
+	now := ctx.Event().Timestamp
+
+	if !req.Expires.After(now) {
+		return nil, fieldError("expires", "expires must be in the future")
+	}
+	if req.UserId == req.BusinessId {
+		return nil, fieldError("businessId", "%s can not pay itself", req.UserId)
+	}
+	err := checkAccount(ctx, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	var business User
+	found, err := readState(stub, req.BusinessId, &business)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, newError(ERR_NOT_FOUND, "business %s does not exist", req.BusinessId)
+	}
+
+	key, err := compositeKey(stub, paymentAuthorizationObject, req.UserId, req.AuthorizationId)
+	if err != nil {
+		return nil, err
+	}
+	var existing PaymentAuthorization
+	found, err = readState(stub, key, &existing)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return nil, newError(ERR_ALREADY_EXISTS, "%s already gave payment authorization %s", req.UserId, req.AuthorizationId)
+	}
+
+	authorization := PaymentAuthorization{AuthorizationId: req.AuthorizationId, UserId: req.UserId,
+		BusinessId: req.BusinessId, MaxAmount: req.MaxAmount, Expires: req.Expires, Status: PAYMENT_AUTHORIZED, Created: now}
+	err = writeState(stub, key, authorization)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Event().paymentAuthorizationChanged(authorization)
+
+	asBytes, _ := json.Marshal(authorization)
+	return asBytes, nil
+}
@@ -0,0 +1,137 @@
+package openpoints
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// ============================================================================================================================
+// Structured errors
+//
+// Every function fails with a ChaincodeError. Its message is the JSON encoding of the error, so clients can decode
+// the string returned by the peer and switch on Code:
+//
+//	{"Code":"INSUFFICIENT_FUNDS","Message":"user B1928564 has 10 points, 800 required","Field":""}
+//
+// Codes are stable; new ones may be added but existing ones are never renamed.
+// ============================================================================================================================
+
+// The request is missing a field, has an unknown field or a field of the wrong type or range
+const ERR_VALIDATION_FAILED = "VALIDATION_FAILED"
+
+// A user, contract or other record named by the request does not exist
+const ERR_NOT_FOUND = "NOT_FOUND"
+
+// The sending account does not hold enough points
+const ERR_INSUFFICIENT_FUNDS = "INSUFFICIENT_FUNDS"
+
+// The transaction would take a contract past its point budget
+const ERR_BUDGET_EXCEEDED = "BUDGET_EXCEEDED"
+
+// A record with the same id already exists
+const ERR_ALREADY_EXISTS = "ALREADY_EXISTS"
+
+// The record is not in a state that allows the operation
+const ERR_INVALID_STATE = "INVALID_STATE"
+
+// The function name is not known to the chaincode
+const ERR_UNKNOWN_FUNCTION = "UNKNOWN_FUNCTION"
+
+// The caller role is not allowed to call the function
+const ERR_FORBIDDEN = "FORBIDDEN"
+
+// A risk rule blocked the transfer
+const ERR_RISK_BLOCKED = "RISK_BLOCKED"
+
+// An account of the transfer is frozen or on the sanctions list, or the caller identity is listed
+const ERR_COMPLIANCE_HOLD = "COMPLIANCE_HOLD"
+
+// The call matches an approval policy and must be submitted with proposeOperation
+const ERR_APPROVAL_REQUIRED = "APPROVAL_REQUIRED"
+
+// A transfer breaks the contribution rules of a pool or the spending limits of the member spending from it
+const ERR_POOL_LIMIT = "POOL_LIMIT"
+
+// A record on the ledger could not be decoded
+const ERR_CORRUPT_STATE = "CORRUPT_STATE"
+
+// Reading or writing the ledger failed
+const ERR_LEDGER = "LEDGER_ERROR"
+
+// Error returned by every chaincode function
+type ChaincodeError struct {
+	Code    string `json:"Code"`
+	Message string `json:"Message"`
+	Field   string `json:"Field"`
+}
+
+func (e *ChaincodeError) Error() string {
+	asBytes, err := json.Marshal(e)
+	if err != nil {
+		return e.Code + ": " + e.Message
+	}
+	return string(asBytes)
+}
+
+func newError(code string, format string, a ...interface{}) *ChaincodeError {
+	return &ChaincodeError{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// Validation failure on a single request field
+func fieldError(field string, format string, a ...interface{}) *ChaincodeError {
+	return &ChaincodeError{Code: ERR_VALIDATION_FAILED, Message: fmt.Sprintf(format, a...), Field: field}
+}
+
+// ============================================================================================================================
+// Read a JSON record from the ledger into v. Returns false if the key does not exist.
+// ============================================================================================================================
+func readState(stub shim.ChaincodeStubInterface, key string, v interface{}) (bool, error) {
+
+	asBytes, err := stub.GetState(key)
+	if err != nil {
+		return false, newError(ERR_LEDGER, "failed to read %s: %s", key, err)
+	}
+	if asBytes == nil {
+		return false, nil
+	}
+
+	err = json.Unmarshal(asBytes, v)
+	if err != nil {
+		return false, newError(ERR_CORRUPT_STATE, "failed to decode %s: %s", key, err)
+	}
+
+	return true, nil
+}
+
+// ============================================================================================================================
+// Build a composite key, failing with a structured error
+// ============================================================================================================================
+func compositeKey(stub shim.ChaincodeStubInterface, objectType string, attributes ...string) (string, error) {
+
+	key, err := stub.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return "", newError(ERR_VALIDATION_FAILED, "invalid %s key: %s", objectType, err)
+	}
+
+	return key, nil
+}
+
+// ============================================================================================================================
+// Write v to the ledger as JSON
+// ============================================================================================================================
+func writeState(stub shim.ChaincodeStubInterface, key string, v interface{}) error {
+
+	asBytes, err := json.Marshal(v)
+	if err != nil {
+		return newError(ERR_CORRUPT_STATE, "failed to encode %s: %s", key, err)
+	}
+
+	err = stub.PutState(key, asBytes)
+	if err != nil {
+		return newError(ERR_LEDGER, "failed to write %s: %s", key, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,143 @@
+package openpoints_test
+
+import (
+	"testing"
+
+	"github.com/gscdist/GscLabChaincode/openpoints"
+)
+
+// A call that fails with a ChaincodeError code. setup prepares the ledger as an admin and returns the request when it
+// names what setup created. The call is then made with role on behalf of account.
+type errorCase struct {
+	name     string
+	code     string
+	role     string
+	account  string
+	function string
+	request  interface{}
+	setup    func(l *ledger) request
+}
+
+var errorCases = []errorCase{
+	{name: "request is not an object", code: openpoints.ERR_VALIDATION_FAILED, role: member, account: natalieId,
+		function: "getUserAccount", request: []string{natalieId}},
+	{name: "unknown field", code: openpoints.ERR_VALIDATION_FAILED, role: member, account: natalieId,
+		function: "getUserAccount", request: request{"userId": natalieId, "user": natalieId}},
+	{name: "missing field", code: openpoints.ERR_VALIDATION_FAILED, role: member, account: natalieId,
+		function: "transferPoints", request: request{"from": natalieId, "type": "purchase", "amount": 100}},
+	{name: "negative amount", code: openpoints.ERR_VALIDATION_FAILED, role: member, account: natalieId,
+		function: "transferPoints", request: request{"from": natalieId, "to": retailId, "type": "purchase", "amount": -1}},
+	{name: "unknown function", code: openpoints.ERR_UNKNOWN_FUNCTION, role: admin, function: "mintPoints",
+		request: request{}},
+	{name: "role too low", code: openpoints.ERR_FORBIDDEN, role: member, account: natalieId,
+		function: "setRiskRule", request: request{"ruleId": "big", "kind": "maxAmount", "limit": 1, "severity": "block"}},
+	{name: "other account", code: openpoints.ERR_FORBIDDEN, role: member, account: natalieId,
+		function: "transferPoints", request: request{"from": anthonyId, "to": natalieId, "type": "gift", "amount": 10}},
+	{name: "unknown user", code: openpoints.ERR_NOT_FOUND, role: admin, function: "getUserAccount",
+		request: request{"userId": "U0000000"}},
+	{name: "unknown program", code: openpoints.ERR_NOT_FOUND, role: admin, function: "getProgram",
+		request: request{openpoints.PROGRAM_FIELD: "sea"}},
+	{name: "balance too low", code: openpoints.ERR_INSUFFICIENT_FUNDS, role: member, account: natalieId,
+		function: "transferPoints", request: request{"from": natalieId, "to": retailId, "type": "purchase", "amount": 5000}},
+	{name: "contract budget spent", code: openpoints.ERR_BUDGET_EXCEEDED, role: member, account: natalieId,
+		function: "transferPoints", request: request{"from": natalieId, "to": retailId, "type": "purchase",
+			"contractId": "Promo1", "amount": 300},
+		setup: func(l *ledger) request {
+			l.must("addSmartContract", request{"id": "Promo1", "businessId": retailId, "title": "Half off",
+				"discountRate": 0.5, "budget": 100})
+			return nil
+		}},
+	{name: "program exists", code: openpoints.ERR_ALREADY_EXISTS, role: admin, function: "createProgram",
+		request: request{"id": airId, "name": "Air Miles", "originatorId": "AIR1", "currency": "Miles",
+			"tiers": []string{"Blue"}},
+		setup: func(l *ledger) request { airProgram(l); return nil }},
+	{name: "pool exists", code: openpoints.ERR_ALREADY_EXISTS, role: member, account: natalieId, function: "createPool",
+		request: request{"poolId": "F1", "name": "Family", "ownerId": natalieId},
+		setup:   func(l *ledger) request { pool(l); return nil }},
+	{name: "order cancelled twice", code: openpoints.ERR_INVALID_STATE, role: business, account: retailId,
+		function: "cancelOrder",
+		setup: func(l *ledger) request {
+			orderId := catalogOrder(l)
+			l.must("cancelOrder", request{"orderId": orderId})
+			return request{"orderId": orderId}
+		}},
+	{name: "reversed twice", code: openpoints.ERR_INVALID_STATE, role: business, account: retailId,
+		function: "reverseTransaction", request: request{"refNumber": firstRefNumber, "reason": "returned"},
+		setup: func(l *ledger) request {
+			transfer(l, natalieId, retailId, 100)
+			l.must("reverseTransaction", request{"refNumber": firstRefNumber, "reason": "returned"})
+			return nil
+		}},
+	{name: "risk rule blocks", code: openpoints.ERR_RISK_BLOCKED, role: member, account: natalieId,
+		function: "transferPoints", request: request{"from": natalieId, "to": retailId, "type": "purchase", "amount": 100},
+		setup: func(l *ledger) request {
+			l.must("setRiskRule", request{"ruleId": "big", "kind": "maxAmount", "limit": 50, "severity": "block",
+				"active": true})
+			return nil
+		}},
+	{name: "account frozen", code: openpoints.ERR_COMPLIANCE_HOLD, role: member, account: natalieId,
+		function: "transferPoints", request: request{"from": natalieId, "to": retailId, "type": "purchase", "amount": 100},
+		setup: func(l *ledger) request {
+			l.must("freezeAccount", request{"userId": natalieId, "reasonCode": "AML-01"})
+			return nil
+		}},
+	{name: "receiver sanctioned", code: openpoints.ERR_COMPLIANCE_HOLD, role: member, account: natalieId,
+		function: "transferPoints", request: request{"from": natalieId, "to": anthonyId, "type": "gift", "amount": 100},
+		setup: func(l *ledger) request {
+			l.must("listIdentity", request{"identity": anthonyId, "reasonCode": "OFAC"})
+			return nil
+		}},
+	{name: "approval policy", code: openpoints.ERR_APPROVAL_REQUIRED, role: admin, function: "transferPoints",
+		request: request{"from": bankId, "to": natalieId, "type": "grant", "amount": 5000},
+		setup: func(l *ledger) request {
+			l.must("setApprovalPolicy", request{"policyId": "treasury", "function": "transferPoints", "account": bankId,
+				"minAmount": 1000, "approvers": []string{"t1", "t2"}, "threshold": 1, "ttlHours": 24, "active": true})
+			return nil
+		}},
+	{name: "pool contribution too small", code: openpoints.ERR_POOL_LIMIT, role: member, account: natalieId,
+		function: "transferPoints", request: request{"from": natalieId, "to": "F1", "type": "gift", "amount": 10},
+		setup: func(l *ledger) request {
+			l.must("setPoolRules", request{"poolId": pool(l), "minContribution": 50})
+			return nil
+		}},
+}
+
+func runErrorCases(t *testing.T, cases []errorCase) {
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			l := newLedger(t)
+			req := c.request
+			if c.setup != nil {
+				if setupReq := c.setup(l); setupReq != nil {
+					req = setupReq
+				}
+			}
+
+			l.as(c.role, c.account).mustFail(c.function, req, c.code)
+		})
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	runErrorCases(t, errorCases)
+}
+
+// Every code a client can get from a call has a case, the corrupt state and ledger failures aside
+func TestEveryErrorCodeHasACase(t *testing.T) {
+
+	var api openpoints.APIDescription
+	l := newLedger(t)
+	l.decode(l.must("describeFunctions", nil), &api)
+
+	covered := map[string]bool{openpoints.ERR_CORRUPT_STATE: true, openpoints.ERR_LEDGER: true}
+	for _, c := range errorCases {
+		covered[c.code] = true
+	}
+	for _, code := range api.ErrorCodes {
+		if !covered[code] {
+			t.Errorf("%s has no case", code)
+		}
+	}
+}
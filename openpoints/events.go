@@ -0,0 +1,408 @@
+package openpoints
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// ============================================================================================================================
+// Chaincode events
+//
+// Every successful invoke emits exactly one chaincode event named EVENT_NAME. Its payload is a LedgerEvent that
+// summarizes everything the invoke changed, in the order it happened, so that listeners can build projections of
+// the ledger without polling getTxs.
+//
+//	{
+//	  "SchemaVersion": 1,
+//	  "Function": "transferPoints",
+//	  "ProgramId": "openpoints",
+//	  "TxId": "9f2c...",
+//	  "Timestamp": "2017-05-06T10:15:00Z",
+//	  "Effects": [
+//	    {"Type": "balanceChanged", "UserId": "U2974034", "Delta": 800, "User": {...User record after the change...}},
+//	    {"Type": "balanceChanged", "UserId": "T5940872", "Delta": -800, "User": {...}},
+//	    {"Type": "transfer", "Transaction": {...Transaction record...}}
+//	  ]
+//	}
+//
+// Effect types and the fields they carry:
+//
+//	transfer          Transaction                    points moved between two members, burned when ToUserid is empty
+//	                                                 or minted when FromUserid is empty
+//	balanceChanged    UserId, Delta, User            a member balance changed, User is the record after the change
+//	userCreated       UserId, User                   a member record was created
+//	userUpdated       UserId, User                   a member record changed other than its balance or tier
+//	tierChanged       UserId, PreviousTier, User     the member Status (tier) changed
+//	reversal          Transaction, ReversedRef       a previous transaction was reversed
+//	contractAdded     ContractId, Contract           a smart contract was created
+//	contractUpdated   ContractId, Contract           an existing smart contract was replaced or its budget was used
+//	contractRemoved   ContractId                     a smart contract was deleted
+//	referenceNumber   RefNumber                      the transaction reference number was changed
+//	settlementChanged UserId, Settlement             a settlement batch was created, approved or paid
+//	settlementRule    ContractId, SettlementRule     the settlement rule of a contract was set
+//	programChanged    Program, User                  a program was created, with its originator, or updated
+//	oracleChanged     Oracle                         an oracle was registered, replaced or disabled
+//	exchangePair      ExchangePair                   the terms or the rate of a currency pair changed
+//	catalogItem       CatalogItem                    a catalog item was set or its stock changed
+//	orderChanged      UserId, Order                  an order was placed, fulfilled or cancelled
+//	earnRule          UserId, EarnRule               the earn rates of a business changed, UserId is the business
+//	voucherChanged    UserId, Voucher                a voucher was issued or redeemed, UserId is the business
+//	referralRule      UserId, ReferralRule           the referral rule was set, UserId is the funding business
+//	referralCode      UserId, ReferralCode           a referral code was created or counted a referral
+//	referralChanged   UserId, Referral               a referral was recorded, rewarded or rejected, UserId is the referee
+//	riskRule          RiskRule                       a risk rule was created or replaced
+//	riskCase          UserId, RiskCase               a transfer was held or flagged or its case reviewed, UserId is the sender
+//	compliance        UserId, ComplianceAction       an account was frozen or unfrozen or an identity listed or delisted
+//	approvalPolicy    Policy                         an approval policy was created or replaced
+//	operation         Operation                      an operation was proposed, voted on, executed, rejected or expired
+//	scheduleChanged   UserId, Schedule               a schedule was created, run or cancelled, UserId is its sender
+//	pendingEarning    UserId, Earning                points earned on a purchase were held, matured or cancelled
+//	poolChanged       UserId, Pool                   a pool was created, its rules or members changed or it was used
+//	spendOrder        SpendOrder                     the order members spend their wallets in was set
+//	delegation        Delegation                     a business granted or revoked a delegation to a staff identity
+//	authorization     UserId, Authorization          a member authorized a payment to a business or it was used
+//
+// Points do not expire yet, no function posts an expire transaction, so there is no effect for expiries. Expiration
+// will add one when it is built.
+//
+// The event names the program of the call and the client identity of its caller in Caller. Effects on another
+// program, the receiving leg of exchangePoints, also carry its ProgramId.
+//
+// Listeners must ignore effect types and fields they do not know. Fields are only ever added within a schema
+// version; renaming or removing one bumps EVENT_SCHEMA_VERSION.
+// ============================================================================================================================
+
+// Name of the chaincode event emitted by every invoke
+const EVENT_NAME = "OpenPointsEvent"
+
+// Version of the LedgerEvent payload schema
+const EVENT_SCHEMA_VERSION = 1
+
+// Effect types carried in LedgerEvent.Effects
+const EFFECT_TRANSFER = "transfer"
+const EFFECT_BALANCE_CHANGED = "balanceChanged"
+const EFFECT_USER_CREATED = "userCreated"
+const EFFECT_USER_UPDATED = "userUpdated"
+const EFFECT_TIER_CHANGED = "tierChanged"
+const EFFECT_REVERSAL = "reversal"
+const EFFECT_CONTRACT_ADDED = "contractAdded"
+const EFFECT_CONTRACT_UPDATED = "contractUpdated"
+const EFFECT_CONTRACT_REMOVED = "contractRemoved"
+const EFFECT_REFERENCE_NUMBER = "referenceNumber"
+const EFFECT_SETTLEMENT_CHANGED = "settlementChanged"
+const EFFECT_SETTLEMENT_RULE = "settlementRule"
+const EFFECT_PROGRAM_CHANGED = "programChanged"
+const EFFECT_ORACLE_CHANGED = "oracleChanged"
+const EFFECT_EXCHANGE_PAIR = "exchangePair"
+const EFFECT_CATALOG_ITEM = "catalogItem"
+const EFFECT_ORDER_CHANGED = "orderChanged"
+const EFFECT_EARN_RULE = "earnRule"
+const EFFECT_VOUCHER_CHANGED = "voucherChanged"
+const EFFECT_REFERRAL_RULE = "referralRule"
+const EFFECT_REFERRAL_CODE = "referralCode"
+const EFFECT_REFERRAL_CHANGED = "referralChanged"
+const EFFECT_RISK_RULE = "riskRule"
+const EFFECT_RISK_CASE = "riskCase"
+const EFFECT_COMPLIANCE = "compliance"
+const EFFECT_APPROVAL_POLICY = "approvalPolicy"
+const EFFECT_OPERATION = "operation"
+const EFFECT_SCHEDULE_CHANGED = "scheduleChanged"
+const EFFECT_PENDING_EARNING = "pendingEarning"
+const EFFECT_POOL_CHANGED = "poolChanged"
+const EFFECT_SPEND_ORDER = "spendOrder"
+const EFFECT_DELEGATION = "delegation"
+const EFFECT_AUTHORIZATION = "authorization"
+
+// Payload of the chaincode event emitted once per invoke
+type LedgerEvent struct {
+	SchemaVersion int           `json:"SchemaVersion"`
+	Function      string        `json:"Function"`
+	ProgramId     string        `json:"ProgramId"`
+	TxId          string        `json:"TxId"`
+	Timestamp     time.Time     `json:"Timestamp"`
+	Caller        string        `json:"Caller,omitempty"`
+	Effects       []EventEffect `json:"Effects"`
+
+	// Program the effects being added belong to, when it is not the program of the call
+	program string
+
+	// Role of the caller, and whether only a delegation let it call the function
+	role      string
+	delegated bool
+
+	// Whether the call runs an approved operation, whose transfers need no further approvals
+	approved bool
+}
+
+// A single state change made by an invoke
+type EventEffect struct {
+	Type         string       `json:"Type"`
+	UserId       string       `json:"UserId,omitempty"`
+	ContractId   string       `json:"ContractId,omitempty"`
+	Delta        float64      `json:"Delta,omitempty"`
+	PreviousTier string       `json:"PreviousTier,omitempty"`
+	ReversedRef  string       `json:"ReversedRef,omitempty"`
+	RefNumber    int          `json:"RefNumber,omitempty"`
+	User         *User        `json:"User,omitempty"`
+	Contract     *Contract    `json:"Contract,omitempty"`
+	Transaction  *Transaction `json:"Transaction,omitempty"`
+
+	Settlement     *SettlementBatch `json:"Settlement,omitempty"`
+	SettlementRule *SettlementRule  `json:"SettlementRule,omitempty"`
+
+	ProgramId    string            `json:"ProgramId,omitempty"`
+	Program      *Program          `json:"Program,omitempty"`
+	Oracle       *Oracle           `json:"Oracle,omitempty"`
+	ExchangePair *ExchangePair     `json:"ExchangePair,omitempty"`
+	CatalogItem  *CatalogItem      `json:"CatalogItem,omitempty"`
+	Order        *Order            `json:"Order,omitempty"`
+	EarnRule     *EarnRule         `json:"EarnRule,omitempty"`
+	Voucher      *Voucher          `json:"Voucher,omitempty"`
+	ReferralRule *ReferralRule     `json:"ReferralRule,omitempty"`
+	ReferralCode *ReferralCode     `json:"ReferralCode,omitempty"`
+	Referral     *Referral         `json:"Referral,omitempty"`
+	RiskRule     *RiskRule         `json:"RiskRule,omitempty"`
+	RiskCase     *RiskCase         `json:"RiskCase,omitempty"`
+	Compliance   *ComplianceAction `json:"Compliance,omitempty"`
+	Policy       *ApprovalPolicy   `json:"Policy,omitempty"`
+	Operation    *Operation        `json:"Operation,omitempty"`
+	Schedule     *Schedule         `json:"Schedule,omitempty"`
+	Earning      *PendingEarning   `json:"Earning,omitempty"`
+	Pool         *Pool             `json:"Pool,omitempty"`
+	SpendOrder   []string          `json:"SpendOrder,omitempty"`
+	Delegation   *Delegation       `json:"Delegation,omitempty"`
+
+	Authorization *PaymentAuthorization `json:"Authorization,omitempty"`
+}
+
+// ============================================================================================================================
+// Start collecting the effects of an invoke
+// ============================================================================================================================
+func newLedgerEvent(stub shim.ChaincodeStubInterface, function string) (*LedgerEvent, error) {
+
+	timestamp, err := txTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var ev LedgerEvent
+	ev.SchemaVersion = EVENT_SCHEMA_VERSION
+	ev.Function = function
+	ev.TxId = stub.GetTxID()
+	ev.Timestamp = timestamp
+	ev.Effects = []EventEffect{}
+
+	return &ev, nil
+}
+
+// ============================================================================================================================
+// Timestamp of the current transaction proposal. Every endorser must compute the same writes, so there is no fallback
+// to the local clock when the peer does not supply one.
+// ============================================================================================================================
+func txTimestamp(stub shim.ChaincodeStubInterface) (time.Time, error) {
+
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, newError(ERR_LEDGER, "failed to read the transaction timestamp: %s", err)
+	}
+	if ts == nil {
+		return time.Time{}, newError(ERR_LEDGER, "the transaction has no timestamp")
+	}
+
+	return time.Unix(ts.GetSeconds(), int64(ts.GetNanos())).UTC(), nil
+}
+
+func (ev *LedgerEvent) add(effect EventEffect) {
+	if ev.program != "" && ev.program != ev.ProgramId {
+		effect.ProgramId = ev.program
+	}
+	ev.Effects = append(ev.Effects, effect)
+}
+
+// Record a completed points transfer
+func (ev *LedgerEvent) transfer(tx Transaction) {
+	ev.add(EventEffect{Type: EFFECT_TRANSFER, Transaction: &tx})
+}
+
+// Record a member balance change, user is the record after the change
+func (ev *LedgerEvent) balanceChanged(user User, delta float64) {
+	ev.add(EventEffect{Type: EFFECT_BALANCE_CHANGED, UserId: user.UserId, Delta: delta, User: &user})
+}
+
+// Record a member record being written. before is nil when the member did not exist yet.
+func (ev *LedgerEvent) userWritten(before *User, after User) {
+
+	if before == nil {
+		ev.add(EventEffect{Type: EFFECT_USER_CREATED, UserId: after.UserId, User: &after})
+		return
+	}
+
+	if before.Status != after.Status {
+		ev.add(EventEffect{Type: EFFECT_TIER_CHANGED, UserId: after.UserId, PreviousTier: before.Status, User: &after})
+	}
+
+	if before.Name != after.Name || before.Expiration != after.Expiration || before.Join != after.Join {
+		ev.add(EventEffect{Type: EFFECT_USER_UPDATED, UserId: after.UserId, User: &after})
+	}
+}
+
+// Record a reversal, tx is the compensating transaction
+func (ev *LedgerEvent) reversal(tx Transaction, reversedRef string) {
+	ev.add(EventEffect{Type: EFFECT_REVERSAL, ReversedRef: reversedRef, Transaction: &tx})
+}
+
+// Record a smart contract being written
+func (ev *LedgerEvent) contractWritten(contract Contract, existed bool) {
+
+	effectType := EFFECT_CONTRACT_ADDED
+	if existed {
+		effectType = EFFECT_CONTRACT_UPDATED
+	}
+
+	ev.add(EventEffect{Type: effectType, ContractId: contract.Id, Contract: &contract})
+}
+
+// Record a smart contract being deleted
+func (ev *LedgerEvent) contractRemoved(contractId string) {
+	ev.add(EventEffect{Type: EFFECT_CONTRACT_REMOVED, ContractId: contractId})
+}
+
+// Record the reference number being changed
+func (ev *LedgerEvent) referenceNumber(refNumber int) {
+	ev.add(EventEffect{Type: EFFECT_REFERENCE_NUMBER, RefNumber: refNumber})
+}
+
+// Record a settlement batch being written, UserId is the business
+func (ev *LedgerEvent) settlementChanged(batch SettlementBatch) {
+	ev.add(EventEffect{Type: EFFECT_SETTLEMENT_CHANGED, UserId: batch.BusinessId, Settlement: &batch})
+}
+
+// Record the settlement rule of a contract being set
+func (ev *LedgerEvent) settlementRuleSet(rule SettlementRule) {
+	ev.add(EventEffect{Type: EFFECT_SETTLEMENT_RULE, ContractId: rule.ContractId, SettlementRule: &rule})
+}
+
+// Record a program being created or updated, originator is set when it was created
+func (ev *LedgerEvent) programChanged(program Program, originator *User) {
+	ev.add(EventEffect{Type: EFFECT_PROGRAM_CHANGED, Program: &program, User: originator})
+}
+
+// Record an oracle being set
+func (ev *LedgerEvent) oracleSet(oracle Oracle) {
+	ev.add(EventEffect{Type: EFFECT_ORACLE_CHANGED, Oracle: &oracle})
+}
+
+// Record the terms or the rate of a currency pair changing
+func (ev *LedgerEvent) exchangePairChanged(pair ExchangePair) {
+	ev.add(EventEffect{Type: EFFECT_EXCHANGE_PAIR, ExchangePair: &pair})
+}
+
+// Record a catalog item being set or its stock changing
+func (ev *LedgerEvent) catalogItemChanged(item CatalogItem) {
+	ev.add(EventEffect{Type: EFFECT_CATALOG_ITEM, CatalogItem: &item})
+}
+
+// Record an order being written
+func (ev *LedgerEvent) orderChanged(order Order) {
+	ev.add(EventEffect{Type: EFFECT_ORDER_CHANGED, UserId: order.UserId, Order: &order})
+}
+
+// Record the earn rates of a business changing
+func (ev *LedgerEvent) earnRuleChanged(rule EarnRule) {
+	ev.add(EventEffect{Type: EFFECT_EARN_RULE, UserId: rule.BusinessId, EarnRule: &rule})
+}
+
+// Record a voucher being issued or redeemed
+func (ev *LedgerEvent) voucherChanged(voucher Voucher) {
+	ev.add(EventEffect{Type: EFFECT_VOUCHER_CHANGED, UserId: voucher.BusinessId, Voucher: &voucher})
+}
+
+// Record the referral rule being set
+func (ev *LedgerEvent) referralRuleSet(rule ReferralRule) {
+	ev.add(EventEffect{Type: EFFECT_REFERRAL_RULE, UserId: rule.BusinessId, ReferralRule: &rule})
+}
+
+// Record a referral code being created or counting a referral
+func (ev *LedgerEvent) referralCodeChanged(code ReferralCode) {
+	ev.add(EventEffect{Type: EFFECT_REFERRAL_CODE, UserId: code.UserId, ReferralCode: &code})
+}
+
+// Record a referral being recorded, rewarded or rejected
+func (ev *LedgerEvent) referralChanged(referral Referral) {
+	ev.add(EventEffect{Type: EFFECT_REFERRAL_CHANGED, UserId: referral.RefereeId, Referral: &referral})
+}
+
+// Record a risk rule being set
+func (ev *LedgerEvent) riskRuleSet(rule RiskRule) {
+	ev.add(EventEffect{Type: EFFECT_RISK_RULE, RiskRule: &rule})
+}
+
+// Record a transfer being held or flagged or its risk case reviewed
+func (ev *LedgerEvent) riskCaseChanged(riskCase RiskCase) {
+	ev.add(EventEffect{Type: EFFECT_RISK_CASE, UserId: riskCase.UserId, RiskCase: &riskCase})
+}
+
+// Record a compliance action, UserId is its subject
+func (ev *LedgerEvent) complianceAction(action ComplianceAction) {
+	ev.add(EventEffect{Type: EFFECT_COMPLIANCE, UserId: action.Subject, Compliance: &action})
+}
+
+// Record an approval policy being set
+func (ev *LedgerEvent) approvalPolicySet(policy ApprovalPolicy) {
+	ev.add(EventEffect{Type: EFFECT_APPROVAL_POLICY, Policy: &policy})
+}
+
+// Record an operation being proposed, voted on or closed
+func (ev *LedgerEvent) operationChanged(operation Operation) {
+	ev.add(EventEffect{Type: EFFECT_OPERATION, Operation: &operation})
+}
+
+// Record a schedule being created, run or cancelled
+func (ev *LedgerEvent) scheduleChanged(schedule Schedule) {
+	ev.add(EventEffect{Type: EFFECT_SCHEDULE_CHANGED, UserId: schedule.From, Schedule: &schedule})
+}
+
+// Record pending points being held, matured or cancelled
+func (ev *LedgerEvent) pendingEarning(earning PendingEarning) {
+	ev.add(EventEffect{Type: EFFECT_PENDING_EARNING, UserId: earning.UserId, Earning: &earning})
+}
+
+// Record a pool being written, UserId is the pool account
+func (ev *LedgerEvent) poolChanged(pool Pool) {
+	ev.add(EventEffect{Type: EFFECT_POOL_CHANGED, UserId: pool.PoolId, Pool: &pool})
+}
+
+// Record the spend order of the program being set
+func (ev *LedgerEvent) spendOrderChanged(order []string) {
+	ev.add(EventEffect{Type: EFFECT_SPEND_ORDER, SpendOrder: order})
+}
+
+// Record a delegation being granted or revoked
+func (ev *LedgerEvent) delegationChanged(delegation Delegation) {
+	ev.add(EventEffect{Type: EFFECT_DELEGATION, UserId: delegation.BusinessId, Delegation: &delegation})
+}
+
+// Record a payment authorization being given or used
+func (ev *LedgerEvent) paymentAuthorizationChanged(authorization PaymentAuthorization) {
+	ev.add(EventEffect{Type: EFFECT_AUTHORIZATION, UserId: authorization.UserId, Authorization: &authorization})
+}
+
+// ============================================================================================================================
+// Emit the collected effects as the single chaincode event of this invoke
+// ============================================================================================================================
+func (ev *LedgerEvent) emit(stub shim.ChaincodeStubInterface) error {
+
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	err = stub.SetEvent(EVENT_NAME, payload)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,608 @@
+package openpoints
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// ============================================================================================================================
+// Points exchange between programs
+//
+// Rates are kept in one table of currency pairs, shared by all programs, and price both ways a member of the current
+// program can move points to a member of another program:
+//
+//	exchangePoints   the originators clear the exchange: the member pays the originator of the current program and
+//	                 the originator of the other program pays the converted amount, so the supply of each program
+//	                 is unchanged
+//	convertPoints    the points are burned in the current program and the converted amount is minted in the other
+//
+// Both post a linked pair of transactions that name each other in LinkedRef. Admins of the default program
+// configure a pair with its spread, flat fee and daily limit, and register the oracles allowed to quote it. An
+// oracle signs each rate with its ECDSA key over
+//
+//	<fromCurrency>|<toCurrency>|<rate>|<asOf RFC 3339>|<validUntil RFC 3339>
+//
+// with the rate formatted by strconv.FormatFloat(rate, 'f', -1, 64), and anyone may submit the signed rate. A rate
+// replaces the current one only if it is newer, and the pair is refused once it is past validUntil. Admins may also
+// fix the rate of a pair with setExchangePair, which holds until an oracle submits a newer one.
+//
+// Moving amount points costs the member amount plus the fee, the fee goes to the originator of the source program.
+// The member receives amount * rate * (1 - spread) in the destination program. A member may move at most
+// DailyLimit points per pair and UTC day, a DailyLimit of 0 means no limit.
+// ============================================================================================================================
+
+// Transaction types of an exchange, a conversion and the fee of either
+const TX_TYPE_EXCHANGE = "exchange"
+const TX_TYPE_CONVERT = "convert"
+const TX_TYPE_CONVERSION_FEE = "conversionFee"
+
+// Composite key object types, oracles and pairs are shared by all programs, usage is kept per program
+const oracleObject = "oracle"
+const exchangePairObject = "exchangePair"
+const conversionUsageObject = "conversionUsage"
+
+// An identity allowed to quote exchange rates
+type Oracle struct {
+	OracleId  string `json:"OracleId"`
+	PublicKey string `json:"PublicKey"`
+	Enabled   bool   `json:"Enabled"`
+}
+
+// Terms and current rate of one currency pair. OracleId is empty when an admin fixed the rate, which then has no
+// ValidUntil.
+type ExchangePair struct {
+	FromCurrency string    `json:"FromCurrency"`
+	ToCurrency   string    `json:"ToCurrency"`
+	Spread       float64   `json:"Spread"`
+	Fee          float64   `json:"Fee"`
+	DailyLimit   float64   `json:"DailyLimit"`
+	Oracles      []string  `json:"Oracles"`
+	Enabled      bool      `json:"Enabled"`
+	Rate         float64   `json:"Rate"`
+	AsOf         time.Time `json:"AsOf"`
+	ValidUntil   time.Time `json:"ValidUntil"`
+	OracleId     string    `json:"OracleId"`
+	Signature    string    `json:"Signature"`
+}
+
+// Price of a conversion
+type ConversionQuote struct {
+	FromProgramId  string    `json:"FromProgramId"`
+	ToProgramId    string    `json:"ToProgramId"`
+	FromCurrency   string    `json:"FromCurrency"`
+	ToCurrency     string    `json:"ToCurrency"`
+	Amount         float64   `json:"Amount"`
+	Fee            float64   `json:"Fee"`
+	Rate           float64   `json:"Rate"`
+	Spread         float64   `json:"Spread"`
+	Converted      float64   `json:"Converted"`
+	ValidUntil     time.Time `json:"ValidUntil"`
+	LimitRemaining float64   `json:"LimitRemaining"`
+}
+
+// Request for setOracle
+type oracleRequest struct {
+	OracleId  string `json:"oracleId" validate:"required"`
+	PublicKey string `json:"publicKey" validate:"required"`
+	Enabled   bool   `json:"enabled"`
+}
+
+// Request for setExchangePair, a rate above 0 fixes the rate of the pair
+type exchangePairRequest struct {
+	FromCurrency string   `json:"fromCurrency" validate:"required"`
+	ToCurrency   string   `json:"toCurrency" validate:"required"`
+	Spread       float64  `json:"spread" validate:"min=0,max=1"`
+	Fee          float64  `json:"fee" validate:"min=0"`
+	DailyLimit   float64  `json:"dailyLimit" validate:"min=0"`
+	Oracles      []string `json:"oracles"`
+	Rate         float64  `json:"rate" validate:"min=0"`
+	Enabled      bool     `json:"enabled"`
+}
+
+// Request for submitExchangeRate
+type submitRateRequest struct {
+	OracleId     string    `json:"oracleId" validate:"required"`
+	FromCurrency string    `json:"fromCurrency" validate:"required"`
+	ToCurrency   string    `json:"toCurrency" validate:"required"`
+	Rate         float64   `json:"rate" validate:"required,min=0"`
+	AsOf         time.Time `json:"asOf" validate:"required"`
+	ValidUntil   time.Time `json:"validUntil" validate:"required"`
+	Signature    string    `json:"signature" validate:"required"`
+}
+
+// Request for quoteConversion
+type quoteConversionRequest struct {
+	UserId      string  `json:"userId" validate:"required"`
+	ToProgramId string  `json:"toProgramId" validate:"required"`
+	Amount      float64 `json:"amount" validate:"required,min=0"`
+}
+
+// Request for exchangePoints
+type exchangePointsRequest struct {
+	UserId      string  `json:"userId" validate:"required"`
+	ToProgramId string  `json:"toProgramId" validate:"required"`
+	ToUserId    string  `json:"toUserId" validate:"required"`
+	Amount      float64 `json:"amount" validate:"required,min=0"`
+}
+
+// Request for convertPoints
+type convertPointsRequest struct {
+	UserId      string  `json:"userId" validate:"required"`
+	ToProgramId string  `json:"toProgramId" validate:"required"`
+	ToUserId    string  `json:"toUserId" validate:"required"`
+	Amount      float64 `json:"amount" validate:"required,min=0"`
+}
+
+// Message an oracle signs for a rate
+func rateMessage(fromCurrency string, toCurrency string, rate float64, asOf time.Time, validUntil time.Time) string {
+	return fromCurrency + "|" + toCurrency + "|" + strconv.FormatFloat(rate, 'f', -1, 64) + "|" +
+		asOf.UTC().Format(time.RFC3339) + "|" + validUntil.UTC().Format(time.RFC3339)
+}
+
+// Decode a PEM encoded ECDSA public key
+func parseOracleKey(publicKey string) (*ecdsa.PublicKey, error) {
+
+	block, _ := pem.Decode([]byte(publicKey))
+	if block == nil {
+		return nil, fmt.Errorf("not PEM encoded")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("not an ECDSA key")
+	}
+
+	return ecKey, nil
+}
+
+// ============================================================================================================================
+// Register, replace or disable an oracle
+// ============================================================================================================================
+func (t *SimpleChaincode) setOracle(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*oracleRequest)
+	root := ctx.rootStub()
+
+	err := requireDefaultProgram(ctx, "setOracle")
+	if err != nil {
+		return nil, err
+	}
+	_, err = parseOracleKey(req.PublicKey)
+	if err != nil {
+		return nil, fieldError("publicKey", "publicKey is not a PEM encoded ECDSA public key: %s", err)
+	}
+
+	oracle := Oracle{OracleId: req.OracleId, PublicKey: req.PublicKey, Enabled: req.Enabled}
+
+	key, err := compositeKey(root, oracleObject, oracle.OracleId)
+	if err != nil {
+		return nil, err
+	}
+	err = writeState(root, key, oracle)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Event().oracleSet(oracle)
+
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Configure the terms of a currency pair, keeping its current rate unless the request fixes one
+// ============================================================================================================================
+func (t *SimpleChaincode) setExchangePair(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*exchangePairRequest)
+	root := ctx.rootStub()
+
+	err := requireDefaultProgram(ctx, "setExchangePair")
+	if err != nil {
+		return nil, err
+	}
+	if req.FromCurrency == req.ToCurrency {
+		return nil, fieldError("toCurrency", "cannot convert %s to itself", req.FromCurrency)
+	}
+
+	key, err := compositeKey(root, exchangePairObject, req.FromCurrency, req.ToCurrency)
+	if err != nil {
+		return nil, err
+	}
+
+	var pair ExchangePair
+	_, err = readState(root, key, &pair)
+	if err != nil {
+		return nil, err
+	}
+
+	pair.FromCurrency = req.FromCurrency
+	pair.ToCurrency = req.ToCurrency
+	pair.Spread = req.Spread
+	pair.Fee = req.Fee
+	pair.DailyLimit = req.DailyLimit
+	pair.Oracles = req.Oracles
+	pair.Enabled = req.Enabled
+	if req.Rate > 0 {
+		pair.Rate = req.Rate
+		pair.AsOf = ctx.Event().Timestamp
+		pair.ValidUntil = time.Time{}
+		pair.OracleId = ""
+		pair.Signature = ""
+	}
+
+	err = writeState(root, key, pair)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Event().exchangePairChanged(pair)
+
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Replace the rate of a currency pair by a newer one signed by one of its oracles
+// ============================================================================================================================
+func (t *SimpleChaincode) submitExchangeRate(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*submitRateRequest)
+	root := ctx.rootStub()
+
+	if !req.AsOf.Before(req.ValidUntil) {
+		return nil, fieldError("validUntil", "validUntil must be after asOf")
+	}
+
+	key, err := compositeKey(root, exchangePairObject, req.FromCurrency, req.ToCurrency)
+	if err != nil {
+		return nil, err
+	}
+	var pair ExchangePair
+	found, err := readState(root, key, &pair)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, newError(ERR_NOT_FOUND, "currency pair %s/%s does not exist", req.FromCurrency, req.ToCurrency)
+	}
+	if !containsString(pair.Oracles, req.OracleId) {
+		return nil, newError(ERR_FORBIDDEN, "oracle %s does not quote %s/%s", req.OracleId, req.FromCurrency, req.ToCurrency)
+	}
+	if !req.AsOf.After(pair.AsOf) {
+		return nil, newError(ERR_INVALID_STATE, "a rate as of %s is already set", pair.AsOf.Format(time.RFC3339))
+	}
+
+	oracleKey, err := compositeKey(root, oracleObject, req.OracleId)
+	if err != nil {
+		return nil, err
+	}
+	var oracle Oracle
+	found, err = readState(root, oracleKey, &oracle)
+	if err != nil {
+		return nil, err
+	}
+	if !found || !oracle.Enabled {
+		return nil, newError(ERR_FORBIDDEN, "oracle %s is not enabled", req.OracleId)
+	}
+
+	publicKey, err := parseOracleKey(oracle.PublicKey)
+	if err != nil {
+		return nil, newError(ERR_CORRUPT_STATE, "key of oracle %s can not be decoded: %s", oracle.OracleId, err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(req.Signature)
+	if err != nil {
+		return nil, fieldError("signature", "signature must be base64")
+	}
+	digest := sha256.Sum256([]byte(rateMessage(req.FromCurrency, req.ToCurrency, req.Rate, req.AsOf, req.ValidUntil)))
+	if !ecdsa.VerifyASN1(publicKey, digest[:], signature) {
+		return nil, fieldError("signature", "signature of oracle %s does not match the rate", oracle.OracleId)
+	}
+
+	pair.Rate = req.Rate
+	pair.AsOf = req.AsOf
+	pair.ValidUntil = req.ValidUntil
+	pair.OracleId = req.OracleId
+	pair.Signature = req.Signature
+
+	err = writeState(root, key, pair)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Event().exchangePairChanged(pair)
+
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Get every currency pair with its terms and current rate
+// ============================================================================================================================
+func (t *SimpleChaincode) getExchangePairs(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	iter, err := ctx.rootStub().GetStateByPartialCompositeKey(exchangePairObject, []string{})
+	if err != nil {
+		return nil, newError(ERR_LEDGER, "failed to list currency pairs: %s", err)
+	}
+	defer iter.Close()
+
+	pairs := []ExchangePair{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, newError(ERR_LEDGER, "failed to list currency pairs: %s", err)
+		}
+
+		var pair ExchangePair
+		err = json.Unmarshal(kv.Value, &pair)
+		if err != nil {
+			return nil, newError(ERR_CORRUPT_STATE, "failed to decode currency pair %s: %s", kv.Key, err)
+		}
+		pairs = append(pairs, pair)
+	}
+
+	asBytes, _ := json.Marshal(pairs)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Price an exchange or a conversion of the points of a member of the current program. Returns the quote and the key
+// and amount of the daily usage of the member after it.
+// ============================================================================================================================
+func quoteConversion(ctx *TransactionContext, userId string, toProgramId string, amount float64) (*ConversionQuote, string, float64, error) {
+
+	if amount <= 0 {
+		return nil, "", 0, fieldError("amount", "amount must be more than 0")
+	}
+
+	from := ctx.Program()
+	to, err := loadProgram(ctx.rootStub(), toProgramId)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	if to.ProgramId == from.ProgramId {
+		return nil, "", 0, fieldError("toProgramId", "cannot convert points of %s to itself", from.ProgramId)
+	}
+
+	key, err := compositeKey(ctx.rootStub(), exchangePairObject, from.Currency, to.Currency)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	var pair ExchangePair
+	found, err := readState(ctx.rootStub(), key, &pair)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	if !found || !pair.Enabled {
+		return nil, "", 0, newError(ERR_INVALID_STATE, "%s can not be converted to %s", from.Currency, to.Currency)
+	}
+	stub := ctx.GetStub()
+	now, err := txTimestamp(stub)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	if pair.Rate <= 0 || (!pair.ValidUntil.IsZero() && !now.Before(pair.ValidUntil)) {
+		return nil, "", 0, newError(ERR_INVALID_STATE, "no current rate for %s/%s", from.Currency, to.Currency)
+	}
+
+	var quote ConversionQuote
+	quote.FromProgramId = from.ProgramId
+	quote.ToProgramId = to.ProgramId
+	quote.FromCurrency = from.Currency
+	quote.ToCurrency = to.Currency
+	quote.Amount = amount
+	quote.Fee = pair.Fee
+	quote.Rate = pair.Rate
+	quote.Spread = pair.Spread
+	quote.Converted = math.Floor(amount*pair.Rate*(1-pair.Spread)*100) / 100
+	quote.ValidUntil = pair.ValidUntil
+
+	usageKey, err := compositeKey(stub, conversionUsageObject, userId, to.Currency, now.Format(DATE_LAYOUT))
+	if err != nil {
+		return nil, "", 0, err
+	}
+	var used float64
+	_, err = readState(stub, usageKey, &used)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	quote.LimitRemaining = -1
+	if pair.DailyLimit > 0 {
+		quote.LimitRemaining = math.Max(pair.DailyLimit-used, 0)
+		if amount > quote.LimitRemaining {
+			return &quote, "", 0, newError(ERR_INVALID_STATE, "%s can convert %v more %s to %s today", userId,
+				quote.LimitRemaining, from.Currency, to.Currency)
+		}
+		quote.LimitRemaining = quote.LimitRemaining - amount
+	}
+
+	return &quote, usageKey, used + amount, nil
+}
+
+// ============================================================================================================================
+// Price a conversion without making it, LimitRemaining is what the member could still convert today afterwards or
+// -1 if the pair has no limit
+// ============================================================================================================================
+func (t *SimpleChaincode) quoteConversion(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*quoteConversionRequest)
+
+	quote, _, _, err := quoteConversion(ctx, req.UserId, req.ToProgramId, req.Amount)
+	if err != nil {
+		return nil, err
+	}
+
+	asBytes, _ := json.Marshal(quote)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Convert points of a member of the current program into points of a member of another program at the current rate
+// ============================================================================================================================
+func (t *SimpleChaincode) convertPoints(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*convertPointsRequest)
+	stub := ctx.GetStub()
+	ev := ctx.Event()
+
+	err := checkAccount(ctx, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+	quote, usageKey, used, err := quoteConversion(ctx, req.UserId, req.ToProgramId, req.Amount)
+	if err != nil {
+		return nil, err
+	}
+	if quote.Converted <= 0 {
+		return nil, fieldError("amount", "%v %s converts to nothing", req.Amount, quote.FromCurrency)
+	}
+
+	var tx Transaction
+	tx.Date = ev.Timestamp.Truncate(time.Minute)
+	tx.StatusCode = 1
+	tx.StatusMsg = "Transaction Completed"
+	tx.TxId = stub.GetTxID()
+	txs, err := postConversionFee(ctx, tx, req.UserId, quote)
+	if err != nil {
+		return nil, err
+	}
+
+	// Burn in the source program, mint in the destination program
+	burn := tx
+	burn.Type = TX_TYPE_CONVERT
+	burn.From = req.UserId
+	burn.Amount = req.Amount
+	burn.ListAmount = req.Amount
+	burn.Description = fmt.Sprintf("Converted to %v %s at %v", quote.Converted, quote.ToCurrency, quote.Rate)
+
+	mint := tx
+	mint.Type = TX_TYPE_CONVERT
+	mint.To = req.ToUserId
+	mint.Amount = quote.Converted
+	mint.ListAmount = quote.Converted
+	mint.Description = fmt.Sprintf("Converted from %v %s at %v", req.Amount, quote.FromCurrency, quote.Rate)
+
+	err = postLinkedPair(ctx, &burn, quote.ToProgramId, &mint)
+	if err != nil {
+		return nil, err
+	}
+	txs = append(txs, burn, mint)
+
+	err = writeState(stub, usageKey, used)
+	if err != nil {
+		return nil, err
+	}
+
+	asBytes, _ := json.Marshal(txs)
+	return asBytes, nil
+}
+
+// Charge the fee of a quote to the member, the fee goes to the originator of the current program
+func postConversionFee(ctx *TransactionContext, tx Transaction, userId string, quote *ConversionQuote) ([]Transaction, error) {
+
+	if quote.Fee <= 0 {
+		return []Transaction{}, nil
+	}
+
+	var err error
+	tx.Type = TX_TYPE_CONVERSION_FEE
+	tx.From = userId
+	tx.To = ctx.Program().OriginatorId
+	tx.Amount = quote.Fee
+	tx.ListAmount = quote.Fee
+	tx.Description = fmt.Sprintf("Fee for moving %v %s to %s", quote.Amount, quote.FromCurrency, quote.ToCurrency)
+	tx.RefNumber, err = nextRefNumber(ctx.GetStub(), ctx.Event())
+	if err != nil {
+		return nil, err
+	}
+	err = postTransfer(ctx.GetStub(), ctx.Event(), &tx)
+	if err != nil {
+		return nil, err
+	}
+
+	return []Transaction{tx}, nil
+}
+
+// ============================================================================================================================
+// Exchange points of a member of the current program for points of a member of another program at the current rate
+// of their currency pair. The originators clear the exchange, so the supply of each program is unchanged.
+// ============================================================================================================================
+func (t *SimpleChaincode) exchangePoints(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*exchangePointsRequest)
+	stub := ctx.GetStub()
+	ev := ctx.Event()
+	from := ctx.Program()
+
+	if req.UserId == from.OriginatorId {
+		return nil, fieldError("userId", "the originator of %s can not exchange points", from.ProgramId)
+	}
+	err := checkAccount(ctx, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+	quote, usageKey, used, err := quoteConversion(ctx, req.UserId, req.ToProgramId, req.Amount)
+	if err != nil {
+		return nil, err
+	}
+	if quote.Converted <= 0 {
+		return nil, fieldError("amount", "%v %s exchanges for nothing", req.Amount, quote.FromCurrency)
+	}
+	to, err := loadProgram(ctx.rootStub(), req.ToProgramId)
+	if err != nil {
+		return nil, err
+	}
+	if req.ToUserId == to.OriginatorId {
+		return nil, fieldError("toUserId", "the originator of %s can not receive exchanged points", to.ProgramId)
+	}
+
+	var tx Transaction
+	tx.Date = ev.Timestamp.Truncate(time.Minute)
+	tx.Type = TX_TYPE_EXCHANGE
+	tx.StatusCode = 1
+	tx.StatusMsg = "Transaction Completed"
+	tx.TxId = stub.GetTxID()
+	txs, err := postConversionFee(ctx, tx, req.UserId, quote)
+	if err != nil {
+		return nil, err
+	}
+
+	// Leg paid by the member in the current program
+	out := tx
+	out.From = req.UserId
+	out.To = from.OriginatorId
+	out.Amount = req.Amount
+	out.ListAmount = req.Amount
+	out.Description = fmt.Sprintf("Exchange for %v %s of %s at %v", quote.Converted, to.Currency, to.ProgramId, quote.Rate)
+
+	// Leg paid by the originator of the other program
+	in := tx
+	in.From = to.OriginatorId
+	in.To = req.ToUserId
+	in.Amount = quote.Converted
+	in.ListAmount = quote.Converted
+	in.Description = fmt.Sprintf("Exchange of %v %s of %s at %v", req.Amount, from.Currency, from.ProgramId, quote.Rate)
+
+	err = postLinkedPair(ctx, &out, to.ProgramId, &in)
+	if err != nil {
+		return nil, err
+	}
+	txs = append(txs, out, in)
+
+	err = writeState(stub, usageKey, used)
+	if err != nil {
+		return nil, err
+	}
+
+	asBytes, _ := json.Marshal(txs)
+	return asBytes, nil
+}
@@ -0,0 +1,763 @@
+package openpoints_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gscdist/GscLabChaincode/openpoints"
+)
+
+type request = map[string]interface{}
+
+// A successful call of one registered function. setup prepares the ledger as an admin and returns the request, or
+// the case uses request as is. The call is then made with role on behalf of account.
+type functionCase struct {
+	function string
+	role     string
+	account  string
+	request  request
+	setup    func(l *ledger) request
+	check    func(l *ledger, payload []byte)
+}
+
+// ============================================================================================================================
+// Setups shared by several cases, each returns the id of what it created
+// ============================================================================================================================
+
+// transfer posts a transfer from a member as that member and returns its reference number
+func transfer(l *ledger, from string, to string, amount float64) string {
+
+	l.t.Helper()
+	l.as(openpoints.ROLE_MEMBER, from).must("transferPoints",
+		request{"from": from, "to": to, "type": "purchase", "amount": amount})
+	refNumber := l.effect(openpoints.EFFECT_TRANSFER).Transaction.RefNumber
+	l.admin()
+
+	return refNumber
+}
+
+// airProgram creates a second program whose Miles trade at half an Open Point, with Natalie enrolled
+func airProgram(l *ledger) string {
+
+	l.t.Helper()
+	l.must("createProgram", request{"id": airId, "name": "Air Miles", "originatorId": "AIR1", "currency": "Miles",
+		"tiers": []string{"Blue", "Gold"}, "supply": 100000})
+	l.must("enrollMember", request{openpoints.PROGRAM_FIELD: airId, "userId": natalieId, "name": "Natalie"})
+	l.must("setExchangePair", request{"fromCurrency": "OpenPoints", "toCurrency": "Miles", "rate": 0.5, "enabled": true})
+
+	return airId
+}
+
+func settlementBatch(l *ledger) string {
+
+	l.t.Helper()
+	transfer(l, natalieId, retailId, 100)
+	l.h.Clock = l.h.Clock.AddDate(0, 0, 2)
+	l.must("createSettlementBatch", request{"businessId": retailId, "from": "2017-05-01", "to": "2017-05-07"})
+
+	return l.effect(openpoints.EFFECT_SETTLEMENT_CHANGED).Settlement.BatchId
+}
+
+func catalogOrder(l *ledger) string {
+
+	l.t.Helper()
+	l.must("setCatalogItem", request{"sku": "MUG", "businessId": retailId, "title": "Mug", "pointPrice": 100,
+		"stock": 3, "active": true})
+	payload := l.must("redeemItem", request{"userId": natalieId, "sku": "MUG", "quantity": 1})
+
+	var order openpoints.Order
+	l.decode(payload, &order)
+	return order.OrderId
+}
+
+func issueVoucher(l *ledger) (string, string) {
+
+	l.t.Helper()
+	sum := sha256.Sum256([]byte("pepper" + "SPRING10"))
+	l.must("issueVoucher", request{"voucherId": "SPRING", "businessId": retailId, "kind": "points", "value": 50,
+		"salt": "pepper", "codeHash": hex.EncodeToString(sum[:]), "expiresAt": "2018-01-01", "maxRedemptions": 2})
+
+	return "SPRING", "SPRING10"
+}
+
+// percentVoucher issues a 90% discount of OpenRetail that redeems once
+func percentVoucher(l *ledger) (string, string) {
+
+	l.t.Helper()
+	sum := sha256.Sum256([]byte("pepper" + "NINETY"))
+	l.must("issueVoucher", request{"voucherId": "NINETY", "businessId": retailId, "kind": "percent", "value": 90,
+		"salt": "pepper", "codeHash": hex.EncodeToString(sum[:]), "expiresAt": "2018-01-01", "maxRedemptions": 1})
+
+	return "NINETY", "NINETY"
+}
+
+func pool(l *ledger) string {
+
+	l.t.Helper()
+	l.as(openpoints.ROLE_MEMBER, natalieId).must("createPool", request{"poolId": "F1", "name": "Family", "ownerId": natalieId})
+	l.admin()
+
+	return "F1"
+}
+
+// fundedPool creates pool F1 and has Natalie contribute 200 points to it
+func fundedPool(l *ledger) string {
+
+	l.t.Helper()
+	poolId := pool(l)
+	transfer(l, natalieId, poolId, 200)
+
+	return poolId
+}
+
+// paymentAuthorization has Natalie authorize a business to take up to 200 points from her once and returns the
+// authorization
+func paymentAuthorization(l *ledger, businessId string) string {
+
+	l.t.Helper()
+	l.as(openpoints.ROLE_MEMBER, natalieId).must("authorizePayment", request{"authorizationId": "A1",
+		"userId": natalieId, "businessId": businessId, "maxAmount": 200, "expires": l.h.Clock.Add(time.Hour)})
+	l.admin()
+
+	return "A1"
+}
+
+// cashier grants the delegate identity of a cashier permissions of a business and returns it
+func cashier(l *ledger, businessId string, permissions ...string) string {
+
+	l.t.Helper()
+	delegate := callerId(l, member, "cashier")
+	l.must("grantDelegation", request{"businessId": businessId, "delegate": delegate, "permissions": permissions})
+
+	return delegate
+}
+
+// callerId returns the id the chaincode records for the callers of a role and account
+func callerId(l *ledger, role string, account string) string {
+
+	l.t.Helper()
+	l.as(role, account).must("expireOperations", nil)
+	l.admin()
+
+	ev, err := l.h.LastEvent()
+	if err != nil {
+		l.t.Fatal(err)
+	}
+	return ev.Caller
+}
+
+// operation sets a policy that treasury transfers need one of two approvers and proposes one. It returns the
+// operation and the approver that may vote on it.
+func operation(l *ledger) (string, string) {
+
+	l.t.Helper()
+	approver := callerId(l, openpoints.ROLE_MEMBER, "approver")
+	l.must("setApprovalPolicy", request{"policyId": "treasury", "function": "transferPoints", "account": bankId,
+		"minAmount": 1000, "approvers": []string{approver, "other"}, "threshold": 1, "ttlHours": 24, "active": true})
+
+	payload := l.as(openpoints.ROLE_MEMBER, bankId).must("proposeOperation", request{"function": "transferPoints",
+		"request": `{"from":"` + bankId + `","to":"` + natalieId + `","type":"grant","amount":5000}`})
+	l.admin()
+
+	var op openpoints.Operation
+	l.decode(payload, &op)
+	return op.OperationId, approver
+}
+
+func schedule(l *ledger) string {
+
+	l.t.Helper()
+	l.as(openpoints.ROLE_MEMBER, natalieId).must("createSchedule", request{"scheduleId": "S1", "from": natalieId,
+		"to": retailId, "amount": 10, "recurrence": "0 * * * *"})
+	l.admin()
+
+	return "S1"
+}
+
+// heldCase keeps a transfer from Natalie unposted for review and returns its case
+func heldCase(l *ledger) string {
+
+	l.t.Helper()
+	l.must("setRiskRule", request{"ruleId": "big", "kind": "maxAmount", "limit": 50, "severity": "hold", "active": true})
+	l.as(openpoints.ROLE_MEMBER, natalieId).must("transferPoints",
+		request{"from": natalieId, "to": retailId, "type": "purchase", "amount": 100})
+	l.admin()
+
+	var cases []openpoints.RiskCase
+	l.decode(l.must("getRiskCases", request{"status": "HELD"}), &cases)
+	if len(cases) != 1 {
+		l.t.Fatalf("%d held cases, want 1", len(cases))
+	}
+	return cases[0].CaseId
+}
+
+// oracle registers an oracle for the pair of the air program and returns a rate it signed
+func oracle(l *ledger) request {
+
+	l.t.Helper()
+	airProgram(l)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		l.t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		l.t.Fatal(err)
+	}
+	publicKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	l.must("setOracle", request{"oracleId": "fx1", "publicKey": publicKey, "enabled": true})
+	l.must("setExchangePair", request{"fromCurrency": "OpenPoints", "toCurrency": "Miles", "rate": 0.5,
+		"oracles": []string{"fx1"}, "enabled": true})
+
+	asOf := l.h.Clock.UTC().Truncate(time.Second)
+	validUntil := asOf.Add(time.Hour)
+	message := "OpenPoints|Miles|0.6|" + asOf.Format(time.RFC3339) + "|" + validUntil.Format(time.RFC3339)
+	digest := sha256.Sum256([]byte(message))
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		l.t.Fatal(err)
+	}
+
+	return request{"oracleId": "fx1", "fromCurrency": "OpenPoints", "toCurrency": "Miles", "rate": 0.6,
+		"asOf": asOf, "validUntil": validUntil, "signature": base64.StdEncoding.EncodeToString(signature)}
+}
+
+func checkBalance(userId string, balance float64) func(l *ledger, payload []byte) {
+	return func(l *ledger, payload []byte) {
+		l.t.Helper()
+		if user := l.user(userId); user.Balance != balance {
+			l.t.Errorf("%s has %v points, want %v", userId, user.Balance, balance)
+		}
+	}
+}
+
+const (
+	admin      = openpoints.ROLE_ADMIN
+	business   = openpoints.ROLE_BUSINESS
+	member     = openpoints.ROLE_MEMBER
+	compliance = openpoints.ROLE_COMPLIANCE
+	risk       = openpoints.ROLE_RISK_OFFICER
+)
+
+var functionCases = []functionCase{
+	// Ledger setup and transfers
+	{function: "init", role: admin, setup: func(l *ledger) request {
+		transfer(l, natalieId, retailId, 100)
+		return nil
+	}, check: checkBalance(natalieId, 1000)},
+	{function: "transferPoints", role: member, account: natalieId,
+		request: request{"from": natalieId, "to": retailId, "type": "purchase", "amount": 100},
+		check:   checkBalance(natalieId, 900)},
+	{function: "addSmartContract", role: business, account: retailId,
+		request: request{"id": "Promo1", "businessId": retailId, "title": "10 off", "discountRate": 0.1, "budget": 1000}},
+	{function: "incrementReferenceNumber", role: admin, check: func(l *ledger, payload []byte) {
+		if refNumber := string(l.must("getReferenceNumber", nil)); refNumber != "2985674979" {
+			l.t.Errorf("reference number %s, want 2985674979", refNumber)
+		}
+	}},
+
+	// Settlement
+	{function: "setSettlementRule", role: admin,
+		request: request{"contractId": openpoints.RETAIL_CONTRACT, "pointValue": 0.01, "originatorDiscountShare": 0.5}},
+	{function: "createSettlementBatch", role: business, account: retailId, setup: func(l *ledger) request {
+		transfer(l, natalieId, retailId, 100)
+		l.h.Clock = l.h.Clock.AddDate(0, 0, 2)
+		return request{"businessId": retailId, "from": "2017-05-01", "to": "2017-05-07"}
+	}},
+	{function: "approveSettlementBatch", role: admin, setup: func(l *ledger) request {
+		return request{"batchId": settlementBatch(l)}
+	}},
+	{function: "markSettlementBatchPaid", role: admin, setup: func(l *ledger) request {
+		batchId := settlementBatch(l)
+		l.must("approveSettlementBatch", request{"batchId": batchId})
+		return request{"batchId": batchId, "paymentReference": "WIRE-1"}
+	}},
+
+	// Programs and exchange
+	{function: "createProgram", role: admin, request: request{"id": airId, "name": "Air Miles", "originatorId": "AIR1",
+		"currency": "Miles", "tiers": []string{"Blue", "Gold"}, "supply": 5000}},
+	{function: "updateProgram", role: admin, setup: func(l *ledger) request {
+		return request{openpoints.PROGRAM_FIELD: airProgram(l), "name": "Air Miles Plus"}
+	}},
+	{function: "enrollMember", role: admin, setup: func(l *ledger) request {
+		return request{openpoints.PROGRAM_FIELD: airProgram(l), "userId": anthonyId, "name": "Anthony"}
+	}},
+	{function: "exchangePoints", role: member, account: natalieId, setup: func(l *ledger) request {
+		return request{"userId": natalieId, "toProgramId": airProgram(l), "toUserId": natalieId, "amount": 100}
+	}, check: checkBalance(natalieId, 900)},
+	{function: "setOracle", role: admin, setup: func(l *ledger) request {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		return request{"oracleId": "fx1", "publicKey": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+			"enabled": true}
+	}},
+	{function: "setExchangePair", role: admin, setup: func(l *ledger) request {
+		l.must("createProgram", request{"id": airId, "name": "Air Miles", "originatorId": "AIR1", "currency": "Miles",
+			"tiers": []string{"Blue"}})
+		return request{"fromCurrency": "OpenPoints", "toCurrency": "Miles", "rate": 0.5, "enabled": true}
+	}},
+	{function: "submitExchangeRate", role: member, setup: oracle},
+	{function: "convertPoints", role: member, account: natalieId, setup: func(l *ledger) request {
+		return request{"userId": natalieId, "toProgramId": airProgram(l), "toUserId": natalieId, "amount": 200}
+	}},
+
+	// Catalog and orders
+	{function: "setCatalogItem", role: business, account: retailId, request: request{"sku": "MUG", "businessId": retailId,
+		"title": "Mug", "pointPrice": 100, "moneyCopay": 2.5, "stock": 3, "active": true}},
+	{function: "redeemItem", role: member, account: natalieId, setup: func(l *ledger) request {
+		l.must("setCatalogItem", request{"sku": "MUG", "businessId": retailId, "title": "Mug", "pointPrice": 100,
+			"stock": 3, "active": true})
+		return request{"userId": natalieId, "sku": "MUG", "quantity": 2}
+	}, check: checkBalance(natalieId, 840)}, // priced by the 20% off of Sonic
+	{function: "fulfillOrder", role: business, account: retailId, setup: func(l *ledger) request {
+		return request{"orderId": catalogOrder(l), "reference": "DHL123"}
+	}},
+	{function: "cancelOrder", role: business, account: retailId, setup: func(l *ledger) request {
+		return request{"orderId": catalogOrder(l)}
+	}, check: checkBalance(natalieId, 1000)},
+	{function: "cancelOrder", role: member, account: "cashier", setup: func(l *ledger) request {
+		cashier(l, retailId, "refund")
+		return request{"orderId": catalogOrder(l)}
+	}, check: checkBalance(natalieId, 1000)},
+
+	// Earning and vouchers
+	{function: "setEarnRate", role: business, account: retailId, request: request{"businessId": retailId, "rate": 2}},
+	{function: "purchase", role: business, account: retailId, setup: func(l *ledger) request {
+		l.must("setEarnRate", request{"businessId": retailId, "rate": 2})
+		return request{"userId": natalieId, "businessId": retailId, "points": 100, "money": 20,
+			"authorizationId": paymentAuthorization(l, retailId)}
+	}, check: checkBalance(natalieId, 960)},
+	{function: "purchase", role: member, account: natalieId,
+		request: request{"userId": natalieId, "businessId": retailId, "points": 100},
+		check:   checkBalance(natalieId, 920)},
+	{function: "issueVoucher", role: business, account: retailId, setup: func(l *ledger) request {
+		sum := sha256.Sum256([]byte("salt" + "CODE"))
+		return request{"voucherId": "V1", "businessId": retailId, "kind": "percent", "value": 10, "salt": "salt",
+			"codeHash": hex.EncodeToString(sum[:]), "expiresAt": "2018-01-01", "maxRedemptions": 1}
+	}},
+	{function: "redeemVoucher", role: member, account: natalieId, setup: func(l *ledger) request {
+		voucherId, code := issueVoucher(l)
+		return request{"voucherId": voucherId, "code": code, "userId": natalieId}
+	}, check: checkBalance(natalieId, 1050)},
+
+	// Referrals
+	{function: "setReferralRule", role: admin, request: request{"businessId": retailId, "referrerReward": 100,
+		"refereeReward": 50, "minAmount": 10, "maxReferrals": 1, "active": true}},
+	{function: "createReferralCode", role: member, account: natalieId, request: request{"userId": natalieId}},
+
+	// Risk and compliance
+	{function: "setRiskRule", role: risk, request: request{"ruleId": "big", "kind": "maxAmount", "limit": 1000,
+		"severity": "flag", "active": true}},
+	{function: "reviewRiskCase", role: risk, setup: func(l *ledger) request {
+		return request{"caseId": heldCase(l), "approve": true}
+	}, check: checkBalance(natalieId, 900)},
+	{function: "freezeAccount", role: compliance, request: request{"userId": natalieId, "reasonCode": "AML-01"}},
+	{function: "unfreezeAccount", role: compliance, setup: func(l *ledger) request {
+		l.must("freezeAccount", request{"userId": natalieId, "reasonCode": "AML-01"})
+		return request{"userId": natalieId, "reasonCode": "CLEARED"}
+	}},
+	{function: "listIdentity", role: compliance, request: request{"identity": anthonyId, "reasonCode": "OFAC"}},
+	{function: "delistIdentity", role: compliance, setup: func(l *ledger) request {
+		l.must("listIdentity", request{"identity": anthonyId, "reasonCode": "OFAC"})
+		return request{"identity": anthonyId, "reasonCode": "CLEARED"}
+	}},
+
+	// Approvals
+	{function: "setApprovalPolicy", role: admin, request: request{"policyId": "treasury", "function": "transferPoints",
+		"account": bankId, "minAmount": 1000, "approvers": []string{"t1", "t2"}, "threshold": 1, "ttlHours": 24, "active": true}},
+	{function: "proposeOperation", role: member, account: bankId, setup: func(l *ledger) request {
+		l.must("setApprovalPolicy", request{"policyId": "treasury", "function": "transferPoints", "account": bankId,
+			"minAmount": 1000, "approvers": []string{"t1", "t2"}, "threshold": 1, "ttlHours": 24, "active": true})
+		return request{"function": "transferPoints",
+			"request": `{"from":"` + bankId + `","to":"` + natalieId + `","type":"grant","amount":5000}`}
+	}},
+	{function: "approveOperation", role: member, account: "approver", setup: func(l *ledger) request {
+		operationId, _ := operation(l)
+		return request{"operationId": operationId}
+	}, check: checkBalance(natalieId, 6000)},
+	{function: "rejectOperation", role: member, account: "approver", setup: func(l *ledger) request {
+		operationId, _ := operation(l)
+		return request{"operationId": operationId}
+	}, check: checkBalance(natalieId, 1000)},
+	{function: "expireOperations", role: member},
+
+	// Schedules and pending earnings
+	{function: "createSchedule", role: member, account: natalieId, request: request{"scheduleId": "S1", "from": natalieId,
+		"to": retailId, "amount": 10, "recurrence": "0 * * * *"}},
+	{function: "cancelSchedule", role: member, account: natalieId, setup: func(l *ledger) request {
+		return request{"scheduleId": schedule(l)}
+	}},
+	{function: "runDueSchedules", role: admin, setup: func(l *ledger) request {
+		schedule(l)
+		l.h.Clock = l.h.Clock.Add(2 * time.Hour)
+		return nil
+	}, check: func(l *ledger, payload []byte) {
+		if user := l.user(natalieId); user.Balance >= 1000 {
+			l.t.Errorf("no scheduled transfer ran, Natalie has %v points", user.Balance)
+		}
+	}},
+	{function: "matureEarnings", role: admin},
+	{function: "reverseTransaction", role: business, account: retailId, setup: func(l *ledger) request {
+		return request{"refNumber": transfer(l, natalieId, retailId, 100), "reason": "returned"}
+	}, check: checkBalance(natalieId, 1000)},
+
+	// Pools
+	{function: "createPool", role: member, account: natalieId, request: request{"poolId": "F1", "name": "Family",
+		"ownerId": natalieId}},
+	{function: "setPoolRules", role: member, account: natalieId, setup: func(l *ledger) request {
+		return request{"poolId": pool(l), "minContribution": 1}
+	}},
+	{function: "setPoolMember", role: member, account: natalieId, setup: func(l *ledger) request {
+		return request{"poolId": pool(l), "userId": anthonyId, "canSpend": true}
+	}},
+	{function: "removePoolMember", role: member, account: natalieId, setup: func(l *ledger) request {
+		poolId := pool(l)
+		l.must("setPoolMember", request{"poolId": poolId, "userId": anthonyId, "canSpend": true})
+		return request{"poolId": poolId, "userId": anthonyId}
+	}},
+	{function: "setSpendOrder", role: admin, request: request{"order": []string{"purchased", "promotional", "earned"}}},
+
+	// Delegation
+	{function: "grantDelegation", role: business, account: retailId, request: request{"businessId": retailId,
+		"delegate": "cashier1", "permissions": []string{"redeem"}}},
+	{function: "revokeDelegation", role: business, account: retailId, setup: func(l *ledger) request {
+		l.must("grantDelegation", request{"businessId": retailId, "delegate": "cashier1", "permissions": []string{"redeem"}})
+		return request{"businessId": retailId, "delegate": "cashier1"}
+	}},
+	{function: "authorizePayment", role: member, account: natalieId, request: request{"authorizationId": "A1",
+		"userId": natalieId, "businessId": retailId, "maxAmount": 200, "expires": "2018-01-01T00:00:00Z"}},
+	{function: "transferPoints", role: business, account: retailId, setup: func(l *ledger) request {
+		return request{"from": natalieId, "to": retailId, "type": "purchase", "amount": 100,
+			"authorizationId": paymentAuthorization(l, retailId)}
+	}, check: checkBalance(natalieId, 900)},
+	{function: "transferPoints", role: member, account: "cashier", setup: func(l *ledger) request {
+		cashier(l, retailId, "redeem")
+		return request{"from": natalieId, "to": retailId, "type": "purchase", "amount": 100,
+			"authorizationId": paymentAuthorization(l, retailId)}
+	}, check: checkBalance(natalieId, 900)},
+
+	// Queries
+	{function: "getTxs", role: member, account: natalieId, setup: func(l *ledger) request {
+		transfer(l, natalieId, retailId, 100)
+		return request{"userId": natalieId}
+	}, check: func(l *ledger, payload []byte) {
+		var txs openpoints.AllTransactions
+		l.decode(payload, &txs)
+		if len(txs.Transactions) != 1 || txs.Transactions[0].RefNumber != firstRefNumber {
+			l.t.Errorf("transactions %+v, want %s", txs.Transactions, firstRefNumber)
+		}
+	}},
+	{function: "getUserAccount", role: member, account: natalieId, request: request{"userId": natalieId},
+		check: func(l *ledger, payload []byte) {
+			var user openpoints.User
+			l.decode(payload, &user)
+			if user.Name != "Natalie" || user.Balance != 1000 {
+				l.t.Errorf("account %+v, want Natalie with 1000 points", user)
+			}
+		}},
+	{function: "getAllContracts", role: member, check: func(l *ledger, payload []byte) {
+		var contracts []openpoints.Contract
+		l.decode(payload, &contracts)
+		if len(contracts) != 2 || contracts[0].Id != openpoints.RETAIL_CONTRACT || contracts[1].Id != openpoints.FEEDBACK_CONTRACT {
+			l.t.Errorf("contracts %+v, want Sonic and Feedback", contracts)
+		}
+	}},
+	{function: "getReferenceNumber", role: member, check: func(l *ledger, payload []byte) {
+		if string(payload) != firstRefNumber {
+			l.t.Errorf("reference number %s, want %s", payload, firstRefNumber)
+		}
+	}},
+	{function: "getBalanceAt", role: member, account: natalieId, setup: func(l *ledger) request {
+		at := l.h.Clock
+		transfer(l, natalieId, retailId, 100)
+		return request{"userId": natalieId, "at": at}
+	}},
+	{function: "getAccountHistory", role: member, account: natalieId, request: request{"userId": natalieId}},
+	{function: "getStatement", role: member, account: natalieId, request: request{"userId": natalieId,
+		"from": "2017-01-01", "to": "2017-12-31", "format": "csv"}},
+	{function: "getSettlementBatch", role: business, account: retailId, setup: func(l *ledger) request {
+		return request{"batchId": settlementBatch(l)}
+	}},
+	{function: "getSettlementBatches", role: business, account: retailId, request: request{"businessId": retailId}},
+	{function: "getProgram", role: member},
+	{function: "getPrograms", role: member},
+	{function: "getExchangePairs", role: member},
+	{function: "quoteConversion", role: member, account: natalieId, setup: func(l *ledger) request {
+		return request{"userId": natalieId, "toProgramId": airProgram(l), "amount": 200}
+	}},
+	{function: "getCatalog", role: member, request: request{"businessId": retailId}},
+	{function: "getOrder", role: member, account: natalieId, setup: func(l *ledger) request {
+		return request{"orderId": catalogOrder(l)}
+	}},
+	{function: "getOrders", role: member, account: natalieId, request: request{"userId": natalieId}},
+	{function: "getEarnRule", role: member, setup: func(l *ledger) request {
+		l.must("setEarnRate", request{"businessId": retailId, "rate": 2})
+		return request{"businessId": retailId}
+	}},
+	{function: "getVouchers", role: business, account: retailId, request: request{"businessId": retailId}},
+	{function: "getReferrals", role: business, account: retailId},
+	{function: "getRiskRules", role: risk},
+	{function: "getRiskCases", role: risk, request: request{"status": "HELD"}},
+	{function: "getSanctionsList", role: compliance},
+	{function: "getComplianceActions", role: compliance},
+	{function: "getApprovalPolicies", role: member},
+	{function: "getOperations", role: member, request: request{"status": "PENDING"}},
+	{function: "getSchedules", role: member, account: natalieId, request: request{"userId": natalieId}},
+	{function: "getPendingEarnings", role: member, account: natalieId, request: request{"userId": natalieId}},
+	{function: "getPool", role: member, account: natalieId, setup: func(l *ledger) request {
+		return request{"poolId": pool(l)}
+	}},
+	{function: "getSpendOrder", role: member},
+	{function: "getDelegations", role: business, account: retailId, request: request{"businessId": retailId}},
+	{function: "describeFunctions", role: member},
+}
+
+// Calls refused to a caller that does not act for the accounts they touch, or that sends what only the chaincode posts
+var refusedCases = []errorCase{
+	// Ledger setup and transfers
+	{name: "transfer typed refund", code: openpoints.ERR_VALIDATION_FAILED, role: member, account: natalieId,
+		function: "transferPoints", request: request{"from": natalieId, "to": retailId, "type": "refund", "amount": 100}},
+	{name: "transfer typed reversal", code: openpoints.ERR_VALIDATION_FAILED, role: member, account: natalieId,
+		function: "transferPoints", request: request{"from": natalieId, "to": retailId, "type": "reversal", "amount": 100}},
+	{name: "transfer typed expire", code: openpoints.ERR_VALIDATION_FAILED, role: member, account: natalieId,
+		function: "transferPoints", request: request{"from": natalieId, "to": retailId, "type": "expire", "amount": 100}},
+
+	// Catalog and orders
+	{name: "catalog item of another business", code: openpoints.ERR_FORBIDDEN, role: business, account: retailId,
+		function: "setCatalogItem", request: request{"sku": "MUG", "businessId": bankId, "title": "Mug",
+			"pointPrice": 1, "stock": 3, "active": true}},
+	{name: "catalog item taken over from another business", code: openpoints.ERR_FORBIDDEN, role: business,
+		account: retailId, function: "setCatalogItem", request: request{"sku": "MUG", "businessId": retailId,
+			"title": "Mug", "pointPrice": 1, "stock": 3, "active": true},
+		setup: func(l *ledger) request {
+			l.must("setCatalogItem", request{"sku": "MUG", "businessId": bankId, "title": "Mug", "pointPrice": 100,
+				"stock": 3, "active": true})
+			return nil
+		}},
+	{name: "order fulfilled by another business", code: openpoints.ERR_FORBIDDEN, role: business, account: bankId,
+		function: "fulfillOrder", setup: func(l *ledger) request {
+			return request{"orderId": catalogOrder(l), "reference": "DHL123"}
+		}},
+	{name: "order cancelled by another business", code: openpoints.ERR_FORBIDDEN, role: business, account: bankId,
+		function: "cancelOrder", setup: func(l *ledger) request {
+			return request{"orderId": catalogOrder(l)}
+		}},
+	{name: "order cancelled by a delegate of another business", code: openpoints.ERR_FORBIDDEN, role: member,
+		account: "cashier", function: "cancelOrder", setup: func(l *ledger) request {
+			cashier(l, bankId, "refund")
+			return request{"orderId": catalogOrder(l)}
+		}},
+
+	// Earning and vouchers
+	{name: "voucher charged to another business", code: openpoints.ERR_FORBIDDEN, role: business, account: retailId,
+		function: "issueVoucher", setup: func(l *ledger) request {
+			sum := sha256.Sum256([]byte("salt" + "CODE"))
+			return request{"voucherId": "V1", "businessId": bankId, "kind": "points", "value": 100000, "salt": "salt",
+				"codeHash": hex.EncodeToString(sum[:]), "expiresAt": "2018-01-01", "maxRedemptions": 1}
+		}},
+	{name: "voucher redeemed for another member", code: openpoints.ERR_FORBIDDEN, role: member, account: anthonyId,
+		function: "redeemVoucher", setup: func(l *ledger) request {
+			voucherId, code := issueVoucher(l)
+			return request{"voucherId": voucherId, "code": code, "userId": natalieId}
+		}},
+	{name: "earn rate of another business", code: openpoints.ERR_FORBIDDEN, role: business, account: retailId,
+		function: "setEarnRate", request: request{"businessId": bankId, "rate": 100}},
+	{name: "member declares its own money", code: openpoints.ERR_FORBIDDEN, role: member, account: natalieId,
+		function: "purchase", request: request{"userId": natalieId, "businessId": retailId, "points": 10, "money": 1000},
+		setup: func(l *ledger) request {
+			l.must("setEarnRate", request{"businessId": retailId, "rate": 2})
+			return nil
+		}},
+	{name: "purchase points without an authorization", code: openpoints.ERR_FORBIDDEN, role: business,
+		account: retailId, function: "purchase",
+		request: request{"userId": natalieId, "businessId": retailId, "points": 100, "money": 20}},
+	{name: "percent voucher on a refund", code: openpoints.ERR_VALIDATION_FAILED, role: member, account: natalieId,
+		function: "transferPoints", setup: func(l *ledger) request {
+			voucherId, code := percentVoucher(l)
+			return request{"from": natalieId, "to": retailId, "type": "refund", "amount": 100, "voucherId": voucherId,
+				"voucherCode": code}
+		}},
+	{name: "percent voucher used twice", code: openpoints.ERR_INVALID_STATE, role: member, account: natalieId,
+		function: "transferPoints", setup: func(l *ledger) request {
+			voucherId, code := percentVoucher(l)
+			use := request{"from": natalieId, "to": retailId, "type": "purchase", "amount": 100, "voucherId": voucherId,
+				"voucherCode": code}
+			l.as(openpoints.ROLE_MEMBER, natalieId).must("transferPoints", use)
+			l.admin()
+			return use
+		}},
+
+	// Referrals
+	{name: "referral code of another member", code: openpoints.ERR_FORBIDDEN, role: member, account: anthonyId,
+		function: "createReferralCode", request: request{"userId": natalieId}},
+	{name: "referral code of a member from a second identity", code: openpoints.ERR_FORBIDDEN, role: member,
+		account: "cashier", function: "createReferralCode", request: request{"userId": natalieId}},
+
+	// Pools
+	{name: "pool spend by a stranger", code: openpoints.ERR_FORBIDDEN, role: member, account: anthonyId,
+		function: "transferPoints", request: request{"from": "F1", "to": retailId, "type": "purchase", "amount": 50},
+		setup: func(l *ledger) request { fundedPool(l); return nil }},
+	{name: "pool spend by a stranger typed refund", code: openpoints.ERR_VALIDATION_FAILED, role: member,
+		account: anthonyId, function: "transferPoints",
+		request: request{"from": "F1", "to": anthonyId, "type": "refund", "amount": 200},
+		setup:   func(l *ledger) request { fundedPool(l); return nil }},
+	{name: "pool spend by a member who may not spend", code: openpoints.ERR_FORBIDDEN, role: member, account: anthonyId,
+		function: "transferPoints", request: request{"from": "F1", "to": retailId, "type": "purchase", "amount": 50},
+		setup: func(l *ledger) request {
+			l.as(openpoints.ROLE_MEMBER, natalieId).must("setPoolMember",
+				request{"poolId": fundedPool(l), "userId": anthonyId, "canSpend": false})
+			l.admin()
+			return nil
+		}},
+
+	// Delegation
+	{name: "business pulls points without an authorization", code: openpoints.ERR_FORBIDDEN, role: business,
+		account: retailId, function: "transferPoints",
+		request: request{"from": natalieId, "to": retailId, "type": "purchase", "amount": 100}},
+	{name: "delegate pulls points without an authorization", code: openpoints.ERR_FORBIDDEN, role: member,
+		account: "cashier", function: "transferPoints",
+		request: request{"from": natalieId, "to": retailId, "type": "purchase", "amount": 100},
+		setup:   func(l *ledger) request { cashier(l, retailId, "redeem"); return nil }},
+	{name: "authorization of another business", code: openpoints.ERR_FORBIDDEN, role: business, account: retailId,
+		function: "transferPoints", setup: func(l *ledger) request {
+			return request{"from": natalieId, "to": retailId, "type": "purchase", "amount": 100,
+				"authorizationId": paymentAuthorization(l, bankId)}
+		}},
+	{name: "authorization exceeded", code: openpoints.ERR_FORBIDDEN, role: business, account: retailId,
+		function: "transferPoints", setup: func(l *ledger) request {
+			return request{"from": natalieId, "to": retailId, "type": "purchase", "amount": 300,
+				"authorizationId": paymentAuthorization(l, retailId)}
+		}},
+	{name: "authorization used twice", code: openpoints.ERR_INVALID_STATE, role: business, account: retailId,
+		function: "transferPoints", setup: func(l *ledger) request {
+			pull := request{"from": natalieId, "to": retailId, "type": "purchase", "amount": 100,
+				"authorizationId": paymentAuthorization(l, retailId)}
+			l.as(openpoints.ROLE_BUSINESS, retailId).must("transferPoints", pull)
+			l.admin()
+			return pull
+		}},
+	{name: "authorization given by another member", code: openpoints.ERR_FORBIDDEN, role: member, account: anthonyId,
+		function: "authorizePayment", request: request{"authorizationId": "A1", "userId": natalieId,
+			"businessId": retailId, "maxAmount": 200, "expires": "2018-01-01T00:00:00Z"}},
+	{name: "reversal by a delegate of another business", code: openpoints.ERR_FORBIDDEN, role: member,
+		account: "cashier", function: "reverseTransaction", request: request{"refNumber": firstRefNumber, "reason": "returned"},
+		setup: func(l *ledger) request {
+			cashier(l, bankId, "refund")
+			transfer(l, natalieId, retailId, 100)
+			return nil
+		}},
+
+	// Risk and compliance
+	{name: "pool spend by a frozen member", code: openpoints.ERR_COMPLIANCE_HOLD, role: member, account: natalieId,
+		function: "transferPoints", request: request{"from": "F1", "to": retailId, "type": "purchase", "amount": 50},
+		setup: func(l *ledger) request {
+			fundedPool(l)
+			l.must("freezeAccount", request{"userId": natalieId, "reasonCode": "AML-01"})
+			return nil
+		}},
+	{name: "refund past a block rule", code: openpoints.ERR_VALIDATION_FAILED, role: member, account: natalieId,
+		function: "transferPoints", request: request{"from": natalieId, "to": retailId, "type": "refund", "amount": 100},
+		setup: func(l *ledger) request {
+			l.must("setRiskRule", request{"ruleId": "big", "kind": "maxAmount", "limit": 50, "severity": "block",
+				"active": true})
+			return nil
+		}},
+}
+
+func TestFunctionsRefuse(t *testing.T) {
+	runErrorCases(t, refusedCases)
+}
+
+func TestEveryFunctionHasACase(t *testing.T) {
+
+	covered := map[string]bool{}
+	for _, c := range functionCases {
+		if _, registered := readFunctions[c.function]; !registered {
+			t.Errorf("%s has a case but is not registered", c.function)
+		}
+		covered[c.function] = true
+	}
+	for function := range readFunctions {
+		if !covered[function] {
+			t.Errorf("%s is registered but has no case", function)
+		}
+	}
+}
+
+func TestFunctions(t *testing.T) {
+
+	for i, c := range functionCases {
+		c := c
+		t.Run(c.function+"/"+strconv.Itoa(i), func(t *testing.T) {
+			l := newLedger(t)
+
+			// A nil request is sent as no request at all, not as a JSON null
+			var req interface{}
+			if c.request != nil {
+				req = c.request
+			}
+			if c.setup != nil {
+				if setupReq := c.setup(l); setupReq != nil {
+					req = setupReq
+				}
+			}
+
+			l.as(c.role, c.account)
+			payload := l.must(c.function, req)
+			l.admin()
+
+			if c.check != nil {
+				c.check(l, payload)
+			}
+		})
+	}
+}
+
+// Callers below the role of a function are turned away before it runs
+func TestFunctionsCheckTheRole(t *testing.T) {
+
+	for _, desc := range registered {
+		if desc.Role == openpoints.ROLE_MEMBER || desc.Delegate != "" {
+			continue
+		}
+		t.Run(desc.Name, func(t *testing.T) {
+			l := newLedger(t)
+			l.as(openpoints.ROLE_MEMBER, natalieId).mustFail(desc.Name, nil, openpoints.ERR_FORBIDDEN)
+		})
+	}
+}
+
+// Requests without a required field are rejected with the field named
+func TestFunctionsCheckRequiredFields(t *testing.T) {
+
+	for _, desc := range registered {
+		var required string
+		for _, field := range desc.Request {
+			if field.Required {
+				required = field.Name
+				break
+			}
+		}
+		if required == "" {
+			continue
+		}
+		t.Run(desc.Name, func(t *testing.T) {
+			l := newLedger(t)
+			_, err := l.call(desc.Name, request{})
+			checkCode(t, desc.Name, err, openpoints.ERR_VALIDATION_FAILED)
+			if field := err.(*openpoints.ChaincodeError).Field; field == "" {
+				t.Errorf("%s: the error names no field, %s is required", desc.Name, required)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package openpoints_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/gscdist/GscLabChaincode/mockstub"
+	"github.com/gscdist/GscLabChaincode/openpoints"
+)
+
+// Members created by init
+const (
+	bankId    = openpoints.ORIGINATOR_ID
+	retailId  = "T5940872"
+	natalieId = "U2974034"
+	anthonyId = "U3151672"
+)
+
+// Program the tests create next to the default program
+const airId = "air"
+
+// First reference number handed out after init
+const firstRefNumber = "2985674978"
+
+// An initialized ledger and the test that drives it. Calls are submitted as an admin unless as sets another caller.
+type ledger struct {
+	t *testing.T
+	h *mockstub.Harness
+}
+
+func newLedger(t *testing.T) *ledger {
+
+	t.Helper()
+	h, err := mockstub.NewInitializedHarness()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := &ledger{t: t, h: h}
+	return l.admin()
+}
+
+// as submits the following calls with a role and the member account the caller acts for, in the default program and
+// in the air program
+func (l *ledger) as(role string, account string) *ledger {
+
+	l.t.Helper()
+	attrs := map[string]string{}
+	for _, suffix := range []string{"", "." + airId} {
+		attrs[openpoints.ROLE_ATTRIBUTE+suffix] = role
+		if account != "" {
+			attrs[openpoints.ACCOUNT_ATTRIBUTE+suffix] = account
+		}
+	}
+	err := l.h.SetIdentity(role+account, attrs)
+	if err != nil {
+		l.t.Fatal(err)
+	}
+
+	return l
+}
+
+func (l *ledger) admin() *ledger {
+	return l.as(openpoints.ROLE_ADMIN, "")
+}
+
+// call runs a function, invoking it if it writes and evaluating it otherwise
+func (l *ledger) call(function string, request interface{}) ([]byte, error) {
+	if readFunctions[function] {
+		return l.h.Query(function, request)
+	}
+	return l.h.Invoke(function, request)
+}
+
+// must runs a function that is expected to succeed and returns its payload
+func (l *ledger) must(function string, request interface{}) []byte {
+
+	l.t.Helper()
+	payload, err := l.call(function, request)
+	if err != nil {
+		l.t.Fatalf("%s: %s", function, err)
+	}
+
+	return payload
+}
+
+// mustFail runs a function that is expected to fail with a code
+func (l *ledger) mustFail(function string, request interface{}, code string) {
+
+	l.t.Helper()
+	_, err := l.call(function, request)
+	checkCode(l.t, function, err, code)
+}
+
+// decode unmarshals a payload into v
+func (l *ledger) decode(payload []byte, v interface{}) {
+
+	l.t.Helper()
+	err := json.Unmarshal(payload, v)
+	if err != nil {
+		l.t.Fatalf("failed to decode %s: %s", payload, err)
+	}
+}
+
+// user reads a member account as an admin
+func (l *ledger) user(userId string) openpoints.User {
+
+	l.t.Helper()
+	payload, err := l.h.Query("getUserAccount", map[string]string{"userId": userId})
+	if err != nil {
+		l.t.Fatalf("getUserAccount %s: %s", userId, err)
+	}
+	var user openpoints.User
+	l.decode(payload, &user)
+
+	return user
+}
+
+// effect returns the first effect of a type the last call recorded
+func (l *ledger) effect(effectType string) openpoints.EventEffect {
+
+	l.t.Helper()
+	ev, err := l.h.LastEvent()
+	if err != nil {
+		l.t.Fatal(err)
+	}
+	for _, effect := range ev.Effects {
+		if effect.Type == effectType {
+			return effect
+		}
+	}
+	l.t.Fatalf("%s recorded no %s effect", ev.Function, effectType)
+
+	return openpoints.EventEffect{}
+}
+
+// checkCode fails the test unless err is a ChaincodeError with the code
+func checkCode(t *testing.T, function string, err error, code string) {
+
+	t.Helper()
+	if err == nil {
+		t.Fatalf("%s succeeded, want %s", function, code)
+	}
+	ccErr, ok := err.(*openpoints.ChaincodeError)
+	if !ok {
+		t.Fatalf("%s: %v is not a ChaincodeError", function, err)
+	}
+	if ccErr.Code != code {
+		t.Fatalf("%s: %s, want %s", function, ccErr, code)
+	}
+}
+
+// The functions describeFunctions lists, and which of them are reads that are evaluated without committing
+var (
+	registered    []openpoints.FunctionDescription
+	readFunctions = map[string]bool{}
+)
+
+func init() {
+
+	h, err := mockstub.NewHarness()
+	if err != nil {
+		panic(err)
+	}
+	payload, err := h.Query("describeFunctions", nil)
+	if err != nil {
+		panic(err)
+	}
+	var api openpoints.APIDescription
+	err = json.Unmarshal(payload, &api)
+	if err != nil {
+		panic(err)
+	}
+	registered = api.Functions
+	for _, desc := range api.Functions {
+		readFunctions[desc.Name] = desc.Access == openpoints.ACCESS_READ
+	}
+}
@@ -0,0 +1,173 @@
+package openpoints
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ============================================================================================================================
+// Account history
+//
+// Both queries read the key history of the member record, so the peer must run with the history database enabled
+// (core.ledger.history.enableHistoryDatabase). Versions are linked to the transfer that wrote them through the
+// TxId recorded on every Transaction. One Fabric transaction may post several, such as a purchase with its earnings
+// or both legs of an exchange, so a version lists all of them.
+// ============================================================================================================================
+
+// Request for getBalanceAt. A date without a time means midnight UTC at the start of that day.
+type balanceAtRequest struct {
+	UserId string    `json:"userId" validate:"required"`
+	At     time.Time `json:"at" validate:"required"`
+}
+
+// Member balance, tier and transaction count as of a point in time
+type BalanceAt struct {
+	UserId        string    `json:"UserId"`
+	At            time.Time `json:"At"`
+	Balance       float64   `json:"Balance"`
+	Status        string    `json:"Status"`
+	NumTxs        int       `json:"NumberOfTransactions"`
+	AsOfTxId      string    `json:"AsOfTxId"`
+	AsOfTimestamp time.Time `json:"AsOfTimestamp"`
+}
+
+// One version of a member record with the transactions of the member posted by the Fabric transaction that wrote it
+type AccountVersion struct {
+	TxId         string        `json:"TxId"`
+	Timestamp    time.Time     `json:"Timestamp"`
+	IsDelete     bool          `json:"IsDelete"`
+	User         *User         `json:"User,omitempty"`
+	Transactions []Transaction `json:"Transactions,omitempty"`
+}
+
+// Every version of a member record, newest first
+type AccountHistory struct {
+	UserId   string           `json:"UserId"`
+	Versions []AccountVersion `json:"Versions"`
+}
+
+// ============================================================================================================================
+// Read every version of a member record, newest first
+// ============================================================================================================================
+func userVersions(ctx *TransactionContext, userId string) ([]AccountVersion, error) {
+
+	iter, err := ctx.GetStub().GetHistoryForKey(userId)
+	if err != nil {
+		return nil, newError(ERR_LEDGER, "failed to read history of %s: %s", userId, err)
+	}
+	defer iter.Close()
+
+	var versions []AccountVersion
+	for iter.HasNext() {
+		mod, err := iter.Next()
+		if err != nil {
+			return nil, newError(ERR_LEDGER, "failed to read history of %s: %s", userId, err)
+		}
+
+		var version AccountVersion
+		version.TxId = mod.TxId
+		version.IsDelete = mod.IsDelete
+		if mod.Timestamp != nil {
+			version.Timestamp = time.Unix(mod.Timestamp.GetSeconds(), int64(mod.Timestamp.GetNanos())).UTC()
+		}
+		if !mod.IsDelete {
+			var user User
+			err = json.Unmarshal(mod.Value, &user)
+			if err != nil {
+				return nil, newError(ERR_CORRUPT_STATE, "failed to decode version %s of %s: %s", mod.TxId, userId, err)
+			}
+			version.User = &user
+		}
+
+		versions = append(versions, version)
+	}
+
+	if len(versions) == 0 {
+		return nil, newError(ERR_NOT_FOUND, "user %s does not exist", userId)
+	}
+
+	return versions, nil
+}
+
+// ============================================================================================================================
+// Balance, tier and transaction count of a member as of a point in time
+// ============================================================================================================================
+func (t *SimpleChaincode) getBalanceAt(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*balanceAtRequest)
+
+	versions, err := userVersions(ctx, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	version := versionAt(versions, req.At)
+	if version == nil {
+		return nil, newError(ERR_NOT_FOUND, "user %s did not exist at %s", req.UserId, req.At.Format(time.RFC3339))
+	}
+
+	var res BalanceAt
+	res.UserId = req.UserId
+	res.At = req.At
+	res.Balance = version.User.Balance
+	res.Status = version.User.Status
+	res.NumTxs = version.User.NumTxs
+	res.AsOfTxId = version.TxId
+	res.AsOfTimestamp = version.Timestamp
+
+	resAsBytes, _ := json.Marshal(res)
+	return resAsBytes, nil
+}
+
+// The version of a member record current at a point in time, nil if the member did not exist then
+func versionAt(versions []AccountVersion, at time.Time) *AccountVersion {
+
+	for i := range versions {
+		if versions[i].Timestamp.After(at) {
+			continue
+		}
+		if versions[i].IsDelete {
+			return nil
+		}
+		return &versions[i]
+	}
+
+	return nil
+}
+
+// ============================================================================================================================
+// Every version of a member record with the transaction that wrote it
+// ============================================================================================================================
+func (t *SimpleChaincode) getAccountHistory(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*userRequest)
+
+	versions, err := userVersions(ctx, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	var txs AllTransactions
+	_, err = readState(ctx.GetStub(), "allTx", &txs)
+	if err != nil {
+		return nil, err
+	}
+
+	txsById := make(map[string][]Transaction)
+	for _, tx := range txs.Transactions {
+		if tx.TxId != "" && (tx.To == req.UserId || tx.From == req.UserId) {
+			txsById[tx.TxId] = append(txsById[tx.TxId], tx)
+		}
+	}
+
+	for i := range versions {
+		versions[i].Transactions = txsById[versions[i].TxId]
+	}
+
+	var res AccountHistory
+	res.UserId = req.UserId
+	res.Versions = versions
+
+	resAsBytes, _ := json.Marshal(res)
+	return resAsBytes, nil
+}
@@ -0,0 +1,272 @@
+package openpoints
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+)
+
+// ============================================================================================================================
+// Points plus money purchases
+//
+// A purchase splits its price between points and money. The points part is priced by the best active contract of
+// the business, like a catalog redemption. The money part earns points at the earn rate of the business for the tier
+// of the member, or at its default rate if the tier has none. Both halves are one Transaction from the member to the
+// business:
+//
+//	ListAmount   points part before the contract discount
+//	Amount       points part the member pays
+//	ContractId   contract that priced the points part, empty if none lowered it
+//	Money        money part
+//	EarnRate     points earned per unit of money
+//	Earned       points the business credits the member for the money part
+//
+// The member balance changes by Earned - Amount and the business balance by Amount - Earned. Earnings inside the
+// return window of the business are EarnedPending and go to the pending balance of the member instead.
+//
+// Only the business, or its delegate with the redeem permission, declares a money part. The member pays the points
+// part itself, or gives the business a payment authorization for it.
+// ============================================================================================================================
+
+// Transaction type of a purchase
+const TX_TYPE_PURCHASE = "purchase"
+
+// Composite key object type of earn rules
+const earnRuleObject = "earnRule"
+
+// Earn rate of one tier
+type TierRate struct {
+	Tier string  `json:"Tier"`
+	Rate float64 `json:"Rate"`
+}
+
+// Points a business gives per unit of money spent
+type EarnRule struct {
+	BusinessId string     `json:"BusinessId"`
+	Rate       float64    `json:"Rate"`
+	TierRates  []TierRate `json:"TierRates"`
+	// Return window in days before earned points can be spent, 0 makes them available at once
+	MaturityDays int `json:"MaturityDays"`
+}
+
+// Request for setEarnRate, without a tier it sets the default rate and the return window of the business
+type earnRateRequest struct {
+	BusinessId   string  `json:"businessId" validate:"required"`
+	Tier         string  `json:"tier"`
+	Rate         float64 `json:"rate" validate:"required,min=0"`
+	MaturityDays int     `json:"maturityDays" validate:"min=0"`
+}
+
+// Request for getEarnRule
+type earnRuleRequest struct {
+	BusinessId string `json:"businessId" validate:"required"`
+}
+
+// Request for purchase
+type purchaseRequest struct {
+	UserId      string  `json:"userId" validate:"required"`
+	BusinessId  string  `json:"businessId" validate:"required"`
+	Points      float64 `json:"points" validate:"min=0"`
+	Money       float64 `json:"money" validate:"min=0"`
+	Description string  `json:"description"`
+	// Payment authorization of the member, when the business or a delegate takes the points
+	AuthorizationId string `json:"authorizationId"`
+}
+
+// Earn rate of a tier, the default rate if the tier has none
+func (rule EarnRule) rateFor(tier string) float64 {
+
+	for _, tierRate := range rule.TierRates {
+		if tierRate.Tier == tier {
+			return tierRate.Rate
+		}
+	}
+
+	return rule.Rate
+}
+
+func loadEarnRule(ctx *TransactionContext, businessId string) (string, EarnRule, error) {
+
+	rule := EarnRule{BusinessId: businessId, TierRates: []TierRate{}}
+
+	key, err := compositeKey(ctx.GetStub(), earnRuleObject, businessId)
+	if err != nil {
+		return "", rule, err
+	}
+	_, err = readState(ctx.GetStub(), key, &rule)
+
+	return key, rule, err
+}
+
+// ============================================================================================================================
+// Set the default earn rate of a business or the rate of one tier
+// ============================================================================================================================
+func (t *SimpleChaincode) setEarnRate(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*earnRateRequest)
+	stub := ctx.GetStub()
+
+	err := checkAccount(ctx, req.BusinessId)
+	if err != nil {
+		return nil, err
+	}
+
+	var business User
+	found, err := readState(stub, req.BusinessId, &business)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, newError(ERR_NOT_FOUND, "business %s does not exist", req.BusinessId)
+	}
+	if req.Tier != "" && !containsString(ctx.Program().Tiers, req.Tier) {
+		return nil, fieldError("tier", "tier %s does not exist in program %s", req.Tier, ctx.Program().ProgramId)
+	}
+
+	key, rule, err := loadEarnRule(ctx, req.BusinessId)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Tier == "" {
+		rule.Rate = req.Rate
+		rule.MaturityDays = req.MaturityDays
+	} else {
+		set := false
+		for i := range rule.TierRates {
+			if rule.TierRates[i].Tier == req.Tier {
+				rule.TierRates[i].Rate = req.Rate
+				set = true
+			}
+		}
+		if !set {
+			rule.TierRates = append(rule.TierRates, TierRate{Tier: req.Tier, Rate: req.Rate})
+		}
+	}
+
+	err = writeState(stub, key, rule)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Event().earnRuleChanged(rule)
+
+	asBytes, _ := json.Marshal(rule)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Get the earn rates of a business
+// ============================================================================================================================
+func (t *SimpleChaincode) getEarnRule(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*earnRuleRequest)
+
+	_, rule, err := loadEarnRule(ctx, req.BusinessId)
+	if err != nil {
+		return nil, err
+	}
+
+	asBytes, _ := json.Marshal(rule)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Pay a business partly in points and partly in money, earning points on the money part
+// ============================================================================================================================
+func (t *SimpleChaincode) purchase(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*purchaseRequest)
+	stub := ctx.GetStub()
+	ev := ctx.Event()
+
+	if req.Points == 0 && req.Money == 0 {
+		return nil, fieldError("points", "a purchase needs points, money or both")
+	}
+	if req.UserId == req.BusinessId {
+		return nil, fieldError("businessId", "%s can not buy from itself", req.UserId)
+	}
+	// The business attests the money it was paid, the member consents to the points it pays
+	var err error
+	if req.Money > 0 {
+		err = checkBusiness(ctx, req.BusinessId, DELEGATE_REDEEM)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if req.Points > 0 {
+		err = checkPayer(ctx, req.UserId, req.BusinessId, req.AuthorizationId, req.Points)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var member User
+	found, err := readState(stub, req.UserId, &member)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, newError(ERR_NOT_FOUND, "user %s does not exist", req.UserId)
+	}
+
+	var tx Transaction
+	tx.Date = ev.Timestamp.Truncate(time.Minute)
+	tx.Type = TX_TYPE_PURCHASE
+	tx.From = req.UserId
+	tx.To = req.BusinessId
+	tx.Description = req.Description
+	tx.Amount = req.Points
+	tx.ListAmount = req.Points
+	tx.Money = req.Money
+	tx.StatusCode = 1
+	tx.StatusMsg = "Transaction Completed"
+	tx.TxId = stub.GetTxID()
+
+	if tx.Amount > 0 {
+		tx.ContractId, tx.Amount, err = bestContractPrice(stub, tx, req.BusinessId)
+		if err != nil {
+			return nil, err
+		}
+		if tx.ContractId != "" {
+			err = chargeContract(stub, ev, tx)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	_, rule, err := loadEarnRule(ctx, req.BusinessId)
+	if err != nil {
+		return nil, err
+	}
+	tx.EarnRate = rule.rateFor(member.Status)
+	tx.Earned = math.Floor(tx.Money*tx.EarnRate*100) / 100
+	if tx.Description == "" {
+		tx.Description = fmt.Sprintf("%v points and %v money, earned %v", tx.Amount, tx.Money, tx.Earned)
+	}
+
+	matures, err := earningMaturity(ctx, tx, rule)
+	if err != nil {
+		return nil, err
+	}
+	tx.EarnedPending = tx.Earned > 0 && !matures.IsZero()
+
+	tx.RefNumber, err = nextRefNumber(stub, ev)
+	if err != nil {
+		return nil, err
+	}
+	err = postTransfer(stub, ev, &tx)
+	if err != nil {
+		return nil, err
+	}
+	if tx.EarnedPending {
+		err = holdEarning(ctx, tx, matures)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	asBytes, _ := json.Marshal(tx)
+	return asBytes, nil
+}
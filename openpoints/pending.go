@@ -0,0 +1,344 @@
+package openpoints
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// ============================================================================================================================
+// Pending earnings
+//
+// Points earned on a purchase wait out the return window of the business before the member can spend them. The
+// window is MaturityDays of the contract that priced the purchase, or of the earn rule of the business when the
+// contract sets none, and earnings without a window are available at once. Pending points are held in the
+// PendingBalance of the member next to its Balance and tracked as one PendingEarning per purchase. matureEarnings
+// moves every earning past its maturity date into the balance and its earned wallet, a member matures its own
+// earnings and admins those of every member. Reversing the purchase with reverseTransaction before then cancels the
+// pending points instead of taking them from the balance. Only the business that received a transaction, or its
+// delegates with the refund permission, reverses it.
+// ============================================================================================================================
+
+// Pending earning statuses
+const EARNING_PENDING = "PENDING"
+const EARNING_MATURED = "MATURED"
+const EARNING_CANCELLED = "CANCELLED"
+
+// Composite key object types
+const pendingEarningObject = "pendingEarning"
+const reversalObject = "reversal"
+
+// Points earned on one purchase, waiting for the end of its return window
+type PendingEarning struct {
+	UserId     string    `json:"UserId"`
+	RefNumber  string    `json:"RefNumber"`
+	BusinessId string    `json:"BusinessId"`
+	ContractId string    `json:"ContractId,omitempty"`
+	Amount     float64   `json:"Amount"`
+	Earned     time.Time `json:"Earned"`
+	Matures    time.Time `json:"Matures"`
+	Status     string    `json:"Status"`
+	Closed     time.Time `json:"Closed"`
+	ClosedRef  string    `json:"ClosedRef,omitempty"`
+}
+
+// Request for matureEarnings, without a userId an admin matures the earnings of every member
+type matureEarningsRequest struct {
+	UserId string `json:"userId"`
+}
+
+// Request for getPendingEarnings
+type pendingEarningsRequest struct {
+	UserId string `json:"userId" validate:"required"`
+	Status string `json:"status" validate:"oneof=PENDING|MATURED|CANCELLED"`
+}
+
+// Request for reverseTransaction
+type reverseTransactionRequest struct {
+	RefNumber string `json:"refNumber" validate:"required"`
+	Reason    string `json:"reason"`
+}
+
+// Maturity date of the points earned by a purchase, zero when they are available at once
+func earningMaturity(ctx *TransactionContext, tx Transaction, rule EarnRule) (time.Time, error) {
+
+	days := rule.MaturityDays
+	if tx.ContractId != "" {
+		var contract Contract
+		_, err := readState(ctx.GetStub(), tx.ContractId, &contract)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if contract.MaturityDays > 0 {
+			days = contract.MaturityDays
+		}
+	}
+	if days == 0 {
+		return time.Time{}, nil
+	}
+
+	return ctx.Event().Timestamp.AddDate(0, 0, days), nil
+}
+
+func pendingEarningKey(ctx *TransactionContext, userId string, refNumber string) (string, error) {
+	return compositeKey(ctx.GetStub(), pendingEarningObject, userId, refNumber)
+}
+
+// Track the pending points of a posted purchase
+func holdEarning(ctx *TransactionContext, tx Transaction, matures time.Time) error {
+
+	earning := PendingEarning{UserId: tx.From, RefNumber: tx.RefNumber, BusinessId: tx.To, ContractId: tx.ContractId,
+		Amount: tx.Earned, Earned: ctx.Event().Timestamp, Matures: matures, Status: EARNING_PENDING}
+
+	key, err := pendingEarningKey(ctx, earning.UserId, earning.RefNumber)
+	if err != nil {
+		return err
+	}
+	err = writeState(ctx.GetStub(), key, earning)
+	if err != nil {
+		return err
+	}
+	ctx.Event().pendingEarning(earning)
+
+	return nil
+}
+
+func loadPendingEarnings(ctx *TransactionContext, userId string) ([]PendingEarning, error) {
+
+	attributes := []string{}
+	if userId != "" {
+		attributes = append(attributes, userId)
+	}
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(pendingEarningObject, attributes)
+	if err != nil {
+		return nil, newError(ERR_LEDGER, "failed to list pending earnings: %s", err)
+	}
+	defer iter.Close()
+
+	earnings := []PendingEarning{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, newError(ERR_LEDGER, "failed to list pending earnings: %s", err)
+		}
+
+		var earning PendingEarning
+		err = json.Unmarshal(kv.Value, &earning)
+		if err != nil {
+			return nil, newError(ERR_CORRUPT_STATE, "failed to decode pending earning %s: %s", kv.Key, err)
+		}
+		earnings = append(earnings, earning)
+	}
+
+	return earnings, nil
+}
+
+// ============================================================================================================================
+// Move every pending earning past its maturity date into the balance of its member
+// ============================================================================================================================
+func (t *SimpleChaincode) matureEarnings(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*matureEarningsRequest)
+	stub := ctx.GetStub()
+	ev := ctx.Event()
+
+	if req.UserId == "" && roleRank[ctx.Role()] < roleRank[ROLE_ADMIN] {
+		return nil, newError(ERR_FORBIDDEN, "only admins mature the earnings of every member")
+	}
+	if req.UserId != "" {
+		err := checkAccount(ctx, req.UserId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	earnings, err := loadPendingEarnings(ctx, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	matured := []PendingEarning{}
+	for _, earning := range earnings {
+		if earning.Status != EARNING_PENDING || earning.Matures.After(ev.Timestamp) {
+			continue
+		}
+
+		var user User
+		found, err := readState(stub, earning.UserId, &user)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, newError(ERR_NOT_FOUND, "user %s does not exist", earning.UserId)
+		}
+		user.normalizeWallets()
+		user.Pending = user.Pending - earning.Amount
+		user.Balance = user.Balance + earning.Amount
+		user.creditWallets(map[string]float64{WALLET_EARNED: earning.Amount})
+		user.Modified = ev.Timestamp.Format(time.RFC822)
+		err = writeState(stub, user.UserId, user)
+		if err != nil {
+			return nil, err
+		}
+		ev.balanceChanged(user, earning.Amount)
+
+		earning.Status = EARNING_MATURED
+		earning.Closed = ev.Timestamp
+		key, err := pendingEarningKey(ctx, earning.UserId, earning.RefNumber)
+		if err != nil {
+			return nil, err
+		}
+		err = writeState(stub, key, earning)
+		if err != nil {
+			return nil, err
+		}
+		ev.pendingEarning(earning)
+		matured = append(matured, earning)
+	}
+
+	asBytes, _ := json.Marshal(matured)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// List the earnings of a member, optionally in one status, by maturity date
+// ============================================================================================================================
+func (t *SimpleChaincode) getPendingEarnings(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*pendingEarningsRequest)
+
+	earnings, err := loadPendingEarnings(ctx, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []PendingEarning{}
+	for _, earning := range earnings {
+		if req.Status == "" || earning.Status == req.Status {
+			res = append(res, earning)
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Matures.Before(res[j].Matures) })
+
+	asBytes, _ := json.Marshal(res)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Reverse a posted transaction with a compensating TX_TYPE_REVERSAL transaction from its receiver back to its sender.
+// The reversal gives the points back to the budget of the contract and takes back the points the sender earned,
+// cancelling them while they are still pending. A transaction is reversed at most once and reversals and refunds
+// can not be reversed.
+// ============================================================================================================================
+func (t *SimpleChaincode) reverseTransaction(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*reverseTransactionRequest)
+	stub := ctx.GetStub()
+	ev := ctx.Event()
+
+	var txs AllTransactions
+	_, err := readState(stub, "allTx", &txs)
+	if err != nil {
+		return nil, err
+	}
+	var original *Transaction
+	for i := range txs.Transactions {
+		if txs.Transactions[i].RefNumber == req.RefNumber {
+			original = &txs.Transactions[i]
+		}
+	}
+	if original == nil {
+		return nil, newError(ERR_NOT_FOUND, "transaction %s does not exist", req.RefNumber)
+	}
+	if original.Type == TX_TYPE_REVERSAL || original.Type == TX_TYPE_REFUND {
+		return nil, newError(ERR_INVALID_STATE, "transaction %s is a %s and can not be reversed", original.RefNumber, original.Type)
+	}
+
+	// The receiver gives the points back, or its delegate with the refund permission
+	err = checkBusiness(ctx, original.To, DELEGATE_REFUND)
+	if err != nil {
+		return nil, err
+	}
+
+	reversalKey, err := compositeKey(stub, reversalObject, original.RefNumber)
+	if err != nil {
+		return nil, err
+	}
+	var reversedBy string
+	found, err := readState(stub, reversalKey, &reversedBy)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return nil, newError(ERR_INVALID_STATE, "transaction %s is already reversed by %s", original.RefNumber, reversedBy)
+	}
+
+	var tx Transaction
+	tx.Date = ev.Timestamp.Truncate(time.Minute)
+	tx.Type = TX_TYPE_REVERSAL
+	tx.From = original.To
+	tx.To = original.From
+	tx.Description = "Reversal of " + original.RefNumber
+	if req.Reason != "" {
+		tx.Description = tx.Description + ": " + req.Reason
+	}
+	tx.ContractId = original.ContractId
+	tx.Amount = original.Amount
+	tx.ListAmount = original.ListAmount
+	tx.Money = original.Money
+	tx.Earned = original.Earned
+	tx.StatusCode = 1
+	tx.StatusMsg = "Transaction Completed"
+	tx.TxId = stub.GetTxID()
+	tx.LinkedRef = ctx.Program().ProgramId + "/" + original.RefNumber
+
+	tx.RefNumber, err = nextRefNumber(stub, ev)
+	if err != nil {
+		return nil, err
+	}
+
+	// Earnings still inside their return window are cancelled rather than taken from the balance
+	if original.EarnedPending {
+		key, err := pendingEarningKey(ctx, original.From, original.RefNumber)
+		if err != nil {
+			return nil, err
+		}
+		var earning PendingEarning
+		found, err := readState(stub, key, &earning)
+		if err != nil {
+			return nil, err
+		}
+		if found && earning.Status == EARNING_PENDING {
+			tx.EarnedPending = true
+			earning.Status = EARNING_CANCELLED
+			earning.Closed = ev.Timestamp
+			earning.ClosedRef = tx.RefNumber
+			err = writeState(stub, key, earning)
+			if err != nil {
+				return nil, err
+			}
+			ev.pendingEarning(earning)
+		}
+	}
+
+	if tx.ContractId != "" {
+		err = releaseContract(stub, ev, tx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = postTransfer(stub, ev, &tx)
+	if err != nil {
+		return nil, err
+	}
+	ev.reversal(tx, original.RefNumber)
+
+	err = writeState(stub, reversalKey, tx.RefNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	asBytes, _ := json.Marshal(tx)
+	return asBytes, nil
+}
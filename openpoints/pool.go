@@ -0,0 +1,475 @@
+package openpoints
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// ============================================================================================================================
+// Pooled accounts
+//
+// A pool is a shared wallet for a family or household. It is a member account of its own, so it has a balance and
+// appears in transactions like any other, plus a Pool record with its owner, its members and its contribution rules.
+// Only pool members can transfer points into a pool, each transfer between MinContribution and MaxContribution.
+// Points leave a pool through transferPoints called by a member of the pool, whose account attribute names the
+// member who spends them. That member needs CanSpend and stays within its TxLimit per transfer and MonthlyLimit per
+// calendar month, 0 meaning no limit. The spender is recorded on the transaction as SpentBy and every member keeps
+// running Contributed and Spent totals. postTransfer applies the rules to every posting from or into a pool except
+// the reversals and refunds the chaincode posts. Only the owner, or an admin, creates a pool and changes its rules
+// and members.
+// ============================================================================================================================
+
+// Composite key object type of pools
+const poolObject = "pool"
+
+// A member of a pool and its spending permission
+type PoolMember struct {
+	UserId       string  `json:"UserId"`
+	CanSpend     bool    `json:"CanSpend"`
+	TxLimit      float64 `json:"TxLimit"`
+	MonthlyLimit float64 `json:"MonthlyLimit"`
+	Month        string  `json:"Month"`
+	MonthSpent   float64 `json:"MonthSpent"`
+	Contributed  float64 `json:"Contributed"`
+	Spent        float64 `json:"Spent"`
+}
+
+// A pooled account, its balance is on the member account PoolId
+type Pool struct {
+	PoolId          string       `json:"PoolId"`
+	Name            string       `json:"Name"`
+	OwnerId         string       `json:"OwnerId"`
+	MinContribution float64      `json:"MinContribution"`
+	MaxContribution float64      `json:"MaxContribution"`
+	Members         []PoolMember `json:"Members"`
+	Created         time.Time    `json:"Created"`
+}
+
+// Request for createPool
+type createPoolRequest struct {
+	PoolId          string  `json:"poolId" validate:"required"`
+	Name            string  `json:"name" validate:"required"`
+	OwnerId         string  `json:"ownerId" validate:"required"`
+	MinContribution float64 `json:"minContribution" validate:"min=0"`
+	MaxContribution float64 `json:"maxContribution" validate:"min=0"`
+}
+
+// Request for setPoolRules
+type poolRulesRequest struct {
+	PoolId          string  `json:"poolId" validate:"required"`
+	MinContribution float64 `json:"minContribution" validate:"min=0"`
+	MaxContribution float64 `json:"maxContribution" validate:"min=0"`
+}
+
+// Request for setPoolMember, adding the member or updating its permission
+type poolMemberRequest struct {
+	PoolId       string  `json:"poolId" validate:"required"`
+	UserId       string  `json:"userId" validate:"required"`
+	CanSpend     bool    `json:"canSpend"`
+	TxLimit      float64 `json:"txLimit" validate:"min=0"`
+	MonthlyLimit float64 `json:"monthlyLimit" validate:"min=0"`
+}
+
+// Request for removePoolMember
+type poolUserRequest struct {
+	PoolId string `json:"poolId" validate:"required"`
+	UserId string `json:"userId" validate:"required"`
+}
+
+// Request for getPool
+type poolRequest struct {
+	PoolId string `json:"poolId" validate:"required"`
+}
+
+// Pool member with the given id, nil if there is none
+func (pool *Pool) member(userId string) *PoolMember {
+
+	for i := range pool.Members {
+		if pool.Members[i].UserId == userId {
+			return &pool.Members[i]
+		}
+	}
+
+	return nil
+}
+
+// Pool of an account, nil if the account is not a pool
+func loadPool(stub shim.ChaincodeStubInterface, poolId string) (*Pool, error) {
+
+	key, err := compositeKey(stub, poolObject, poolId)
+	if err != nil {
+		return nil, err
+	}
+
+	var pool Pool
+	found, err := readState(stub, key, &pool)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return &pool, nil
+}
+
+func savePool(stub shim.ChaincodeStubInterface, ev *LedgerEvent, pool Pool) error {
+
+	key, err := compositeKey(stub, poolObject, pool.PoolId)
+	if err != nil {
+		return err
+	}
+	err = writeState(stub, key, pool)
+	if err != nil {
+		return err
+	}
+	ev.poolChanged(pool)
+
+	return nil
+}
+
+func requirePool(ctx *TransactionContext, poolId string) (*Pool, error) {
+
+	pool, err := loadPool(ctx.GetStub(), poolId)
+	if err != nil {
+		return nil, err
+	}
+	if pool == nil {
+		return nil, newError(ERR_NOT_FOUND, "pool %s does not exist", poolId)
+	}
+
+	return pool, nil
+}
+
+// Pool the caller manages as its owner
+func requireOwnedPool(ctx *TransactionContext, poolId string) (*Pool, error) {
+
+	pool, err := requirePool(ctx, poolId)
+	if err != nil {
+		return nil, err
+	}
+	err = checkAccount(ctx, pool.OwnerId)
+	if err != nil {
+		return nil, err
+	}
+
+	return pool, nil
+}
+
+// Member a pool spend is charged to, checked against its permission and limits
+func poolSpender(pool *Pool, tx Transaction) (*PoolMember, error) {
+
+	if tx.SpentBy == "" {
+		return nil, newError(ERR_FORBIDDEN, "spending from pool %s needs the member who spends", pool.PoolId)
+	}
+	member := pool.member(tx.SpentBy)
+	if member == nil || !member.CanSpend {
+		return nil, newError(ERR_FORBIDDEN, "%s may not spend from pool %s", tx.SpentBy, pool.PoolId)
+	}
+	if member.TxLimit > 0 && tx.Amount > member.TxLimit {
+		return nil, newError(ERR_POOL_LIMIT, "%s may spend at most %v points at once from pool %s, %v required",
+			member.UserId, member.TxLimit, pool.PoolId, tx.Amount)
+	}
+
+	month := tx.Date.Format("2006-01")
+	spent := 0.0
+	if member.Month == month {
+		spent = member.MonthSpent
+	}
+	if member.MonthlyLimit > 0 && spent+tx.Amount > member.MonthlyLimit {
+		return nil, newError(ERR_POOL_LIMIT, "%s has %v of its %v monthly points left in pool %s, %v required",
+			member.UserId, member.MonthlyLimit-spent, member.MonthlyLimit, pool.PoolId, tx.Amount)
+	}
+
+	return member, nil
+}
+
+// Member a pool contribution comes from, checked against the contribution rules
+func poolContributor(pool *Pool, tx Transaction) (*PoolMember, error) {
+
+	member := pool.member(tx.From)
+	if member == nil {
+		return nil, newError(ERR_FORBIDDEN, "only members can transfer points into pool %s", pool.PoolId)
+	}
+	if tx.Amount < pool.MinContribution {
+		return nil, newError(ERR_POOL_LIMIT, "pool %s takes contributions of at least %v points", pool.PoolId, pool.MinContribution)
+	}
+	if pool.MaxContribution > 0 && tx.Amount > pool.MaxContribution {
+		return nil, newError(ERR_POOL_LIMIT, "pool %s takes contributions of at most %v points", pool.PoolId, pool.MaxContribution)
+	}
+
+	return member, nil
+}
+
+// Check a posting from or into a pool against its rules without writing anything
+func checkPoolTransfer(stub shim.ChaincodeStubInterface, tx Transaction) error {
+
+	_, _, err := poolsOf(stub, tx)
+	return err
+}
+
+// Pools a posting spends from and contributes to, checked against their rules. Reversals and refunds are exempt,
+// only the chaincode posts them to give back points it moved before.
+func poolsOf(stub shim.ChaincodeStubInterface, tx Transaction) (*Pool, *Pool, error) {
+
+	if tx.Type == TX_TYPE_REVERSAL || tx.Type == TX_TYPE_REFUND {
+		return nil, nil, nil
+	}
+
+	var from, to *Pool
+	var err error
+	if tx.From != "" {
+		from, err = loadPool(stub, tx.From)
+		if err != nil {
+			return nil, nil, err
+		}
+		if from != nil {
+			_, err = poolSpender(from, tx)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if tx.To != "" {
+		to, err = loadPool(stub, tx.To)
+		if err != nil {
+			return nil, nil, err
+		}
+		if to != nil {
+			_, err = poolContributor(to, tx)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	return from, to, nil
+}
+
+// ============================================================================================================================
+// Apply a posting to the pools it spends from or contributes to, attributing it to the member who made it
+// ============================================================================================================================
+func applyPoolTransfer(stub shim.ChaincodeStubInterface, ev *LedgerEvent, tx Transaction) error {
+
+	from, to, err := poolsOf(stub, tx)
+	if err != nil {
+		return err
+	}
+
+	if from != nil {
+		member, _ := poolSpender(from, tx)
+		month := tx.Date.Format("2006-01")
+		if member.Month != month {
+			member.Month = month
+			member.MonthSpent = 0
+		}
+		member.MonthSpent = member.MonthSpent + tx.Amount
+		member.Spent = member.Spent + tx.Amount
+		err = savePool(stub, ev, *from)
+		if err != nil {
+			return err
+		}
+	}
+	if to != nil {
+		member, _ := poolContributor(to, tx)
+		member.Contributed = member.Contributed + tx.Amount
+		err = savePool(stub, ev, *to)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ============================================================================================================================
+// Create a pool with its own account, owned by a member who can spend from it without limits
+// ============================================================================================================================
+func (t *SimpleChaincode) createPool(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*createPoolRequest)
+	stub := ctx.GetStub()
+	ev := ctx.Event()
+	program := ctx.Program()
+
+	if req.MaxContribution > 0 && req.MaxContribution < req.MinContribution {
+		return nil, fieldError("maxContribution", "maxContribution is below minContribution")
+	}
+	err := checkAccount(ctx, req.OwnerId)
+	if err != nil {
+		return nil, err
+	}
+
+	var owner User
+	found, err := readState(stub, req.OwnerId, &owner)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, newError(ERR_NOT_FOUND, "user %s does not exist", req.OwnerId)
+	}
+
+	if containsString(reservedKeys, req.PoolId) {
+		return nil, fieldError("poolId", "%s is reserved", req.PoolId)
+	}
+	existing, err := stub.GetState(req.PoolId)
+	if err != nil {
+		return nil, newError(ERR_LEDGER, "failed to read %s: %s", req.PoolId, err)
+	}
+	if existing != nil {
+		return nil, newError(ERR_ALREADY_EXISTS, "%s already exists", req.PoolId)
+	}
+
+	var account User
+	account.UserId = req.PoolId
+	account.Name = req.Name
+	if len(program.Tiers) > 0 {
+		account.Status = program.Tiers[0]
+	}
+	account.Join = ev.Timestamp.Format(DATE_LAYOUT)
+	account.Expiration = ev.Timestamp.AddDate(2, 0, 0).Format(DATE_LAYOUT)
+	account.Modified = ev.Timestamp.Format(DATE_LAYOUT)
+
+	err = writeState(stub, account.UserId, account)
+	if err != nil {
+		return nil, err
+	}
+	ev.userWritten(nil, account)
+
+	pool := Pool{PoolId: req.PoolId, Name: req.Name, OwnerId: req.OwnerId, MinContribution: req.MinContribution,
+		MaxContribution: req.MaxContribution, Members: []PoolMember{{UserId: req.OwnerId, CanSpend: true}}, Created: ev.Timestamp}
+	err = savePool(stub, ev, pool)
+	if err != nil {
+		return nil, err
+	}
+
+	asBytes, _ := json.Marshal(pool)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Set the contribution rules of a pool
+// ============================================================================================================================
+func (t *SimpleChaincode) setPoolRules(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*poolRulesRequest)
+
+	if req.MaxContribution > 0 && req.MaxContribution < req.MinContribution {
+		return nil, fieldError("maxContribution", "maxContribution is below minContribution")
+	}
+
+	pool, err := requireOwnedPool(ctx, req.PoolId)
+	if err != nil {
+		return nil, err
+	}
+
+	pool.MinContribution = req.MinContribution
+	pool.MaxContribution = req.MaxContribution
+	err = savePool(ctx.GetStub(), ctx.Event(), *pool)
+	if err != nil {
+		return nil, err
+	}
+
+	asBytes, _ := json.Marshal(pool)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Add a member to a pool or change its spending permission and limits
+// ============================================================================================================================
+func (t *SimpleChaincode) setPoolMember(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*poolMemberRequest)
+	stub := ctx.GetStub()
+
+	pool, err := requireOwnedPool(ctx, req.PoolId)
+	if err != nil {
+		return nil, err
+	}
+	if req.UserId == pool.PoolId {
+		return nil, fieldError("userId", "pool %s can not be a member of itself", pool.PoolId)
+	}
+
+	member := pool.member(req.UserId)
+	if member == nil {
+		var user User
+		found, err := readState(stub, req.UserId, &user)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, newError(ERR_NOT_FOUND, "user %s does not exist", req.UserId)
+		}
+		nested, err := loadPool(stub, req.UserId)
+		if err != nil {
+			return nil, err
+		}
+		if nested != nil {
+			return nil, fieldError("userId", "pool %s can not be a member of another pool", req.UserId)
+		}
+
+		pool.Members = append(pool.Members, PoolMember{UserId: req.UserId})
+		member = &pool.Members[len(pool.Members)-1]
+	}
+
+	member.CanSpend = req.CanSpend
+	member.TxLimit = req.TxLimit
+	member.MonthlyLimit = req.MonthlyLimit
+	err = savePool(stub, ctx.Event(), *pool)
+	if err != nil {
+		return nil, err
+	}
+
+	asBytes, _ := json.Marshal(pool)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Remove a member from a pool, the owner stays
+// ============================================================================================================================
+func (t *SimpleChaincode) removePoolMember(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*poolUserRequest)
+
+	pool, err := requireOwnedPool(ctx, req.PoolId)
+	if err != nil {
+		return nil, err
+	}
+	if req.UserId == pool.OwnerId {
+		return nil, fieldError("userId", "%s owns pool %s and can not be removed", req.UserId, pool.PoolId)
+	}
+
+	members := []PoolMember{}
+	for _, member := range pool.Members {
+		if member.UserId != req.UserId {
+			members = append(members, member)
+		}
+	}
+	if len(members) == len(pool.Members) {
+		return nil, newError(ERR_NOT_FOUND, "%s is not a member of pool %s", req.UserId, pool.PoolId)
+	}
+
+	pool.Members = members
+	err = savePool(ctx.GetStub(), ctx.Event(), *pool)
+	if err != nil {
+		return nil, err
+	}
+
+	asBytes, _ := json.Marshal(pool)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Get a pool with its members, their permissions and what each contributed and spent
+// ============================================================================================================================
+func (t *SimpleChaincode) getPool(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*poolRequest)
+
+	pool, err := requirePool(ctx, req.PoolId)
+	if err != nil {
+		return nil, err
+	}
+
+	asBytes, _ := json.Marshal(pool)
+	return asBytes, nil
+}
@@ -0,0 +1,579 @@
+package openpoints
+
+import (
+	"encoding/json"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// ============================================================================================================================
+// Loyalty programs
+//
+// One chaincode instance hosts any number of loyalty programs. Every request takes an optional programId field,
+// DEFAULT_PROGRAM when omitted, and the function then runs against the state of that program only. The default
+// program keeps its records under their plain keys, so ledgers created before programs existed are its state. Every
+// other program has its own namespace: a key k of program p is stored as the composite key ("ns", [p, "", k]) and a
+// composite key (objectType, attributes) as ("ns", [p, objectType, attributes...]). Handlers never see the namespace,
+// the stub returned by TransactionContext.GetStub translates keys in both directions.
+//
+// The program registry and the currency pairs between programs are shared by all programs. Admins of the default
+// program operate the platform: they create programs and configure currency pairs, see exchange.go. Roles are per
+// program, the certificate attribute "role.<programId>" holds the role of the caller in that program. The plain
+// "role" attribute only applies to the default program.
+// ============================================================================================================================
+
+// Program of requests without a programId
+const DEFAULT_PROGRAM = "openpoints"
+
+// Request field naming the program, accepted by every function
+const PROGRAM_FIELD = "programId"
+
+// Composite key object types of shared records, and of namespaced keys
+const programObject = "program"
+const namespaceObject = "ns"
+
+// A loyalty program
+type Program struct {
+	ProgramId    string   `json:"ProgramId"`
+	Name         string   `json:"Name"`
+	OriginatorId string   `json:"OriginatorId"`
+	Currency     string   `json:"Currency"`
+	Tiers        []string `json:"Tiers"`
+}
+
+// The default program, as it was before programs could be configured
+func defaultProgram() Program {
+	return Program{
+		ProgramId:    DEFAULT_PROGRAM,
+		Name:         "Open Points Network",
+		OriginatorId: ORIGINATOR_ID,
+		Currency:     "OpenPoints",
+		Tiers:        []string{"Member", "Silver", "Platinum"},
+	}
+}
+
+// Request for createProgram, supply is the opening balance of the originator
+type createProgramRequest struct {
+	Id             string   `json:"id" validate:"required"`
+	Name           string   `json:"name" validate:"required"`
+	OriginatorId   string   `json:"originatorId" validate:"required"`
+	OriginatorName string   `json:"originatorName"`
+	Currency       string   `json:"currency" validate:"required"`
+	Tiers          []string `json:"tiers" validate:"required"`
+	Supply         float64  `json:"supply" validate:"min=0"`
+}
+
+// Request for updateProgram, omitted fields are left unchanged
+type updateProgramRequest struct {
+	Name     string   `json:"name"`
+	Currency string   `json:"currency"`
+	Tiers    []string `json:"tiers"`
+}
+
+// Request for enrollMember, tier defaults to the first tier of the program
+type enrollMemberRequest struct {
+	UserId       string `json:"userId" validate:"required"`
+	Name         string `json:"name" validate:"required"`
+	Tier         string `json:"tier"`
+	ReferralCode string `json:"referralCode"`
+}
+
+// ============================================================================================================================
+// Take the programId field out of a request, returning the program and the remaining request
+// ============================================================================================================================
+func splitProgramId(args []string) (string, []string, error) {
+
+	if len(args) != 1 {
+		return DEFAULT_PROGRAM, args, nil
+	}
+
+	var raw map[string]json.RawMessage
+	err := json.Unmarshal([]byte(args[0]), &raw)
+	if err != nil || raw[PROGRAM_FIELD] == nil {
+		// parseRequest reports malformed requests
+		return DEFAULT_PROGRAM, args, nil
+	}
+
+	var programId string
+	err = json.Unmarshal(raw[PROGRAM_FIELD], &programId)
+	if err != nil {
+		return "", nil, fieldError(PROGRAM_FIELD, "%s must be a string", PROGRAM_FIELD)
+	}
+	if programId == "" {
+		programId = DEFAULT_PROGRAM
+	}
+
+	delete(raw, PROGRAM_FIELD)
+	rest, _ := json.Marshal(raw)
+
+	return programId, []string{string(rest)}, nil
+}
+
+// ============================================================================================================================
+// Read a program from the registry. The default program exists even if it was never configured.
+// ============================================================================================================================
+func loadProgram(stub shim.ChaincodeStubInterface, programId string) (*Program, error) {
+
+	key, err := compositeKey(stub, programObject, programId)
+	if err != nil {
+		return nil, err
+	}
+
+	var program Program
+	found, err := readState(stub, key, &program)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		if programId != DEFAULT_PROGRAM {
+			return nil, &ChaincodeError{Code: ERR_NOT_FOUND, Message: "program " + programId + " does not exist", Field: PROGRAM_FIELD}
+		}
+		program = defaultProgram()
+	}
+
+	return &program, nil
+}
+
+func saveProgram(stub shim.ChaincodeStubInterface, program Program) error {
+
+	key, err := compositeKey(stub, programObject, program.ProgramId)
+	if err != nil {
+		return err
+	}
+
+	return writeState(stub, key, program)
+}
+
+// Check that the current program is the default one, for functions that operate the platform
+func requireDefaultProgram(ctx *TransactionContext, function string) error {
+
+	if ctx.Program().ProgramId != DEFAULT_PROGRAM {
+		return newError(ERR_FORBIDDEN, "%s can only be called in the %s program", function, DEFAULT_PROGRAM)
+	}
+
+	return nil
+}
+
+// ============================================================================================================================
+// Create a program with its originator holding the whole supply and empty transaction, contract and reference
+// number records
+// ============================================================================================================================
+func (t *SimpleChaincode) createProgram(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*createProgramRequest)
+	ev := ctx.Event()
+
+	err := requireDefaultProgram(ctx, "createProgram")
+	if err != nil {
+		return nil, err
+	}
+	if req.Id == DEFAULT_PROGRAM {
+		return nil, newError(ERR_ALREADY_EXISTS, "program %s already exists", req.Id)
+	}
+
+	root := ctx.rootStub()
+	_, err = loadProgram(root, req.Id)
+	if err == nil {
+		return nil, newError(ERR_ALREADY_EXISTS, "program %s already exists", req.Id)
+	}
+	if e, ok := err.(*ChaincodeError); !ok || e.Code != ERR_NOT_FOUND {
+		return nil, err
+	}
+	if containsString(reservedKeys, req.OriginatorId) {
+		return nil, fieldError("originatorId", "%s is reserved", req.OriginatorId)
+	}
+
+	program := Program{ProgramId: req.Id, Name: req.Name, OriginatorId: req.OriginatorId, Currency: req.Currency, Tiers: req.Tiers}
+	err = saveProgram(root, program)
+	if err != nil {
+		return nil, err
+	}
+
+	var originator User
+	originator.UserId = req.OriginatorId
+	originator.Name = req.OriginatorName
+	if originator.Name == "" {
+		originator.Name = req.Name
+	}
+	originator.Balance = req.Supply
+	originator.Status = "Originator"
+	originator.Join = ev.Timestamp.Format(DATE_LAYOUT)
+	originator.Expiration = "2099-12-31"
+	originator.Modified = ev.Timestamp.Format(DATE_LAYOUT)
+
+	stub := ctx.programStub(program.ProgramId)
+	err = writeState(stub, originator.UserId, originator)
+	if err != nil {
+		return nil, err
+	}
+	err = writeState(stub, "allTx", AllTransactions{Transactions: []Transaction{}})
+	if err != nil {
+		return nil, err
+	}
+	err = writeState(stub, "refNumber", 1)
+	if err != nil {
+		return nil, err
+	}
+	err = writeState(stub, "contractIds", []string{})
+	if err != nil {
+		return nil, err
+	}
+
+	ev.programChanged(program, &originator)
+
+	asBytes, _ := json.Marshal(program)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Change the name, currency or tiers of the current program
+// ============================================================================================================================
+func (t *SimpleChaincode) updateProgram(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*updateProgramRequest)
+
+	program := *ctx.Program()
+	if req.Name != "" {
+		program.Name = req.Name
+	}
+	if req.Currency != "" {
+		program.Currency = req.Currency
+	}
+	if len(req.Tiers) > 0 {
+		program.Tiers = req.Tiers
+	}
+
+	err := saveProgram(ctx.rootStub(), program)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Event().programChanged(program, nil)
+
+	asBytes, _ := json.Marshal(program)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Add a member with no points to the current program
+// ============================================================================================================================
+func (t *SimpleChaincode) enrollMember(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*enrollMemberRequest)
+	stub := ctx.GetStub()
+	ev := ctx.Event()
+	program := ctx.Program()
+
+	tier := req.Tier
+	if tier == "" && len(program.Tiers) > 0 {
+		tier = program.Tiers[0]
+	}
+	if !containsString(program.Tiers, tier) {
+		return nil, fieldError("tier", "tier %s does not exist in program %s", tier, program.ProgramId)
+	}
+
+	if containsString(reservedKeys, req.UserId) {
+		return nil, fieldError("userId", "%s is reserved", req.UserId)
+	}
+	existing, err := stub.GetState(req.UserId)
+	if err != nil {
+		return nil, newError(ERR_LEDGER, "failed to read %s: %s", req.UserId, err)
+	}
+	if existing != nil {
+		return nil, newError(ERR_ALREADY_EXISTS, "%s already exists", req.UserId)
+	}
+
+	var user User
+	user.UserId = req.UserId
+	user.Name = req.Name
+	user.Status = tier
+	user.Join = ev.Timestamp.Format(DATE_LAYOUT)
+	user.Expiration = ev.Timestamp.AddDate(2, 0, 0).Format(DATE_LAYOUT)
+	user.Modified = ev.Timestamp.Format(DATE_LAYOUT)
+
+	err = writeState(stub, user.UserId, user)
+	if err != nil {
+		return nil, err
+	}
+	ev.userWritten(nil, user)
+
+	if req.ReferralCode != "" {
+		err = recordReferral(ctx, user.UserId, req.ReferralCode)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	asBytes, _ := json.Marshal(user)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Get the current program
+// ============================================================================================================================
+func (t *SimpleChaincode) getProgram(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	asBytes, _ := json.Marshal(ctx.Program())
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Get every program, the default one first
+// ============================================================================================================================
+func (t *SimpleChaincode) getPrograms(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	root := ctx.rootStub()
+
+	def, err := loadProgram(root, DEFAULT_PROGRAM)
+	if err != nil {
+		return nil, err
+	}
+	programs := []Program{*def}
+
+	iter, err := root.GetStateByPartialCompositeKey(programObject, []string{})
+	if err != nil {
+		return nil, newError(ERR_LEDGER, "failed to list programs: %s", err)
+	}
+	defer iter.Close()
+
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, newError(ERR_LEDGER, "failed to list programs: %s", err)
+		}
+
+		var program Program
+		err = json.Unmarshal(kv.Value, &program)
+		if err != nil {
+			return nil, newError(ERR_CORRUPT_STATE, "failed to decode program %s: %s", kv.Key, err)
+		}
+		if program.ProgramId != DEFAULT_PROGRAM {
+			programs = append(programs, program)
+		}
+	}
+
+	asBytes, _ := json.Marshal(programs)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Post a transaction in the current program and its counterpart in another program. Each gets the next reference
+// number of its program and names the other in LinkedRef as <programId>/<refNumber>.
+// ============================================================================================================================
+func postLinkedPair(ctx *TransactionContext, out *Transaction, programId string, in *Transaction) error {
+
+	ev := ctx.Event()
+	stub := ctx.programStub(programId)
+
+	var err error
+	out.RefNumber, err = nextRefNumber(ctx.GetStub(), ev)
+	if err != nil {
+		return err
+	}
+	ev.program = programId
+	in.RefNumber, err = nextRefNumber(stub, ev)
+	ev.program = ""
+	if err != nil {
+		return err
+	}
+	out.LinkedRef = programId + "/" + in.RefNumber
+	in.LinkedRef = ctx.Program().ProgramId + "/" + out.RefNumber
+
+	err = postTransfer(ctx.GetStub(), ev, out)
+	if err != nil {
+		return err
+	}
+
+	ev.program = programId
+	defer func() { ev.program = "" }()
+
+	return postTransfer(stub, ev, in)
+}
+
+// ============================================================================================================================
+// Stub of one program, translating the keys of the program to and from its namespace
+// ============================================================================================================================
+type programStub struct {
+	shim.ChaincodeStubInterface
+	programId string
+}
+
+func newProgramStub(stub shim.ChaincodeStubInterface, programId string) shim.ChaincodeStubInterface {
+
+	if programId == DEFAULT_PROGRAM {
+		return stub
+	}
+
+	return &programStub{ChaincodeStubInterface: stub, programId: programId}
+}
+
+// Key of the program in the shared key space. Composite keys are already namespaced by CreateCompositeKey, and
+// only they start with a NUL since parseRequest rejects requests carrying one.
+func (s *programStub) stateKey(key string) (string, error) {
+
+	if key != "" && key[0] == 0 {
+		return key, nil
+	}
+
+	return s.ChaincodeStubInterface.CreateCompositeKey(namespaceObject, []string{s.programId, "", key})
+}
+
+// Key as seen by the program
+func (s *programStub) programKey(key string) string {
+
+	objectType, attributes, err := s.ChaincodeStubInterface.SplitCompositeKey(key)
+	if err != nil || objectType != namespaceObject || len(attributes) != 3 || attributes[1] != "" {
+		return key
+	}
+
+	return attributes[2]
+}
+
+func (s *programStub) GetState(key string) ([]byte, error) {
+
+	key, err := s.stateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.ChaincodeStubInterface.GetState(key)
+}
+
+func (s *programStub) PutState(key string, value []byte) error {
+
+	key, err := s.stateKey(key)
+	if err != nil {
+		return err
+	}
+
+	return s.ChaincodeStubInterface.PutState(key, value)
+}
+
+func (s *programStub) DelState(key string) error {
+
+	key, err := s.stateKey(key)
+	if err != nil {
+		return err
+	}
+
+	return s.ChaincodeStubInterface.DelState(key)
+}
+
+func (s *programStub) SetStateValidationParameter(key string, ep []byte) error {
+
+	key, err := s.stateKey(key)
+	if err != nil {
+		return err
+	}
+
+	return s.ChaincodeStubInterface.SetStateValidationParameter(key, ep)
+}
+
+func (s *programStub) GetStateValidationParameter(key string) ([]byte, error) {
+
+	key, err := s.stateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.ChaincodeStubInterface.GetStateValidationParameter(key)
+}
+
+func (s *programStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+
+	key, err := s.stateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.ChaincodeStubInterface.GetHistoryForKey(key)
+}
+
+func (s *programStub) CreateCompositeKey(objectType string, attributes []string) (string, error) {
+	return s.ChaincodeStubInterface.CreateCompositeKey(namespaceObject, append([]string{s.programId, objectType}, attributes...))
+}
+
+func (s *programStub) SplitCompositeKey(compositeKey string) (string, []string, error) {
+
+	objectType, attributes, err := s.ChaincodeStubInterface.SplitCompositeKey(compositeKey)
+	if err != nil || objectType != namespaceObject || len(attributes) < 2 || attributes[0] != s.programId {
+		return objectType, attributes, err
+	}
+
+	return attributes[1], attributes[2:], nil
+}
+
+// Range of plain keys, an empty end key is unbounded
+func (s *programStub) rangeKeys(startKey, endKey string) (string, string, error) {
+
+	start, err := s.stateKey(startKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	var end string
+	if endKey == "" {
+		end, err = s.ChaincodeStubInterface.CreateCompositeKey(namespaceObject, []string{s.programId, ""})
+		end = end + string(utf8.MaxRune)
+	} else {
+		end, err = s.stateKey(endKey)
+	}
+
+	return start, end, err
+}
+
+func (s *programStub) GetStateByRange(startKey, endKey string) (shim.StateQueryIteratorInterface, error) {
+
+	start, end, err := s.rangeKeys(startKey, endKey)
+	if err != nil {
+		return nil, err
+	}
+
+	iter, err := s.ChaincodeStubInterface.GetStateByRange(start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	return &programIterator{StateQueryIteratorInterface: iter, stub: s}, nil
+}
+
+func (s *programStub) GetStateByRangeWithPagination(startKey, endKey string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+
+	start, end, err := s.rangeKeys(startKey, endKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	iter, metadata, err := s.ChaincodeStubInterface.GetStateByRangeWithPagination(start, end, pageSize, bookmark)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &programIterator{StateQueryIteratorInterface: iter, stub: s}, metadata, nil
+}
+
+func (s *programStub) GetStateByPartialCompositeKey(objectType string, keys []string) (shim.StateQueryIteratorInterface, error) {
+	return s.ChaincodeStubInterface.GetStateByPartialCompositeKey(namespaceObject, append([]string{s.programId, objectType}, keys...))
+}
+
+func (s *programStub) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	return s.ChaincodeStubInterface.GetStateByPartialCompositeKeyWithPagination(namespaceObject, append([]string{s.programId, objectType}, keys...), pageSize, bookmark)
+}
+
+// Range query results with plain keys translated back to the keys of the program
+type programIterator struct {
+	shim.StateQueryIteratorInterface
+	stub *programStub
+}
+
+func (it *programIterator) Next() (*queryresult.KV, error) {
+
+	kv, err := it.StateQueryIteratorInterface.Next()
+	if err != nil || kv == nil {
+		return kv, err
+	}
+
+	return &queryresult.KV{Namespace: kv.Namespace, Key: it.stub.programKey(kv.Key), Value: kv.Value}, nil
+}
@@ -0,0 +1,432 @@
+package openpoints
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ============================================================================================================================
+// Referrals
+//
+// A member takes a referral code with createReferralCode and hands it to a friend. Enrolling the friend with
+// enrollMember and the code records a PENDING referral. The first transferPoints of at least MinAmount points sent
+// or received by the referee, other than one with the referrer, rewards both sides from the funding business of the
+// referral rule and marks the referral REWARDED.
+//
+// A referral is REJECTED instead when:
+//
+//	the referrer already has MaxReferrals referrals that were not rejected
+//	the enrollment or the qualifying transfer is submitted with the identity that created the referral code
+// ============================================================================================================================
+
+// Referral statuses
+const REFERRAL_PENDING = "PENDING"
+const REFERRAL_REWARDED = "REWARDED"
+const REFERRAL_REJECTED = "REJECTED"
+
+// Transaction type of a referral reward
+const TX_TYPE_REFERRAL = "referral"
+
+// Composite key object types
+const referralCodeObject = "referralCode"
+const referrerObject = "referrer"
+const referralObject = "referral"
+
+// Key of the referral rule of a program
+const referralRuleKey = "referralRule"
+
+// Rewards of the referral program, paid by BusinessId
+type ReferralRule struct {
+	BusinessId     string  `json:"BusinessId"`
+	ReferrerReward float64 `json:"ReferrerReward"`
+	RefereeReward  float64 `json:"RefereeReward"`
+	MinAmount      float64 `json:"MinAmount"`
+	MaxReferrals   int     `json:"MaxReferrals"`
+	Active         bool    `json:"Active"`
+}
+
+// Referral code of a member. CreatorId is the client identity that created it.
+type ReferralCode struct {
+	Code      string    `json:"Code"`
+	UserId    string    `json:"UserId"`
+	CreatorId string    `json:"CreatorId"`
+	Referrals int       `json:"Referrals"`
+	Created   time.Time `json:"Created"`
+}
+
+// Referral of a new member, keyed by the referee
+type Referral struct {
+	RefereeId  string    `json:"RefereeId"`
+	ReferrerId string    `json:"ReferrerId"`
+	Code       string    `json:"Code"`
+	Status     string    `json:"Status"`
+	Reason     string    `json:"Reason,omitempty"`
+	Created    time.Time `json:"Created"`
+	Updated    time.Time `json:"Updated"`
+	QualifyRef string    `json:"QualifyRef,omitempty"`
+	RewardRefs []string  `json:"RewardRefs"`
+}
+
+// Request for setReferralRule
+type referralRuleRequest struct {
+	BusinessId     string  `json:"businessId" validate:"required"`
+	ReferrerReward float64 `json:"referrerReward" validate:"min=0"`
+	RefereeReward  float64 `json:"refereeReward" validate:"min=0"`
+	MinAmount      float64 `json:"minAmount" validate:"min=0"`
+	MaxReferrals   int     `json:"maxReferrals" validate:"min=0"`
+	Active         bool    `json:"active"`
+}
+
+// Request for getReferrals, userId lists the referrals of one referrer
+type referralsRequest struct {
+	UserId string `json:"userId"`
+	Status string `json:"status" validate:"oneof=PENDING|REWARDED|REJECTED"`
+}
+
+// Client identity of the caller, empty if it can not be read
+func callerId(ctx *TransactionContext) string {
+
+	identity := ctx.GetClientIdentity()
+	if identity == nil {
+		return ""
+	}
+	id, err := identity.GetID()
+	if err != nil {
+		return ""
+	}
+
+	return id
+}
+
+func loadReferralRule(ctx *TransactionContext) (*ReferralRule, error) {
+
+	var rule ReferralRule
+	_, err := readState(ctx.GetStub(), referralRuleKey, &rule)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rule, nil
+}
+
+func loadReferral(ctx *TransactionContext, refereeId string) (string, *Referral, error) {
+
+	key, err := compositeKey(ctx.GetStub(), referralObject, refereeId)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var referral Referral
+	found, err := readState(ctx.GetStub(), key, &referral)
+	if err != nil || !found {
+		return key, nil, err
+	}
+
+	return key, &referral, nil
+}
+
+func saveReferral(ctx *TransactionContext, key string, referral Referral) error {
+
+	err := writeState(ctx.GetStub(), key, referral)
+	if err != nil {
+		return err
+	}
+	ctx.Event().referralChanged(referral)
+
+	return nil
+}
+
+// ============================================================================================================================
+// Set the rewards and limits of the referral program
+// ============================================================================================================================
+func (t *SimpleChaincode) setReferralRule(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*referralRuleRequest)
+	stub := ctx.GetStub()
+
+	var business User
+	found, err := readState(stub, req.BusinessId, &business)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, newError(ERR_NOT_FOUND, "business %s does not exist", req.BusinessId)
+	}
+
+	rule := ReferralRule{BusinessId: req.BusinessId, ReferrerReward: req.ReferrerReward, RefereeReward: req.RefereeReward,
+		MinAmount: req.MinAmount, MaxReferrals: req.MaxReferrals, Active: req.Active}
+
+	err = writeState(stub, referralRuleKey, rule)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Event().referralRuleSet(rule)
+
+	asBytes, _ := json.Marshal(rule)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Get the referral code of a member, creating it on first use
+// ============================================================================================================================
+func (t *SimpleChaincode) createReferralCode(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*userRequest)
+	stub := ctx.GetStub()
+
+	err := checkAccount(ctx, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	var user User
+	found, err := readState(stub, req.UserId, &user)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, newError(ERR_NOT_FOUND, "user %s does not exist", req.UserId)
+	}
+
+	referrerKey, err := compositeKey(stub, referrerObject, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+	var code ReferralCode
+	found, err = readState(stub, referrerKey, &code)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		asBytes, _ := json.Marshal(code)
+		return asBytes, nil
+	}
+
+	sum := sha256.Sum256([]byte(ctx.Program().ProgramId + "|" + req.UserId + "|" + stub.GetTxID()))
+	code = ReferralCode{Code: strings.ToUpper(hex.EncodeToString(sum[:4])), UserId: req.UserId, CreatorId: callerId(ctx),
+		Created: ctx.Event().Timestamp}
+
+	codeKey, err := compositeKey(stub, referralCodeObject, code.Code)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := stub.GetState(codeKey)
+	if err != nil {
+		return nil, newError(ERR_LEDGER, "failed to read referral code %s: %s", code.Code, err)
+	}
+	if existing != nil {
+		return nil, newError(ERR_ALREADY_EXISTS, "referral code %s is taken, retry", code.Code)
+	}
+
+	err = writeState(stub, codeKey, code.UserId)
+	if err != nil {
+		return nil, err
+	}
+	err = writeState(stub, referrerKey, code)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Event().referralCodeChanged(code)
+
+	asBytes, _ := json.Marshal(code)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Record the referral of a member being enrolled with a referral code
+// ============================================================================================================================
+func recordReferral(ctx *TransactionContext, refereeId string, code string) error {
+
+	stub := ctx.GetStub()
+	ev := ctx.Event()
+
+	codeKey, err := compositeKey(stub, referralCodeObject, strings.ToUpper(code))
+	if err != nil {
+		return err
+	}
+	var referrerId string
+	found, err := readState(stub, codeKey, &referrerId)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fieldError("referralCode", "referral code %s does not exist", code)
+	}
+
+	referrerKey, err := compositeKey(stub, referrerObject, referrerId)
+	if err != nil {
+		return err
+	}
+	var referrer ReferralCode
+	_, err = readState(stub, referrerKey, &referrer)
+	if err != nil {
+		return err
+	}
+
+	rule, err := loadReferralRule(ctx)
+	if err != nil {
+		return err
+	}
+
+	referral := Referral{RefereeId: refereeId, ReferrerId: referrerId, Code: referrer.Code, Status: REFERRAL_PENDING,
+		Created: ev.Timestamp, Updated: ev.Timestamp, RewardRefs: []string{}}
+	if referrer.CreatorId != "" && referrer.CreatorId == callerId(ctx) {
+		referral.Status = REFERRAL_REJECTED
+		referral.Reason = "enrolled by the identity that created the referral code"
+	} else if rule.MaxReferrals > 0 && referrer.Referrals >= rule.MaxReferrals {
+		referral.Status = REFERRAL_REJECTED
+		referral.Reason = "referrer reached the limit of referrals"
+	} else {
+		referrer.Referrals++
+		err = writeState(stub, referrerKey, referrer)
+		if err != nil {
+			return err
+		}
+		ev.referralCodeChanged(referrer)
+	}
+
+	key, err := compositeKey(stub, referralObject, refereeId)
+	if err != nil {
+		return err
+	}
+	return saveReferral(ctx, key, referral)
+}
+
+// ============================================================================================================================
+// Reward the pending referral of the sender or receiver of a posted transfer if the transfer qualifies
+// ============================================================================================================================
+func qualifyReferral(ctx *TransactionContext, tx Transaction) error {
+
+	rule, err := loadReferralRule(ctx)
+	if err != nil {
+		return err
+	}
+	if !rule.Active || tx.Amount < rule.MinAmount {
+		return nil
+	}
+
+	for _, refereeId := range []string{tx.From, tx.To} {
+		if refereeId == "" {
+			continue
+		}
+		key, referral, err := loadReferral(ctx, refereeId)
+		if err != nil {
+			return err
+		}
+		if referral == nil || referral.Status != REFERRAL_PENDING {
+			continue
+		}
+		if tx.From == referral.ReferrerId || tx.To == referral.ReferrerId {
+			continue
+		}
+
+		err = rewardReferral(ctx, rule, key, *referral, tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func rewardReferral(ctx *TransactionContext, rule *ReferralRule, key string, referral Referral, qualifying Transaction) error {
+
+	stub := ctx.GetStub()
+	ev := ctx.Event()
+
+	referrerKey, err := compositeKey(stub, referrerObject, referral.ReferrerId)
+	if err != nil {
+		return err
+	}
+	var referrer ReferralCode
+	_, err = readState(stub, referrerKey, &referrer)
+	if err != nil {
+		return err
+	}
+
+	referral.QualifyRef = qualifying.RefNumber
+	referral.Updated = ev.Timestamp
+	if referrer.CreatorId != "" && referrer.CreatorId == callerId(ctx) {
+		referral.Status = REFERRAL_REJECTED
+		referral.Reason = "qualifying transfer submitted by the identity that created the referral code"
+		return saveReferral(ctx, key, referral)
+	}
+
+	rewards := []struct {
+		userId string
+		amount float64
+	}{{referral.ReferrerId, rule.ReferrerReward}, {referral.RefereeId, rule.RefereeReward}}
+
+	for _, reward := range rewards {
+		if reward.amount == 0 {
+			continue
+		}
+
+		var tx Transaction
+		tx.Date = ev.Timestamp.Truncate(time.Minute)
+		tx.Type = TX_TYPE_REFERRAL
+		tx.From = rule.BusinessId
+		tx.To = reward.userId
+		tx.Description = "Referral of " + referral.RefereeId
+		tx.Amount = reward.amount
+		tx.LinkedRef = qualifying.RefNumber
+		tx.StatusCode = 1
+		tx.StatusMsg = "Transaction Completed"
+		tx.TxId = stub.GetTxID()
+
+		tx.RefNumber, err = nextRefNumber(stub, ev)
+		if err != nil {
+			return err
+		}
+		err = postTransfer(stub, ev, &tx)
+		if err != nil {
+			return err
+		}
+		referral.RewardRefs = append(referral.RewardRefs, tx.RefNumber)
+	}
+
+	referral.Status = REFERRAL_REWARDED
+	return saveReferral(ctx, key, referral)
+}
+
+// ============================================================================================================================
+// List referrals, optionally of one referrer and in one status, by referee
+// ============================================================================================================================
+func (t *SimpleChaincode) getReferrals(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*referralsRequest)
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(referralObject, []string{})
+	if err != nil {
+		return nil, newError(ERR_LEDGER, "failed to list referrals: %s", err)
+	}
+	defer iter.Close()
+
+	referrals := []Referral{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, newError(ERR_LEDGER, "failed to list referrals: %s", err)
+		}
+
+		var referral Referral
+		err = json.Unmarshal(kv.Value, &referral)
+		if err != nil {
+			return nil, newError(ERR_CORRUPT_STATE, "failed to decode referral %s: %s", kv.Key, err)
+		}
+
+		if (req.UserId != "" && referral.ReferrerId != req.UserId) || (req.Status != "" && referral.Status != req.Status) {
+			continue
+		}
+		referrals = append(referrals, referral)
+	}
+
+	sort.Slice(referrals, func(i, j int) bool { return referrals[i].RefereeId < referrals[j].RefereeId })
+
+	asBytes, _ := json.Marshal(referrals)
+	return asBytes, nil
+}
@@ -0,0 +1,503 @@
+package openpoints
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ============================================================================================================================
+// Function registry
+//
+// Every chaincode function is declared once in the functions table below with its name, whether it reads or writes
+// the ledger, the minimum role of the caller, its request type and its handler. The table drives dispatch, access
+// control and the describeFunctions query. Write functions emit the chaincode event of their transaction; read
+// functions never do, so evaluating them leaves no trace.
+// ============================================================================================================================
+
+// Ledger access of a function
+const ACCESS_READ = "read"
+const ACCESS_WRITE = "write"
+
+// Caller roles, in increasing order of privilege
+const ROLE_MEMBER = "member"
+const ROLE_BUSINESS = "business"
+const ROLE_RISK_OFFICER = "riskOfficer"
+const ROLE_COMPLIANCE = "compliance"
+const ROLE_ADMIN = "admin"
+
+// Certificate attribute holding the role of the caller, as issued by the Fabric CA. Callers without it are members.
+// The attribute ROLE_ATTRIBUTE + "." + programId holds the role in one program and takes precedence.
+const ROLE_ATTRIBUTE = "role"
+
+// Certificate attribute naming the member account the caller acts for. Only admins act for other accounts.
+// The attribute ACCOUNT_ATTRIBUTE + "." + programId names the account in one program and takes precedence.
+const ACCOUNT_ATTRIBUTE = "userId"
+
+// Version of the describeFunctions output
+const API_VERSION = 1
+
+var roleRank = map[string]int{
+	ROLE_MEMBER:       0,
+	ROLE_BUSINESS:     1,
+	ROLE_RISK_OFFICER: 2,
+	ROLE_COMPLIANCE:   3,
+	ROLE_ADMIN:        4,
+}
+
+// Handler of a registered function, request is a pointer to a value of the declared request type
+type FunctionHandler func(t *SimpleChaincode, ctx *TransactionContext, request interface{}) ([]byte, error)
+
+// Declaration of one chaincode function
+type FunctionSpec struct {
+	Name        string
+	Access      string
+	Role        string
+	Description string
+	Request     interface{}
+	Handler     FunctionHandler
+	// Delegation permission that lets a delegate below Role call the function
+	Delegate string
+}
+
+// Transaction context of the contract, shared by the handlers of a single function call. The contract API creates a
+// fresh one for every transaction.
+type TransactionContext struct {
+	contractapi.TransactionContext
+	event     *LedgerEvent
+	role      string
+	account   string
+	delegated bool
+	program   *Program
+	root      *txStub
+	stub      shim.ChaincodeStubInterface
+}
+
+// Stub of the current program, its keys are kept apart from those of every other program
+func (ctx *TransactionContext) GetStub() shim.ChaincodeStubInterface {
+	if ctx.stub != nil {
+		return ctx.stub
+	}
+	return ctx.rootStub()
+}
+
+// Stub of the state shared by all programs
+func (ctx *TransactionContext) rootStub() shim.ChaincodeStubInterface {
+	if ctx.root == nil {
+		ctx.root = newTxStub(ctx.TransactionContext.GetStub())
+	}
+	return ctx.root
+}
+
+// Stub of another program
+func (ctx *TransactionContext) programStub(programId string) shim.ChaincodeStubInterface {
+	return newProgramStub(ctx.rootStub(), programId)
+}
+
+// Program the call runs in
+func (ctx *TransactionContext) Program() *Program {
+	return ctx.program
+}
+
+// Effects of the call, emitted as its chaincode event once a write function succeeds
+func (ctx *TransactionContext) Event() *LedgerEvent {
+	return ctx.event
+}
+
+// Role of the caller
+func (ctx *TransactionContext) Role() string {
+	return ctx.role
+}
+
+// Member account of the caller, empty if its certificate names none
+func (ctx *TransactionContext) Account() string {
+	return ctx.account
+}
+
+var functions []FunctionSpec
+var functionsByName map[string]*FunctionSpec
+
+func init() {
+
+	functions = []FunctionSpec{
+		{Name: "init", Access: ACCESS_WRITE, Role: ROLE_ADMIN, Request: emptyRequest{}, Handler: (*SimpleChaincode).resetLedger,
+			Description: "Reset the ledger to the initial members, contracts and reference number"},
+		{Name: "transferPoints", Access: ACCESS_WRITE, Role: ROLE_MEMBER, Request: transferPointsRequest{}, Handler: (*SimpleChaincode).transferPoints,
+			Description: "Transfer points between two members, priced by the named smart contract and an optional percent voucher and checked by the risk rules"},
+		{Name: "addSmartContract", Access: ACCESS_WRITE, Role: ROLE_BUSINESS, Request: addSmartContractRequest{}, Handler: (*SimpleChaincode).addSmartContract,
+			Description: "Create or replace a discount smart contract"},
+		{Name: "incrementReferenceNumber", Access: ACCESS_WRITE, Role: ROLE_ADMIN, Request: emptyRequest{}, Handler: (*SimpleChaincode).incrementReferenceNumber,
+			Description: "Skip the next transaction reference number"},
+
+		{Name: "setSettlementRule", Access: ACCESS_WRITE, Role: ROLE_ADMIN, Request: settlementRuleRequest{}, Handler: (*SimpleChaincode).setSettlementRule,
+			Description: "Set the point value and originator discount share used to settle a contract"},
+		{Name: "createSettlementBatch", Access: ACCESS_WRITE, Role: ROLE_BUSINESS, Request: createSettlementRequest{}, Handler: (*SimpleChaincode).createSettlementBatch,
+			Description: "Settle the unsettled contract transactions of a business in a period"},
+		{Name: "approveSettlementBatch", Access: ACCESS_WRITE, Role: ROLE_ADMIN, Request: settlementBatchRequest{}, Handler: (*SimpleChaincode).approveSettlementBatch,
+			Description: "Approve an open settlement batch for payment"},
+		{Name: "markSettlementBatchPaid", Access: ACCESS_WRITE, Role: ROLE_ADMIN, Request: settlementPaidRequest{}, Handler: (*SimpleChaincode).markSettlementBatchPaid,
+			Description: "Record the payment of an approved settlement batch"},
+
+		{Name: "createProgram", Access: ACCESS_WRITE, Role: ROLE_ADMIN, Request: createProgramRequest{}, Handler: (*SimpleChaincode).createProgram,
+			Description: "Create a loyalty program with its own namespace, originator and currency, default program only"},
+		{Name: "updateProgram", Access: ACCESS_WRITE, Role: ROLE_ADMIN, Request: updateProgramRequest{}, Handler: (*SimpleChaincode).updateProgram,
+			Description: "Change the name, currency or tiers of the program"},
+		{Name: "enrollMember", Access: ACCESS_WRITE, Role: ROLE_BUSINESS, Request: enrollMemberRequest{}, Handler: (*SimpleChaincode).enrollMember,
+			Description: "Add a member with no points to the program, optionally referred by a referral code"},
+		{Name: "exchangePoints", Access: ACCESS_WRITE, Role: ROLE_MEMBER, Request: exchangePointsRequest{}, Handler: (*SimpleChaincode).exchangePoints,
+			Description: "Exchange points of a member for points of a member of another program through the originators"},
+		{Name: "setOracle", Access: ACCESS_WRITE, Role: ROLE_ADMIN, Request: oracleRequest{}, Handler: (*SimpleChaincode).setOracle,
+			Description: "Register, replace or disable an exchange rate oracle, default program only"},
+		{Name: "setExchangePair", Access: ACCESS_WRITE, Role: ROLE_ADMIN, Request: exchangePairRequest{}, Handler: (*SimpleChaincode).setExchangePair,
+			Description: "Set the spread, fee, daily limit, oracles or a fixed rate of a currency pair, default program only"},
+		{Name: "submitExchangeRate", Access: ACCESS_WRITE, Role: ROLE_MEMBER, Request: submitRateRequest{}, Handler: (*SimpleChaincode).submitExchangeRate,
+			Description: "Set the rate of a currency pair from a quote signed by one of its oracles"},
+		{Name: "convertPoints", Access: ACCESS_WRITE, Role: ROLE_MEMBER, Request: convertPointsRequest{}, Handler: (*SimpleChaincode).convertPoints,
+			Description: "Burn points of a member and mint the converted amount in another program"},
+		{Name: "setCatalogItem", Access: ACCESS_WRITE, Role: ROLE_BUSINESS, Request: catalogItemRequest{}, Handler: (*SimpleChaincode).setCatalogItem,
+			Description: "Create or replace a catalog item with its price, co-pay, stock and eligible tiers"},
+		{Name: "redeemItem", Access: ACCESS_WRITE, Role: ROLE_MEMBER, Request: redeemItemRequest{}, Handler: (*SimpleChaincode).redeemItem,
+			Description: "Redeem catalog items for points priced by the best active contract, placing an order"},
+		{Name: "fulfillOrder", Access: ACCESS_WRITE, Role: ROLE_BUSINESS, Request: orderStatusRequest{}, Handler: (*SimpleChaincode).fulfillOrder,
+			Description: "Mark a placed order as fulfilled"},
+		{Name: "cancelOrder", Access: ACCESS_WRITE, Role: ROLE_BUSINESS, Request: orderStatusRequest{}, Handler: (*SimpleChaincode).cancelOrder,
+			Delegate: DELEGATE_REFUND, Description: "Cancel a placed order, refunding its points and restocking its items"},
+		{Name: "setEarnRate", Access: ACCESS_WRITE, Role: ROLE_BUSINESS, Request: earnRateRequest{}, Handler: (*SimpleChaincode).setEarnRate,
+			Description: "Set the points a business gives per unit of money, by default or for one tier"},
+		{Name: "purchase", Access: ACCESS_WRITE, Role: ROLE_MEMBER, Request: purchaseRequest{}, Handler: (*SimpleChaincode).purchase,
+			Description: "Pay a business in points and money, the points discounted by contracts and the money earning points"},
+		{Name: "issueVoucher", Access: ACCESS_WRITE, Role: ROLE_BUSINESS, Request: issueVoucherRequest{}, Handler: (*SimpleChaincode).issueVoucher,
+			Description: "Issue a points or percent voucher, stored as a salted hash of its code"},
+		{Name: "redeemVoucher", Access: ACCESS_WRITE, Role: ROLE_MEMBER, Request: redeemVoucherRequest{}, Handler: (*SimpleChaincode).redeemVoucher,
+			Description: "Redeem a points voucher, crediting its value from the issuing business"},
+		{Name: "setReferralRule", Access: ACCESS_WRITE, Role: ROLE_ADMIN, Request: referralRuleRequest{}, Handler: (*SimpleChaincode).setReferralRule,
+			Description: "Set the rewards, qualifying amount and referrer limit of the referral program"},
+		{Name: "createReferralCode", Access: ACCESS_WRITE, Role: ROLE_MEMBER, Request: userRequest{}, Handler: (*SimpleChaincode).createReferralCode,
+			Description: "Referral code of a member, created on first use"},
+		{Name: "setRiskRule", Access: ACCESS_WRITE, Role: ROLE_RISK_OFFICER, Request: riskRuleRequest{}, Handler: (*SimpleChaincode).setRiskRule,
+			Description: "Create or replace a rule that blocks, holds or flags transfers"},
+		{Name: "reviewRiskCase", Access: ACCESS_WRITE, Role: ROLE_RISK_OFFICER, Request: reviewRiskCaseRequest{}, Handler: (*SimpleChaincode).reviewRiskCase,
+			Description: "Release or reject a held transfer, or clear or confirm a flagged one"},
+		{Name: "freezeAccount", Access: ACCESS_WRITE, Role: ROLE_COMPLIANCE, Request: accountFreezeRequest{}, Handler: (*SimpleChaincode).freezeAccount,
+			Description: "Freeze a member account with a reason code, it can neither send nor receive points"},
+		{Name: "unfreezeAccount", Access: ACCESS_WRITE, Role: ROLE_COMPLIANCE, Request: accountFreezeRequest{}, Handler: (*SimpleChaincode).unfreezeAccount,
+			Description: "Unfreeze a frozen member account with a reason code"},
+		{Name: "listIdentity", Access: ACCESS_WRITE, Role: ROLE_COMPLIANCE, Request: sanctionRequest{}, Handler: (*SimpleChaincode).listIdentity,
+			Description: "Put a member id or client identity on the sanctions list"},
+		{Name: "delistIdentity", Access: ACCESS_WRITE, Role: ROLE_COMPLIANCE, Request: sanctionRequest{}, Handler: (*SimpleChaincode).delistIdentity,
+			Description: "Take an identity off the sanctions list"},
+		{Name: "setApprovalPolicy", Access: ACCESS_WRITE, Role: ROLE_ADMIN, Request: approvalPolicyRequest{}, Handler: (*SimpleChaincode).setApprovalPolicy,
+			Description: "Put calls of a write function behind a number of approvals out of a list of approver identities"},
+		{Name: "proposeOperation", Access: ACCESS_WRITE, Role: ROLE_MEMBER, Request: proposeOperationRequest{}, Handler: (*SimpleChaincode).proposeOperation,
+			Description: "Propose a call that needs approvals, kept pending until approved, rejected or expired"},
+		{Name: "approveOperation", Access: ACCESS_WRITE, Role: ROLE_MEMBER, Request: operationVoteRequest{}, Handler: (*SimpleChaincode).approveOperation,
+			Description: "Approve a pending operation as one of its approvers, running it once the threshold is met"},
+		{Name: "rejectOperation", Access: ACCESS_WRITE, Role: ROLE_MEMBER, Request: operationVoteRequest{}, Handler: (*SimpleChaincode).rejectOperation,
+			Description: "Reject a pending operation as one of its approvers"},
+		{Name: "expireOperations", Access: ACCESS_WRITE, Role: ROLE_MEMBER, Request: emptyRequest{}, Handler: (*SimpleChaincode).expireOperations,
+			Description: "Expire every pending operation past its deadline"},
+		{Name: "createSchedule", Access: ACCESS_WRITE, Role: ROLE_MEMBER, Request: createScheduleRequest{}, Handler: (*SimpleChaincode).createSchedule,
+			Description: "Create a standing transfer on a cron recurrence between a start and an end date"},
+		{Name: "cancelSchedule", Access: ACCESS_WRITE, Role: ROLE_MEMBER, Request: scheduleRequest{}, Handler: (*SimpleChaincode).cancelSchedule,
+			Description: "Cancel an active schedule"},
+		{Name: "runDueSchedules", Access: ACCESS_WRITE, Role: ROLE_ADMIN, Request: runSchedulesRequest{}, Handler: (*SimpleChaincode).runDueSchedules,
+			Description: "Post every scheduled transfer due up to the proposal timestamp"},
+		{Name: "matureEarnings", Access: ACCESS_WRITE, Role: ROLE_MEMBER, Request: matureEarningsRequest{}, Handler: (*SimpleChaincode).matureEarnings,
+			Description: "Move every pending earning past its maturity date into the balance of its member"},
+		{Name: "reverseTransaction", Access: ACCESS_WRITE, Role: ROLE_BUSINESS, Request: reverseTransactionRequest{}, Handler: (*SimpleChaincode).reverseTransaction,
+			Delegate: DELEGATE_REFUND, Description: "Reverse a posted transaction, cancelling its earnings while they are pending"},
+		{Name: "createPool", Access: ACCESS_WRITE, Role: ROLE_MEMBER, Request: createPoolRequest{}, Handler: (*SimpleChaincode).createPool,
+			Description: "Create a pooled account owned by a member"},
+		{Name: "setPoolRules", Access: ACCESS_WRITE, Role: ROLE_MEMBER, Request: poolRulesRequest{}, Handler: (*SimpleChaincode).setPoolRules,
+			Description: "Set the smallest and largest contribution a pool takes"},
+		{Name: "setPoolMember", Access: ACCESS_WRITE, Role: ROLE_MEMBER, Request: poolMemberRequest{}, Handler: (*SimpleChaincode).setPoolMember,
+			Description: "Add a member to a pool or change its spending permission and limits"},
+		{Name: "removePoolMember", Access: ACCESS_WRITE, Role: ROLE_MEMBER, Request: poolUserRequest{}, Handler: (*SimpleChaincode).removePoolMember,
+			Description: "Remove a member from a pool"},
+		{Name: "setSpendOrder", Access: ACCESS_WRITE, Role: ROLE_ADMIN, Request: spendOrderRequest{}, Handler: (*SimpleChaincode).setSpendOrder,
+			Description: "Set the order in which members spend their earned, promotional and purchased wallets"},
+		{Name: "grantDelegation", Access: ACCESS_WRITE, Role: ROLE_BUSINESS, Request: grantDelegationRequest{}, Handler: (*SimpleChaincode).grantDelegation,
+			Description: "Grant a staff identity scoped permissions on a business account"},
+		{Name: "revokeDelegation", Access: ACCESS_WRITE, Role: ROLE_BUSINESS, Request: revokeDelegationRequest{}, Handler: (*SimpleChaincode).revokeDelegation,
+			Description: "Revoke the delegation of a business to a staff identity"},
+		{Name: "authorizePayment", Access: ACCESS_WRITE, Role: ROLE_MEMBER, Request: authorizePaymentRequest{}, Handler: (*SimpleChaincode).authorizePayment,
+			Description: "Let a business or its delegates take up to an amount of points from a member once, at the point of sale"},
+
+		{Name: "getTxs", Access: ACCESS_READ, Role: ROLE_MEMBER, Request: userRequest{}, Handler: (*SimpleChaincode).getTxs,
+			Description: "Most recent transactions sent or received by a member"},
+		{Name: "getUserAccount", Access: ACCESS_READ, Role: ROLE_MEMBER, Request: userRequest{}, Handler: (*SimpleChaincode).getUserAccount,
+			Description: "Account record of a member"},
+		{Name: "getAllContracts", Access: ACCESS_READ, Role: ROLE_MEMBER, Request: emptyRequest{}, Handler: (*SimpleChaincode).getAllContracts,
+			Description: "Metadata of every smart contract"},
+		{Name: "getReferenceNumber", Access: ACCESS_READ, Role: ROLE_MEMBER, Request: emptyRequest{}, Handler: (*SimpleChaincode).getReferenceNumber,
+			Description: "Next transaction reference number"},
+		{Name: "getBalanceAt", Access: ACCESS_READ, Role: ROLE_MEMBER, Request: balanceAtRequest{}, Handler: (*SimpleChaincode).getBalanceAt,
+			Description: "Balance, tier and transaction count of a member as of a point in time"},
+		{Name: "getAccountHistory", Access: ACCESS_READ, Role: ROLE_MEMBER, Request: userRequest{}, Handler: (*SimpleChaincode).getAccountHistory,
+			Description: "Every version of a member record with the transaction that changed it"},
+		{Name: "getStatement", Access: ACCESS_READ, Role: ROLE_MEMBER, Request: statementRequest{}, Handler: (*SimpleChaincode).getStatement,
+			Description: "Statement of a member for a period as json, csv or text"},
+		{Name: "getSettlementBatch", Access: ACCESS_READ, Role: ROLE_BUSINESS, Request: settlementBatchRequest{}, Handler: (*SimpleChaincode).getSettlementBatch,
+			Description: "One settlement batch"},
+		{Name: "getSettlementBatches", Access: ACCESS_READ, Role: ROLE_BUSINESS, Request: settlementBatchesRequest{}, Handler: (*SimpleChaincode).getSettlementBatches,
+			Description: "Open or closed settlement batches, optionally of one business"},
+		{Name: "getProgram", Access: ACCESS_READ, Role: ROLE_MEMBER, Request: emptyRequest{}, Handler: (*SimpleChaincode).getProgram,
+			Description: "The program"},
+		{Name: "getPrograms", Access: ACCESS_READ, Role: ROLE_MEMBER, Request: emptyRequest{}, Handler: (*SimpleChaincode).getPrograms,
+			Description: "Every program on the chaincode"},
+		{Name: "getExchangePairs", Access: ACCESS_READ, Role: ROLE_MEMBER, Request: emptyRequest{}, Handler: (*SimpleChaincode).getExchangePairs,
+			Description: "Terms and current rate of every currency pair"},
+		{Name: "quoteConversion", Access: ACCESS_READ, Role: ROLE_MEMBER, Request: quoteConversionRequest{}, Handler: (*SimpleChaincode).quoteConversion,
+			Description: "Price a conversion of points to another program without making it"},
+		{Name: "getCatalog", Access: ACCESS_READ, Role: ROLE_MEMBER, Request: catalogRequest{}, Handler: (*SimpleChaincode).getCatalog,
+			Description: "Active catalog items, optionally of one business or tier"},
+		{Name: "getOrder", Access: ACCESS_READ, Role: ROLE_MEMBER, Request: orderRequest{}, Handler: (*SimpleChaincode).getOrder,
+			Description: "One order"},
+		{Name: "getOrders", Access: ACCESS_READ, Role: ROLE_MEMBER, Request: ordersRequest{}, Handler: (*SimpleChaincode).getOrders,
+			Description: "Orders, optionally of one member or business and in one status"},
+		{Name: "getEarnRule", Access: ACCESS_READ, Role: ROLE_MEMBER, Request: earnRuleRequest{}, Handler: (*SimpleChaincode).getEarnRule,
+			Description: "Earn rates of a business"},
+		{Name: "getVouchers", Access: ACCESS_READ, Role: ROLE_BUSINESS, Request: vouchersRequest{}, Handler: (*SimpleChaincode).getVouchers,
+			Description: "Vouchers of a business with their redemption counts"},
+		{Name: "getReferrals", Access: ACCESS_READ, Role: ROLE_BUSINESS, Request: referralsRequest{}, Handler: (*SimpleChaincode).getReferrals,
+			Description: "Referrals, optionally of one referrer and in one status"},
+		{Name: "getRiskRules", Access: ACCESS_READ, Role: ROLE_RISK_OFFICER, Request: emptyRequest{}, Handler: (*SimpleChaincode).getRiskRules,
+			Description: "Every risk rule"},
+		{Name: "getRiskCases", Access: ACCESS_READ, Role: ROLE_RISK_OFFICER, Request: riskCasesRequest{}, Handler: (*SimpleChaincode).getRiskCases,
+			Description: "Held and flagged transfers, optionally of one sender and in one status"},
+		{Name: "getSanctionsList", Access: ACCESS_READ, Role: ROLE_COMPLIANCE, Request: emptyRequest{}, Handler: (*SimpleChaincode).getSanctionsList,
+			Description: "Identities on the sanctions list"},
+		{Name: "getComplianceActions", Access: ACCESS_READ, Role: ROLE_COMPLIANCE, Request: complianceActionsRequest{}, Handler: (*SimpleChaincode).getComplianceActions,
+			Description: "Freezes, unfreezes, listings and delistings with who took them and when"},
+		{Name: "getApprovalPolicies", Access: ACCESS_READ, Role: ROLE_MEMBER, Request: emptyRequest{}, Handler: (*SimpleChaincode).getApprovalPolicies,
+			Description: "Every approval policy"},
+		{Name: "getOperations", Access: ACCESS_READ, Role: ROLE_MEMBER, Request: operationsRequest{}, Handler: (*SimpleChaincode).getOperations,
+			Description: "Proposed operations, optionally of one function and in one status"},
+		{Name: "getSchedules", Access: ACCESS_READ, Role: ROLE_MEMBER, Request: schedulesRequest{}, Handler: (*SimpleChaincode).getSchedules,
+			Description: "Schedules, optionally sent or received by one member and in one status"},
+		{Name: "getPendingEarnings", Access: ACCESS_READ, Role: ROLE_MEMBER, Request: pendingEarningsRequest{}, Handler: (*SimpleChaincode).getPendingEarnings,
+			Description: "Earnings of a member, optionally in one status, by maturity date"},
+		{Name: "getPool", Access: ACCESS_READ, Role: ROLE_MEMBER, Request: poolRequest{}, Handler: (*SimpleChaincode).getPool,
+			Description: "A pool with its members, their permissions and what each contributed and spent"},
+		{Name: "getSpendOrder", Access: ACCESS_READ, Role: ROLE_MEMBER, Request: emptyRequest{}, Handler: (*SimpleChaincode).getSpendOrder,
+			Description: "Order in which members spend their wallets"},
+		{Name: "getDelegations", Access: ACCESS_READ, Role: ROLE_BUSINESS, Request: delegationsRequest{}, Handler: (*SimpleChaincode).getDelegations,
+			Description: "Delegations of a business to staff identities"},
+		{Name: "describeFunctions", Access: ACCESS_READ, Role: ROLE_MEMBER, Request: emptyRequest{}, Handler: (*SimpleChaincode).describeFunctions,
+			Description: "Machine readable description of every chaincode function"},
+	}
+
+	functionsByName = make(map[string]*FunctionSpec)
+	for i := range functions {
+		functionsByName[functions[i].Name] = &functions[i]
+	}
+}
+
+// ============================================================================================================================
+// Look up a function, check the caller may call it, decode its request and run it
+// ============================================================================================================================
+func (t *SimpleChaincode) dispatch(ctx *TransactionContext, function string, args []string) ([]byte, error) {
+
+	spec, ok := functionsByName[function]
+	if !ok {
+		return nil, newError(ERR_UNKNOWN_FUNCTION, "Received unknown function invocation %s", function)
+	}
+
+	programId, args, err := splitProgramId(args)
+	if err != nil {
+		return nil, err
+	}
+	ctx.program, err = loadProgram(ctx.rootStub(), programId)
+	if err != nil {
+		return nil, err
+	}
+	ctx.stub = newProgramStub(ctx.rootStub(), programId)
+
+	ctx.role = callerRole(ctx)
+	ctx.account = callerAttribute(ctx, ACCOUNT_ATTRIBUTE)
+
+	allowed, err := roleAllowed(ctx, spec)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		return nil, newError(ERR_FORBIDDEN, "%s requires the %s role, caller has %s", function, spec.Role, ctx.role)
+	}
+
+	// Listed callers can not change the ledger, compliance officers can so they may delist
+	if spec.Access == ACCESS_WRITE && roleRank[ctx.role] < roleRank[ROLE_COMPLIANCE] {
+		err = checkCaller(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	request := reflect.New(reflect.TypeOf(spec.Request)).Interface()
+	err = parseRequest(args, request)
+	if err != nil {
+		return nil, err
+	}
+
+	if spec.Access == ACCESS_READ {
+		return spec.Handler(t, ctx, request)
+	}
+
+	// Calls matching an approval policy only run through approveOperation
+	policy, err := matchApprovalPolicy(ctx, function, request)
+	if err != nil {
+		return nil, err
+	}
+	if policy != nil {
+		return nil, newError(ERR_APPROVAL_REQUIRED, "%s needs %d approvals under policy %s, submit it with proposeOperation",
+			function, policy.Threshold, policy.PolicyId)
+	}
+
+	// Collect the effects of this invoke, emitted as one chaincode event once it succeeds
+	stub := ctx.GetStub()
+	ctx.event, err = newLedgerEvent(stub, function)
+	if err != nil {
+		return nil, err
+	}
+	ctx.event.ProgramId = programId
+	ctx.event.Caller = callerId(ctx)
+	ctx.event.role = ctx.role
+	ctx.event.delegated = ctx.delegated
+
+	res, err := spec.Handler(t, ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ctx.event.emit(stub)
+	if err != nil {
+		return nil, newError(ERR_LEDGER, "failed to emit event: %s", err)
+	}
+
+	return res, nil
+}
+
+// ============================================================================================================================
+// Check the caller role against the function. A delegate holding the Delegate permission of the function may call it
+// below its role. The first init of an empty default program is open to anyone, since it runs when the chaincode is
+// deployed, before any roles exist.
+// ============================================================================================================================
+func roleAllowed(ctx *TransactionContext, spec *FunctionSpec) (bool, error) {
+
+	if roleRank[ctx.role] >= roleRank[spec.Role] {
+		return true, nil
+	}
+
+	if spec.Delegate != "" {
+		held, err := holdsDelegation(ctx, spec.Delegate)
+		if err != nil || held {
+			ctx.delegated = held
+			return held, err
+		}
+	}
+
+	if spec.Name == "init" && ctx.Program().ProgramId == DEFAULT_PROGRAM {
+		refNumberBytes, err := ctx.GetStub().GetState("refNumber")
+		if err != nil {
+			return false, newError(ERR_LEDGER, "failed to read refNumber: %s", err)
+		}
+		return refNumberBytes == nil, nil
+	}
+
+	return false, nil
+}
+
+// ============================================================================================================================
+// Role of the caller in the current program, read from its certificate
+// ============================================================================================================================
+func callerRole(ctx *TransactionContext) string {
+
+	role := callerAttribute(ctx, ROLE_ATTRIBUTE)
+	if _, ok := roleRank[role]; !ok {
+		return ROLE_MEMBER
+	}
+
+	return role
+}
+
+// Certificate attribute of the caller in the current program, empty if it has none
+func callerAttribute(ctx *TransactionContext, name string) string {
+
+	identity := ctx.GetClientIdentity()
+	if identity == nil {
+		return ""
+	}
+
+	programId := ctx.Program().ProgramId
+	value, found, err := identity.GetAttributeValue(name + "." + programId)
+	if err == nil && !found && programId == DEFAULT_PROGRAM {
+		value, found, err = identity.GetAttributeValue(name)
+	}
+	if err != nil || !found {
+		return ""
+	}
+
+	return value
+}
+
+// ============================================================================================================================
+// Check the caller acts for a member account, admins act for every account
+// ============================================================================================================================
+func checkAccount(ctx *TransactionContext, userId string) error {
+
+	if roleRank[ctx.role] >= roleRank[ROLE_ADMIN] || (ctx.account != "" && ctx.account == userId) {
+		return nil
+	}
+
+	return newError(ERR_FORBIDDEN, "the caller does not act for %s", userId)
+}
+
+// Description of one function returned by describeFunctions
+type FunctionDescription struct {
+	Name        string        `json:"Name"`
+	Access      string        `json:"Access"`
+	Role        string        `json:"Role"`
+	Delegate    string        `json:"Delegate,omitempty"`
+	Description string        `json:"Description"`
+	Request     []FieldSchema `json:"Request"`
+}
+
+// Output of describeFunctions
+type APIDescription struct {
+	APIVersion         int                   `json:"APIVersion"`
+	EventName          string                `json:"EventName"`
+	EventSchemaVersion int                   `json:"EventSchemaVersion"`
+	Roles              []string              `json:"Roles"`
+	ErrorCodes         []string              `json:"ErrorCodes"`
+	Functions          []FunctionDescription `json:"Functions"`
+}
+
+// ============================================================================================================================
+// Describe every registered function, its access, role and request schema
+// ============================================================================================================================
+func (t *SimpleChaincode) describeFunctions(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	var api APIDescription
+	api.APIVersion = API_VERSION
+	api.EventName = EVENT_NAME
+	api.EventSchemaVersion = EVENT_SCHEMA_VERSION
+	api.Roles = []string{ROLE_MEMBER, ROLE_BUSINESS, ROLE_RISK_OFFICER, ROLE_COMPLIANCE, ROLE_ADMIN}
+	api.ErrorCodes = []string{ERR_VALIDATION_FAILED, ERR_NOT_FOUND, ERR_INSUFFICIENT_FUNDS, ERR_BUDGET_EXCEEDED,
+		ERR_ALREADY_EXISTS, ERR_INVALID_STATE, ERR_UNKNOWN_FUNCTION, ERR_CORRUPT_STATE, ERR_LEDGER, ERR_FORBIDDEN,
+		ERR_RISK_BLOCKED, ERR_COMPLIANCE_HOLD, ERR_APPROVAL_REQUIRED, ERR_POOL_LIMIT}
+
+	for _, spec := range functions {
+		var desc FunctionDescription
+		desc.Name = spec.Name
+		desc.Access = spec.Access
+		desc.Role = spec.Role
+		desc.Delegate = spec.Delegate
+		desc.Description = spec.Description
+		desc.Request = append(requestSchema(spec.Request), FieldSchema{Name: PROGRAM_FIELD, Type: FIELD_STRING})
+		api.Functions = append(api.Functions, desc)
+	}
+
+	asBytes, _ := json.Marshal(api)
+	return asBytes, nil
+}
@@ -0,0 +1,277 @@
+package openpoints
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================================================================================
+// Typed requests
+//
+// Every function takes a single argument, a JSON object that is decoded into the request struct of the function.
+// The struct is the declared schema of the request: the json tag names the field and the validate tag lists its
+// rules, for example
+//
+//	Amount float64 `json:"amount" validate:"required,min=0"`
+//
+// Supported rules are required, min=<n>, max=<n> and oneof=<a>|<b>. Field types map to schema types as follows:
+// string -> string, float64 -> number, int -> integer, bool -> boolean, time.Time -> date, []string -> string[].
+// Dates are accepted as RFC 3339 timestamps or as 2006-01-02. Unknown fields are rejected, and so are strings with a
+// NUL character, which only keys built by CreateCompositeKey may contain.
+// Every request may also name the program it runs in with a programId field, see program.go.
+// ============================================================================================================================
+
+// Schema types of request fields
+const FIELD_STRING = "string"
+const FIELD_NUMBER = "number"
+const FIELD_INTEGER = "integer"
+const FIELD_BOOLEAN = "boolean"
+const FIELD_DATE = "date"
+const FIELD_STRING_LIST = "string[]"
+
+// Date only layout accepted for date fields
+const DATE_LAYOUT = "2006-01-02"
+
+// Declared shape of one request field
+type FieldSchema struct {
+	Name     string   `json:"Name"`
+	Type     string   `json:"Type"`
+	Required bool     `json:"Required"`
+	Min      *float64 `json:"Min,omitempty"`
+	Max      *float64 `json:"Max,omitempty"`
+	OneOf    []string `json:"OneOf,omitempty"`
+}
+
+// ============================================================================================================================
+// Derive the schema of a request struct from its tags
+// ============================================================================================================================
+func requestSchema(req interface{}) []FieldSchema {
+
+	var fields []FieldSchema
+
+	rt := reflect.TypeOf(req)
+	for rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		name := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+
+		var field FieldSchema
+		field.Name = name
+		field.Type = fieldType(sf.Type)
+
+		for _, rule := range strings.Split(sf.Tag.Get("validate"), ",") {
+			if rule == "required" {
+				field.Required = true
+			} else if strings.HasPrefix(rule, "min=") {
+				min, _ := strconv.ParseFloat(strings.TrimPrefix(rule, "min="), 64)
+				field.Min = &min
+			} else if strings.HasPrefix(rule, "max=") {
+				max, _ := strconv.ParseFloat(strings.TrimPrefix(rule, "max="), 64)
+				field.Max = &max
+			} else if strings.HasPrefix(rule, "oneof=") {
+				field.OneOf = strings.Split(strings.TrimPrefix(rule, "oneof="), "|")
+			}
+		}
+
+		fields = append(fields, field)
+	}
+
+	return fields
+}
+
+func fieldType(t reflect.Type) string {
+
+	if t == reflect.TypeOf(time.Time{}) {
+		return FIELD_DATE
+	}
+
+	switch t.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return FIELD_NUMBER
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return FIELD_INTEGER
+	case reflect.Bool:
+		return FIELD_BOOLEAN
+	case reflect.Slice:
+		return FIELD_STRING_LIST
+	}
+
+	return FIELD_STRING
+}
+
+// ============================================================================================================================
+// Decode the JSON request in args into req after validating it against the schema declared by req
+// ============================================================================================================================
+func parseRequest(args []string, req interface{}) error {
+
+	if len(args) > 1 {
+		return newError(ERR_VALIDATION_FAILED, "expecting a single JSON request object, got %d arguments", len(args))
+	}
+
+	requestStr := "{}"
+	if len(args) == 1 && strings.TrimSpace(args[0]) != "" {
+		requestStr = args[0]
+	}
+
+	var raw map[string]json.RawMessage
+	err := json.Unmarshal([]byte(requestStr), &raw)
+	if err != nil || raw == nil {
+		return newError(ERR_VALIDATION_FAILED, "request is not a JSON object")
+	}
+
+	schema := requestSchema(req)
+	known := make(map[string]bool)
+	for _, field := range schema {
+		known[field.Name] = true
+	}
+	for name := range raw {
+		if !known[name] {
+			return fieldError(name, "unknown field %s", name)
+		}
+	}
+
+	for _, field := range schema {
+		value, present := raw[field.Name]
+		if !present || string(value) == "null" {
+			if field.Required {
+				return fieldError(field.Name, "%s is required", field.Name)
+			}
+			delete(raw, field.Name)
+			continue
+		}
+
+		normalized, err := validateField(field, value)
+		if err != nil {
+			return err
+		}
+		raw[field.Name] = normalized
+	}
+
+	normalizedAsBytes, _ := json.Marshal(raw)
+	err = json.Unmarshal(normalizedAsBytes, req)
+	if err != nil {
+		return newError(ERR_VALIDATION_FAILED, "request does not match schema: %s", err)
+	}
+
+	return nil
+}
+
+// ============================================================================================================================
+// Check one raw field value against its schema, returns the value to decode
+// ============================================================================================================================
+func validateField(field FieldSchema, value json.RawMessage) (json.RawMessage, error) {
+
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+	var v interface{}
+	err := decoder.Decode(&v)
+	if err != nil {
+		return nil, fieldError(field.Name, "%s is not valid JSON", field.Name)
+	}
+
+	switch field.Type {
+	case FIELD_STRING:
+		s, ok := v.(string)
+		if !ok {
+			return nil, fieldError(field.Name, "%s must be a string", field.Name)
+		}
+		if field.Required && strings.TrimSpace(s) == "" {
+			return nil, fieldError(field.Name, "%s must not be empty", field.Name)
+		}
+		if strings.ContainsRune(s, 0) {
+			return nil, fieldError(field.Name, "%s must not contain a NUL character", field.Name)
+		}
+		if len(field.OneOf) > 0 && !containsString(field.OneOf, s) {
+			return nil, fieldError(field.Name, "%s must be one of %s", field.Name, strings.Join(field.OneOf, ", "))
+		}
+
+	case FIELD_NUMBER, FIELD_INTEGER:
+		n, ok := v.(json.Number)
+		if !ok {
+			return nil, fieldError(field.Name, "%s must be a number", field.Name)
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return nil, fieldError(field.Name, "%s must be a number", field.Name)
+		}
+		if field.Type == FIELD_INTEGER {
+			_, err = n.Int64()
+			if err != nil {
+				return nil, fieldError(field.Name, "%s must be an integer", field.Name)
+			}
+		}
+		if field.Min != nil && f < *field.Min {
+			return nil, fieldError(field.Name, "%s must be at least %v", field.Name, *field.Min)
+		}
+		if field.Max != nil && f > *field.Max {
+			return nil, fieldError(field.Name, "%s must be at most %v", field.Name, *field.Max)
+		}
+
+	case FIELD_BOOLEAN:
+		_, ok := v.(bool)
+		if !ok {
+			return nil, fieldError(field.Name, "%s must be true or false", field.Name)
+		}
+
+	case FIELD_DATE:
+		s, ok := v.(string)
+		if !ok {
+			return nil, fieldError(field.Name, "%s must be a date", field.Name)
+		}
+		date, err := parseDate(s)
+		if err != nil {
+			return nil, fieldError(field.Name, "%s must be a date as 2006-01-02 or RFC 3339", field.Name)
+		}
+		value, _ = json.Marshal(date)
+
+	case FIELD_STRING_LIST:
+		list, ok := v.([]interface{})
+		if !ok {
+			return nil, fieldError(field.Name, "%s must be a list of strings", field.Name)
+		}
+		for _, item := range list {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fieldError(field.Name, "%s must be a list of strings", field.Name)
+			}
+			if strings.ContainsRune(s, 0) {
+				return nil, fieldError(field.Name, "%s must not contain a NUL character", field.Name)
+			}
+		}
+		if field.Required && len(list) == 0 {
+			return nil, fieldError(field.Name, "%s must not be empty", field.Name)
+		}
+	}
+
+	return value, nil
+}
+
+// Parse a date given as RFC 3339 or as 2006-01-02
+func parseDate(s string) (time.Time, error) {
+
+	date, err := time.Parse(time.RFC3339, s)
+	if err == nil {
+		return date.UTC(), nil
+	}
+
+	return time.Parse(DATE_LAYOUT, s)
+}
+
+func containsString(list []string, s string) bool {
+	for i := range list {
+		if list[i] == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,544 @@
+package openpoints
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// ============================================================================================================================
+// Risk rules on transfers
+//
+// Risk officers set rules that every transfer is checked against before its points move, whichever function posts
+// it. Reversals, refunds and expiries give back or drop points already moved and are exempt. A rule applies to
+// every sender or only to senders of one tier, and hits when:
+//
+//	maxAmount      the priced amount is above Limit points
+//	dailyAmount    the points sent today, this transfer included, are above Limit
+//	monthlyAmount  the points sent this month, this transfer included, are above Limit
+//	hourlyCount    the transfers sent this hour, this transfer included, are more than Limit
+//	newAccount     the sender joined less than Limit days ago
+//	newReceiver    the sender never sent points to the receiver before
+//
+// The most severe rule that hits decides: block fails the transfer with RISK_BLOCKED, hold keeps it unposted in a
+// HELD risk case until a risk officer releases or rejects it, and flag posts it and opens a FLAGGED case. Only
+// transferPoints and scheduled runs can be held, any other call a rule would hold fails with RISK_BLOCKED. The ids
+// of the rules that hit are kept in RiskFlags of the transaction and every posted transfer counts in the usage of
+// its sender.
+// ============================================================================================================================
+
+// Risk rule kinds
+const RISK_MAX_AMOUNT = "maxAmount"
+const RISK_DAILY_AMOUNT = "dailyAmount"
+const RISK_MONTHLY_AMOUNT = "monthlyAmount"
+const RISK_HOURLY_COUNT = "hourlyCount"
+const RISK_NEW_ACCOUNT = "newAccount"
+const RISK_NEW_RECEIVER = "newReceiver"
+
+// Risk rule severities, in increasing order
+const RISK_FLAG = "flag"
+const RISK_HOLD = "hold"
+const RISK_BLOCK = "block"
+
+// Risk case statuses
+const RISK_CASE_HELD = "HELD"
+const RISK_CASE_FLAGGED = "FLAGGED"
+const RISK_CASE_RELEASED = "RELEASED"
+const RISK_CASE_REJECTED = "REJECTED"
+const RISK_CASE_CLEARED = "CLEARED"
+const RISK_CASE_CONFIRMED = "CONFIRMED"
+
+// Composite key object types
+const riskRuleObject = "riskRule"
+const riskUsageObject = "riskUsage"
+const riskPayeeObject = "riskPayee"
+const riskCaseObject = "riskCase"
+
+var riskSeverityRank = map[string]int{
+	"":         0,
+	RISK_FLAG:  1,
+	RISK_HOLD:  2,
+	RISK_BLOCK: 3,
+}
+
+// A risk rule, Tier limits it to senders of that tier
+type RiskRule struct {
+	RuleId   string  `json:"RuleId"`
+	Kind     string  `json:"Kind"`
+	Tier     string  `json:"Tier,omitempty"`
+	Limit    float64 `json:"Limit"`
+	Severity string  `json:"Severity"`
+	Active   bool    `json:"Active"`
+}
+
+// Points and transfers sent by a member in one day, month or hour
+type RiskUsage struct {
+	Amount float64 `json:"Amount"`
+	Count  int     `json:"Count"`
+}
+
+// A rule that hit a transfer
+type RiskHit struct {
+	RuleId   string `json:"RuleId"`
+	Severity string `json:"Severity"`
+	Reason   string `json:"Reason"`
+}
+
+// Outcome of checking a transfer against the risk rules
+type RiskScreening struct {
+	Severity string    `json:"Severity"`
+	Hits     []RiskHit `json:"Hits"`
+}
+
+// A held or flagged transfer, keyed by its reference number
+type RiskCase struct {
+	CaseId      string      `json:"CaseId"`
+	UserId      string      `json:"UserId"`
+	Status      string      `json:"Status"`
+	Hits        []RiskHit   `json:"Hits"`
+	Transaction Transaction `json:"Transaction"`
+	Created     time.Time   `json:"Created"`
+	Reviewed    time.Time   `json:"Reviewed"`
+	ReviewedBy  string      `json:"ReviewedBy,omitempty"`
+	Notes       string      `json:"Notes,omitempty"`
+}
+
+// Request for setRiskRule
+type riskRuleRequest struct {
+	RuleId   string  `json:"ruleId" validate:"required"`
+	Kind     string  `json:"kind" validate:"required,oneof=maxAmount|dailyAmount|monthlyAmount|hourlyCount|newAccount|newReceiver"`
+	Tier     string  `json:"tier"`
+	Limit    float64 `json:"limit" validate:"min=0"`
+	Severity string  `json:"severity" validate:"required,oneof=flag|hold|block"`
+	Active   bool    `json:"active"`
+}
+
+// Request for reviewRiskCase. Approving releases a held transfer or clears a flagged one, rejecting drops a held
+// transfer or confirms a flagged one.
+type reviewRiskCaseRequest struct {
+	CaseId  string `json:"caseId" validate:"required"`
+	Approve bool   `json:"approve"`
+	Notes   string `json:"notes"`
+}
+
+// Request for getRiskCases
+type riskCasesRequest struct {
+	UserId string `json:"userId"`
+	Status string `json:"status" validate:"oneof=HELD|FLAGGED|RELEASED|REJECTED|CLEARED|CONFIRMED"`
+}
+
+// ============================================================================================================================
+// Create or replace a risk rule
+// ============================================================================================================================
+func (t *SimpleChaincode) setRiskRule(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*riskRuleRequest)
+	stub := ctx.GetStub()
+
+	if req.Tier != "" && !containsString(ctx.Program().Tiers, req.Tier) {
+		return nil, fieldError("tier", "tier %s does not exist in program %s", req.Tier, ctx.Program().ProgramId)
+	}
+
+	rule := RiskRule{RuleId: req.RuleId, Kind: req.Kind, Tier: req.Tier, Limit: req.Limit, Severity: req.Severity, Active: req.Active}
+
+	key, err := compositeKey(stub, riskRuleObject, rule.RuleId)
+	if err != nil {
+		return nil, err
+	}
+	err = writeState(stub, key, rule)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Event().riskRuleSet(rule)
+
+	asBytes, _ := json.Marshal(rule)
+	return asBytes, nil
+}
+
+func loadRiskRules(stub shim.ChaincodeStubInterface) ([]RiskRule, error) {
+
+	iter, err := stub.GetStateByPartialCompositeKey(riskRuleObject, []string{})
+	if err != nil {
+		return nil, newError(ERR_LEDGER, "failed to list risk rules: %s", err)
+	}
+	defer iter.Close()
+
+	rules := []RiskRule{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, newError(ERR_LEDGER, "failed to list risk rules: %s", err)
+		}
+
+		var rule RiskRule
+		err = json.Unmarshal(kv.Value, &rule)
+		if err != nil {
+			return nil, newError(ERR_CORRUPT_STATE, "failed to decode risk rule %s: %s", kv.Key, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	sort.Slice(rules, func(i, j int) bool { return rules[i].RuleId < rules[j].RuleId })
+	return rules, nil
+}
+
+// ============================================================================================================================
+// Get every risk rule
+// ============================================================================================================================
+func (t *SimpleChaincode) getRiskRules(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	rules, err := loadRiskRules(ctx.GetStub())
+	if err != nil {
+		return nil, err
+	}
+
+	asBytes, _ := json.Marshal(rules)
+	return asBytes, nil
+}
+
+// Usage periods of a transfer: its day, month and hour
+func riskPeriods(at time.Time) map[string]string {
+	return map[string]string{
+		RISK_DAILY_AMOUNT:   at.Format(DATE_LAYOUT),
+		RISK_MONTHLY_AMOUNT: at.Format("2006-01"),
+		RISK_HOURLY_COUNT:   at.Format("2006-01-02T15"),
+	}
+}
+
+func loadRiskUsage(stub shim.ChaincodeStubInterface, userId string, period string) (string, RiskUsage, error) {
+
+	var usage RiskUsage
+	key, err := compositeKey(stub, riskUsageObject, userId, period)
+	if err != nil {
+		return "", usage, err
+	}
+	_, err = readState(stub, key, &usage)
+
+	return key, usage, err
+}
+
+// Reversals, refunds and expiries give back or drop points already moved. They are not checked against the risk
+// rules or approval policies, nor counted in the usage of the sender. Only the chaincode posts them.
+func screenExempt(tx Transaction) bool {
+	return tx.Type == TX_TYPE_REVERSAL || tx.Type == TX_TYPE_REFUND || tx.Type == TX_TYPE_EXPIRE
+}
+
+// Rule ids and reasons of the hits of one severity
+func (screening *RiskScreening) reasons(severity string) string {
+
+	reasons := []string{}
+	for _, hit := range screening.Hits {
+		if hit.Severity == severity {
+			reasons = append(reasons, hit.RuleId+": "+hit.Reason)
+		}
+	}
+
+	return strings.Join(reasons, "; ")
+}
+
+// ============================================================================================================================
+// Check a priced transfer against the risk rules. A blocked transfer returns RISK_BLOCKED, any other hit is recorded
+// in RiskFlags of the transfer.
+// ============================================================================================================================
+func screenTransfer(stub shim.ChaincodeStubInterface, ev *LedgerEvent, tx *Transaction) (*RiskScreening, error) {
+
+	now := ev.Timestamp
+	screening := &RiskScreening{Hits: []RiskHit{}}
+
+	if tx.From == "" || screenExempt(*tx) {
+		return screening, nil
+	}
+	var sender User
+	found, err := readState(stub, tx.From, &sender)
+	if err != nil || !found {
+		// postTransfer reports a missing sender
+		return screening, err
+	}
+
+	rules, err := loadRiskRules(stub)
+	if err != nil {
+		return nil, err
+	}
+	periods := riskPeriods(now)
+
+	for _, rule := range rules {
+		if !rule.Active || (rule.Tier != "" && rule.Tier != sender.Status) {
+			continue
+		}
+
+		reason := ""
+		switch rule.Kind {
+		case RISK_MAX_AMOUNT:
+			if tx.Amount > rule.Limit {
+				reason = fmt.Sprintf("%v points is above the limit of %v per transfer", tx.Amount, rule.Limit)
+			}
+		case RISK_DAILY_AMOUNT, RISK_MONTHLY_AMOUNT:
+			_, usage, err := loadRiskUsage(stub, tx.From, periods[rule.Kind])
+			if err != nil {
+				return nil, err
+			}
+			if usage.Amount+tx.Amount > rule.Limit {
+				reason = fmt.Sprintf("%v points sent in %s is above the limit of %v", usage.Amount+tx.Amount, periods[rule.Kind], rule.Limit)
+			}
+		case RISK_HOURLY_COUNT:
+			_, usage, err := loadRiskUsage(stub, tx.From, periods[rule.Kind])
+			if err != nil {
+				return nil, err
+			}
+			if float64(usage.Count+1) > rule.Limit {
+				reason = fmt.Sprintf("%d transfers sent in hour %s is above the limit of %v", usage.Count+1, periods[rule.Kind], rule.Limit)
+			}
+		case RISK_NEW_ACCOUNT:
+			joined, err := time.Parse(DATE_LAYOUT, sender.Join)
+			if err == nil && now.Before(joined.Add(time.Duration(rule.Limit*24)*time.Hour)) {
+				reason = fmt.Sprintf("account joined on %s, less than %v days ago", sender.Join, rule.Limit)
+			}
+		case RISK_NEW_RECEIVER:
+			if tx.To == "" {
+				continue
+			}
+			key, err := compositeKey(stub, riskPayeeObject, tx.From, tx.To)
+			if err != nil {
+				return nil, err
+			}
+			var firstRef string
+			found, err := readState(stub, key, &firstRef)
+			if err != nil {
+				return nil, err
+			}
+			if !found {
+				reason = fmt.Sprintf("first transfer to %s", tx.To)
+			}
+		}
+		if reason == "" {
+			continue
+		}
+
+		screening.Hits = append(screening.Hits, RiskHit{RuleId: rule.RuleId, Severity: rule.Severity, Reason: reason})
+		tx.RiskFlags = append(tx.RiskFlags, rule.RuleId)
+		if riskSeverityRank[rule.Severity] > riskSeverityRank[screening.Severity] {
+			screening.Severity = rule.Severity
+		}
+	}
+
+	if screening.Severity == RISK_BLOCK {
+		return nil, newError(ERR_RISK_BLOCKED, "transfer from %s blocked by %s", tx.From, screening.reasons(RISK_BLOCK))
+	}
+
+	return screening, nil
+}
+
+// ============================================================================================================================
+// Keep a screened transfer unposted until a risk officer reviews it. Its contract is charged and its voucher
+// redeemed only once it is released.
+// ============================================================================================================================
+func holdTransfer(stub shim.ChaincodeStubInterface, ev *LedgerEvent, tx Transaction, screening *RiskScreening) (*RiskCase, error) {
+
+	tx.StatusCode = 0
+	tx.StatusMsg = "Transaction Held For Review"
+
+	riskCase := RiskCase{CaseId: tx.RefNumber, UserId: tx.From, Status: RISK_CASE_HELD, Hits: screening.Hits,
+		Transaction: tx, Created: ev.Timestamp}
+
+	err := saveRiskCase(stub, ev, riskCase)
+	if err != nil {
+		return nil, err
+	}
+
+	return &riskCase, nil
+}
+
+// ============================================================================================================================
+// Count a posted transfer in the usage of its sender and open a case if it was flagged
+// ============================================================================================================================
+func trackTransfer(stub shim.ChaincodeStubInterface, ev *LedgerEvent, tx Transaction, screening *RiskScreening) error {
+
+	if tx.From == "" || screenExempt(tx) {
+		return nil
+	}
+
+	for _, period := range riskPeriods(ev.Timestamp) {
+		key, usage, err := loadRiskUsage(stub, tx.From, period)
+		if err != nil {
+			return err
+		}
+		usage.Amount = usage.Amount + tx.Amount
+		usage.Count++
+		err = writeState(stub, key, usage)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tx.To != "" {
+		key, err := compositeKey(stub, riskPayeeObject, tx.From, tx.To)
+		if err != nil {
+			return err
+		}
+		existing, err := stub.GetState(key)
+		if err != nil {
+			return newError(ERR_LEDGER, "failed to read %s: %s", key, err)
+		}
+		if existing == nil {
+			err = writeState(stub, key, tx.RefNumber)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if screening != nil && screening.Severity == RISK_FLAG {
+		riskCase := RiskCase{CaseId: tx.RefNumber, UserId: tx.From, Status: RISK_CASE_FLAGGED, Hits: screening.Hits,
+			Transaction: tx, Created: ev.Timestamp}
+		return saveRiskCase(stub, ev, riskCase)
+	}
+
+	return nil
+}
+
+func loadRiskCase(ctx *TransactionContext, caseId string) (*RiskCase, error) {
+
+	key, err := compositeKey(ctx.GetStub(), riskCaseObject, caseId)
+	if err != nil {
+		return nil, err
+	}
+
+	var riskCase RiskCase
+	found, err := readState(ctx.GetStub(), key, &riskCase)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, newError(ERR_NOT_FOUND, "risk case %s does not exist", caseId)
+	}
+
+	return &riskCase, nil
+}
+
+func saveRiskCase(stub shim.ChaincodeStubInterface, ev *LedgerEvent, riskCase RiskCase) error {
+
+	key, err := compositeKey(stub, riskCaseObject, riskCase.CaseId)
+	if err != nil {
+		return err
+	}
+	err = writeState(stub, key, riskCase)
+	if err != nil {
+		return err
+	}
+	ev.riskCaseChanged(riskCase)
+
+	return nil
+}
+
+// ============================================================================================================================
+// Release or reject a held transfer, or clear or confirm a flagged one
+// ============================================================================================================================
+func (t *SimpleChaincode) reviewRiskCase(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*reviewRiskCaseRequest)
+	stub := ctx.GetStub()
+	ev := ctx.Event()
+
+	riskCase, err := loadRiskCase(ctx, req.CaseId)
+	if err != nil {
+		return nil, err
+	}
+
+	switch riskCase.Status {
+	case RISK_CASE_HELD:
+		if !req.Approve {
+			riskCase.Status = RISK_CASE_REJECTED
+			riskCase.Transaction.StatusMsg = "Transaction Rejected"
+			break
+		}
+
+		tx := riskCase.Transaction
+		tx.StatusCode = 1
+		tx.StatusMsg = "Transaction Completed"
+		tx.TxId = stub.GetTxID()
+		if tx.ContractId != "" {
+			err = chargeContract(stub, ev, tx)
+			if err != nil {
+				return nil, err
+			}
+		}
+		// The officer decided on the hold, the released transfer is not screened again
+		err = postScreenedTransfer(stub, ev, &tx, nil)
+		if err != nil {
+			return nil, err
+		}
+		err = qualifyReferral(ctx, tx)
+		if err != nil {
+			return nil, err
+		}
+		riskCase.Transaction = tx
+		riskCase.Status = RISK_CASE_RELEASED
+	case RISK_CASE_FLAGGED:
+		riskCase.Status = RISK_CASE_CONFIRMED
+		if req.Approve {
+			riskCase.Status = RISK_CASE_CLEARED
+		}
+	default:
+		return nil, newError(ERR_INVALID_STATE, "risk case %s is %s and was already reviewed", riskCase.CaseId, riskCase.Status)
+	}
+
+	riskCase.Reviewed = ev.Timestamp
+	riskCase.ReviewedBy = callerId(ctx)
+	riskCase.Notes = req.Notes
+
+	err = saveRiskCase(stub, ev, *riskCase)
+	if err != nil {
+		return nil, err
+	}
+
+	asBytes, _ := json.Marshal(riskCase)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// List risk cases, optionally of one sender and in one status, oldest first
+// ============================================================================================================================
+func (t *SimpleChaincode) getRiskCases(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*riskCasesRequest)
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(riskCaseObject, []string{})
+	if err != nil {
+		return nil, newError(ERR_LEDGER, "failed to list risk cases: %s", err)
+	}
+	defer iter.Close()
+
+	cases := []RiskCase{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, newError(ERR_LEDGER, "failed to list risk cases: %s", err)
+		}
+
+		var riskCase RiskCase
+		err = json.Unmarshal(kv.Value, &riskCase)
+		if err != nil {
+			return nil, newError(ERR_CORRUPT_STATE, "failed to decode risk case %s: %s", kv.Key, err)
+		}
+
+		if (req.UserId != "" && riskCase.UserId != req.UserId) || (req.Status != "" && riskCase.Status != req.Status) {
+			continue
+		}
+		cases = append(cases, riskCase)
+	}
+
+	// Case ids are reference numbers, which only grow
+	sort.Slice(cases, func(i, j int) bool {
+		a, _ := strconv.Atoi(cases[i].CaseId)
+		b, _ := strconv.Atoi(cases[j].CaseId)
+		return a < b
+	})
+
+	asBytes, _ := json.Marshal(cases)
+	return asBytes, nil
+}
@@ -0,0 +1,486 @@
+package openpoints
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ============================================================================================================================
+// Scheduled transfers
+//
+// A schedule is a standing instruction to transfer Amount points from From to To, optionally under a contract, at
+// every time matching its cron Recurrence between StartDate and EndDate, at most MaxRuns times. runDueSchedules
+// posts every run due up to the timestamp of its proposal, oldest first, as a TX_TYPE_SCHEDULED transaction carrying
+// the ScheduleId. Missed runs are caught up. A run that can not be posted, because the sender is short of points,
+// the contract budget is spent, an account is frozen, it needs approvals or a risk rule blocks it, is skipped and
+// counted in Failures with its reason. A run a risk rule holds waits in a risk case like a held transferPoints. A
+// schedule is COMPLETED after its last run and CANCELLED by cancelSchedule. Only the caller acting for From, or an
+// admin, creates and cancels the schedules of an account.
+// ============================================================================================================================
+
+// Transaction type of a scheduled run
+const TX_TYPE_SCHEDULED = "scheduled"
+
+// Schedule statuses
+const SCHEDULE_ACTIVE = "ACTIVE"
+const SCHEDULE_COMPLETED = "COMPLETED"
+const SCHEDULE_CANCELLED = "CANCELLED"
+
+// Runs runDueSchedules posts when the request does not set a limit
+const DEFAULT_SCHEDULE_RUNS = 100
+
+// Composite key object type of schedules
+const scheduleObject = "schedule"
+
+// A standing transfer instruction
+type Schedule struct {
+	ScheduleId  string    `json:"ScheduleId"`
+	From        string    `json:"From"`
+	To          string    `json:"To"`
+	Amount      float64   `json:"Amount"`
+	ContractId  string    `json:"ContractId,omitempty"`
+	Description string    `json:"Description"`
+	Recurrence  string    `json:"Recurrence"`
+	StartDate   time.Time `json:"StartDate"`
+	EndDate     time.Time `json:"EndDate"`
+	MaxRuns     int       `json:"MaxRuns"`
+	Runs        int       `json:"Runs"`
+	Failures    int       `json:"Failures"`
+	NextRun     time.Time `json:"NextRun"`
+	LastRun     time.Time `json:"LastRun"`
+	LastRef     string    `json:"LastRef,omitempty"`
+	LastError   string    `json:"LastError,omitempty"`
+	Status      string    `json:"Status"`
+	CreatedBy   string    `json:"CreatedBy"`
+	Created     time.Time `json:"Created"`
+}
+
+// Outcome of one due run
+type ScheduleRun struct {
+	ScheduleId string    `json:"ScheduleId"`
+	Due        time.Time `json:"Due"`
+	RefNumber  string    `json:"RefNumber,omitempty"`
+	Held       bool      `json:"Held,omitempty"`
+	Error      string    `json:"Error,omitempty"`
+}
+
+// Request for createSchedule, maxRuns 0 runs until endDate
+type createScheduleRequest struct {
+	ScheduleId  string    `json:"scheduleId" validate:"required"`
+	From        string    `json:"from" validate:"required"`
+	To          string    `json:"to" validate:"required"`
+	Amount      float64   `json:"amount" validate:"required,min=0"`
+	ContractId  string    `json:"contractId"`
+	Description string    `json:"description"`
+	Recurrence  string    `json:"recurrence" validate:"required"`
+	StartDate   time.Time `json:"startDate"`
+	EndDate     time.Time `json:"endDate"`
+	MaxRuns     int       `json:"maxRuns" validate:"min=0"`
+}
+
+// Request for cancelSchedule
+type scheduleRequest struct {
+	ScheduleId string `json:"scheduleId" validate:"required"`
+}
+
+// Request for runDueSchedules, limit caps the runs posted by one call
+type runSchedulesRequest struct {
+	Limit int `json:"limit" validate:"min=0"`
+}
+
+// Request for getSchedules, userId lists the schedules it sends or receives
+type schedulesRequest struct {
+	UserId string `json:"userId"`
+	Status string `json:"status" validate:"oneof=ACTIVE|COMPLETED|CANCELLED"`
+}
+
+func loadSchedule(ctx *TransactionContext, scheduleId string) (*Schedule, error) {
+
+	key, err := compositeKey(ctx.GetStub(), scheduleObject, scheduleId)
+	if err != nil {
+		return nil, err
+	}
+
+	var schedule Schedule
+	found, err := readState(ctx.GetStub(), key, &schedule)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, newError(ERR_NOT_FOUND, "schedule %s does not exist", scheduleId)
+	}
+
+	return &schedule, nil
+}
+
+func saveSchedule(ctx *TransactionContext, schedule Schedule) error {
+
+	key, err := compositeKey(ctx.GetStub(), scheduleObject, schedule.ScheduleId)
+	if err != nil {
+		return err
+	}
+	err = writeState(ctx.GetStub(), key, schedule)
+	if err != nil {
+		return err
+	}
+	ctx.Event().scheduleChanged(schedule)
+
+	return nil
+}
+
+// Move a schedule to its next run after at, completing it when it has none left
+func advanceSchedule(schedule *Schedule, cron *cronSchedule, at time.Time) {
+
+	schedule.NextRun = cron.next(at)
+	if schedule.NextRun.IsZero() || (!schedule.EndDate.IsZero() && schedule.NextRun.After(schedule.EndDate)) ||
+		(schedule.MaxRuns > 0 && schedule.Runs >= schedule.MaxRuns) {
+		schedule.Status = SCHEDULE_COMPLETED
+		schedule.NextRun = time.Time{}
+	}
+}
+
+// ============================================================================================================================
+// Create a standing transfer instruction
+// ============================================================================================================================
+func (t *SimpleChaincode) createSchedule(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*createScheduleRequest)
+	stub := ctx.GetStub()
+	now := ctx.Event().Timestamp
+
+	if req.From == req.To {
+		return nil, fieldError("to", "cannot schedule points from %s to itself", req.From)
+	}
+	err := checkAccount(ctx, req.From)
+	if err != nil {
+		return nil, err
+	}
+	cron, err := parseCron(req.Recurrence)
+	if err != nil {
+		return nil, fieldError("recurrence", "recurrence %q is not valid: %s", req.Recurrence, err)
+	}
+	if !req.EndDate.IsZero() && !req.EndDate.After(req.StartDate) {
+		return nil, fieldError("endDate", "endDate must be after startDate")
+	}
+
+	for _, userId := range []string{req.From, req.To} {
+		var user User
+		found, err := readState(stub, userId, &user)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, newError(ERR_NOT_FOUND, "user %s does not exist", userId)
+		}
+	}
+	if req.ContractId != "" {
+		var contract Contract
+		found, err := readState(stub, req.ContractId, &contract)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, newError(ERR_NOT_FOUND, "contract %s does not exist", req.ContractId)
+		}
+	}
+
+	key, err := compositeKey(stub, scheduleObject, req.ScheduleId)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := stub.GetState(key)
+	if err != nil {
+		return nil, newError(ERR_LEDGER, "failed to read schedule %s: %s", req.ScheduleId, err)
+	}
+	if existing != nil {
+		return nil, newError(ERR_ALREADY_EXISTS, "schedule %s already exists", req.ScheduleId)
+	}
+
+	schedule := Schedule{ScheduleId: req.ScheduleId, From: req.From, To: req.To, Amount: req.Amount, ContractId: req.ContractId,
+		Description: req.Description, Recurrence: req.Recurrence, StartDate: req.StartDate, EndDate: req.EndDate,
+		MaxRuns: req.MaxRuns, Status: SCHEDULE_ACTIVE, CreatedBy: callerId(ctx), Created: now}
+
+	start := req.StartDate
+	if start.Before(now) {
+		start = now
+	}
+	advanceSchedule(&schedule, cron, start.Add(-time.Minute))
+	if schedule.Status != SCHEDULE_ACTIVE {
+		return nil, fieldError("recurrence", "recurrence %q has no run between the start and end dates", req.Recurrence)
+	}
+
+	err = saveSchedule(ctx, schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	asBytes, _ := json.Marshal(schedule)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Cancel an active schedule
+// ============================================================================================================================
+func (t *SimpleChaincode) cancelSchedule(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*scheduleRequest)
+
+	schedule, err := loadSchedule(ctx, req.ScheduleId)
+	if err != nil {
+		return nil, err
+	}
+	err = checkAccount(ctx, schedule.From)
+	if err != nil {
+		return nil, err
+	}
+	if schedule.Status != SCHEDULE_ACTIVE {
+		return nil, newError(ERR_INVALID_STATE, "schedule %s is %s", schedule.ScheduleId, schedule.Status)
+	}
+
+	schedule.Status = SCHEDULE_CANCELLED
+	schedule.NextRun = time.Time{}
+	err = saveSchedule(ctx, *schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	asBytes, _ := json.Marshal(schedule)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Reason a priced scheduled run can not be posted, checked before anything is written so a skipped run leaves no trace
+// ============================================================================================================================
+func scheduledRunBlocked(ctx *TransactionContext, tx Transaction) error {
+
+	stub := ctx.GetStub()
+
+	err := checkCompliance(stub, tx)
+	if err != nil {
+		return err
+	}
+	err = checkPoolTransfer(stub, tx)
+	if err != nil {
+		return err
+	}
+	err = checkTransferApproval(stub, ctx.Event(), tx)
+	if err != nil {
+		return err
+	}
+
+	var sender, receiver User
+	found, err := readState(stub, tx.From, &sender)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return newError(ERR_NOT_FOUND, "sender %s does not exist", tx.From)
+	}
+	if sender.Balance < tx.Amount {
+		return newError(ERR_INSUFFICIENT_FUNDS, "user %s has %v points, %v required", sender.UserId, sender.Balance, tx.Amount)
+	}
+	found, err = readState(stub, tx.To, &receiver)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return newError(ERR_NOT_FOUND, "receiver %s does not exist", tx.To)
+	}
+
+	if tx.ContractId != "" {
+		var contract Contract
+		found, err = readState(stub, tx.ContractId, &contract)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return newError(ERR_NOT_FOUND, "contract %s does not exist", tx.ContractId)
+		}
+		if contract.Budget > 0 && contract.PointsUsed+tx.Amount > contract.Budget {
+			return newError(ERR_BUDGET_EXCEEDED, "contract %s has %v of its %v point budget left, %v required",
+				contract.Id, contract.Budget-contract.PointsUsed, contract.Budget, tx.Amount)
+		}
+	}
+
+	return nil
+}
+
+// ============================================================================================================================
+// Post one due run of a schedule. A run that can not be posted is returned as a skip reason, not as an error.
+// ============================================================================================================================
+func runSchedule(ctx *TransactionContext, schedule *Schedule, due time.Time) (*ScheduleRun, error) {
+
+	stub := ctx.GetStub()
+	ev := ctx.Event()
+	run := &ScheduleRun{ScheduleId: schedule.ScheduleId, Due: due}
+
+	var tx Transaction
+	tx.Date = ev.Timestamp.Truncate(time.Minute)
+	tx.Type = TX_TYPE_SCHEDULED
+	tx.From = schedule.From
+	tx.To = schedule.To
+	tx.Description = schedule.Description
+	if tx.Description == "" {
+		tx.Description = fmt.Sprintf("Schedule %s due %s", schedule.ScheduleId, due.Format(time.RFC3339))
+	}
+	tx.ContractId = schedule.ContractId
+	tx.Amount = schedule.Amount
+	tx.ListAmount = schedule.Amount
+	tx.ScheduleId = schedule.ScheduleId
+	tx.StatusCode = 1
+	tx.StatusMsg = "Transaction Completed"
+	tx.TxId = stub.GetTxID()
+
+	var err error
+	var screening *RiskScreening
+	tx.Amount, err = priceTransaction(tx, stub)
+	if err == nil {
+		err = scheduledRunBlocked(ctx, tx)
+	}
+	if err == nil {
+		screening, err = screenTransfer(stub, ev, &tx)
+	}
+	if err != nil {
+		chaincodeErr, ok := err.(*ChaincodeError)
+		if !ok || chaincodeErr.Code == ERR_LEDGER || chaincodeErr.Code == ERR_CORRUPT_STATE {
+			return nil, err
+		}
+		run.Error = chaincodeErr.Error()
+		schedule.Failures++
+		schedule.LastError = run.Error
+		return run, nil
+	}
+
+	tx.RefNumber, err = nextRefNumber(stub, ev)
+	if err != nil {
+		return nil, err
+	}
+	if screening.Severity == RISK_HOLD {
+		_, err = holdTransfer(stub, ev, tx, screening)
+		if err != nil {
+			return nil, err
+		}
+		run.Held = true
+	} else {
+		if tx.ContractId != "" {
+			err = chargeContract(stub, ev, tx)
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = postScreenedTransfer(stub, ev, &tx, screening)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	run.RefNumber = tx.RefNumber
+	schedule.Runs++
+	schedule.LastRun = ev.Timestamp
+	schedule.LastRef = tx.RefNumber
+	schedule.LastError = ""
+	return run, nil
+}
+
+// ============================================================================================================================
+// Post every scheduled run due up to the proposal timestamp, oldest first
+// ============================================================================================================================
+func (t *SimpleChaincode) runDueSchedules(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*runSchedulesRequest)
+	now := ctx.Event().Timestamp
+
+	limit := req.Limit
+	if limit == 0 {
+		limit = DEFAULT_SCHEDULE_RUNS
+	}
+
+	schedules, err := loadSchedules(ctx, "", SCHEDULE_ACTIVE)
+	if err != nil {
+		return nil, err
+	}
+
+	runs := []ScheduleRun{}
+	for len(runs) < limit {
+		// Take the schedule with the oldest due run
+		sort.SliceStable(schedules, func(i, j int) bool { return schedules[i].NextRun.Before(schedules[j].NextRun) })
+		if len(schedules) == 0 || schedules[0].Status != SCHEDULE_ACTIVE || schedules[0].NextRun.After(now) {
+			break
+		}
+		schedule := &schedules[0]
+
+		cron, err := parseCron(schedule.Recurrence)
+		if err != nil {
+			return nil, newError(ERR_CORRUPT_STATE, "schedule %s has an invalid recurrence: %s", schedule.ScheduleId, err)
+		}
+
+		due := schedule.NextRun
+		run, err := runSchedule(ctx, schedule, due)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, *run)
+
+		advanceSchedule(schedule, cron, due)
+		err = saveSchedule(ctx, *schedule)
+		if err != nil {
+			return nil, err
+		}
+		if schedule.Status != SCHEDULE_ACTIVE {
+			schedules = schedules[1:]
+		}
+	}
+
+	asBytes, _ := json.Marshal(runs)
+	return asBytes, nil
+}
+
+func loadSchedules(ctx *TransactionContext, userId string, status string) ([]Schedule, error) {
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(scheduleObject, []string{})
+	if err != nil {
+		return nil, newError(ERR_LEDGER, "failed to list schedules: %s", err)
+	}
+	defer iter.Close()
+
+	schedules := []Schedule{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, newError(ERR_LEDGER, "failed to list schedules: %s", err)
+		}
+
+		var schedule Schedule
+		err = json.Unmarshal(kv.Value, &schedule)
+		if err != nil {
+			return nil, newError(ERR_CORRUPT_STATE, "failed to decode schedule %s: %s", kv.Key, err)
+		}
+
+		if (userId != "" && schedule.From != userId && schedule.To != userId) || (status != "" && schedule.Status != status) {
+			continue
+		}
+		schedules = append(schedules, schedule)
+	}
+
+	return schedules, nil
+}
+
+// ============================================================================================================================
+// List schedules, optionally sent or received by one member and in one status, by id
+// ============================================================================================================================
+func (t *SimpleChaincode) getSchedules(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*schedulesRequest)
+
+	schedules, err := loadSchedules(ctx, req.UserId, req.Status)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].ScheduleId < schedules[j].ScheduleId })
+
+	asBytes, _ := json.Marshal(schedules)
+	return asBytes, nil
+}
@@ -0,0 +1,437 @@
+package openpoints
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ============================================================================================================================
+// Business settlement
+//
+// Points that a business accepts or issues through its contracts are settled in money with the originator
+// of the program once per settlement period. Each contract has a settlement rule, or DEFAULT_POINT_VALUE and
+// DEFAULT_ORIGINATOR_DISCOUNT_SHARE when none is set. For each contract line of a batch:
+//
+//	PointsRedeemed   points members paid the business under the contract
+//	PointsIssued     points the business gave members under the contract, including points earned on spend
+//	DiscountPoints   list price minus points paid, over the redemptions
+//	MoneyCollected   Transaction.Money of the redemptions, collected by the originator for the business
+//
+//	NetAmount = (PointsRedeemed - PointsIssued) * PointValue
+//	          + DiscountPoints * PointValue * OriginatorDiscountShare
+//	          + MoneyCollected
+//
+// Refunds count as negative redemptions. A positive NetAmount is owed by the originator to the business, a negative
+// one by the business to the originator. Only the contracts of the business are settled in its batches, and only by
+// callers acting for the business. A batch moves from OPEN to APPROVED to PAID. Every transaction is settled in at
+// most one batch.
+// ============================================================================================================================
+
+// Money value of one point and originator share of contract discounts when a contract has no settlement rule
+const DEFAULT_POINT_VALUE = 0.01
+const DEFAULT_ORIGINATOR_DISCOUNT_SHARE = 0.5
+
+// Settlement batch statuses
+const SETTLEMENT_OPEN = "OPEN"
+const SETTLEMENT_APPROVED = "APPROVED"
+const SETTLEMENT_PAID = "PAID"
+
+// Values of the status filter of getSettlementBatches: open covers OPEN and APPROVED, closed covers PAID
+const SETTLEMENT_FILTER_OPEN = "open"
+const SETTLEMENT_FILTER_CLOSED = "closed"
+
+// Composite key object types
+const settlementRuleObject = "settlementRule"
+const settlementBatchObject = "settlementBatch"
+const settledTxObject = "settledTx"
+
+// How the transactions of a contract are settled
+type SettlementRule struct {
+	ContractId              string  `json:"ContractId"`
+	PointValue              float64 `json:"PointValue"`
+	OriginatorDiscountShare float64 `json:"OriginatorDiscountShare"`
+}
+
+// Totals of one contract in a settlement batch
+type SettlementLine struct {
+	ContractId              string  `json:"ContractId"`
+	PointValue              float64 `json:"PointValue"`
+	OriginatorDiscountShare float64 `json:"OriginatorDiscountShare"`
+	TxCount                 int     `json:"TxCount"`
+	PointsRedeemed          float64 `json:"PointsRedeemed"`
+	PointsIssued            float64 `json:"PointsIssued"`
+	DiscountPoints          float64 `json:"DiscountPoints"`
+	MoneyCollected          float64 `json:"MoneyCollected"`
+	NetAmount               float64 `json:"NetAmount"`
+}
+
+// Settlement of one business with the originator for one period
+type SettlementBatch struct {
+	BatchId          string           `json:"BatchId"`
+	BusinessId       string           `json:"BusinessId"`
+	OriginatorId     string           `json:"OriginatorId"`
+	From             time.Time        `json:"From"`
+	To               time.Time        `json:"To"`
+	Status           string           `json:"Status"`
+	Lines            []SettlementLine `json:"Lines"`
+	RefNumbers       []string         `json:"RefNumbers"`
+	NetAmount        float64          `json:"NetAmount"`
+	Created          time.Time        `json:"Created"`
+	Approved         time.Time        `json:"Approved,omitempty"`
+	Paid             time.Time        `json:"Paid,omitempty"`
+	PaymentReference string           `json:"PaymentReference,omitempty"`
+}
+
+// Request for setSettlementRule
+type settlementRuleRequest struct {
+	ContractId              string  `json:"contractId" validate:"required"`
+	PointValue              float64 `json:"pointValue" validate:"required,min=0"`
+	OriginatorDiscountShare float64 `json:"originatorDiscountShare" validate:"required,min=0,max=1"`
+}
+
+// Request for createSettlementBatch, the period starts at from and ends before to
+type createSettlementRequest struct {
+	BusinessId string    `json:"businessId" validate:"required"`
+	From       time.Time `json:"from" validate:"required"`
+	To         time.Time `json:"to" validate:"required"`
+}
+
+// Request naming a settlement batch
+type settlementBatchRequest struct {
+	BatchId string `json:"batchId" validate:"required"`
+}
+
+// Request for markSettlementBatchPaid
+type settlementPaidRequest struct {
+	BatchId          string `json:"batchId" validate:"required"`
+	PaymentReference string `json:"paymentReference" validate:"required"`
+}
+
+// Request for getSettlementBatches
+type settlementBatchesRequest struct {
+	BusinessId string `json:"businessId"`
+	Status     string `json:"status" validate:"oneof=open|closed"`
+}
+
+// ============================================================================================================================
+// Set how the transactions of a contract are settled
+// ============================================================================================================================
+func (t *SimpleChaincode) setSettlementRule(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*settlementRuleRequest)
+	stub := ctx.GetStub()
+
+	var contract Contract
+	found, err := readState(stub, req.ContractId, &contract)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, newError(ERR_NOT_FOUND, "contract %s does not exist", req.ContractId)
+	}
+
+	rule := SettlementRule{ContractId: req.ContractId, PointValue: req.PointValue, OriginatorDiscountShare: req.OriginatorDiscountShare}
+
+	key, err := compositeKey(stub, settlementRuleObject, req.ContractId)
+	if err != nil {
+		return nil, err
+	}
+	err = writeState(stub, key, rule)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Event().settlementRuleSet(rule)
+
+	return nil, nil
+}
+
+// Settlement rule of a contract, or the default rule
+func settlementRule(ctx *TransactionContext, contractId string) (SettlementRule, error) {
+
+	rule := SettlementRule{ContractId: contractId, PointValue: DEFAULT_POINT_VALUE, OriginatorDiscountShare: DEFAULT_ORIGINATOR_DISCOUNT_SHARE}
+
+	key, err := compositeKey(ctx.GetStub(), settlementRuleObject, contractId)
+	if err != nil {
+		return rule, err
+	}
+	_, err = readState(ctx.GetStub(), key, &rule)
+
+	return rule, err
+}
+
+// ============================================================================================================================
+// Aggregate the unsettled contract transactions of a business in a period into a new OPEN batch
+// ============================================================================================================================
+func (t *SimpleChaincode) createSettlementBatch(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*createSettlementRequest)
+	stub := ctx.GetStub()
+
+	if !req.From.Before(req.To) {
+		return nil, fieldError("to", "to must be after from")
+	}
+	if !req.To.Before(ctx.Event().Timestamp) {
+		return nil, fieldError("to", "a period can only be settled once it has ended")
+	}
+
+	err := checkAccount(ctx, req.BusinessId)
+	if err != nil {
+		return nil, err
+	}
+	var business User
+	found, err := readState(stub, req.BusinessId, &business)
+	if err != nil {
+		return nil, err
+	}
+	if !found || business.UserId != req.BusinessId {
+		return nil, newError(ERR_NOT_FOUND, "business %s does not exist", req.BusinessId)
+	}
+
+	var batch SettlementBatch
+	batch.BatchId = req.BusinessId + "-" + req.From.Format("20060102T150405") + "-" + req.To.Format("20060102T150405")
+	batch.BusinessId = req.BusinessId
+	batch.OriginatorId = ctx.Program().OriginatorId
+	batch.From = req.From
+	batch.To = req.To
+	batch.Status = SETTLEMENT_OPEN
+	batch.Lines = []SettlementLine{}
+	batch.RefNumbers = []string{}
+	batch.Created = ctx.Event().Timestamp
+
+	batchKey, err := compositeKey(stub, settlementBatchObject, batch.BatchId)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := stub.GetState(batchKey)
+	if err != nil {
+		return nil, newError(ERR_LEDGER, "failed to read batch %s: %s", batch.BatchId, err)
+	}
+	if existing != nil {
+		return nil, newError(ERR_ALREADY_EXISTS, "settlement batch %s already exists", batch.BatchId)
+	}
+
+	var txs AllTransactions
+	_, err = readState(stub, "allTx", &txs)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := make(map[string]*SettlementLine)
+	var contractIds []string
+	owned := make(map[string]bool)
+
+	for _, tx := range txs.Transactions {
+		if tx.ContractId == "" || (tx.To != req.BusinessId && tx.From != req.BusinessId) {
+			continue
+		}
+		if tx.Date.Before(req.From) || !tx.Date.Before(req.To) {
+			continue
+		}
+
+		// Contracts of other businesses are settled with them
+		mine, checked := owned[tx.ContractId]
+		if !checked {
+			var contract Contract
+			found, err := readState(stub, tx.ContractId, &contract)
+			if err != nil {
+				return nil, err
+			}
+			mine = found && contract.Id == tx.ContractId && contract.BusinessId == req.BusinessId
+			owned[tx.ContractId] = mine
+		}
+		if !mine {
+			continue
+		}
+
+		settledKey, err := compositeKey(stub, settledTxObject, tx.RefNumber)
+		if err != nil {
+			return nil, err
+		}
+		settledBy, err := stub.GetState(settledKey)
+		if err != nil {
+			return nil, newError(ERR_LEDGER, "failed to read settlement of %s: %s", tx.RefNumber, err)
+		}
+		if settledBy != nil {
+			continue
+		}
+
+		line, ok := lines[tx.ContractId]
+		if !ok {
+			rule, err := settlementRule(ctx, tx.ContractId)
+			if err != nil {
+				return nil, err
+			}
+			line = &SettlementLine{ContractId: tx.ContractId, PointValue: rule.PointValue, OriginatorDiscountShare: rule.OriginatorDiscountShare}
+			lines[tx.ContractId] = line
+			contractIds = append(contractIds, tx.ContractId)
+		}
+
+		line.TxCount++
+		if (tx.Type == TX_TYPE_REFUND || tx.Type == TX_TYPE_REVERSAL) && tx.From == req.BusinessId {
+			// A refund or reversal takes back a redemption and the points it earned
+			line.PointsRedeemed = line.PointsRedeemed - tx.Amount
+			line.PointsIssued = line.PointsIssued - tx.Earned
+			line.MoneyCollected = line.MoneyCollected - tx.Money
+			if tx.ListAmount > tx.Amount {
+				line.DiscountPoints = line.DiscountPoints - (tx.ListAmount - tx.Amount)
+			}
+		} else if tx.To == req.BusinessId {
+			line.PointsRedeemed = line.PointsRedeemed + tx.Amount
+			line.PointsIssued = line.PointsIssued + tx.Earned
+			line.MoneyCollected = line.MoneyCollected + tx.Money
+			if tx.ListAmount > tx.Amount {
+				line.DiscountPoints = line.DiscountPoints + tx.ListAmount - tx.Amount
+			}
+		} else {
+			line.PointsIssued = line.PointsIssued + tx.Amount
+		}
+
+		err = stub.PutState(settledKey, []byte(batch.BatchId))
+		if err != nil {
+			return nil, newError(ERR_LEDGER, "failed to mark %s settled: %s", tx.RefNumber, err)
+		}
+		batch.RefNumbers = append(batch.RefNumbers, tx.RefNumber)
+	}
+
+	for _, contractId := range contractIds {
+		line := lines[contractId]
+		line.NetAmount = (line.PointsRedeemed-line.PointsIssued)*line.PointValue +
+			line.DiscountPoints*line.PointValue*line.OriginatorDiscountShare + line.MoneyCollected
+		batch.NetAmount = batch.NetAmount + line.NetAmount
+		batch.Lines = append(batch.Lines, *line)
+	}
+
+	err = writeState(stub, batchKey, batch)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Event().settlementChanged(batch)
+
+	batchAsBytes, _ := json.Marshal(batch)
+	return batchAsBytes, nil
+}
+
+// ============================================================================================================================
+// Approve an OPEN batch for payment
+// ============================================================================================================================
+func (t *SimpleChaincode) approveSettlementBatch(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*settlementBatchRequest)
+
+	return updateSettlementBatch(ctx, req.BatchId, SETTLEMENT_OPEN, func(batch *SettlementBatch) {
+		batch.Status = SETTLEMENT_APPROVED
+		batch.Approved = ctx.Event().Timestamp
+	})
+}
+
+// ============================================================================================================================
+// Record the payment of an APPROVED batch
+// ============================================================================================================================
+func (t *SimpleChaincode) markSettlementBatchPaid(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*settlementPaidRequest)
+
+	return updateSettlementBatch(ctx, req.BatchId, SETTLEMENT_APPROVED, func(batch *SettlementBatch) {
+		batch.Status = SETTLEMENT_PAID
+		batch.Paid = ctx.Event().Timestamp
+		batch.PaymentReference = req.PaymentReference
+	})
+}
+
+func updateSettlementBatch(ctx *TransactionContext, batchId string, fromStatus string, update func(batch *SettlementBatch)) ([]byte, error) {
+
+	stub := ctx.GetStub()
+
+	key, err := compositeKey(stub, settlementBatchObject, batchId)
+	if err != nil {
+		return nil, err
+	}
+
+	var batch SettlementBatch
+	found, err := readState(stub, key, &batch)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, newError(ERR_NOT_FOUND, "settlement batch %s does not exist", batchId)
+	}
+	if batch.Status != fromStatus {
+		return nil, newError(ERR_INVALID_STATE, "settlement batch %s is %s, expected %s", batchId, batch.Status, fromStatus)
+	}
+
+	update(&batch)
+
+	err = writeState(stub, key, batch)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Event().settlementChanged(batch)
+
+	batchAsBytes, _ := json.Marshal(batch)
+	return batchAsBytes, nil
+}
+
+// ============================================================================================================================
+// Get one settlement batch
+// ============================================================================================================================
+func (t *SimpleChaincode) getSettlementBatch(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*settlementBatchRequest)
+	stub := ctx.GetStub()
+
+	key, err := compositeKey(stub, settlementBatchObject, req.BatchId)
+	if err != nil {
+		return nil, err
+	}
+
+	batchAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, newError(ERR_LEDGER, "failed to read batch %s: %s", req.BatchId, err)
+	}
+	if batchAsBytes == nil {
+		return nil, newError(ERR_NOT_FOUND, "settlement batch %s does not exist", req.BatchId)
+	}
+
+	return batchAsBytes, nil
+}
+
+// ============================================================================================================================
+// List settlement batches, optionally of one business and only open or only closed ones
+// ============================================================================================================================
+func (t *SimpleChaincode) getSettlementBatches(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*settlementBatchesRequest)
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(settlementBatchObject, []string{})
+	if err != nil {
+		return nil, newError(ERR_LEDGER, "failed to list settlement batches: %s", err)
+	}
+	defer iter.Close()
+
+	batches := []SettlementBatch{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, newError(ERR_LEDGER, "failed to list settlement batches: %s", err)
+		}
+
+		var batch SettlementBatch
+		err = json.Unmarshal(kv.Value, &batch)
+		if err != nil {
+			return nil, newError(ERR_CORRUPT_STATE, "failed to decode settlement batch %s: %s", kv.Key, err)
+		}
+
+		if req.BusinessId != "" && batch.BusinessId != req.BusinessId {
+			continue
+		}
+		closed := batch.Status == SETTLEMENT_PAID
+		if (req.Status == SETTLEMENT_FILTER_OPEN && closed) || (req.Status == SETTLEMENT_FILTER_CLOSED && !closed) {
+			continue
+		}
+
+		batches = append(batches, batch)
+	}
+
+	asBytes, _ := json.Marshal(batches)
+	return asBytes, nil
+}
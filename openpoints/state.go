@@ -0,0 +1,57 @@
+package openpoints
+
+import (
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// ============================================================================================================================
+// Reading our own writes
+//
+// Fabric reads return the state as of the start of the transaction, a key written earlier in the same transaction
+// still reads its old value. Handlers that post several transactions in one call, a fee and a conversion for
+// example, must see their own updates to balances, allTx and refNumber. Every stub handed to a handler therefore
+// sits on a txStub that remembers the writes of the transaction and serves them to later reads. Range, composite
+// key and history queries still see the state as of the start of the transaction.
+// ============================================================================================================================
+
+type txStub struct {
+	shim.ChaincodeStubInterface
+	writes map[string][]byte
+}
+
+func newTxStub(stub shim.ChaincodeStubInterface) *txStub {
+	return &txStub{ChaincodeStubInterface: stub, writes: make(map[string][]byte)}
+}
+
+func (s *txStub) GetState(key string) ([]byte, error) {
+
+	value, written := s.writes[key]
+	if written {
+		return value, nil
+	}
+
+	return s.ChaincodeStubInterface.GetState(key)
+}
+
+func (s *txStub) PutState(key string, value []byte) error {
+
+	err := s.ChaincodeStubInterface.PutState(key, value)
+	if err != nil {
+		return err
+	}
+	s.writes[key] = value
+
+	return nil
+}
+
+func (s *txStub) DelState(key string) error {
+
+	err := s.ChaincodeStubInterface.DelState(key)
+	if err != nil {
+		return err
+	}
+	// A deleted key reads as missing, like a key that never existed
+	s.writes[key] = nil
+
+	return nil
+}
@@ -0,0 +1,307 @@
+package openpoints
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ============================================================================================================================
+// Member statements
+//
+// A statement covers the period after From up to and including To. The opening balance is the balance as of From
+// and the closing balance the balance as of To, both read from the key history of the member, so opening balance
+// plus the entries always equals the closing balance. Balances include pending points, which are on the statement
+// from the purchase that earned them.
+// ============================================================================================================================
+
+// Statement output formats
+const STATEMENT_JSON = "json"
+const STATEMENT_CSV = "csv"
+const STATEMENT_TEXT = "text"
+
+// Statement entry categories
+const CATEGORY_EARN = "earn"
+const CATEGORY_REDEEM = "redeem"
+const CATEGORY_TRANSFER = "transfer"
+const CATEGORY_EXPIRE = "expire"
+const CATEGORY_REVERSAL = "reversal"
+const CATEGORY_EXCHANGE = "exchange"
+
+// Request for getStatement
+type statementRequest struct {
+	UserId string    `json:"userId" validate:"required"`
+	From   time.Time `json:"from" validate:"required"`
+	To     time.Time `json:"to" validate:"required"`
+	Format string    `json:"format" validate:"oneof=json|csv|text"`
+}
+
+// One transaction on a statement. Amount is signed from the point of view of the member.
+type StatementEntry struct {
+	Timestamp        time.Time `json:"Timestamp"`
+	RefNumber        string    `json:"RefNumber"`
+	Category         string    `json:"Category"`
+	Type             string    `json:"Type"`
+	Description      string    `json:"Description"`
+	ContractId       string    `json:"ContractId"`
+	CounterpartyId   string    `json:"CounterpartyId"`
+	CounterpartyName string    `json:"CounterpartyName"`
+	Amount           float64   `json:"Amount"`
+	Money            float64   `json:"Money"`
+	Balance          float64   `json:"Balance"`
+}
+
+// Net points and number of entries of one contract on a statement, ContractId is empty for plain transfers
+type ContractTotal struct {
+	ContractId string  `json:"ContractId"`
+	Count      int     `json:"Count"`
+	Amount     float64 `json:"Amount"`
+}
+
+// Member statement for a period
+type Statement struct {
+	UserId         string           `json:"UserId"`
+	Name           string           `json:"Name"`
+	From           time.Time        `json:"From"`
+	To             time.Time        `json:"To"`
+	OpeningBalance float64          `json:"OpeningBalance"`
+	TotalIn        float64          `json:"TotalIn"`
+	TotalOut       float64          `json:"TotalOut"`
+	ClosingBalance float64          `json:"ClosingBalance"`
+	Entries        []StatementEntry `json:"Entries"`
+	ContractTotals []ContractTotal  `json:"ContractTotals"`
+}
+
+// ============================================================================================================================
+// Statement of a member for a period as JSON, CSV or fixed width text
+// ============================================================================================================================
+func (t *SimpleChaincode) getStatement(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*statementRequest)
+
+	if !req.From.Before(req.To) {
+		return nil, fieldError("to", "to must be after from")
+	}
+
+	statement, err := buildStatement(ctx, req.UserId, req.From, req.To)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Format == STATEMENT_CSV {
+		return statementCSV(statement), nil
+	}
+	if req.Format == STATEMENT_TEXT {
+		return statementText(statement), nil
+	}
+
+	asBytes, _ := json.Marshal(statement)
+	return asBytes, nil
+}
+
+func buildStatement(ctx *TransactionContext, userId string, from time.Time, to time.Time) (*Statement, error) {
+
+	versions, err := userVersions(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	var statement Statement
+	statement.UserId = userId
+	statement.From = from
+	statement.To = to
+	statement.Entries = []StatementEntry{}
+	statement.ContractTotals = []ContractTotal{}
+
+	if opening := versionAt(versions, from); opening != nil {
+		statement.OpeningBalance = opening.User.Balance + opening.User.Pending
+	}
+	if closing := versionAt(versions, to); closing != nil {
+		statement.ClosingBalance = closing.User.Balance + closing.User.Pending
+		statement.Name = closing.User.Name
+	}
+
+	// Transactions are placed at the commit timestamp of the member version they wrote
+	committedAt := make(map[string]time.Time)
+	for _, version := range versions {
+		committedAt[version.TxId] = version.Timestamp
+	}
+
+	var txs AllTransactions
+	_, err = readState(ctx.GetStub(), "allTx", &txs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tx := range txs.Transactions {
+		if tx.To != userId && tx.From != userId {
+			continue
+		}
+
+		timestamp, ok := committedAt[tx.TxId]
+		if !ok {
+			timestamp = tx.Date
+		}
+		if !timestamp.After(from) || timestamp.After(to) {
+			continue
+		}
+
+		var entry StatementEntry
+		entry.Timestamp = timestamp
+		entry.RefNumber = tx.RefNumber
+		entry.Category = statementCategory(tx)
+		entry.Type = tx.Type
+		entry.Description = tx.Description
+		entry.ContractId = tx.ContractId
+		entry.Money = tx.Money
+		if tx.To == userId {
+			entry.Amount = tx.Amount - tx.Earned
+			entry.CounterpartyId = tx.From
+			entry.CounterpartyName = tx.FromName
+		} else {
+			entry.Amount = tx.Earned - tx.Amount
+			entry.CounterpartyId = tx.To
+			entry.CounterpartyName = tx.ToName
+		}
+
+		statement.Entries = append(statement.Entries, entry)
+	}
+
+	sort.SliceStable(statement.Entries, func(i, j int) bool {
+		return statement.Entries[i].Timestamp.Before(statement.Entries[j].Timestamp)
+	})
+
+	totals := make(map[string]*ContractTotal)
+	var contractIds []string
+	balance := statement.OpeningBalance
+	for i := range statement.Entries {
+		entry := &statement.Entries[i]
+		balance = balance + entry.Amount
+		entry.Balance = balance
+
+		if entry.Amount >= 0 {
+			statement.TotalIn = statement.TotalIn + entry.Amount
+		} else {
+			statement.TotalOut = statement.TotalOut - entry.Amount
+		}
+
+		total, ok := totals[entry.ContractId]
+		if !ok {
+			total = &ContractTotal{ContractId: entry.ContractId}
+			totals[entry.ContractId] = total
+			contractIds = append(contractIds, entry.ContractId)
+		}
+		total.Count++
+		total.Amount = total.Amount + entry.Amount
+	}
+
+	sort.Strings(contractIds)
+	for _, id := range contractIds {
+		statement.ContractTotals = append(statement.ContractTotals, *totals[id])
+	}
+
+	return &statement, nil
+}
+
+// Category of a transaction from the point of view of the member
+func statementCategory(tx Transaction) string {
+
+	if tx.Type == TX_TYPE_EXPIRE {
+		return CATEGORY_EXPIRE
+	}
+	if tx.Type == TX_TYPE_REVERSAL || tx.Type == TX_TYPE_REFUND {
+		return CATEGORY_REVERSAL
+	}
+	if tx.Type == TX_TYPE_EXCHANGE || tx.Type == TX_TYPE_CONVERT || tx.Type == TX_TYPE_CONVERSION_FEE {
+		return CATEGORY_EXCHANGE
+	}
+	if tx.ContractId == FEEDBACK_CONTRACT || tx.Type == TX_TYPE_VOUCHER || tx.Type == TX_TYPE_REFERRAL {
+		return CATEGORY_EARN
+	}
+	if tx.Type == TX_TYPE_PURCHASE && tx.Amount == 0 {
+		return CATEGORY_EARN
+	}
+	if tx.ContractId != "" || tx.Type == TX_TYPE_REDEEM || tx.Type == TX_TYPE_PURCHASE {
+		return CATEGORY_REDEEM
+	}
+
+	return CATEGORY_TRANSFER
+}
+
+// ============================================================================================================================
+// CSV layout: one row per entry after a header, then the contract totals and the balances as labelled rows
+// ============================================================================================================================
+func statementCSV(statement *Statement) []byte {
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	w.Write([]string{"Timestamp", "RefNumber", "Category", "Type", "Description", "ContractId", "CounterpartyId",
+		"CounterpartyName", "Amount", "Money", "Balance"})
+	for _, entry := range statement.Entries {
+		w.Write([]string{entry.Timestamp.Format(time.RFC3339), entry.RefNumber, entry.Category, entry.Type,
+			entry.Description, entry.ContractId, entry.CounterpartyId, entry.CounterpartyName, formatPoints(entry.Amount),
+			formatPoints(entry.Money), formatPoints(entry.Balance)})
+	}
+
+	w.Write([]string{})
+	for _, total := range statement.ContractTotals {
+		w.Write([]string{"ContractTotal", total.ContractId, strconv.Itoa(total.Count), formatPoints(total.Amount)})
+	}
+	w.Write([]string{"OpeningBalance", formatPoints(statement.OpeningBalance)})
+	w.Write([]string{"TotalIn", formatPoints(statement.TotalIn)})
+	w.Write([]string{"TotalOut", formatPoints(statement.TotalOut)})
+	w.Write([]string{"ClosingBalance", formatPoints(statement.ClosingBalance)})
+
+	w.Flush()
+	return buf.Bytes()
+}
+
+// ============================================================================================================================
+// Fixed width text layout for printing, 96 columns wide
+// ============================================================================================================================
+func statementText(statement *Statement) []byte {
+
+	var buf bytes.Buffer
+	rule := string(bytes.Repeat([]byte("-"), 96)) + "\n"
+
+	fmt.Fprintf(&buf, "%-96s\n", "OPEN POINTS STATEMENT")
+	fmt.Fprintf(&buf, "Member: %-30.30s Id: %-20.20s\n", statement.Name, statement.UserId)
+	fmt.Fprintf(&buf, "Period: %s to %s\n", statement.From.Format(time.RFC3339), statement.To.Format(time.RFC3339))
+	buf.WriteString(rule)
+	fmt.Fprintf(&buf, "%-10s %-10s %-8s %-21s %-10s %-10s %10s %10s\n",
+		"DATE", "REF", "CATEGORY", "DESCRIPTION", "CONTRACT", "PARTY", "AMOUNT", "BALANCE")
+	buf.WriteString(rule)
+	fmt.Fprintf(&buf, "%-76s %19s\n", "OPENING BALANCE", formatPoints(statement.OpeningBalance))
+
+	for _, entry := range statement.Entries {
+		fmt.Fprintf(&buf, "%-10s %-10.10s %-8.8s %-21.21s %-10.10s %-10.10s %10s %10s\n",
+			entry.Timestamp.Format(DATE_LAYOUT), entry.RefNumber, entry.Category, entry.Description,
+			entry.ContractId, entry.CounterpartyId, formatPoints(entry.Amount), formatPoints(entry.Balance))
+	}
+
+	buf.WriteString(rule)
+	fmt.Fprintf(&buf, "%-40s %5s %10s\n", "TOTALS BY CONTRACT", "COUNT", "AMOUNT")
+	for _, total := range statement.ContractTotals {
+		contractId := total.ContractId
+		if contractId == "" {
+			contractId = "(transfers)"
+		}
+		fmt.Fprintf(&buf, "%-40.40s %5d %10s\n", contractId, total.Count, formatPoints(total.Amount))
+	}
+
+	buf.WriteString(rule)
+	fmt.Fprintf(&buf, "%-76s %19s\n", "TOTAL IN", formatPoints(statement.TotalIn))
+	fmt.Fprintf(&buf, "%-76s %19s\n", "TOTAL OUT", formatPoints(statement.TotalOut))
+	fmt.Fprintf(&buf, "%-76s %19s\n", "CLOSING BALANCE", formatPoints(statement.ClosingBalance))
+
+	return buf.Bytes()
+}
+
+func formatPoints(points float64) string {
+	return strconv.FormatFloat(points, 'f', 2, 64)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strconv"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// ============================================================================================================================
+// Legacy replay recorder
+//
+// TestRecord writes testdata/legacy_replay.json. It sends the invocations of the fixture to the legacy chaincode on
+// the MockStub of the Fabric v0.6 shim it was written for, and records what it answered: the error, the query
+// payload and the world state after every invoke. The go tool skips testdata, so the recorder is run on its own,
+// next to chaincode.go of the baseline commit, in a GOPATH that holds github.com/hyperledger/fabric at v0.6:
+//
+//	cd openpoints/testdata/legacy
+//	git show 8ea5f7f:chaincode.go > chaincode.go
+//	GO111MODULE=off go test -vet=off -run TestRecord
+//	rm chaincode.go
+//
+// To replay a new invocation, add a step with its kind, function and args to the fixture and record it again. The
+// legacy chaincode stamps transactions with the wall clock, TestLegacyReplay skips those fields.
+// ============================================================================================================================
+
+const fixture = "../legacy_replay.json"
+
+// A recorded invocation and the answer of the legacy chaincode
+type step struct {
+	Kind     string                     `json:"kind"`
+	Function string                     `json:"function"`
+	Args     []string                   `json:"args"`
+	Error    string                     `json:"error,omitempty"`
+	Payload  json.RawMessage            `json:"payload,omitempty"`
+	State    map[string]json.RawMessage `json:"state,omitempty"`
+}
+
+func TestRecord(t *testing.T) {
+
+	asBytes, err := ioutil.ReadFile(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var steps []step
+	err = json.Unmarshal(asBytes, &steps)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stub := shim.NewMockStub("legacy", new(SimpleChaincode))
+	for i := range steps {
+		s := &steps[i]
+		s.Error, s.Payload, s.State = "", nil, nil
+
+		var payload []byte
+		if s.Kind == "invoke" {
+			payload, err = stub.MockInvoke(strconv.Itoa(i), s.Function, s.Args)
+		} else {
+			payload, err = stub.MockQuery(s.Function, s.Args)
+		}
+		if err != nil {
+			s.Error = err.Error()
+		}
+		if len(payload) > 0 {
+			s.Payload = payload
+		}
+		if s.Kind == "invoke" {
+			s.State = map[string]json.RawMessage{}
+			for key, value := range stub.State {
+				s.State[key] = value
+			}
+		}
+	}
+
+	asBytes, err = json.MarshalIndent(steps, "", "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(fixture, append(asBytes, '\n'), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,378 @@
+package openpoints
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// ============================================================================================================================
+// Vouchers
+//
+// A business issues a voucher by submitting the salt and the hex SHA-256 of salt followed by the code, so the code
+// itself is never written to the ledger at issue. Members redeem a voucher by its id and code:
+//
+//	points    redeemVoucher moves Value points from the issuing business to the member
+//	percent   transferPoints to the issuing business with voucherId and voucherCode takes Value percent off the
+//	          priced amount
+//
+// A voucher redeems at most MaxRedemptions times in total, at most once per member and only before ExpiresAt. A
+// voucher bound to a member only redeems for that member. A redemption is recorded when its transfer posts, so a
+// transfer held for review uses the voucher only once it is released. Each redemption is kept under its own key, so
+// two redemptions by one member conflict even inside one block.
+// ============================================================================================================================
+
+// Voucher kinds
+const VOUCHER_POINTS = "points"
+const VOUCHER_PERCENT = "percent"
+
+// Transaction type of a points voucher redemption
+const TX_TYPE_VOUCHER = "voucher"
+
+// Composite key object types
+const voucherObject = "voucher"
+const voucherRedemptionObject = "voucherRedemption"
+
+// A voucher, the code is only kept as a salted hash
+type Voucher struct {
+	VoucherId      string    `json:"VoucherId"`
+	BusinessId     string    `json:"BusinessId"`
+	Kind           string    `json:"Kind"`
+	Value          float64   `json:"Value"`
+	Salt           string    `json:"Salt"`
+	CodeHash       string    `json:"CodeHash"`
+	ExpiresAt      time.Time `json:"ExpiresAt"`
+	MaxRedemptions int       `json:"MaxRedemptions"`
+	Redemptions    int       `json:"Redemptions"`
+	UserId         string    `json:"UserId,omitempty"`
+	Created        time.Time `json:"Created"`
+}
+
+// One redemption of a voucher by a member
+type VoucherRedemption struct {
+	VoucherId string    `json:"VoucherId"`
+	UserId    string    `json:"UserId"`
+	RefNumber string    `json:"RefNumber"`
+	Redeemed  time.Time `json:"Redeemed"`
+}
+
+// Request for issueVoucher
+type issueVoucherRequest struct {
+	VoucherId      string    `json:"voucherId" validate:"required"`
+	BusinessId     string    `json:"businessId" validate:"required"`
+	Kind           string    `json:"kind" validate:"required,oneof=points|percent"`
+	Value          float64   `json:"value" validate:"required,min=0"`
+	Salt           string    `json:"salt" validate:"required"`
+	CodeHash       string    `json:"codeHash" validate:"required"`
+	ExpiresAt      time.Time `json:"expiresAt" validate:"required"`
+	MaxRedemptions int       `json:"maxRedemptions" validate:"required,min=1"`
+	UserId         string    `json:"userId"`
+}
+
+// Request for redeemVoucher
+type redeemVoucherRequest struct {
+	VoucherId string `json:"voucherId" validate:"required"`
+	Code      string `json:"code" validate:"required"`
+	UserId    string `json:"userId" validate:"required"`
+}
+
+// Request for getVouchers
+type vouchersRequest struct {
+	BusinessId string `json:"businessId" validate:"required"`
+}
+
+// Hex SHA-256 of the salt followed by the code
+func voucherHash(salt string, code string) string {
+	sum := sha256.Sum256([]byte(salt + code))
+	return hex.EncodeToString(sum[:])
+}
+
+// ============================================================================================================================
+// Issue a voucher
+// ============================================================================================================================
+func (t *SimpleChaincode) issueVoucher(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*issueVoucherRequest)
+	stub := ctx.GetStub()
+	ev := ctx.Event()
+
+	// The business pays for the points and discounts of its vouchers
+	err := checkAccount(ctx, req.BusinessId)
+	if err != nil {
+		return nil, err
+	}
+
+	codeHash, err := hex.DecodeString(req.CodeHash)
+	if err != nil || len(codeHash) != sha256.Size {
+		return nil, fieldError("codeHash", "codeHash must be a hex SHA-256 digest")
+	}
+	if req.Kind == VOUCHER_PERCENT && req.Value > 100 {
+		return nil, fieldError("value", "a percent voucher can not take off more than 100 percent")
+	}
+	if !req.ExpiresAt.After(ev.Timestamp) {
+		return nil, fieldError("expiresAt", "expiresAt must be in the future")
+	}
+
+	var business User
+	found, err := readState(stub, req.BusinessId, &business)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, newError(ERR_NOT_FOUND, "business %s does not exist", req.BusinessId)
+	}
+	if req.UserId != "" {
+		var member User
+		found, err = readState(stub, req.UserId, &member)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, newError(ERR_NOT_FOUND, "user %s does not exist", req.UserId)
+		}
+	}
+
+	key, err := compositeKey(stub, voucherObject, req.VoucherId)
+	if err != nil {
+		return nil, err
+	}
+	var existing Voucher
+	found, err = readState(stub, key, &existing)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return nil, newError(ERR_ALREADY_EXISTS, "voucher %s already exists", req.VoucherId)
+	}
+
+	voucher := Voucher{VoucherId: req.VoucherId, BusinessId: req.BusinessId, Kind: req.Kind, Value: req.Value,
+		Salt: req.Salt, CodeHash: hex.EncodeToString(codeHash), ExpiresAt: req.ExpiresAt,
+		MaxRedemptions: req.MaxRedemptions, UserId: req.UserId, Created: ev.Timestamp}
+
+	err = writeState(stub, key, voucher)
+	if err != nil {
+		return nil, err
+	}
+	ev.voucherChanged(voucher)
+
+	asBytes, _ := json.Marshal(voucher)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Check that a member can redeem a voucher with its code. Nothing is written, the redemption is recorded when the
+// transfer that uses the voucher posts.
+// ============================================================================================================================
+func checkVoucher(stub shim.ChaincodeStubInterface, ev *LedgerEvent, voucherId string, code string, userId string) (*Voucher, error) {
+
+	_, voucher, err := loadVoucher(stub, voucherId)
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(voucherHash(voucher.Salt, code)), []byte(voucher.CodeHash)) != 1 {
+		return nil, newError(ERR_FORBIDDEN, "code does not match voucher %s", voucherId)
+	}
+	if voucher.UserId != "" && voucher.UserId != userId {
+		return nil, newError(ERR_FORBIDDEN, "voucher %s is bound to another member", voucherId)
+	}
+	if !ev.Timestamp.Before(voucher.ExpiresAt) {
+		return nil, newError(ERR_INVALID_STATE, "voucher %s expired on %s", voucherId, voucher.ExpiresAt.Format(time.RFC3339))
+	}
+	_, err = checkRedemption(stub, *voucher, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return voucher, nil
+}
+
+func loadVoucher(stub shim.ChaincodeStubInterface, voucherId string) (string, *Voucher, error) {
+
+	key, err := compositeKey(stub, voucherObject, voucherId)
+	if err != nil {
+		return "", nil, err
+	}
+	var voucher Voucher
+	found, err := readState(stub, key, &voucher)
+	if err != nil {
+		return "", nil, err
+	}
+	if !found {
+		return "", nil, newError(ERR_NOT_FOUND, "voucher %s does not exist", voucherId)
+	}
+
+	return key, &voucher, nil
+}
+
+// Key of the redemption of a voucher by a member, failing if the voucher has none left or the member redeemed it
+func checkRedemption(stub shim.ChaincodeStubInterface, voucher Voucher, userId string) (string, error) {
+
+	if voucher.Redemptions >= voucher.MaxRedemptions {
+		return "", newError(ERR_INVALID_STATE, "voucher %s has been redeemed %d times, its limit", voucher.VoucherId, voucher.Redemptions)
+	}
+
+	redemptionKey, err := compositeKey(stub, voucherRedemptionObject, voucher.VoucherId, userId)
+	if err != nil {
+		return "", err
+	}
+	var redemption VoucherRedemption
+	found, err := readState(stub, redemptionKey, &redemption)
+	if err != nil {
+		return "", err
+	}
+	if found {
+		return "", newError(ERR_ALREADY_EXISTS, "user %s already redeemed voucher %s in transaction %s", userId, voucher.VoucherId, redemption.RefNumber)
+	}
+
+	return redemptionKey, nil
+}
+
+// ============================================================================================================================
+// Record the redemption of the voucher of a posted transfer by the member on the other side of the issuing business
+// ============================================================================================================================
+func recordRedemption(stub shim.ChaincodeStubInterface, ev *LedgerEvent, tx Transaction) error {
+
+	key, voucher, err := loadVoucher(stub, tx.VoucherId)
+	if err != nil {
+		return err
+	}
+
+	userId := tx.From
+	if tx.From == voucher.BusinessId {
+		userId = tx.To
+	}
+	redemptionKey, err := checkRedemption(stub, *voucher, userId)
+	if err != nil {
+		return err
+	}
+
+	redemption := VoucherRedemption{VoucherId: voucher.VoucherId, UserId: userId, RefNumber: tx.RefNumber, Redeemed: ev.Timestamp}
+	err = writeState(stub, redemptionKey, redemption)
+	if err != nil {
+		return err
+	}
+
+	voucher.Redemptions++
+	err = writeState(stub, key, voucher)
+	if err != nil {
+		return err
+	}
+	ev.voucherChanged(*voucher)
+
+	return nil
+}
+
+// Take the discount of a percent voucher off the priced amount of a transfer to the issuing business
+func applyVoucher(stub shim.ChaincodeStubInterface, ev *LedgerEvent, tx *Transaction, code string) error {
+
+	// Reversals and refunds keep the voucher of the transfer they give back and never redeem one
+	if screenExempt(*tx) {
+		return fieldError("voucherId", "a %s transaction can not redeem a voucher", tx.Type)
+	}
+
+	voucher, err := checkVoucher(stub, ev, tx.VoucherId, code, tx.From)
+	if err != nil {
+		return err
+	}
+	if voucher.Kind != VOUCHER_PERCENT {
+		return newError(ERR_INVALID_STATE, "voucher %s credits points, redeem it with redeemVoucher", voucher.VoucherId)
+	}
+	if tx.To != voucher.BusinessId {
+		return fieldError("voucherId", "voucher %s only applies to transfers to %s", voucher.VoucherId, voucher.BusinessId)
+	}
+
+	tx.Amount = math.Round(tx.Amount*(100-voucher.Value)) / 100
+	return nil
+}
+
+// ============================================================================================================================
+// Redeem a points voucher, crediting its value from the issuing business to the member
+// ============================================================================================================================
+func (t *SimpleChaincode) redeemVoucher(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*redeemVoucherRequest)
+	stub := ctx.GetStub()
+	ev := ctx.Event()
+
+	err := checkAccount(ctx, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	refNumber, err := nextRefNumber(stub, ev)
+	if err != nil {
+		return nil, err
+	}
+
+	voucher, err := checkVoucher(stub, ev, req.VoucherId, req.Code, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+	if voucher.Kind != VOUCHER_POINTS {
+		return nil, newError(ERR_INVALID_STATE, "voucher %s is a discount, attach it to transferPoints", voucher.VoucherId)
+	}
+
+	var tx Transaction
+	tx.RefNumber = refNumber
+	tx.Date = ev.Timestamp.Truncate(time.Minute)
+	tx.Type = TX_TYPE_VOUCHER
+	tx.From = voucher.BusinessId
+	tx.To = req.UserId
+	tx.Description = "Voucher " + voucher.VoucherId
+	tx.Amount = voucher.Value
+	tx.VoucherId = voucher.VoucherId
+	tx.StatusCode = 1
+	tx.StatusMsg = "Transaction Completed"
+	tx.TxId = stub.GetTxID()
+
+	err = postTransfer(stub, ev, &tx)
+	if err != nil {
+		return nil, err
+	}
+
+	asBytes, _ := json.Marshal(tx)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// List the vouchers of a business by id
+// ============================================================================================================================
+func (t *SimpleChaincode) getVouchers(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*vouchersRequest)
+
+	iter, err := ctx.GetStub().GetStateByPartialCompositeKey(voucherObject, []string{})
+	if err != nil {
+		return nil, newError(ERR_LEDGER, "failed to list vouchers: %s", err)
+	}
+	defer iter.Close()
+
+	vouchers := []Voucher{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, newError(ERR_LEDGER, "failed to list vouchers: %s", err)
+		}
+
+		var voucher Voucher
+		err = json.Unmarshal(kv.Value, &voucher)
+		if err != nil {
+			return nil, newError(ERR_CORRUPT_STATE, "failed to decode voucher %s: %s", kv.Key, err)
+		}
+		if voucher.BusinessId == req.BusinessId {
+			vouchers = append(vouchers, voucher)
+		}
+	}
+
+	sort.Slice(vouchers, func(i, j int) bool { return vouchers[i].VoucherId < vouchers[j].VoucherId })
+
+	asBytes, _ := json.Marshal(vouchers)
+	return asBytes, nil
+}
@@ -0,0 +1,170 @@
+package openpoints
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// ============================================================================================================================
+// Sub-wallets
+//
+// The balance of a member is split into typed wallets: earned points, promotional points and points purchased with
+// money. Wallets always add up to Balance. Points a record holds outside any wallet, such as the balances of
+// ledgers older than wallets, count as earned.
+//
+// postTransfer credits the receiver in the wallet its contract declares, in the purchased wallet for points bought
+// with money outside a purchase, and otherwise in the same wallets the points left the sender from, so promotional
+// points stay promotional from member to member. Minted points are earned. The sender spends its wallets in the
+// spend order of the program, promotional first, then earned, then purchased unless setSpendOrder changes it.
+// Points earned on a purchase are credited to the earned wallet once they are available.
+// ============================================================================================================================
+
+// Wallet types
+const WALLET_EARNED = "earned"
+const WALLET_PROMOTIONAL = "promotional"
+const WALLET_PURCHASED = "purchased"
+
+// Every wallet type
+var walletTypes = []string{WALLET_EARNED, WALLET_PROMOTIONAL, WALLET_PURCHASED}
+
+// Spend order of programs that have not set one
+var defaultSpendOrder = []string{WALLET_PROMOTIONAL, WALLET_EARNED, WALLET_PURCHASED}
+
+// Key of the spend order of the program
+const spendOrderKey = "spendOrder"
+
+// Request for setSpendOrder, wallets left out are spent last in the default order
+type spendOrderRequest struct {
+	Order []string `json:"order" validate:"required"`
+}
+
+// Put points a member holds outside any wallet into its earned wallet, so its wallets add up to its balance
+func (user *User) normalizeWallets() {
+
+	wallets := make(map[string]float64)
+	allocated := 0.0
+	for _, wallet := range walletTypes {
+		wallets[wallet] = user.Wallets[wallet]
+		allocated = allocated + wallets[wallet]
+	}
+	wallets[WALLET_EARNED] = wallets[WALLET_EARNED] + user.Balance - allocated
+
+	user.Wallets = wallets
+}
+
+// Take an amount out of the wallets of a member in spend order, returning how much came out of each. The wallets
+// must have been normalized before the balance changed.
+func (user *User) debitWallets(amount float64, order []string) map[string]float64 {
+
+	taken := make(map[string]float64)
+	for _, wallet := range order {
+		if amount <= 0 {
+			break
+		}
+		take := user.Wallets[wallet]
+		if take > amount {
+			take = amount
+		}
+		if take > 0 {
+			user.Wallets[wallet] = user.Wallets[wallet] - take
+			taken[wallet] = take
+			amount = amount - take
+		}
+	}
+
+	// Only rounding is left once the balance has been checked
+	if amount > 0 {
+		user.Wallets[order[0]] = user.Wallets[order[0]] - amount
+		taken[order[0]] = taken[order[0]] + amount
+	}
+
+	return taken
+}
+
+// Add amounts to the wallets of a member, whose wallets must have been normalized before the balance changed
+func (user *User) creditWallets(amounts map[string]float64) {
+
+	for wallet, amount := range amounts {
+		user.Wallets[wallet] = user.Wallets[wallet] + amount
+	}
+}
+
+// Spend order of the current program
+func spendOrder(stub shim.ChaincodeStubInterface) ([]string, error) {
+
+	order := defaultSpendOrder
+	_, err := readState(stub, spendOrderKey, &order)
+
+	return order, err
+}
+
+// Wallet the receiver of a transaction is credited in, empty when it takes the wallets of the sender
+func creditWallet(stub shim.ChaincodeStubInterface, tx Transaction) (string, error) {
+
+	if tx.ContractId != "" {
+		var contract Contract
+		_, err := readState(stub, tx.ContractId, &contract)
+		if err != nil {
+			return "", err
+		}
+		if contract.Wallet != "" {
+			return contract.Wallet, nil
+		}
+	}
+	if tx.Money > 0 && tx.Type != TX_TYPE_PURCHASE {
+		return WALLET_PURCHASED, nil
+	}
+	if tx.From == "" {
+		return WALLET_EARNED, nil
+	}
+
+	return "", nil
+}
+
+// ============================================================================================================================
+// Set the order in which members of the program spend their wallets
+// ============================================================================================================================
+func (t *SimpleChaincode) setSpendOrder(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	req := request.(*spendOrderRequest)
+
+	order := []string{}
+	for _, wallet := range req.Order {
+		if !containsString(walletTypes, wallet) {
+			return nil, fieldError("order", "%s is not a wallet, expected one of %v", wallet, walletTypes)
+		}
+		if containsString(order, wallet) {
+			return nil, fieldError("order", "%s is listed twice", wallet)
+		}
+		order = append(order, wallet)
+	}
+	for _, wallet := range defaultSpendOrder {
+		if !containsString(order, wallet) {
+			order = append(order, wallet)
+		}
+	}
+
+	err := writeState(ctx.GetStub(), spendOrderKey, order)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Event().spendOrderChanged(order)
+
+	asBytes, _ := json.Marshal(order)
+	return asBytes, nil
+}
+
+// ============================================================================================================================
+// Get the order in which members of the program spend their wallets
+// ============================================================================================================================
+func (t *SimpleChaincode) getSpendOrder(ctx *TransactionContext, request interface{}) ([]byte, error) {
+
+	order, err := spendOrder(ctx.GetStub())
+	if err != nil {
+		return nil, err
+	}
+
+	asBytes, _ := json.Marshal(order)
+	return asBytes, nil
+}
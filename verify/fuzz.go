@@ -0,0 +1,228 @@
+package verify
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+
+	"github.com/gscdist/GscLabChaincode/mockstub"
+	"github.com/gscdist/GscLabChaincode/openpoints"
+)
+
+// One chaincode call of a generated sequence
+type Operation struct {
+	Function string `json:"function"`
+	Role     string `json:"role"`
+	Account  string `json:"account,omitempty"`
+	Request  string `json:"request"`
+}
+
+func (op Operation) String() string {
+	return fmt.Sprintf("%s as %s of %s %s", op.Function, op.Role, op.Account, op.Request)
+}
+
+// A sequence that breaks an invariant, the last operation is the one after which the violations were found
+type Failure struct {
+	Seed       int64       `json:"seed"`
+	Operations []Operation `json:"operations"`
+	Violations []Violation `json:"violations"`
+}
+
+// Fuzzing parameters
+type Config struct {
+	Seed      int64
+	Sequences int
+	Length    int
+}
+
+// Members, contracts and amounts that generated operations pick from. They include ids that do not exist and ids
+// that collide with other records, so error paths are exercised too.
+var fuzzUsers = []string{"B1928564", "T5940872", "U2974034", "U3151672", "U0000000"}
+var fuzzContracts = []string{"", openpoints.RETAIL_CONTRACT, openpoints.FEEDBACK_CONTRACT, "Promo1", "Promo2", "U2974034", "allTx"}
+var fuzzAmounts = []float64{0, 0.5, 1, 10, 100, 999.99, 1000, 5000, 60000, 2000000}
+var fuzzRoles = []string{openpoints.ROLE_ADMIN, openpoints.ROLE_COMPLIANCE, openpoints.ROLE_RISK_OFFICER, openpoints.ROLE_BUSINESS, openpoints.ROLE_MEMBER}
+
+// ============================================================================================================================
+// Fuzz runs random sequences until one breaks an invariant and returns it shrunk, or nil if none did
+// ============================================================================================================================
+func Fuzz(cfg Config) (*Failure, error) {
+
+	rng := rand.New(rand.NewSource(cfg.Seed))
+
+	for i := 0; i < cfg.Sequences; i++ {
+		seed := rng.Int63()
+		ops := Generate(rand.New(rand.NewSource(seed)), cfg.Length)
+
+		violations, failedAt, err := Replay(ops)
+		if err != nil {
+			return nil, err
+		}
+		if violations == nil {
+			continue
+		}
+
+		shrunk, err := Shrink(ops[:failedAt+1])
+		if err != nil {
+			return nil, err
+		}
+		violations, _, err = Replay(shrunk)
+		if err != nil {
+			return nil, err
+		}
+
+		return &Failure{Seed: seed, Operations: shrunk, Violations: violations}, nil
+	}
+
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Generate a random sequence of operations
+// ============================================================================================================================
+func Generate(rng *rand.Rand, length int) []Operation {
+
+	ops := make([]Operation, 0, length)
+	for i := 0; i < length; i++ {
+		ops = append(ops, generateOperation(rng))
+	}
+
+	return ops
+}
+
+func generateOperation(rng *rand.Rand) Operation {
+
+	var op Operation
+	op.Role = fuzzRoles[rng.Intn(len(fuzzRoles))]
+	op.Account = pick(rng, fuzzUsers)
+	var request map[string]interface{}
+
+	switch n := rng.Intn(20); {
+	case n < 14:
+		op.Function = "transferPoints"
+		request = map[string]interface{}{
+			"to":          pick(rng, fuzzUsers),
+			"from":        pick(rng, fuzzUsers),
+			"type":        "fuzz",
+			"contractId":  pick(rng, fuzzContracts),
+			"activities":  rng.Intn(3),
+			"amount":      fuzzAmounts[rng.Intn(len(fuzzAmounts))],
+			"money":       float64(rng.Intn(100)),
+			"description": "generated",
+		}
+		// Mostly act for the sender, so the transfers get past the account check and reach the ledger
+		if rng.Intn(4) > 0 {
+			op.Account = request["from"].(string)
+		}
+	case n < 18:
+		op.Function = "addSmartContract"
+		request = map[string]interface{}{
+			"id":           pick(rng, fuzzContracts[1:]),
+			"businessId":   pick(rng, fuzzUsers),
+			"title":        "Generated contract",
+			"conditions":   []string{"generated"},
+			"discountRate": float64(rng.Intn(11)) / 10,
+			"budget":       fuzzAmounts[rng.Intn(len(fuzzAmounts))],
+		}
+	case n < 19:
+		op.Function = "incrementReferenceNumber"
+	default:
+		op.Function = "init"
+	}
+
+	requestAsBytes, _ := json.Marshal(request)
+	op.Request = string(requestAsBytes)
+	if request == nil {
+		op.Request = "{}"
+	}
+
+	return op
+}
+
+func pick(rng *rand.Rand, list []string) string {
+	return list[rng.Intn(len(list))]
+}
+
+// ============================================================================================================================
+// Replay runs a sequence on a freshly initialized ledger and checks the invariants after every operation. It
+// returns the violations and the index of the first operation after which any were found, or nil and -1.
+// Operations rejected by the chaincode are expected and do not stop the replay.
+// ============================================================================================================================
+func Replay(ops []Operation) ([]Violation, int, error) {
+
+	h, err := mockstub.NewInitializedHarness()
+	if err != nil {
+		return nil, -1, err
+	}
+
+	checker, err := NewChecker(h.Stub)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	for i, op := range ops {
+		err = h.SetIdentity(op.Role, map[string]string{openpoints.ROLE_ATTRIBUTE: op.Role, openpoints.ACCOUNT_ATTRIBUTE: op.Account})
+		if err != nil {
+			return nil, -1, err
+		}
+
+		_, err = h.Invoke(op.Function, op.Request)
+		if err != nil {
+			if _, ok := err.(*openpoints.ChaincodeError); !ok {
+				return nil, -1, err
+			}
+		}
+
+		violations := checker.Check(h.Stub)
+		if len(violations) > 0 {
+			return violations, i, nil
+		}
+	}
+
+	return nil, -1, nil
+}
+
+// ============================================================================================================================
+// Shrink removes operations from a failing sequence for as long as it keeps breaking the same invariant, first in
+// large chunks and then one at a time
+// ============================================================================================================================
+func Shrink(ops []Operation) ([]Operation, error) {
+
+	violations, _, err := Replay(ops)
+	if err != nil {
+		return nil, err
+	}
+	if violations == nil {
+		return ops, nil
+	}
+	invariant := violations[0].Invariant
+
+	fails := func(candidate []Operation) (bool, error) {
+		violations, _, err := Replay(candidate)
+		if err != nil {
+			return false, err
+		}
+		for _, v := range violations {
+			if v.Invariant == invariant {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	for chunk := len(ops) / 2; chunk >= 1; chunk /= 2 {
+		for start := 0; start+chunk <= len(ops); {
+			candidate := append(append([]Operation{}, ops[:start]...), ops[start+chunk:]...)
+			failed, err := fails(candidate)
+			if err != nil {
+				return nil, err
+			}
+			if failed {
+				ops = candidate
+			} else {
+				start += chunk
+			}
+		}
+	}
+
+	return ops, nil
+}
@@ -0,0 +1,61 @@
+package verify
+
+import (
+	"encoding/json"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestFuzz(t *testing.T) {
+
+	cfg := Config{Seed: 1, Sequences: 40, Length: 40}
+	if testing.Short() {
+		cfg.Sequences = 5
+	}
+
+	failure, err := Fuzz(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failure != nil {
+		out, _ := json.MarshalIndent(failure, "", "  ")
+		t.Fatalf("invariant violated, minimal sequence:\n%s", out)
+	}
+}
+
+func TestGenerateIsDeterministic(t *testing.T) {
+
+	first := Generate(rand.New(rand.NewSource(7)), 40)
+	second := Generate(rand.New(rand.NewSource(7)), 40)
+	if !reflect.DeepEqual(first, second) {
+		t.Error("the same seed generated different sequences")
+	}
+}
+
+// FuzzLedger replays the sequence generated from each seed, go test -fuzz=FuzzLedger ./verify searches for more
+func FuzzLedger(f *testing.F) {
+
+	for _, seed := range []int64{1, 5, 42, 2017} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, seed int64) {
+		ops := Generate(rand.New(rand.NewSource(seed)), 40)
+
+		violations, failedAt, err := Replay(ops)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if violations == nil {
+			return
+		}
+
+		shrunk, err := Shrink(ops[:failedAt+1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, _ := json.MarshalIndent(Failure{Seed: seed, Operations: shrunk, Violations: violations}, "", "  ")
+		t.Fatalf("invariant violated, minimal sequence:\n%s", out)
+	})
+}
@@ -0,0 +1,278 @@
+// Package verify checks ledger invariants of the Open Points chaincode and searches for operation sequences that
+// break them.
+package verify
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gscdist/GscLabChaincode/mockstub"
+	"github.com/gscdist/GscLabChaincode/openpoints"
+)
+
+// Invariants checked by Checker
+const INV_CONSERVATION = "conservation"
+const INV_NON_NEGATIVE = "nonNegativeBalance"
+const INV_TX_COUNT = "txCount"
+const INV_CONTRACT_BUDGET = "contractBudget"
+const INV_CONTRACT_IDS = "contractIdsResolve"
+const INV_REF_NUMBERS = "refNumbers"
+const INV_WALLETS = "wallets"
+const INV_DECODE = "decode"
+
+// Tolerance for comparing point amounts
+const epsilon = 1e-6
+
+// A broken invariant
+type Violation struct {
+	Invariant string `json:"invariant"`
+	Detail    string `json:"detail"`
+}
+
+func (v Violation) String() string {
+	return v.Invariant + ": " + v.Detail
+}
+
+// Checker verifies the invariants of the committed world state of a MockStub
+type Checker struct {
+	// Supply is the total of all member balances before any points were minted or burned
+	Supply float64
+}
+
+// Ledger records decoded from world state
+type ledger struct {
+	users       map[string]openpoints.User
+	contracts   map[string]openpoints.Contract
+	contractIds []string
+	txs         []openpoints.Transaction
+	refNumber   int
+}
+
+// NewChecker creates a checker whose supply is the total balance currently on the ledger
+func NewChecker(stub *mockstub.MockStub) (*Checker, error) {
+
+	l, violations := decodeLedger(stub)
+	if len(violations) > 0 {
+		return nil, fmt.Errorf("ledger can not be decoded: %s", violations[0])
+	}
+
+	return &Checker{Supply: l.totalBalance() - l.netMinted()}, nil
+}
+
+// Check returns every invariant the ledger breaks
+func (c *Checker) Check(stub *mockstub.MockStub) []Violation {
+
+	l, violations := decodeLedger(stub)
+	if len(violations) > 0 {
+		return violations
+	}
+
+	violations = append(violations, c.checkConservation(l)...)
+	violations = append(violations, checkBalances(l)...)
+	violations = append(violations, checkTxCounts(l)...)
+	violations = append(violations, checkContracts(l)...)
+	violations = append(violations, checkRefNumbers(l)...)
+
+	return violations
+}
+
+func (c *Checker) checkConservation(l *ledger) []Violation {
+
+	total := l.totalBalance()
+	supply := c.Supply + l.netMinted()
+	if math.Abs(total-supply) > epsilon {
+		return []Violation{{INV_CONSERVATION, fmt.Sprintf("balances total %v, supply is %v", total, supply)}}
+	}
+
+	return nil
+}
+
+func checkBalances(l *ledger) []Violation {
+
+	var violations []Violation
+	for _, id := range sortedKeys(l.users) {
+		if l.users[id].Balance < -epsilon {
+			violations = append(violations, Violation{INV_NON_NEGATIVE, fmt.Sprintf("%s has balance %v", id, l.users[id].Balance)})
+		}
+		if l.users[id].Pending < -epsilon {
+			violations = append(violations, Violation{INV_NON_NEGATIVE, fmt.Sprintf("%s has pending balance %v", id, l.users[id].Pending)})
+		}
+
+		// Wallets add up to the balance, points outside any wallet count as earned
+		var allocated float64
+		for wallet, amount := range l.users[id].Wallets {
+			if amount < -epsilon {
+				violations = append(violations, Violation{INV_WALLETS, fmt.Sprintf("%s has %v in its %s wallet", id, amount, wallet)})
+			}
+			allocated += amount
+		}
+		if allocated > l.users[id].Balance+epsilon {
+			violations = append(violations, Violation{INV_WALLETS, fmt.Sprintf("%s has wallets of %v over its balance %v", id, allocated, l.users[id].Balance)})
+		}
+	}
+
+	return violations
+}
+
+func checkTxCounts(l *ledger) []Violation {
+
+	counts := make(map[string]int)
+	for _, tx := range l.txs {
+		if tx.From != "" {
+			counts[tx.From]++
+		}
+		if tx.To != "" && tx.To != tx.From {
+			counts[tx.To]++
+		}
+	}
+
+	var violations []Violation
+	for _, id := range sortedKeys(l.users) {
+		if l.users[id].NumTxs != counts[id] {
+			violations = append(violations, Violation{INV_TX_COUNT,
+				fmt.Sprintf("%s has NumTxs %d but %d indexed transactions", id, l.users[id].NumTxs, counts[id])})
+		}
+	}
+
+	return violations
+}
+
+func checkContracts(l *ledger) []Violation {
+
+	var violations []Violation
+
+	for _, id := range l.contractIds {
+		if _, ok := l.contracts[id]; !ok {
+			violations = append(violations, Violation{INV_CONTRACT_IDS, fmt.Sprintf("contract %s is listed but does not exist", id)})
+		}
+	}
+
+	used := make(map[string]float64)
+	for _, tx := range l.txs {
+		if tx.ContractId != "" && (tx.Type == openpoints.TX_TYPE_REFUND || tx.Type == openpoints.TX_TYPE_REVERSAL) {
+			used[tx.ContractId] -= tx.Amount
+		} else if tx.ContractId != "" {
+			used[tx.ContractId] += tx.Amount
+		}
+	}
+
+	for _, id := range l.contractIds {
+		contract, ok := l.contracts[id]
+		if !ok {
+			continue
+		}
+		if contract.Budget > 0 && contract.PointsUsed > contract.Budget+epsilon {
+			violations = append(violations, Violation{INV_CONTRACT_BUDGET,
+				fmt.Sprintf("contract %s used %v of a %v budget", id, contract.PointsUsed, contract.Budget)})
+		}
+		if math.Abs(contract.PointsUsed-used[id]) > epsilon {
+			violations = append(violations, Violation{INV_CONTRACT_BUDGET,
+				fmt.Sprintf("contract %s records %v points used, transactions total %v", id, contract.PointsUsed, used[id])})
+		}
+	}
+
+	return violations
+}
+
+func checkRefNumbers(l *ledger) []Violation {
+
+	var violations []Violation
+	seen := make(map[string]bool)
+
+	for _, tx := range l.txs {
+		if seen[tx.RefNumber] {
+			violations = append(violations, Violation{INV_REF_NUMBERS, fmt.Sprintf("reference number %s is used twice", tx.RefNumber)})
+		}
+		seen[tx.RefNumber] = true
+
+		refNumber, err := strconv.Atoi(tx.RefNumber)
+		if err != nil || refNumber >= l.refNumber {
+			violations = append(violations, Violation{INV_REF_NUMBERS,
+				fmt.Sprintf("reference number %s is not below the next reference number %d", tx.RefNumber, l.refNumber)})
+		}
+	}
+
+	return violations
+}
+
+// ============================================================================================================================
+// Decode the records of world state by shape: members have a UserId, contracts an ID and a Method
+// ============================================================================================================================
+func decodeLedger(stub *mockstub.MockStub) (*ledger, []Violation) {
+
+	l := &ledger{
+		users:     make(map[string]openpoints.User),
+		contracts: make(map[string]openpoints.Contract),
+	}
+	var violations []Violation
+
+	for key, value := range stub.Snapshot() {
+		var err error
+
+		if strings.HasPrefix(key, "\x00") {
+			continue
+		} else if key == "allTx" {
+			var all openpoints.AllTransactions
+			err = json.Unmarshal(value, &all)
+			l.txs = all.Transactions
+		} else if key == "refNumber" {
+			err = json.Unmarshal(value, &l.refNumber)
+		} else if key == "contractIds" {
+			err = json.Unmarshal(value, &l.contractIds)
+		} else {
+			var fields map[string]json.RawMessage
+			err = json.Unmarshal(value, &fields)
+			if err == nil && fields["UserId"] != nil {
+				var user openpoints.User
+				err = json.Unmarshal(value, &user)
+				l.users[key] = user
+			} else if err == nil && fields["ID"] != nil && fields["Method"] != nil {
+				var contract openpoints.Contract
+				err = json.Unmarshal(value, &contract)
+				l.contracts[key] = contract
+			}
+		}
+
+		if err != nil {
+			violations = append(violations, Violation{INV_DECODE, fmt.Sprintf("%s: %s", key, err)})
+		}
+	}
+
+	sort.Slice(violations, func(i, j int) bool { return violations[i].Detail < violations[j].Detail })
+	return l, violations
+}
+
+func (l *ledger) totalBalance() float64 {
+	var total float64
+	for _, user := range l.users {
+		total += user.Balance + user.Pending
+	}
+	return total
+}
+
+// Points minted less points burned by the indexed transactions
+func (l *ledger) netMinted() float64 {
+	var net float64
+	for _, tx := range l.txs {
+		if tx.From == "" {
+			net += tx.Amount
+		}
+		if tx.To == "" {
+			net -= tx.Amount
+		}
+	}
+	return net
+}
+
+func sortedKeys(users map[string]openpoints.User) []string {
+	keys := make([]string, 0, len(users))
+	for key := range users {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}